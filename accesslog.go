@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+type accessLogKey struct{}
+
+// accessLogEntry collects what the handler knows about a logged request
+type accessLogEntry struct {
+	samples int
+}
+
+// loggingResponseWriter records the status and size of the response
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// logSamples records the number of samples written or read by the request,
+// if it is logged
+func logSamples(r *http.Request, samples int) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.samples = samples
+	}
+}
+
+// accessLog logs the given fraction of requests to the handler. A rate of
+// 1 logs every request and 0 none.
+func accessLog(handler string, rate float64, h http.Handler) http.Handler {
+	if rate <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rate < 1 && rand.Float64() >= rate {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		entry := &accessLogEntry{}
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		start := time.Now()
+
+		h.ServeHTTP(lw, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		log.Info("msg", "Request", "handler", handler, "method", r.Method, "status", status,
+			"duration", time.Since(start).Seconds(), "bytes_received", r.ContentLength, "bytes_sent", lw.bytes,
+			"samples", entry.samples, "remote_addr", r.RemoteAddr)
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var entry *accessLogEntry
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logSamples(r, 5)
+		entry, _ = r.Context().Value(accessLogKey{}).(*accessLogEntry)
+
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("stored"))
+	})
+
+	for rate, logged := range map[float64]bool{0: false, 1: true} {
+		entry = nil
+
+		rec := httptest.NewRecorder()
+		accessLog("write", rate, h).ServeHTTP(rec, httptest.NewRequest("POST", "/write", nil))
+
+		if rec.Code != http.StatusAccepted || rec.Body.String() != "stored" {
+			t.Errorf("rate %v: expected the response of the handler, got %d %q", rate, rec.Code, rec.Body.String())
+		}
+
+		if (entry != nil) != logged {
+			t.Errorf("rate %v: expected the request to be logged: %v", rate, logged)
+		}
+
+		if entry != nil && entry.samples != 5 {
+			t.Errorf("rate %v: expected 5 samples to be logged, got %d", rate, entry.samples)
+		}
+	}
+}
+
+func TestLoggingResponseWriter(t *testing.T) {
+	lw := &loggingResponseWriter{ResponseWriter: httptest.NewRecorder()}
+
+	// Writing without a header implies 200
+	lw.Write([]byte("hello "))
+	lw.Write([]byte("world"))
+
+	if lw.status != http.StatusOK || lw.bytes != 11 {
+		t.Errorf("Expected status 200 and 11 bytes, got %d and %d", lw.status, lw.bytes)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The write and read endpoints accept HTTP basic auth or a bearer token, as
+// configured in Prometheus' remote_write and remote_read sections. Either
+// one is enough if both are configured.
+
+// readSecret returns the secret of the flag, or the contents of the file
+// flag if set
+func readSecret(secret, file string) (string, error) {
+	if len(file) == 0 {
+		return secret, nil
+	}
+
+	if len(secret) > 0 {
+		return "", fmt.Errorf("a secret and its file are mutually exclusive")
+	}
+
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func secretsEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// requireAuth rejects requests without the configured basic auth credentials
+// or bearer token
+func requireAuth(cfg *config, handler http.Handler) (http.Handler, error) {
+	password, err := readSecret(cfg.authPassword, cfg.authPasswordFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading basic auth password: %v", err)
+	}
+
+	token, err := readSecret(cfg.authBearerToken, cfg.authBearerTokenFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading bearer token: %v", err)
+	}
+
+	if len(cfg.authUsername) == 0 && len(token) == 0 {
+		return handler, nil
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); ok && len(cfg.authUsername) > 0 {
+			if secretsEqual(user, cfg.authUsername) && secretsEqual(pass, password) {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && len(token) > 0 {
+			if secretsEqual(strings.TrimPrefix(auth, "Bearer "), token) {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if len(cfg.authUsername) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="prometheus-postgresql-adapter"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}), nil
+}
+
+// protect guards the write and read endpoints with the configured client
+// certificate and HTTP authentication
+func protect(cfg *config, handler http.Handler) (http.Handler, error) {
+	handler, err := requireAuth(cfg, handler)
+
+	if err != nil {
+		return nil, err
+	}
+	return requireClientCert(cfg, handler), nil
+}
+
+// parseNetworks parses a comma-separated list of CIDR networks or single IP
+// addresses
+func parseNetworks(networks string) ([]*net.IPNet, error) {
+	var parsed []*net.IPNet
+
+	for _, network := range strings.Split(networks, ",") {
+		network = strings.TrimSpace(network)
+
+		if len(network) == 0 {
+			continue
+		}
+
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", network)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed, nil
+}
+
+// allowNetworks rejects requests from addresses outside the networks, if any.
+// Forwarding headers are not trusted, so the networks must include any
+// proxy in front of the adapter.
+func allowNetworks(networks []*net.IPNet, handler http.Handler) http.Handler {
+	if len(networks) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+
+		if err == nil && ip != nil {
+			for _, network := range networks {
+				if network.Contains(ip) {
+					handler.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRequireAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	basic := &config{authUsername: "prometheus", authPassword: "secret"}
+	bearer := &config{authBearerToken: "token"}
+	both := &config{authUsername: "prometheus", authPassword: "secret", authBearerToken: "token"}
+
+	testCases := []struct {
+		name          string
+		cfg           *config
+		user, pass    string
+		authorization string
+		status        int
+	}{
+		{name: "no authentication", cfg: &config{}, status: http.StatusOK},
+		{name: "basic auth", cfg: basic, user: "prometheus", pass: "secret", status: http.StatusOK},
+		{name: "wrong password", cfg: basic, user: "prometheus", pass: "secrets", status: http.StatusUnauthorized},
+		{name: "wrong username", cfg: basic, user: "grafana", pass: "secret", status: http.StatusUnauthorized},
+		{name: "missing credentials", cfg: basic, status: http.StatusUnauthorized},
+		{name: "bearer token", cfg: bearer, authorization: "Bearer token", status: http.StatusOK},
+		{name: "invalid bearer token", cfg: bearer, authorization: "Bearer tokens", status: http.StatusUnauthorized},
+		{name: "other scheme", cfg: bearer, authorization: "Token token", status: http.StatusUnauthorized},
+		{name: "basic auth without a username", cfg: bearer, user: "", pass: "token", status: http.StatusUnauthorized},
+		{name: "either one", cfg: both, authorization: "Bearer token", status: http.StatusOK},
+		{name: "invalid basic auth and bearer token", cfg: both, user: "prometheus", pass: "token", status: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		handler, err := requireAuth(tc.cfg, ok)
+
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		req := httptest.NewRequest("POST", "/write", nil)
+		if len(tc.user)+len(tc.pass) > 0 {
+			req.SetBasicAuth(tc.user, tc.pass)
+		}
+		if len(tc.authorization) > 0 {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, rec.Code)
+		}
+
+		// Clients are asked for basic auth only if it is configured
+		challenge := rec.Header().Get("WWW-Authenticate")
+		if expected := rec.Code == http.StatusUnauthorized && len(tc.cfg.authUsername) > 0; (len(challenge) > 0) != expected {
+			t.Errorf("%s: unexpected WWW-Authenticate header %q", tc.name, challenge)
+		}
+	}
+}
+
+func TestReadSecret(t *testing.T) {
+	f, err := ioutil.TempFile("", "secret")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("secret\n")
+	f.Close()
+
+	testCases := []struct {
+		secret, file string
+		expected     string
+		err          bool
+	}{
+		{secret: "flag", expected: "flag"},
+		{file: f.Name(), expected: "secret"},
+		{secret: "flag", file: f.Name(), err: true},
+		{file: f.Name() + ".missing", err: true},
+	}
+
+	for _, tc := range testCases {
+		secret, err := readSecret(tc.secret, tc.file)
+
+		if (err != nil) != tc.err {
+			t.Errorf("%q, %q: unexpected error %v", tc.secret, tc.file, err)
+		}
+
+		if secret != tc.expected {
+			t.Errorf("%q, %q: expected %q, got %q", tc.secret, tc.file, tc.expected, secret)
+		}
+	}
+
+	if _, err = requireAuth(&config{authUsername: "prometheus", authPassword: "secret", authPasswordFile: f.Name()}, nil); err == nil {
+		t.Error("Expected an error for a password and a password file")
+	}
+}
+
+func TestProtect(t *testing.T) {
+	handler, err := protect(&config{authBearerToken: "token", tlsClientCAFile: "ca.pem"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Valid credentials still require a client certificate
+	req := httptest.NewRequest("POST", "/write", nil)
+	req.Header.Set("Authorization", "Bearer token")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d without a client certificate, got %d", http.StatusForbidden, rec.Code)
+	}
+}
+
+func TestAllowNetworks(t *testing.T) {
+	networks, err := parseNetworks("10.0.0.0/8, 192.168.1.5,,::1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(networks) != 3 {
+		t.Fatalf("Expected 3 networks, got %v", networks)
+	}
+
+	handler := allowNetworks(networks, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for addr, status := range map[string]int{
+		"10.1.2.3:1234":    http.StatusOK,
+		"192.168.1.5:1234": http.StatusOK,
+		"192.168.1.6:1234": http.StatusForbidden,
+		"[::1]:1234":       http.StatusOK,
+		"[::2]:1234":       http.StatusForbidden,
+		"invalid":          http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("POST", "/write", nil)
+		req.RemoteAddr = addr
+		// Forwarding headers are not trusted
+		req.Header.Set("X-Forwarded-For", "10.1.2.3")
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != status {
+			t.Errorf("%s: expected status %d, got %d", addr, status, rec.Code)
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "10.0.0", "host"} {
+		if _, err := parseNetworks(invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
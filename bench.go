@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+// benchConfig is the synthetic traffic generated by the bench command
+type benchConfig struct {
+	series         int
+	metrics        int
+	churn          float64
+	scrapeInterval time.Duration
+	duration       time.Duration
+	batchSize      int
+	concurrency    int
+	realtime       bool
+}
+
+// benchCommand generates synthetic remote write traffic against a running
+// adapter, or directly against the database with the database flags, and
+// reports the achieved throughput and write latencies for capacity planning
+func benchCommand(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: prometheus-postgresql-adapter [flags] bench [options]")
+		fs.PrintDefaults()
+	}
+
+	var (
+		bc          benchConfig
+		url, tenant string
+	)
+	fs.IntVar(&bc.series, "series", 10000, "The number of active series")
+	fs.IntVar(&bc.metrics, "metrics", 100, "The number of metric names the series are spread over")
+	fs.Float64Var(&bc.churn, "churn", 0, "The fraction of series replaced by new series on each scrape")
+	fs.DurationVar(&bc.scrapeInterval, "scrape-interval", 15*time.Second, "The interval between the samples of a series")
+	fs.DurationVar(&bc.duration, "duration", time.Minute, "How long to generate traffic for")
+	fs.IntVar(&bc.batchSize, "batch-size", 500, "The number of samples per write, like max_samples_per_send of Prometheus")
+	fs.IntVar(&bc.concurrency, "concurrency", 4, "The number of concurrent writes, like the shards of Prometheus")
+	fs.BoolVar(&bc.realtime, "realtime", false, "Send each scrape at its scrape interval, instead of as fast as possible with simulated timestamps")
+	fs.StringVar(&url, "url", "", "The remote write URL of a running adapter, e.g. http://localhost:9201/write. Defaults to writing to the database directly")
+	fs.StringVar(&tenant, "tenant", "", "The tenant to write as")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if bc.series <= 0 || bc.metrics <= 0 || bc.batchSize <= 0 || bc.concurrency <= 0 || bc.scrapeInterval <= 0 {
+		fs.Usage()
+		return fmt.Errorf("-series, -metrics, -batch-size, -concurrency and -scrape-interval must be positive")
+	}
+
+	if bc.churn < 0 || bc.churn > 1 {
+		return fmt.Errorf("-churn must be between 0 and 1")
+	}
+
+	ctx := context.Background()
+	var w writer
+
+	if len(url) > 0 {
+		w = &remoteWriter{url: url, tenant: tenant, tenantHeader: cfg.tenantHeader, client: &http.Client{Timeout: cfg.remoteTimeout}}
+	} else {
+		if len(tenant) > 0 {
+			ctx = pgprometheus.WithTenant(ctx, tenant)
+		}
+
+		client := pgprometheus.NewClient(&cfg.pgPrometheusConfig)
+		defer client.Close()
+		w = client
+	}
+
+	result := runBench(ctx, w, bc)
+	result.report(os.Stdout)
+
+	if result.errors > 0 {
+		return fmt.Errorf("%d writes failed, last error: %v", result.errors, result.lastErr)
+	}
+	return nil
+}
+
+// benchResult collects the outcome of the writes of a bench run
+type benchResult struct {
+	sync.Mutex
+	elapsed   time.Duration
+	samples   int
+	series    int
+	latencies []time.Duration
+	errors    int
+	lastErr   error
+}
+
+func (r *benchResult) record(samples int, latency time.Duration, err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if err != nil {
+		r.errors++
+		r.lastErr = err
+		return
+	}
+
+	r.samples += samples
+	r.latencies = append(r.latencies, latency)
+}
+
+func (r *benchResult) report(w io.Writer) {
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+
+	fmt.Fprintf(w, "%-16s%d\n", "samples:", r.samples)
+	fmt.Fprintf(w, "%-16s%d\n", "series:", r.series)
+	fmt.Fprintf(w, "%-16s%d (%d failed)\n", "writes:", len(r.latencies), r.errors)
+	fmt.Fprintf(w, "%-16s%s\n", "duration:", r.elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "%-16s%.0f\n", "samples/s:", float64(r.samples)/r.elapsed.Seconds())
+
+	for _, q := range []float64{0.5, 0.9, 0.99, 1} {
+		name := "latency p" + strconv.FormatFloat(q*100, 'f', -1, 64) + ":"
+		fmt.Fprintf(w, "%-16s%s\n", name, percentile(r.latencies, q).Round(time.Microsecond))
+	}
+}
+
+// percentile returns the q-quantile of sorted durations
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	i := int(q*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// runBench writes scrapes of the configured series until the duration has
+// elapsed
+func runBench(ctx context.Context, w writer, bc benchConfig) *benchResult {
+	result := &benchResult{}
+	batches := make(chan model.Samples, bc.concurrency)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < bc.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for batch := range batches {
+				begin := time.Now()
+				err := w.WriteContext(ctx, batch)
+				result.record(len(batch), time.Since(begin), err)
+			}
+		}()
+	}
+
+	// Each series has a generation, bumped when churn replaces it
+	generations := make([]int, bc.series)
+	churned := 0.0
+	begin := time.Now()
+	ts := begin
+
+	for scrape := 0; time.Since(begin) < bc.duration; scrape++ {
+		if scrape > 0 {
+			churned += bc.churn * float64(bc.series)
+
+			for ; churned >= 1; churned-- {
+				generations[result.series%bc.series]++
+				result.series++
+			}
+
+			if bc.realtime {
+				time.Sleep(time.Until(begin.Add(time.Duration(scrape) * bc.scrapeInterval)))
+			}
+			ts = ts.Add(bc.scrapeInterval)
+		}
+
+		batch := make(model.Samples, 0, bc.batchSize)
+
+		for i := 0; i < bc.series; i++ {
+			batch = append(batch, benchSample(i, generations[i], bc.metrics, scrape, ts))
+
+			if len(batch) == bc.batchSize || i == bc.series-1 {
+				batches <- batch
+				batch = make(model.Samples, 0, bc.batchSize)
+			}
+		}
+	}
+
+	close(batches)
+	wg.Wait()
+
+	result.series += bc.series
+	result.elapsed = time.Since(begin)
+	return result
+}
+
+func benchSample(i, generation, metrics, scrape int, ts time.Time) *model.Sample {
+	return &model.Sample{
+		Metric: model.Metric{
+			model.MetricNameLabel: model.LabelValue("bench_metric_" + strconv.Itoa(i%metrics)),
+			"instance":            model.LabelValue("bench-" + strconv.Itoa(i/metrics)),
+			"generation":          model.LabelValue(strconv.Itoa(generation)),
+		},
+		Value:     model.SampleValue(scrape),
+		Timestamp: model.TimeFromUnixNano(ts.UnixNano()),
+	}
+}
+
+// remoteWriter sends samples to the remote write endpoint of an adapter
+type remoteWriter struct {
+	url          string
+	tenant       string
+	tenantHeader string
+	client       *http.Client
+}
+
+func (rw *remoteWriter) WriteContext(ctx context.Context, samples model.Samples) error {
+	req := &prompb.WriteRequest{Timeseries: make([]*prompb.TimeSeries, 0, len(samples))}
+
+	for _, s := range samples {
+		ts := &prompb.TimeSeries{
+			Labels:  make([]*prompb.Label, 0, len(s.Metric)),
+			Samples: []*prompb.Sample{{Value: float64(s.Value), Timestamp: int64(s.Timestamp)}},
+		}
+		for name, value := range s.Metric {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: string(name), Value: string(value)})
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+
+	data, err := proto.Marshal(req)
+
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, rw.url, bytes.NewReader(snappy.Encode(nil, data)))
+
+	if err != nil {
+		return err
+	}
+
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if len(rw.tenant) > 0 {
+		httpReq.Header.Set(rw.tenantHeader, rw.tenant)
+	}
+
+	resp, err := rw.client.Do(httpReq.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+func (rw *remoteWriter) Name() string {
+	return "remote_write"
+}
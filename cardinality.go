@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+type cardinalityReporter interface {
+	Cardinality(limit int) (*pgprometheus.CardinalityReport, error)
+}
+
+// cardinalityCommand reports the metrics and label keys with the most series,
+// with suggested relabeling rules
+func cardinalityCommand(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("cardinality", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: prometheus-postgresql-adapter [flags] cardinality [options]")
+		fs.PrintDefaults()
+	}
+
+	var (
+		limit      int
+		jsonOutput bool
+	)
+	fs.IntVar(&limit, "limit", 10, "The number of metrics and label keys to report")
+	fs.BoolVar(&jsonOutput, "json", false, "Write the report as JSON, as served on /api/v1/status/cardinality")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if limit <= 0 || fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("-limit must be positive")
+	}
+
+	client := pgprometheus.NewClient(&cfg.pgPrometheusConfig)
+	defer client.Close()
+
+	report, err := client.Cardinality(limit)
+
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(report)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(w, "SERIES\t%d\n\n", report.Series)
+
+	fmt.Fprintln(w, "METRIC\tSERIES\tTOP LABEL\tVALUES")
+	for _, m := range report.Metrics {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\n", m.Metric, m.Series, m.TopLabel, m.TopLabelValues)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "LABEL\tSERIES\tVALUES")
+	for _, l := range report.Labels {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", l.Label, l.Series, l.Values)
+	}
+
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	if len(report.Suggestions) > 0 {
+		fmt.Println()
+		fmt.Println("# Suggested metric_relabel_configs")
+	}
+
+	for _, s := range report.Suggestions {
+		fmt.Printf("# %s\n%s\n", s.Reason, s.RelabelConfig)
+	}
+	return nil
+}
+
+// cardinality serves the cardinality report in the format of the Prometheus
+// HTTP API. The limit parameter sets the number of metrics and label keys.
+func cardinality(reporter cardinalityReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := 10
+
+		if s := r.FormValue("limit"); len(s) > 0 {
+			var err error
+
+			if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+
+		report, err := reporter.Cardinality(limit)
+
+		if err != nil {
+			log.Error("msg", "Error analyzing cardinality", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		resp := map[string]interface{}{"status": "success", "data": report}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Warn("msg", "Error writing cardinality report", "err", err)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+// checkConfigCommand verifies the flags and the database without starting the
+// adapter or changing the database, and fails if any check fails, e.g. as a
+// gate before a deployment
+func checkConfigCommand(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: prometheus-postgresql-adapter [flags] check-config")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	results := checkWebConfig(cfg)
+	results = append(results, pgprometheus.CheckConfig(&cfg.pgPrometheusConfig)...)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(w, "STATUS\tCHECK\tDETAIL")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Status, r.Name, r.Detail)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if results.Failed() {
+		return fmt.Errorf("the configuration is invalid")
+	}
+	return nil
+}
+
+// checkWebConfig verifies the flags of the web endpoints as main does
+func checkWebConfig(cfg *config) pgprometheus.CheckResults {
+	var results pgprometheus.CheckResults
+
+	add := func(name string, err error) {
+		if err != nil {
+			results = append(results, pgprometheus.CheckResult{Name: name, Status: pgprometheus.CheckFail, Detail: err.Error()})
+		} else {
+			results = append(results, pgprometheus.CheckResult{Name: name, Status: pgprometheus.CheckOK, Detail: "valid"})
+		}
+	}
+
+	_, err := tlsConfig(cfg)
+	add("tls", err)
+
+	_, err = requireTenant(cfg, http.NotFoundHandler())
+
+	if err == nil {
+		_, err = newTenantQuotas(cfg)
+	}
+	add("tenant limits", err)
+
+	_, err = protect(cfg, http.NotFoundHandler())
+	add("authentication", err)
+
+	_, err = newLoadShedder(cfg.shedLatencyThreshold, cfg.shedMaxFraction, nil)
+	add("load shedding", err)
+
+	return results
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+// A command runs instead of the adapter when its name follows the flags, e.g.
+// prometheus-postgresql-adapter -pg.host=db stats
+type command func(cfg *config, args []string) error
+
+var commands = map[string]command{
+	"stats":        statsCommand,
+	"import":       importCommand,
+	"export":       exportCommand,
+	"migrate":      migrateCommand,
+	"bench":        benchCommand,
+	"check-config": checkConfigCommand,
+	"cardinality":  cardinalityCommand,
+	"prune":        pruneCommand,
+	"copy":         copyCommand,
+	"dedup":        dedupCommand,
+}
+
+func runCommand(cfg *config, args []string) int {
+	cmd, ok := commands[args[0]]
+
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+
+	if err := cmd(cfg, args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+type statsReporter interface {
+	Stats() (*pgprometheus.StorageStats, error)
+}
+
+func statsCommand(cfg *config, args []string) error {
+	stats, err := pgprometheus.NewClient(&cfg.pgPrometheusConfig).Stats()
+
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(stats.Tables, func(i, j int) bool { return stats.Tables[i].TotalBytes > stats.Tables[j].TotalBytes })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(w, "TABLE\tMETRIC\tROWS\tBYTES\tCOMPRESSED FROM\tCOMPRESSED TO\tCHUNKS\tOLDEST\tNEWEST")
+	for _, t := range stats.Tables {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\t%s\n", t.Table, t.Metric, t.Rows, t.TotalBytes,
+			t.BeforeCompressionBytes, t.AfterCompressionBytes, t.Chunks, formatTime(t.Oldest), formatTime(t.Newest))
+	}
+
+	if len(stats.Metrics) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "METRIC\tROWS\tOLDEST\tNEWEST")
+		for _, m := range stats.Metrics {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", m.Metric, m.Rows, formatTime(&m.Oldest), formatTime(&m.Newest))
+		}
+	}
+
+	return w.Flush()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func stats(reporter statsReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, err := reporter.Stats()
+		if err != nil {
+			log.Error("msg", "Error collecting storage stats", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Warn("msg", "Error writing storage stats", "err", err)
+		}
+	})
+}
+
+type tenantUsageReporter interface {
+	TenantUsage() []pgprometheus.TenantUsage
+}
+
+// tenantUsage serves the usage of each tenant, e.g. for chargeback, in the
+// format of the Prometheus HTTP API
+func tenantUsage(reporter tenantUsageReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		resp := map[string]interface{}{"status": "success", "data": reporter.TenantUsage()}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Warn("msg", "Error writing tenant usage", "err", err)
+		}
+	})
+}
+
+type topMetricsReporter interface {
+	TopMetrics() []pgprometheus.MetricCount
+}
+
+// topMetrics serves the metrics with the most written samples in the format
+// of the Prometheus HTTP API
+func topMetrics(reporter topMetricsReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counts := reporter.TopMetrics()
+		if counts == nil {
+			counts = []pgprometheus.MetricCount{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		resp := map[string]interface{}{"status": "success", "data": counts}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Warn("msg", "Error writing top metrics", "err", err)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+// copyCommand copies series from the database of the database flags into
+// another database managed by the adapter, e.g. to migrate to a bigger
+// cluster or to rebalance shards
+func copyCommand(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("copy", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: prometheus-postgresql-adapter [flags] copy -to=<url> -start=<time> [options]")
+		fs.PrintDefaults()
+	}
+
+	var (
+		to, toTable, selector, tenant string
+		startTime, endTime            string
+		window                        time.Duration
+		batchSize                     int
+	)
+	fs.StringVar(&to, "to", "", "The libpq connection string or postgres:// URL of the database to copy into")
+	fs.StringVar(&toTable, "to-table", "", "The table to copy into. Defaults to -pg.table")
+	fs.StringVar(&selector, "selector", `{__name__=~".+"}`, "The series selector of the copied series, e.g. up{job=\"node\"}")
+	fs.StringVar(&startTime, "start", "", "Copy samples at or after this RFC 3339 time")
+	fs.StringVar(&endTime, "end", "", "Copy samples at or before this RFC 3339 time. Defaults to now")
+	fs.DurationVar(&window, "window", time.Hour, "The time range copied at a time")
+	fs.IntVar(&batchSize, "batch-size", 500000, "The maximum number of samples written per transaction")
+	fs.StringVar(&tenant, "tenant", "", "Copy the tables of this tenant")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if len(to) == 0 || len(startTime) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("missing -to or -start")
+	}
+
+	start, err := time.Parse(time.RFC3339, startTime)
+
+	if err != nil {
+		return err
+	}
+
+	end := time.Now()
+
+	if len(endTime) > 0 {
+		if end, err = time.Parse(time.RFC3339, endTime); err != nil {
+			return err
+		}
+	}
+
+	if window <= 0 {
+		return fmt.Errorf("invalid -window %s", window)
+	}
+
+	matchers, err := pgprometheus.ParseSelector(selector)
+
+	if err != nil {
+		return fmt.Errorf("invalid selector: %v", err)
+	}
+
+	ctx := context.Background()
+
+	if len(tenant) > 0 {
+		if err = pgprometheus.ValidateTenant(tenant); err != nil {
+			return err
+		}
+		ctx = pgprometheus.WithTenant(ctx, tenant)
+	}
+
+	src := pgprometheus.NewClient(&cfg.pgPrometheusConfig)
+	defer src.Close()
+
+	dstCfg := cfg.pgPrometheusConfig.WithTarget(to, toTable)
+	dst := pgprometheus.NewClient(&dstCfg)
+	defer dst.Close()
+
+	return src.Copy(ctx, dst, matchers, start, end, window, batchSize, printProgress("copied"))
+}
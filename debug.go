@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+type poolReporter interface {
+	PoolStats() sql.DBStats
+}
+
+type queryReporter interface {
+	RecentQueries() []pgprometheus.QueryLog
+}
+
+type debugReporter interface {
+	poolReporter
+	queryReporter
+}
+
+// runtimeStats is served on /debug/stats
+type runtimeStats struct {
+	Goroutines      int    `json:"goroutines"`
+	HeapAllocBytes  uint64 `json:"heap_alloc_bytes"`
+	HeapObjects     uint64 `json:"heap_objects"`
+	GCCycles        uint32 `json:"gc_cycles"`
+	GCPauseTotalNs  uint64 `json:"gc_pause_total_ns"`
+	OpenConnections int    `json:"open_connections"`
+}
+
+// debugHandler serves the pprof profiles and runtime stats under /debug/,
+// below the route prefix
+func debugHandler(cfg *config, reporter debugReporter) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/stats", func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+
+		stats := runtimeStats{
+			Goroutines:      runtime.NumGoroutine(),
+			HeapAllocBytes:  mem.HeapAlloc,
+			HeapObjects:     mem.HeapObjects,
+			GCCycles:        mem.NumGC,
+			GCPauseTotalNs:  mem.PauseTotalNs,
+			OpenConnections: reporter.PoolStats().OpenConnections,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	mux.HandleFunc("/debug/queries", func(w http.ResponseWriter, r *http.Request) {
+		queries := reporter.RecentQueries()
+
+		// Only shows queries at least as slow as min_duration, e.g. 1s
+		if s := r.URL.Query().Get("min_duration"); len(s) > 0 {
+			minDuration, err := time.ParseDuration(s)
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			slow := queries[:0]
+			for _, q := range queries {
+				if q.Duration >= minDuration {
+					slow = append(slow, q)
+				}
+			}
+			queries = slow
+		}
+
+		if queries == nil {
+			queries = []pgprometheus.QueryLog{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(queries); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	// pprof.Index expects the profiles under /debug/pprof/
+	return http.StripPrefix(strings.TrimSuffix(cfg.route("/"), "/"), mux)
+}
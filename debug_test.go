@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+type fakeDebugReporter struct {
+	queries []pgprometheus.QueryLog
+}
+
+func (r *fakeDebugReporter) PoolStats() sql.DBStats {
+	return sql.DBStats{OpenConnections: 3}
+}
+
+func (r *fakeDebugReporter) RecentQueries() []pgprometheus.QueryLog {
+	return append([]pgprometheus.QueryLog(nil), r.queries...)
+}
+
+func TestDebugHandler(t *testing.T) {
+	reporter := &fakeDebugReporter{queries: []pgprometheus.QueryLog{
+		{SQL: "SELECT fast", Duration: time.Millisecond},
+		{SQL: "SELECT slow", Duration: 2 * time.Second},
+	}}
+	handler := debugHandler(&config{routePrefix: "/adapter"}, reporter)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec
+	}
+
+	// Profiles are served below the route prefix
+	if rec := get("/adapter/debug/pprof/"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the pprof index, got status %d", rec.Code)
+	}
+
+	if rec := get("/debug/pprof/"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected no profiles outside the route prefix, got status %d", rec.Code)
+	}
+
+	var stats runtimeStats
+
+	if err := json.Unmarshal(get("/adapter/debug/stats").Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.OpenConnections != 3 || stats.Goroutines == 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	testCases := []struct {
+		query   string
+		status  int
+		queries int
+	}{
+		{query: "", status: http.StatusOK, queries: 2},
+		{query: "?min_duration=1s", status: http.StatusOK, queries: 1},
+		{query: "?min_duration=slow", status: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		rec := get("/adapter/debug/queries" + tc.query)
+
+		if rec.Code != tc.status {
+			t.Errorf("%q: expected status %d, got %d", tc.query, tc.status, rec.Code)
+			continue
+		}
+
+		if rec.Code != http.StatusOK {
+			continue
+		}
+
+		var queries []pgprometheus.QueryLog
+
+		if err := json.Unmarshal(rec.Body.Bytes(), &queries); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(queries) != tc.queries {
+			t.Errorf("%q: expected %d queries, got %d", tc.query, tc.queries, len(queries))
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+// dedupCommand removes duplicate samples of the same series and time, e.g.
+// left by Prometheus re-sending samples after failed writes
+func dedupCommand(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("dedup", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: prometheus-postgresql-adapter [flags] dedup [options]")
+		fs.PrintDefaults()
+	}
+
+	var (
+		opts   pgprometheus.DuplicateOptions
+		tenant string
+	)
+	fs.BoolVar(&opts.KeepLatest, "keep-latest", false, "Keep the value inserted last instead of the first one")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Only count the duplicate samples")
+	fs.StringVar(&opts.Vacuum, "vacuum", pgprometheus.VacuumNone, "Vacuum the tables afterwards and report the space reclaimed [ \"plain\", \"full\" ]. A full vacuum returns the space to the operating system, but locks the tables meanwhile")
+	fs.StringVar(&tenant, "tenant", "", "Remove duplicates from the tables of this tenant")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	ctx := context.Background()
+
+	if len(tenant) > 0 {
+		if err := pgprometheus.ValidateTenant(tenant); err != nil {
+			return err
+		}
+		ctx = pgprometheus.WithTenant(ctx, tenant)
+	}
+
+	client := pgprometheus.NewClient(&cfg.pgPrometheusConfig)
+	defer client.Close()
+
+	results, err := client.RemoveDuplicates(ctx, opts)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(w, "TABLE\tDUPLICATES\tBYTES BEFORE\tBYTES AFTER\tRECLAIMED")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", r.Table, r.Duplicates, r.BytesBefore, r.BytesAfter, r.BytesBefore-r.BytesAfter)
+	}
+
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
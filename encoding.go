@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+)
+
+// Read responses are snappy block compressed, as Prometheus expects. Other
+// clients may ask for the snappy framing format or gzip instead, which can be
+// decoded by streaming.
+const (
+	encodingSnappy       = "snappy"
+	encodingSnappyFramed = "x-snappy-framed"
+	encodingGzip         = "gzip"
+)
+
+// responseEncoding picks the encoding of a read response from the
+// Accept-Encoding header
+func responseEncoding(r *http.Request) string {
+	// Prometheus' HTTP client may accept gzip on its own behalf, but only
+	// decodes snappy
+	if len(r.Header.Get("X-Prometheus-Remote-Read-Version")) > 0 {
+		return encodingSnappy
+	}
+
+	accepted := make(map[string]bool)
+
+	for _, value := range r.Header["Accept-Encoding"] {
+		for _, enc := range strings.Split(value, ",") {
+			parts := strings.Split(enc, ";")
+			name := strings.ToLower(strings.TrimSpace(parts[0]))
+
+			if !acceptable(parts[1:]) {
+				continue
+			}
+			accepted[name] = true
+		}
+	}
+
+	for _, enc := range []string{encodingSnappy, encodingSnappyFramed, encodingGzip} {
+		if accepted[enc] {
+			return enc
+		}
+	}
+	return encodingSnappy
+}
+
+// acceptable returns whether the parameters of an encoding in Accept-Encoding
+// do not refuse it with a quality of 0, e.g. q=0 or q=0.000
+func acceptable(params []string) bool {
+	for _, param := range params {
+		param = strings.Replace(strings.TrimSpace(param), " ", "", -1)
+
+		if !strings.HasPrefix(strings.ToLower(param), "q=") {
+			continue
+		}
+
+		if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeResponse(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	switch encoding {
+	case encodingSnappyFramed:
+		w := snappy.NewBufferedWriter(&buf)
+
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case encodingGzip:
+		w := gzip.NewWriter(&buf)
+
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return snappy.Encode(nil, data), nil
+	}
+	return buf.Bytes(), nil
+}
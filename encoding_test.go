@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestResponseEncoding(t *testing.T) {
+	testCases := []struct {
+		name           string
+		acceptEncoding []string
+		prometheus     bool
+		expected       string
+	}{
+		{name: "no header", expected: encodingSnappy},
+		{name: "gzip", acceptEncoding: []string{"gzip"}, expected: encodingGzip},
+		{name: "case", acceptEncoding: []string{"GZip"}, expected: encodingGzip},
+		{name: "framed snappy before gzip", acceptEncoding: []string{"gzip, x-snappy-framed"}, expected: encodingSnappyFramed},
+		{name: "snappy first", acceptEncoding: []string{"gzip", "snappy, x-snappy-framed"}, expected: encodingSnappy},
+		{name: "refused", acceptEncoding: []string{"x-snappy-framed;q=0, gzip"}, expected: encodingGzip},
+		{name: "refused with spaces", acceptEncoding: []string{"x-snappy-framed; q = 0, gzip;q=0.5"}, expected: encodingGzip},
+		{name: "refused with decimals", acceptEncoding: []string{"x-snappy-framed;q=0.000, gzip"}, expected: encodingGzip},
+		{name: "low quality", acceptEncoding: []string{"gzip;q=0.001"}, expected: encodingGzip},
+		{name: "all refused", acceptEncoding: []string{"gzip;q=0"}, expected: encodingSnappy},
+		{name: "unknown", acceptEncoding: []string{"br"}, expected: encodingSnappy},
+		// Prometheus accepts gzip on its own behalf but only decodes snappy
+		{name: "prometheus", acceptEncoding: []string{"gzip"}, prometheus: true, expected: encodingSnappy},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("POST", "/read", nil)
+
+		for _, value := range tc.acceptEncoding {
+			req.Header.Add("Accept-Encoding", value)
+		}
+		if tc.prometheus {
+			req.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+		}
+
+		if actual := responseEncoding(req); actual != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestEncodeResponse(t *testing.T) {
+	data := bytes.Repeat([]byte("sample "), 1000)
+
+	decoders := map[string]func([]byte) ([]byte, error){
+		encodingSnappy: func(b []byte) ([]byte, error) {
+			return snappy.Decode(nil, b)
+		},
+		encodingSnappyFramed: func(b []byte) ([]byte, error) {
+			return ioutil.ReadAll(snappy.NewReader(bytes.NewReader(b)))
+		},
+		encodingGzip: func(b []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(r)
+		},
+	}
+
+	for encoding, decode := range decoders {
+		encoded, err := encodeResponse(encoding, data)
+
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+
+		decoded, err := decode(encoded)
+
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("%s: expected the data to be decoded", encoding)
+		}
+	}
+}
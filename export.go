@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+const (
+	exportOpenMetrics = "openmetrics"
+	exportTSDB        = "tsdb"
+)
+
+// exportCommand streams samples out of the database into OpenMetrics text or
+// Prometheus TSDB blocks, e.g. to migrate away or to seed a new Prometheus
+// server with archived data
+func exportCommand(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: prometheus-postgresql-adapter [flags] export -start=<time> [options]")
+		fs.PrintDefaults()
+	}
+
+	var (
+		format, selector, output, tenant string
+		startTime, endTime               string
+		window                           time.Duration
+	)
+	fs.StringVar(&format, "format", exportOpenMetrics, "The output format, openmetrics or tsdb")
+	fs.StringVar(&selector, "selector", `{__name__=~".+"}`, "The series selector of the exported series, e.g. up{job=\"node\"}")
+	fs.StringVar(&startTime, "start", "", "Export samples at or after this RFC 3339 time")
+	fs.StringVar(&endTime, "end", "", "Export samples at or before this RFC 3339 time. Defaults to now")
+	fs.DurationVar(&window, "window", 2*time.Hour, "The time range read per query, and covered by each TSDB block")
+	fs.StringVar(&output, "output", "-", "The OpenMetrics file, - for stdout, or the directory TSDB blocks are written to")
+	fs.StringVar(&tenant, "tenant", "", "Export from the tables of this tenant")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	if len(startTime) == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing -start")
+	}
+
+	start, err := time.Parse(time.RFC3339, startTime)
+
+	if err != nil {
+		return err
+	}
+
+	end := time.Now()
+
+	if len(endTime) > 0 {
+		if end, err = time.Parse(time.RFC3339, endTime); err != nil {
+			return err
+		}
+	}
+
+	if window <= 0 {
+		return fmt.Errorf("invalid -window %s", window)
+	}
+
+	matchers, err := pgprometheus.ParseSelector(selector)
+
+	if err != nil {
+		return fmt.Errorf("invalid selector: %v", err)
+	}
+
+	ctx := context.Background()
+
+	if len(tenant) > 0 {
+		if err = pgprometheus.ValidateTenant(tenant); err != nil {
+			return err
+		}
+		ctx = pgprometheus.WithTenant(ctx, tenant)
+	}
+
+	var (
+		export func(mint, maxt int64, series []*prompb.TimeSeries) error
+		w      io.Writer = os.Stdout
+	)
+
+	switch format {
+	case exportOpenMetrics:
+		if output != "-" {
+			f, err := os.Create(output)
+
+			if err != nil {
+				return err
+			}
+
+			defer f.Close()
+			w = f
+		}
+
+		export = func(mint, maxt int64, series []*prompb.TimeSeries) error {
+			return pgprometheus.WriteOpenMetrics(w, series)
+		}
+	case exportTSDB:
+		if output == "-" {
+			return fmt.Errorf("-output must be a directory for TSDB blocks")
+		}
+
+		if err = os.MkdirAll(output, 0777); err != nil {
+			return err
+		}
+
+		export = func(mint, maxt int64, series []*prompb.TimeSeries) error {
+			id, err := pgprometheus.WriteBlock(ctx, output, mint, maxt, series)
+
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "%s\t%s\t%s\t%d series\n", id, formatMillis(mint), formatMillis(maxt), len(series))
+			}
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	client := pgprometheus.NewClient(&cfg.pgPrometheusConfig)
+	defer client.Close()
+
+	err = client.Export(ctx, matchers, start, end, window, export)
+
+	if err == nil && format == exportOpenMetrics {
+		_, err = fmt.Fprintln(w, "# EOF")
+	}
+	return err
+}
+
+func formatMillis(ms int64) string {
+	t := time.Unix(0, ms*int64(time.Millisecond))
+	return formatTime(&t)
+}
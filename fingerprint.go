@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// requestFingerprints remembers the write requests stored within a window, so
+// that the same request delivered again by a proxy or a retry after a lost
+// response is acknowledged without storing its samples twice. Requests are
+// only remembered once stored, so that failed writes can be retried.
+type requestFingerprints struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[[sha256.Size]byte]time.Time
+	lastPurge time.Time
+}
+
+// newRequestFingerprints returns the fingerprints of a window, or nil, which
+// does not skip duplicates, if window is not positive
+func newRequestFingerprints(window time.Duration) *requestFingerprints {
+	if window <= 0 {
+		return nil
+	}
+	return &requestFingerprints{window: window, seen: make(map[[sha256.Size]byte]time.Time), lastPurge: time.Now()}
+}
+
+// fingerprint hashes the decoded payload of a write request of a tenant, so
+// that requests compressed differently are still recognized
+func (f *requestFingerprints) fingerprint(tenant string, payload []byte) [sha256.Size]byte {
+	var fp [sha256.Size]byte
+
+	if f == nil {
+		return fp
+	}
+
+	h := sha256.New()
+	h.Write([]byte(tenant))
+	h.Write([]byte{0})
+	h.Write(payload)
+
+	copy(fp[:], h.Sum(nil))
+	return fp
+}
+
+// duplicate returns whether a request with the fingerprint was stored within
+// the window
+func (f *requestFingerprints) duplicate(fp [sha256.Size]byte) bool {
+	if f == nil {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	seen, ok := f.seen[fp]
+	return ok && time.Since(seen) <= f.window
+}
+
+// remember records that a request with the fingerprint was stored
+func (f *requestFingerprints) remember(fp [sha256.Size]byte) {
+	if f == nil {
+		return
+	}
+
+	now := time.Now()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now.Sub(f.lastPurge) > f.window {
+		for k, seen := range f.seen {
+			if now.Sub(seen) > f.window {
+				delete(f.seen, k)
+			}
+		}
+		f.lastPurge = now
+	}
+	f.seen[fp] = now
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequestFingerprints(t *testing.T) {
+	f := newRequestFingerprints(time.Minute)
+
+	fp := f.fingerprint("tenant", []byte("payload"))
+
+	if f.fingerprint("other", []byte("payload")) == fp || f.fingerprint("tenant", []byte("other")) == fp {
+		t.Error("Expected requests of other tenants or payloads to differ")
+	}
+
+	if f.fingerprint("tenant", []byte("payload")) != fp {
+		t.Error("Expected the fingerprint to be stable")
+	}
+
+	// Requests are duplicates only once stored
+	if f.duplicate(fp) {
+		t.Error("Expected a new request not to be a duplicate")
+	}
+
+	f.remember(fp)
+
+	if !f.duplicate(fp) {
+		t.Error("Expected a stored request to be a duplicate")
+	}
+
+	// Requests stored before the window are forgotten
+	f.seen[fp] = time.Now().Add(-2 * time.Minute)
+
+	if f.duplicate(fp) {
+		t.Error("Expected a request stored before the window not to be a duplicate")
+	}
+
+	// and purged once the window has passed since the last purge
+	f.lastPurge = time.Now().Add(-2 * time.Minute)
+	f.remember(f.fingerprint("tenant", []byte("other")))
+
+	if _, ok := f.seen[fp]; ok || len(f.seen) != 1 {
+		t.Errorf("Expected the expired request to be purged, got %d requests", len(f.seen))
+	}
+}
+
+func TestRequestFingerprintsDisabled(t *testing.T) {
+	f := newRequestFingerprints(0)
+
+	if f != nil {
+		t.Fatal("Expected no fingerprints")
+	}
+
+	fp := f.fingerprint("tenant", []byte("payload"))
+	f.remember(fp)
+
+	if f.duplicate(fp) {
+		t.Error("Expected no duplicates when disabled")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+// importCommand bulk-loads Prometheus TSDB blocks, e.g. to backfill the
+// history of a Prometheus server before it starts writing to the adapter, and
+// OpenMetrics or Prometheus text files exported from other systems
+func importCommand(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: prometheus-postgresql-adapter [flags] import [options] <block, data directory or text file>...")
+		fs.PrintDefaults()
+	}
+
+	var (
+		opts             pgprometheus.ImportOptions
+		minTime, maxTime string
+		format, tenant   string
+	)
+	fs.IntVar(&opts.BatchSize, "batch-size", 500000, "The maximum number of samples written per transaction. 0 writes each chunk interval of a block in a single transaction")
+	fs.StringVar(&minTime, "min-time", "", "Only import samples at or after this RFC 3339 time")
+	fs.StringVar(&maxTime, "max-time", "", "Only import samples at or before this RFC 3339 time")
+	fs.StringVar(&format, "format", pgprometheus.FormatOpenMetrics, "The format of text files, openmetrics or prometheus. Text files are read from files, or from stdin with -")
+	fs.StringVar(&tenant, "tenant", "", "Import into the tables of this tenant")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var err error
+
+	if opts.MinTime, err = parseImportTime(minTime); err != nil {
+		return err
+	}
+
+	if opts.MaxTime, err = parseImportTime(maxTime); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("nothing to import")
+	}
+
+	sources, err := findImportSources(fs.Args())
+
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	if len(tenant) > 0 {
+		if err = pgprometheus.ValidateTenant(tenant); err != nil {
+			return err
+		}
+		ctx = pgprometheus.WithTenant(ctx, tenant)
+	}
+
+	client := pgprometheus.NewClient(&cfg.pgPrometheusConfig)
+	defer client.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tFROM\tTO\tSERIES\tSAMPLES\tEXPIRED\tTRANSACTIONS\tDURATION")
+
+	for _, source := range sources {
+		begin := time.Now()
+		stats, err := importSource(ctx, client, source, format, opts)
+
+		if err != nil {
+			w.Flush()
+			return fmt.Errorf("%s: %v", source, err)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\n", filepath.Base(source), formatTime(&stats.MinTime), formatTime(&stats.MaxTime),
+			stats.Series, stats.Samples, stats.Expired, stats.Transactions, time.Since(begin).Round(time.Millisecond))
+		w.Flush()
+	}
+	return nil
+}
+
+func importSource(ctx context.Context, client *pgprometheus.Client, source, format string, opts pgprometheus.ImportOptions) (*pgprometheus.ImportStats, error) {
+	if pgprometheus.IsBlock(source) {
+		return client.ImportBlock(ctx, source, opts)
+	}
+
+	if source == "-" {
+		return client.ImportText(ctx, os.Stdin, format, opts)
+	}
+
+	f, err := os.Open(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return client.ImportText(ctx, f, format, opts)
+}
+
+func parseImportTime(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// findImportSources returns the given block directories and text files, and
+// the blocks in the given data directories, oldest first within each data
+// directory
+func findImportSources(args []string) ([]string, error) {
+	var sources []string
+
+	for _, arg := range args {
+		if arg == "-" || pgprometheus.IsBlock(arg) {
+			sources = append(sources, arg)
+			continue
+		}
+
+		if info, err := os.Stat(arg); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			sources = append(sources, arg)
+			continue
+		}
+
+		files, err := ioutil.ReadDir(arg)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var found bool
+
+		// Block directories are ULIDs, which sort by creation time
+		for _, f := range files {
+			if block := filepath.Join(arg, f.Name()); f.IsDir() && pgprometheus.IsBlock(block) {
+				sources = append(sources, block)
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("%s: no TSDB block found", arg)
+		}
+	}
+	return sources, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+)
+
+// requestLimiter sheds requests beyond a number of concurrent ones, so that
+// many Prometheus shards sending at once cannot exhaust the memory
+type requestLimiter struct {
+	slots chan struct{}
+}
+
+// newRequestLimiter returns a limiter of max concurrent requests, or nil,
+// which does not limit, if max is not positive
+func newRequestLimiter(max int) *requestLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &requestLimiter{slots: make(chan struct{}, max)}
+}
+
+func (l *requestLimiter) limit(h http.Handler) http.Handler {
+	if l == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			shedRequests.Inc()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+
+		defer func() { <-l.slots }()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// saturated returns whether new requests are shed
+func (l *requestLimiter) saturated() bool {
+	return l != nil && len(l.slots) == cap(l.slots)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	limiter := newRequestLimiter(1)
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := limiter.limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+
+	if limiter.saturated() {
+		t.Error("Expected an idle limiter not to be saturated")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/write", nil))
+		close(done)
+	}()
+	<-entered
+
+	if !limiter.saturated() {
+		t.Error("Expected the limiter to be saturated")
+	}
+
+	// Requests beyond the limit are shed
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/write", nil))
+
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected status 503 with Retry-After, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	<-done
+
+	if limiter.saturated() {
+		t.Error("Expected the slot to be released")
+	}
+
+	// Slots are released, so the next request gets through
+	go func() { <-entered }()
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/write", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", rec.Code)
+	}
+}
+
+func TestRequestLimiterDisabled(t *testing.T) {
+	limiter := newRequestLimiter(0)
+
+	if limiter != nil || limiter.saturated() {
+		t.Fatal("Expected no limiter")
+	}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	rec := httptest.NewRecorder()
+	limiter.limit(h).ServeHTTP(rec, httptest.NewRequest("POST", "/write", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", rec.Code)
+	}
+}
@@ -1,34 +1,134 @@
 package log
 
 import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"github.com/prometheus/common/promlog"
+)
+
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
 )
 
 var (
 	// Application wide logger
 	logger log.Logger
+	// lock guards logger, which is replaced when the log level changes
+	lock sync.RWMutex
+
+	format = FormatLogfmt
+	fields []interface{}
 )
 
+// Init configures the application wide logger to write logfmt lines,
+// falling back to the info level if logLevel is invalid
 func Init(logLevel string) {
-	allowedLevel := promlog.AllowedLevel{}
-	allowedLevel.Set(logLevel)
-	logger = promlog.New(allowedLevel)
+	if err := Setup(logLevel, FormatLogfmt, nil); err != nil {
+		Setup("info", FormatLogfmt, nil)
+	}
+}
+
+// Setup configures the application wide logger to write lines of the given
+// format, "logfmt" or "json", with the static key-value fields added to
+// every line
+func Setup(logLevel, logFormat string, staticFields []interface{}) error {
+	if logFormat != FormatLogfmt && logFormat != FormatJSON {
+		return fmt.Errorf("invalid log format %q", logFormat)
+	}
+
+	lock.Lock()
+	format, fields = logFormat, staticFields
+	lock.Unlock()
+
+	return SetLevel(logLevel)
+}
+
+// SetLevel changes the log level of the application wide logger
+func SetLevel(logLevel string) error {
+	var allowed level.Option
+
+	switch logLevel {
+	case "debug":
+		allowed = level.AllowDebug()
+	case "info":
+		allowed = level.AllowInfo()
+	case "warn":
+		allowed = level.AllowWarn()
+	case "error":
+		allowed = level.AllowError()
+	default:
+		return fmt.Errorf("invalid log level %q", logLevel)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	var l log.Logger
+	if format == FormatJSON {
+		l = log.NewJSONLogger(log.NewSyncWriter(os.Stderr))
+	} else {
+		l = log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+	}
+
+	l = level.NewFilter(l, allowed)
+	// The caller is the caller of Debug, Info, Warn or Error
+	l = log.With(l, "ts", log.DefaultTimestampUTC, "caller", log.Caller(4))
+	if len(fields) > 0 {
+		l = log.With(l, fields...)
+	}
+
+	logger = l
+	return nil
+}
+
+// ParseFields parses comma-separated key=value pairs into key-value fields
+func ParseFields(s string) ([]interface{}, error) {
+	var kvs []interface{}
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf("invalid log field %q, expected key=value", field)
+		}
+
+		kvs = append(kvs, strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return kvs, nil
+}
+
+func current() log.Logger {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return logger
 }
 
 func Debug(keyvals ...interface{}) {
-	level.Debug(logger).Log(keyvals...)
+	level.Debug(current()).Log(keyvals...)
 }
 
 func Info(keyvals ...interface{}) {
-	level.Info(logger).Log(keyvals...)
+	level.Info(current()).Log(keyvals...)
 }
 
 func Warn(keyvals ...interface{}) {
-	level.Warn(logger).Log(keyvals...)
+	if throttler.allow(level.Warn, "warn", keyvals) {
+		level.Warn(current()).Log(keyvals...)
+	}
 }
 
 func Error(keyvals ...interface{}) {
-	level.Error(logger).Log(keyvals...)
+	if throttler.allow(level.Error, "error", keyvals) {
+		level.Error(current()).Log(keyvals...)
+	}
 }
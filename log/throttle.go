@@ -0,0 +1,87 @@
+package log
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Repeated warnings and errors with the same message, e.g. while the database
+// is down, are logged once per interval. The number of suppressed lines and
+// the last of them are logged at the end of the interval.
+
+type throttledLine struct {
+	level      func(log.Logger) log.Logger
+	suppressed int
+	last       []interface{}
+}
+
+type throttle struct {
+	interval time.Duration
+	lock     sync.Mutex
+	lines    map[string]*throttledLine
+}
+
+var throttler *throttle
+
+// SetThrottleInterval starts throttling repeated warnings and errors. It
+// must be called at most once, before logging concurrently.
+func SetThrottleInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	throttler = &throttle{interval: interval, lines: make(map[string]*throttledLine)}
+	go throttler.run()
+}
+
+// allow returns whether a line is logged, or counted for the summary
+func (t *throttle) allow(lvl func(log.Logger) log.Logger, name string, keyvals []interface{}) bool {
+	if t == nil {
+		return true
+	}
+
+	key := name + " " + lineKey(keyvals)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if line, ok := t.lines[key]; ok {
+		line.suppressed++
+		line.last = keyvals
+		return false
+	}
+
+	t.lines[key] = &throttledLine{level: lvl}
+	return true
+}
+
+func (t *throttle) run() {
+	for range time.Tick(t.interval) {
+		t.lock.Lock()
+		lines := t.lines
+		t.lines = make(map[string]*throttledLine)
+		t.lock.Unlock()
+
+		for _, line := range lines {
+			if line.suppressed == 0 {
+				continue
+			}
+
+			keyvals := append(line.last, "repeated", line.suppressed, "interval", t.interval)
+			line.level(current()).Log(keyvals...)
+		}
+	}
+}
+
+// lineKey identifies a line by its message, or all of it without one
+func lineKey(keyvals []interface{}) string {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] == "msg" {
+			return fmt.Sprint(keyvals[i+1])
+		}
+	}
+	return fmt.Sprint(keyvals...)
+}
@@ -0,0 +1,44 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+func TestThrottleAllow(t *testing.T) {
+	th := &throttle{interval: time.Minute, lines: make(map[string]*throttledLine)}
+
+	testCases := []struct {
+		name    string
+		keyvals []interface{}
+		allowed bool
+	}{
+		{name: "error", keyvals: []interface{}{"msg", "Error copying samples", "err", "connection refused"}, allowed: true},
+		{name: "error", keyvals: []interface{}{"msg", "Error copying samples", "err", "connection reset"}},
+		{name: "warn", keyvals: []interface{}{"msg", "Error copying samples"}, allowed: true},
+		{name: "error", keyvals: []interface{}{"msg", "Error on Begin"}, allowed: true},
+		{name: "error", keyvals: []interface{}{"err", "EOF"}, allowed: true},
+		{name: "error", keyvals: []interface{}{"err", "EOF"}},
+		{name: "error", keyvals: []interface{}{"err", "timeout"}, allowed: true},
+	}
+
+	for i, tc := range testCases {
+		if allowed := th.allow(level.Error, tc.name, tc.keyvals); allowed != tc.allowed {
+			t.Errorf("%d: expected allowed %v, got %v", i, tc.allowed, allowed)
+		}
+	}
+
+	line := th.lines["error Error copying samples"]
+
+	if line.suppressed != 1 || line.last[3] != "connection reset" {
+		t.Errorf("expected the last of 1 suppressed lines, got %d: %v", line.suppressed, line.last)
+	}
+
+	var disabled *throttle
+
+	if !disabled.allow(level.Error, "error", []interface{}{"msg", "Error"}) {
+		t.Error("expected a nil throttle to allow every line")
+	}
+}
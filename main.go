@@ -18,20 +18,23 @@ package main
 // documentation/examples/remote_storage/remote_storage_adapter/main.go
 
 import (
+	"context"
 	"flag"
-	"io/ioutil"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"path"
+	"syscall"
 	"time"
 
 	"github.com/timescale/prometheus-postgresql-adapter/log"
+	"github.com/timescale/prometheus-postgresql-adapter/trace"
 
 	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
 	"github.com/timescale/prometheus-postgresql-adapter/util"
 
 	"github.com/gogo/protobuf/proto"
-	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 
@@ -41,12 +44,50 @@ import (
 )
 
 type config struct {
-	remoteTimeout      time.Duration
-	listenAddr         string
-	telemetryPath      string
-	pgPrometheusConfig pgprometheus.Config
-	logLevel           string
-	readOnly           bool
+	remoteTimeout          time.Duration
+	listenAddr             string
+	telemetryPath          string
+	pgPrometheusConfig     pgprometheus.Config
+	logLevel               string
+	readOnly               bool
+	tlsCertFile            string
+	tlsKeyFile             string
+	tlsClientCAFile        string
+	authUsername           string
+	authPassword           string
+	authPasswordFile       string
+	authBearerToken        string
+	authBearerTokenFile    string
+	allowedNetworks        string
+	routePrefix            string
+	writePath              string
+	readPath               string
+	healthPath             string
+	shutdownTimeout        time.Duration
+	configFile             string
+	enableDebug            bool
+	accessLogSampleRate    float64
+	readTimeout            time.Duration
+	readHeaderTimeout      time.Duration
+	writeTimeout           time.Duration
+	idleTimeout            time.Duration
+	maxHeaderBytes         int
+	maxConcurrentRequests  int
+	shedLatencyThreshold   time.Duration
+	shedMaxFraction        float64
+	readyLeaderOnly        bool
+	tenantSource           string
+	tenantHeader           string
+	tenantSamplesPerSecond float64
+	tenantMaxSeries        int
+	tenantLimits           string
+	dedupWindow            time.Duration
+	otlpEndpoint           string
+	serviceName            string
+	traceSampleRate        float64
+	logFormat              string
+	logFields              string
+	logThrottleInterval    time.Duration
 }
 
 const (
@@ -90,6 +131,37 @@ var (
 		},
 		[]string{"path"},
 	)
+	shedRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "http_requests_shed_total",
+			Help: "Total number of write and read requests rejected beyond the concurrent request limit.",
+		},
+	)
+	latencyShedRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "http_write_requests_shed_latency_total",
+			Help: "Total number of write requests rejected while the database latency is above -web.shed-latency-threshold.",
+		},
+	)
+	loadShedFraction = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "http_write_requests_shed_fraction",
+			Help: "The fraction of write requests currently rejected while the database latency is high.",
+		},
+	)
+	duplicateRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "http_write_requests_duplicate_total",
+			Help: "Total number of write requests acknowledged without storing them again since the same request was stored within -web.dedup-window.",
+		},
+	)
+	rejectedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tenant_rejected_samples_total",
+			Help: "Total number of samples rejected beyond the quota of their tenant, by the limit exceeded.",
+		},
+		[]string{"tenant", "reason"},
+	)
 	writeThroughtput = util.NewThroughputCalc(tickInterval)
 )
 
@@ -99,58 +171,301 @@ func init() {
 	prometheus.MustRegister(failedSamples)
 	prometheus.MustRegister(sentBatchDuration)
 	prometheus.MustRegister(httpRequestDuration)
+	prometheus.MustRegister(shedRequests)
+	prometheus.MustRegister(latencyShedRequests)
+	prometheus.MustRegister(loadShedFraction)
+	prometheus.MustRegister(duplicateRequests)
+	prometheus.MustRegister(rejectedSamples)
 	writeThroughtput.Start()
 }
 
 func main() {
 	cfg := parseFlags()
-	log.Init(cfg.logLevel)
-	log.Info("config", fmt.Sprintf("%+v", cfg))
 
-	http.Handle(cfg.telemetryPath, prometheus.Handler())
+	fields, err := log.ParseFields(cfg.logFields)
+
+	if err == nil {
+		err = log.Setup(cfg.logLevel, cfg.logFormat, fields)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	log.SetThrottleInterval(cfg.logThrottleInterval)
+
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(cfg, flag.Args()))
+	}
+
+	log.Info("config", fmt.Sprintf("%+v", cfg.redacted()))
+
+	trace.Init(cfg.otlpEndpoint, cfg.serviceName, cfg.traceSampleRate)
+
+	http.Handle(cfg.route(cfg.telemetryPath), prometheus.Handler())
+
+	quotas, err := newTenantQuotas(cfg)
+
+	if err != nil {
+		log.Error("msg", "Invalid tenant limits", "err", err)
+		os.Exit(1)
+	}
 
 	writer, reader := buildClients(cfg)
 
-	http.Handle("/write", timeHandler("write", write(writer)))
-	http.Handle("/read", timeHandler("read", read(reader)))
-	http.Handle("/healthz", health(reader))
+	fingerprints := newRequestFingerprints(cfg.dedupWindow)
+
+	writeHandler, err := requireTenant(cfg, write(writer, quotas, fingerprints))
+
+	if err != nil {
+		log.Error("msg", "Invalid tenant configuration", "err", err)
+		os.Exit(1)
+	}
+
+	readHandler, err := requireTenant(cfg, read(reader))
+
+	if err != nil {
+		log.Error("msg", "Invalid tenant configuration", "err", err)
+		os.Exit(1)
+	}
+
+	shedder, err := newLoadShedder(cfg.shedLatencyThreshold, cfg.shedMaxFraction, reader)
+
+	if err != nil {
+		log.Error("msg", "Invalid load shedding configuration", "err", err)
+		os.Exit(1)
+	}
+
+	go shedder.run(tickInterval)
+
+	limiter := newRequestLimiter(cfg.maxConcurrentRequests)
+
+	// Requests are authenticated first, so that unauthenticated ones take
+	// up neither concurrency slots nor the shedding budget
+	writeHandler = mustProtect(cfg, limiter.limit(shedder.shed(timeHandler("write", deadlineHandler(cfg.remoteTimeout, writeHandler)))))
+	readHandler = mustProtect(cfg, limiter.limit(timeHandler("read", readHandler)))
+
+	http.Handle(cfg.route(cfg.writePath), traceHandler("write", accessLog("write", cfg.accessLogSampleRate, writeHandler)))
+	http.Handle(cfg.route(cfg.readPath), traceHandler("read", accessLog("read", cfg.accessLogSampleRate, readHandler)))
+	http.Handle(cfg.route(cfg.healthPath), health(reader))
+	http.Handle(cfg.route("/-/healthy"), healthy())
+	http.Handle(cfg.route("/-/ready"), ready(reader, limiter, cfg.readyLeaderOnly))
+	http.Handle(cfg.route("/stats"), mustProtect(cfg, stats(reader)))
+	http.Handle(cfg.route("/api/v1/status/top_metrics"), mustProtect(cfg, topMetrics(reader)))
+	http.Handle(cfg.route("/api/v1/status/tenants"), mustProtect(cfg, tenantUsage(reader)))
+
+	info := newBuildInfo(reader)
+	registerBuildInfo(info)
+	http.Handle(cfg.route("/version"), version(info))
+
+	reloader := &configReloader{args: os.Args[1:], target: reader}
+	go reloader.reloadOnSignal()
+
+	reloadHandler, err := protect(cfg, reloader.handler())
+
+	if err != nil {
+		log.Error("msg", "Invalid authentication configuration", "err", err)
+		os.Exit(1)
+	}
+
+	http.Handle(cfg.route("/-/reload"), reloadHandler)
+
+	// Cardinality queries scan the labels of every series
+	http.Handle(cfg.route("/api/v1/status/cardinality"), mustProtect(cfg, cardinality(reader)))
+
+	if cfg.enableDebug {
+		handler, err := protect(cfg, debugHandler(cfg, reader))
+
+		if err != nil {
+			log.Error("msg", "Invalid authentication configuration", "err", err)
+			os.Exit(1)
+		}
+
+		http.Handle(cfg.route("/debug")+"/", handler)
+	}
+
+	networks, err := parseNetworks(cfg.allowedNetworks)
+
+	if err != nil {
+		log.Error("msg", "Invalid allowed networks", "err", err)
+		os.Exit(1)
+	}
+
+	server := newServer(cfg, allowNetworks(networks, http.DefaultServeMux))
+
+	server.TLSConfig, err = tlsConfig(cfg)
+
+	if err != nil {
+		log.Error("msg", "Invalid TLS configuration", "err", err)
+		os.Exit(1)
+	}
 
 	log.Info("msg", "Starting up...")
-	log.Info("msg", "Listening", "addr", cfg.listenAddr)
+	log.Info("msg", "Listening", "addr", cfg.listenAddr, "tls", server.TLSConfig != nil)
 
-	err := http.ListenAndServe(cfg.listenAddr, nil)
+	listener, err := net.Listen("tcp", cfg.listenAddr)
 
 	if err != nil {
 		log.Error("msg", "Listen failure", "err", err)
 		os.Exit(1)
 	}
+
+	stopped := make(chan struct{})
+	go shutdownOnSignal(server, cfg.shutdownTimeout, stopped)
+
+	// The schema has been validated and the listener is up
+	if err = sdNotify("READY=1"); err != nil {
+		log.Warn("msg", "Error notifying systemd", "err", err)
+	}
+
+	if timeout := sdWatchdogInterval(); timeout > 0 {
+		go runSdWatchdog(timeout)
+	}
+
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+
+	if err != http.ErrServerClosed {
+		log.Error("msg", "Listen failure", "err", err)
+		os.Exit(1)
+	}
+
+	<-stopped
+
+	if err = reader.Close(); err != nil {
+		log.Error("msg", "Error closing the database connections", "err", err)
+	}
+	log.Info("msg", "Shut down")
 }
 
-func parseFlags() *config {
+// newServer returns the web server of the handler, with the timeouts and the
+// header size limit of cfg
+func newServer(cfg *config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.listenAddr,
+		Handler:           handler,
+		ReadTimeout:       cfg.readTimeout,
+		ReadHeaderTimeout: cfg.readHeaderTimeout,
+		WriteTimeout:      cfg.writeTimeout,
+		IdleTimeout:       cfg.idleTimeout,
+		MaxHeaderBytes:    cfg.maxHeaderBytes,
+	}
+}
+
+// shutdownOnSignal stops the server on SIGINT or SIGTERM, waiting for
+// in-flight requests, and thereby the batches they write, to finish
+func shutdownOnSignal(server *http.Server, timeout time.Duration, stopped chan<- struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	cfg := &config{}
+	shutdown(server, timeout, <-signals, stopped)
+}
 
-	pgprometheus.ParseFlags(&cfg.pgPrometheusConfig)
+// shutdown stops the server on the signal, and closes stopped once the
+// in-flight requests finished or the timeout passed
+func shutdown(server *http.Server, timeout time.Duration, sig os.Signal, stopped chan<- struct{}) {
+	log.Info("msg", "Shutting down, draining in-flight requests", "signal", sig, "timeout", timeout)
+	sdNotify("STOPPING=1")
 
-	flag.DurationVar(&cfg.remoteTimeout, "adapter.send-timeout", 30*time.Second, "The timeout to use when sending samples to the remote storage.")
-	flag.StringVar(&cfg.listenAddr, "web.listen-address", ":9201", "Address to listen on for web endpoints.")
-	flag.StringVar(&cfg.telemetryPath, "web.telemetry-path", "/metrics", "Address to listen on for web endpoints.")
-	flag.StringVar(&cfg.logLevel, "log.level", "debug", "The log level to use [ \"error\", \"warn\", \"info\", \"debug\" ].")
-	flag.BoolVar(&cfg.readOnly, "read.only", false, "Read-only mode. Don't write to database.")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	flag.Parse()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warn("msg", "Requests were still in flight after the shutdown timeout", "err", err)
+	}
+	close(stopped)
+}
 
+// route returns the path of an endpoint under the route prefix
+func (cfg *config) route(p string) string {
+	return path.Join("/", cfg.routePrefix, p)
+}
+
+// redacted returns a copy of the config with secrets masked, for logging
+func (cfg *config) redacted() config {
+	redacted := *cfg
+	redacted.pgPrometheusConfig = cfg.pgPrometheusConfig.Redacted()
+
+	for _, secret := range []*string{&redacted.authPassword, &redacted.authBearerToken} {
+		if len(*secret) > 0 {
+			*secret = "********"
+		}
+	}
+	return redacted
+}
+
+func parseFlags() *config {
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 	return cfg
 }
 
+// registerFlags defines the configuration flags of cfg in the flag set
+func registerFlags(fs *flag.FlagSet, cfg *config) {
+	pgprometheus.RegisterFlags(fs, &cfg.pgPrometheusConfig)
+
+	fs.DurationVar(&cfg.remoteTimeout, "adapter.send-timeout", 30*time.Second, "The timeout to use when sending samples to the remote storage. Writes still running are cancelled in the database. 0 disables the timeout.")
+	fs.StringVar(&cfg.listenAddr, "web.listen-address", ":9201", "Address to listen on for web endpoints.")
+	fs.StringVar(&cfg.telemetryPath, "web.telemetry-path", "/metrics", "Address to listen on for web endpoints.")
+	fs.StringVar(&cfg.routePrefix, "web.route-prefix", "", "A path prefix of all web endpoints, e.g. for path-based routing of an ingress.")
+	fs.StringVar(&cfg.writePath, "web.write-path", "/write", "The path of the remote write endpoint.")
+	fs.StringVar(&cfg.readPath, "web.read-path", "/read", "The path of the remote read endpoint.")
+	fs.StringVar(&cfg.healthPath, "web.health-path", "/healthz", "The path of the health endpoint.")
+	fs.StringVar(&cfg.tlsCertFile, "web.tls-cert-file", "", "The certificate file for serving web endpoints over HTTPS. Reloaded when it changes.")
+	fs.StringVar(&cfg.tlsKeyFile, "web.tls-key-file", "", "The private key file of -web.tls-cert-file.")
+	fs.StringVar(&cfg.tlsClientCAFile, "web.tls-client-ca-file", "", "The CA certificates file that client certificates are verified against. If set, the write and read endpoints require a client certificate.")
+	fs.StringVar(&cfg.authUsername, "web.auth-username", "", "The username of HTTP basic auth on the write and read endpoints. Empty disables basic auth.")
+	fs.StringVar(&cfg.authPassword, "web.auth-password", "", "The password of HTTP basic auth on the write and read endpoints.")
+	fs.StringVar(&cfg.authPasswordFile, "web.auth-password-file", "", "A file containing the password of HTTP basic auth on the write and read endpoints.")
+	fs.StringVar(&cfg.authBearerToken, "web.auth-bearer-token", "", "The bearer token accepted by the write and read endpoints. Empty disables bearer tokens.")
+	fs.StringVar(&cfg.authBearerTokenFile, "web.auth-bearer-token-file", "", "A file containing the bearer token accepted by the write and read endpoints.")
+	fs.StringVar(&cfg.allowedNetworks, "web.allowed-networks", "", "Comma-separated CIDR networks or IP addresses allowed to connect to the web endpoints. Empty allows all.")
+	fs.Float64Var(&cfg.accessLogSampleRate, "web.access-log-sample-rate", 0, "The fraction of write and read requests to log, with status, duration, size, number of samples and remote address. 1 logs every request, 0 disables access logs.")
+	fs.BoolVar(&cfg.enableDebug, "web.enable-debug", false, "Serve pprof profiles under /debug/pprof/ and runtime and connection pool stats on /debug/stats.")
+	fs.DurationVar(&cfg.readTimeout, "web.read-timeout", 5*time.Minute, "The max time to read a request, including its body. 0 disables the timeout.")
+	fs.DurationVar(&cfg.readHeaderTimeout, "web.read-header-timeout", 30*time.Second, "The max time to read the headers of a request. 0 uses -web.read-timeout.")
+	fs.DurationVar(&cfg.writeTimeout, "web.write-timeout", 5*time.Minute, "The max time from the end of reading the request headers to the end of writing the response. 0 disables the timeout.")
+	fs.DurationVar(&cfg.idleTimeout, "web.idle-timeout", 2*time.Minute, "How long a keep-alive connection may wait for the next request. 0 uses -web.read-timeout.")
+	fs.IntVar(&cfg.maxHeaderBytes, "web.max-header-bytes", http.DefaultMaxHeaderBytes, "The max size of the headers of a request.")
+	fs.IntVar(&cfg.maxConcurrentRequests, "web.max-concurrent-requests", 0, "The max number of write and read requests processed at once. Requests beyond it are rejected with 503 so that Prometheus retries them later. 0 disables the limit.")
+	fs.DurationVar(&cfg.shedLatencyThreshold, "web.shed-latency-threshold", 0, "The 99th percentile of the time writes wait for a database connection or take to commit above which a growing fraction of write requests is rejected with 429, and below which it shrinks again. 0 disables load shedding.")
+	fs.Float64Var(&cfg.shedMaxFraction, "web.shed-max-fraction", 0.9, "The max fraction of write requests rejected while the database latency is above -web.shed-latency-threshold.")
+	fs.StringVar(&cfg.tenantSource, "web.tenant-source", "", "Where to identify the tenant of write and read requests, whose samples are stored apart as set by -pg.tenant-mode [ \"header\", \"basic-auth\" ]. Empty disables multi-tenancy.")
+	fs.StringVar(&cfg.tenantHeader, "web.tenant-header", "X-Scope-OrgID", "The header holding the tenant with -web.tenant-source=header.")
+	fs.Float64Var(&cfg.tenantSamplesPerSecond, "web.tenant-samples-per-second", 0, "The max rate of samples each tenant may write, with bursts of ten seconds worth. Writes beyond it are rejected with 429. 0 disables the limit.")
+	fs.IntVar(&cfg.tenantMaxSeries, "web.tenant-max-series", 0, "The max number of series with samples in the last 20 minutes of each tenant. Writes of new series beyond it are rejected with 429. 0 disables the limit.")
+	fs.StringVar(&cfg.tenantLimits, "web.tenant-limits", "", "Comma-separated pattern=rate:series limits of the tenants matching the glob pattern, overriding -web.tenant-samples-per-second and -web.tenant-max-series, e.g. \"acme=50000:1000000,team_*=:200000\".")
+	fs.DurationVar(&cfg.dedupWindow, "web.dedup-window", 0, "How long to remember stored write requests, so that the same request delivered again, e.g. by a proxy or a retry after a lost response, is acknowledged without storing its samples twice. 0 disables it.")
+	fs.BoolVar(&cfg.readyLeaderOnly, "web.ready-leader-only", false, "With -pg.leader-election, report followers as not ready on /-/ready, e.g. to only route traffic to the leader.")
+	fs.DurationVar(&cfg.shutdownTimeout, "web.shutdown-timeout", 30*time.Second, "How long to wait for in-flight requests to finish on SIGTERM before closing the database connections.")
+	fs.StringVar(&cfg.otlpEndpoint, "tracing.otlp-endpoint", "", "The OTLP/HTTP endpoint of an OpenTelemetry collector to export traces of the write and read paths to, e.g. http://localhost:4318. Empty disables tracing.")
+	fs.StringVar(&cfg.serviceName, "tracing.service-name", "prometheus-postgresql-adapter", "The service.name of exported traces.")
+	fs.Float64Var(&cfg.traceSampleRate, "tracing.sample-rate", 1, "The fraction of requests to trace, unless a traceparent header decides.")
+	fs.StringVar(&cfg.logLevel, "log.level", "debug", "The log level to use [ \"error\", \"warn\", \"info\", \"debug\" ].")
+	fs.StringVar(&cfg.configFile, "config.file", "", "A file of flag=value lines, one per line, for flags not set on the command line. Reloaded on SIGHUP or a POST to /-/reload, which applies the log level, connection limits and retention policies.")
+	fs.StringVar(&cfg.logFormat, "log.format", log.FormatLogfmt, "The format of log lines [ \"logfmt\", \"json\" ].")
+	fs.StringVar(&cfg.logFields, "log.fields", "", "Comma-separated key=value fields added to every log line, e.g. \"instance=adapter-1,tenant=team-a\".")
+	fs.DurationVar(&cfg.logThrottleInterval, "log.throttle-interval", 30*time.Second, "Log repeated warnings and errors with the same message once per interval, followed by how often they were repeated. 0 logs every line.")
+	fs.BoolVar(&cfg.readOnly, "read.only", false, "Read-only mode. Don't write to database.")
+
+}
+
 type writer interface {
-	Write(samples model.Samples) error
+	WriteContext(ctx context.Context, samples model.Samples) error
 	Name() string
 }
 
 type noOpWriter struct{}
 
-func (no *noOpWriter) Write(samples model.Samples) error {
+func (no *noOpWriter) WriteContext(ctx context.Context, samples model.Samples) error {
 	log.Debug("msg", "Noop writer", "num_samples", len(samples))
 	return nil
 }
@@ -160,35 +475,62 @@ func (no *noOpWriter) Name() string {
 }
 
 type reader interface {
-	Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error)
+	ReadContext(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error)
 	Name() string
 	HealthCheck() error
+	Close() error
+	statsReporter
+	reloader
+	debugReporter
+	storageModeReporter
+	topMetricsReporter
+	tenantUsageReporter
+	leaderReporter
+	cardinalityReporter
+	writeLatencyReporter
+}
+
+type leaderReporter interface {
+	LeaderElection() *pgprometheus.LeaderStatus
 }
 
 func buildClients(cfg *config) (writer, reader) {
 	pgClient := pgprometheus.NewClient(&cfg.pgPrometheusConfig)
+	prometheus.MustRegister(pgClient)
 	if cfg.readOnly {
 		return &noOpWriter{}, pgClient
 	}
 	return pgClient, pgClient
 }
 
-func write(writer writer) http.Handler {
+func write(writer writer, quotas *tenantQuotas, fingerprints *requestFingerprints) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		compressed, err := ioutil.ReadAll(r.Body)
+		buffers := getRequestBuffers()
+		defer buffers.release()
+
+		compressed, err := buffers.readBody(r.Body)
 		if err != nil {
 			log.Error("msg", "Read error", "err", err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		reqBuf, err := snappy.Decode(nil, compressed)
+		reqBuf, err := buffers.decode(compressed)
 		if err != nil {
 			log.Error("msg", "Decode error", "err", err.Error())
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
+		tenant := pgprometheus.TenantFromContext(r.Context())
+		fp := fingerprints.fingerprint(tenant, reqBuf)
+
+		if fingerprints.duplicate(fp) {
+			duplicateRequests.Inc()
+			log.Debug("msg", "Skipped a duplicate write request", "tenant", tenant)
+			return
+		}
+
 		var req prompb.WriteRequest
 		if err := proto.Unmarshal(reqBuf, &req); err != nil {
 			log.Error("msg", "Unmarshal error", "err", err.Error())
@@ -196,13 +538,31 @@ func write(writer writer) http.Handler {
 			return
 		}
 
-		samples := protoToSamples(&req)
+		samples := buffers.toSamples(&req)
 		receivedSamples.Add(float64(len(samples)))
+		logSamples(r, len(samples))
+
+		if err := quotas.admit(tenant, &req, len(samples)); err != nil {
+			reason := err.(*quotaError).reason
+			rejectedSamples.WithLabelValues(tenant, reason).Add(float64(len(samples)))
+			log.Warn("msg", "Rejected samples beyond the tenant quota", "tenant", tenant, "reason", reason, "num_samples", len(samples))
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
 
-		err = sendSamples(writer, samples)
+		err = sendSamples(r.Context(), writer, samples)
 		if err != nil {
-			log.Warn("msg", "Error sending samples to remote storage", "err", err, "storage", writer.Name(), "num_samples", len(samples))
+			status := writeErrorStatus(err)
+			log.Warn("msg", "Error sending samples to remote storage", "err", err, "storage", writer.Name(), "num_samples", len(samples), "status", status)
+
+			if status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "1")
+			}
+			http.Error(w, err.Error(), status)
+			return
 		}
+		fingerprints.remember(fp)
 
 		counter, err := sentSamples.GetMetricWithLabelValues(writer.Name())
 		if err != nil {
@@ -218,6 +578,20 @@ func write(writer writer) http.Handler {
 	})
 }
 
+// writeErrorStatus returns the status of a failed write as the remote write
+// specification defines it: 400 if the database rejected the samples for their
+// content, which Prometheus drops instead of retrying them forever, 429 if the
+// database is overloaded, and 500, which Prometheus retries, otherwise
+func writeErrorStatus(err error) int {
+	switch {
+	case pgprometheus.IsInvalidData(err):
+		return http.StatusBadRequest
+	case pgprometheus.IsOverloaded(err):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
 func getCounterValue(counter prometheus.Counter) float64 {
 	dtoMetric := &io_prometheus_client.Metric{}
 	if err := counter.Write(dtoMetric); err != nil {
@@ -228,14 +602,17 @@ func getCounterValue(counter prometheus.Counter) float64 {
 
 func read(reader reader) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		compressed, err := ioutil.ReadAll(r.Body)
+		buffers := getRequestBuffers()
+		defer buffers.release()
+
+		compressed, err := buffers.readBody(r.Body)
 		if err != nil {
 			log.Error("msg", "Read error", "err", err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		reqBuf, err := snappy.Decode(nil, compressed)
+		reqBuf, err := buffers.decode(compressed)
 		if err != nil {
 			log.Error("msg", "Decode error", "err", err.Error())
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -250,23 +627,33 @@ func read(reader reader) http.Handler {
 		}
 
 		var resp *prompb.ReadResponse
-		resp, err = reader.Read(&req)
+		resp, err = reader.ReadContext(r.Context(), &req)
 		if err != nil {
 			log.Warn("msg", "Error executing query", "query", req, "storage", reader.Name(), "err", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		logSamples(r, countSamples(resp))
+
 		data, err := proto.Marshal(resp)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		encoding := responseEncoding(r)
+
+		compressed, err = encodeResponse(encoding, data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/x-protobuf")
-		w.Header().Set("Content-Encoding", "snappy")
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Add("Vary", "Accept-Encoding")
 
-		compressed = snappy.Encode(nil, data)
 		if _, err := w.Write(compressed); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -285,28 +672,63 @@ func health(reader reader) http.Handler {
 	})
 }
 
-func protoToSamples(req *prompb.WriteRequest) model.Samples {
-	var samples model.Samples
-	for _, ts := range req.Timeseries {
-		metric := make(model.Metric, len(ts.Labels))
-		for _, l := range ts.Labels {
-			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+// healthy reports that the process is alive, regardless of the database
+func healthy() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK\n"))
+	})
+}
+
+// ready reports whether the adapter can serve writes and reads. The server
+// only listens once the schema has been validated, so only the database
+// connection and the concurrent request limit are checked. With leader
+// election, the response tells whether the adapter is the leader, and
+// followers are not ready if leaderOnly is set.
+func ready(reader reader, limiter *requestLimiter, leaderOnly bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limiter.saturated() {
+			http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+
+		if err := reader.HealthCheck(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		status := reader.LeaderElection()
+
+		if status == nil {
+			w.Write([]byte("OK\n"))
+			return
+		}
+
+		if !status.Leader {
+			if leaderOnly {
+				http.Error(w, "follower of the leader election", http.StatusServiceUnavailable)
+				return
+			}
+
+			w.Write([]byte("OK, follower\n"))
+			return
 		}
+		w.Write([]byte("OK, leader\n"))
+	})
+}
 
-		for _, s := range ts.Samples {
-			samples = append(samples, &model.Sample{
-				Metric:    metric,
-				Value:     model.SampleValue(s.Value),
-				Timestamp: model.Time(s.Timestamp),
-			})
+func countSamples(resp *prompb.ReadResponse) int {
+	var n int
+	for _, result := range resp.Results {
+		for _, ts := range result.Timeseries {
+			n += len(ts.Samples)
 		}
 	}
-	return samples
+	return n
 }
 
-func sendSamples(w writer, samples model.Samples) error {
+func sendSamples(ctx context.Context, w writer, samples model.Samples) error {
 	begin := time.Now()
-	err := w.Write(samples)
+	err := w.WriteContext(ctx, samples)
 	duration := time.Since(begin).Seconds()
 	if err != nil {
 		failedSamples.WithLabelValues(w.Name()).Add(float64(len(samples)))
@@ -317,6 +739,48 @@ func sendSamples(w writer, samples model.Samples) error {
 	return nil
 }
 
+// mustProtect protects handler as the write and read endpoints, exiting if
+// the authentication configuration is invalid
+func mustProtect(cfg *config, handler http.Handler) http.Handler {
+	handler, err := protect(cfg, handler)
+
+	if err != nil {
+		log.Error("msg", "Invalid authentication configuration", "err", err)
+		os.Exit(1)
+	}
+	return handler
+}
+
+// deadlineHandler cancels the database statements of requests once the client
+// gives up: when it disconnects, or after timeout, e.g. the remote timeout of
+// Prometheus, whichever comes first
+func deadlineHandler(timeout time.Duration, handler http.Handler) http.Handler {
+	if timeout <= 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// traceHandler traces requests, continuing the trace of their traceparent
+// header
+func traceHandler(name string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := trace.WithTraceParent(r.Context(), r.Header.Get("traceparent"))
+		ctx, span := trace.Start(ctx, name, trace.KindServer)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		defer span.End()
+
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 // timeHandler uses Prometheus histogram to track request time
 func timeHandler(path string, handler http.Handler) http.Handler {
 	f := func(w http.ResponseWriter, r *http.Request) {
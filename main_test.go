@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+func init() {
+	log.Init("error")
+}
+
+func TestDeadlineHandler(t *testing.T) {
+	testCases := []struct {
+		timeout  time.Duration
+		deadline bool
+	}{
+		{timeout: 0, deadline: false},
+		{timeout: time.Minute, deadline: true},
+	}
+
+	for _, tc := range testCases {
+		var (
+			deadline time.Time
+			ok       bool
+		)
+
+		handler := deadlineHandler(tc.timeout, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			deadline, ok = r.Context().Deadline()
+		}))
+
+		begin := time.Now()
+		req := httptest.NewRequest("POST", "/write", nil)
+		// Headers of clients do not shorten the timeout
+		req.Header.Set("X-Prometheus-Remote-Timeout-Seconds", "invalid")
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("timeout %s: expected status 200, got %d", tc.timeout, rec.Code)
+		}
+
+		if ok != tc.deadline {
+			t.Errorf("timeout %s: expected a deadline %t, got %t", tc.timeout, tc.deadline, ok)
+		}
+
+		if ok && (deadline.Before(begin.Add(tc.timeout)) || deadline.After(time.Now().Add(tc.timeout))) {
+			t.Errorf("timeout %s: unexpected deadline %s", tc.timeout, deadline)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	testCases := []struct {
+		prefix   string
+		path     string
+		expected string
+	}{
+		{prefix: "", path: "/write", expected: "/write"},
+		{prefix: "/adapter", path: "/write", expected: "/adapter/write"},
+		{prefix: "adapter/", path: "read", expected: "/adapter/read"},
+		{prefix: "/adapter", path: "/-/healthy", expected: "/adapter/-/healthy"},
+	}
+
+	for _, tc := range testCases {
+		if actual := (&config{routePrefix: tc.prefix}).route(tc.path); actual != tc.expected {
+			t.Errorf("%q, %q: expected %s, got %s", tc.prefix, tc.path, tc.expected, actual)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	for _, drained := range []bool{true, false} {
+		started, release := make(chan struct{}), make(chan struct{})
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}))
+
+		status := make(chan int, 1)
+
+		go func() {
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				status <- 0
+				return
+			}
+			resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+
+		<-started
+
+		timeout := time.Minute
+		if !drained {
+			timeout = 10 * time.Millisecond
+		}
+
+		stopped := make(chan struct{})
+		go shutdown(server.Config, timeout, syscall.SIGTERM, stopped)
+
+		select {
+		case <-stopped:
+			if drained {
+				t.Fatal("Expected the shutdown to wait for the in-flight request")
+			}
+		case <-time.After(50 * time.Millisecond):
+			if !drained {
+				t.Fatal("Expected the shutdown to give up after its timeout")
+			}
+		}
+
+		close(release)
+
+		if code := <-status; code != http.StatusOK {
+			t.Errorf("Expected the in-flight request to succeed, got status %d", code)
+		}
+
+		<-stopped
+		server.Close()
+	}
+}
+
+// fakeReader reports the health and leader election status of a reader,
+// and panics on other calls
+type fakeReader struct {
+	reader
+	err    error
+	leader *pgprometheus.LeaderStatus
+}
+
+func (r *fakeReader) HealthCheck() error {
+	return r.err
+}
+
+func (r *fakeReader) LeaderElection() *pgprometheus.LeaderStatus {
+	return r.leader
+}
+
+func TestReady(t *testing.T) {
+	saturated := newRequestLimiter(1)
+	saturated.slots <- struct{}{}
+
+	testCases := []struct {
+		name       string
+		reader     *fakeReader
+		limiter    *requestLimiter
+		leaderOnly bool
+		status     int
+		body       string
+	}{
+		{name: "ready", reader: &fakeReader{}, status: http.StatusOK, body: "OK\n"},
+		{name: "database down", reader: &fakeReader{err: errors.New("connection refused")}, status: http.StatusServiceUnavailable},
+		{name: "saturated", reader: &fakeReader{}, limiter: saturated, status: http.StatusServiceUnavailable},
+		{name: "leader", reader: &fakeReader{leader: &pgprometheus.LeaderStatus{Leader: true}}, leaderOnly: true, status: http.StatusOK, body: "OK, leader\n"},
+		{name: "follower", reader: &fakeReader{leader: &pgprometheus.LeaderStatus{}}, status: http.StatusOK, body: "OK, follower\n"},
+		{name: "follower of leader only", reader: &fakeReader{leader: &pgprometheus.LeaderStatus{}}, leaderOnly: true, status: http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		ready(tc.reader, tc.limiter, tc.leaderOnly).ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, rec.Code)
+		}
+
+		if len(tc.body) > 0 && rec.Body.String() != tc.body {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.body, rec.Body.String())
+		}
+	}
+
+	// The process is healthy even if the database is down
+	rec := httptest.NewRecorder()
+	healthy().ServeHTTP(rec, httptest.NewRequest("GET", "/-/healthy", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected healthy to be OK, got status %d", rec.Code)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	cfg := &config{}
+	registerFlags(newFlagSet(), cfg)
+	cfg.readHeaderTimeout = 50 * time.Millisecond
+
+	server := newServer(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	if server.ReadTimeout != 5*time.Minute || server.WriteTimeout != 5*time.Minute || server.IdleTimeout != 2*time.Minute ||
+		server.MaxHeaderBytes != http.DefaultMaxHeaderBytes {
+		t.Errorf("Unexpected default timeouts %+v", server)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	// Clients sending their headers too slowly are disconnected
+	if _, err = conn.Write([]byte("POST /write HTTP/1.1\r\nHost: adapter\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err = ioutil.ReadAll(conn); err != nil {
+		t.Errorf("Expected the server to close the connection, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+// migrateCommand converts a raw pg_prometheus table into the normalized
+// tables configured by the database flags, so that users can switch schemas
+// without losing history
+func migrateCommand(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: prometheus-postgresql-adapter [flags] migrate -from=<raw table> [options]")
+		fs.PrintDefaults()
+	}
+
+	var (
+		from               string
+		startTime, endTime string
+		window             time.Duration
+		batchSize          int
+	)
+	fs.StringVar(&from, "from", "", "The raw pg_prometheus table to migrate into the table set by -pg.table")
+	fs.StringVar(&startTime, "start", "", "Migrate samples at or after this RFC 3339 time, e.g. to resume an interrupted migration. Defaults to the oldest sample")
+	fs.StringVar(&endTime, "end", "", "Migrate samples at or before this RFC 3339 time. Defaults to the newest sample")
+	fs.DurationVar(&window, "window", time.Hour, "The time range migrated at a time")
+	fs.IntVar(&batchSize, "batch-size", 500000, "The maximum number of samples written per transaction")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if len(from) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("missing -from")
+	}
+
+	if window <= 0 {
+		return fmt.Errorf("invalid -window %s", window)
+	}
+
+	client := pgprometheus.NewClient(&cfg.pgPrometheusConfig)
+	defer client.Close()
+
+	start, end, err := client.RawTimeRange(from)
+
+	if err != nil {
+		return err
+	}
+
+	if len(startTime) > 0 {
+		if start, err = time.Parse(time.RFC3339, startTime); err != nil {
+			return err
+		}
+	}
+
+	if len(endTime) > 0 {
+		if end, err = time.Parse(time.RFC3339, endTime); err != nil {
+			return err
+		}
+	}
+
+	return client.MigrateRaw(context.Background(), from, start, end, window, batchSize, printProgress("migrated"))
+}
+
+// printProgress returns a callback printing the progress and the estimated
+// remaining time of a migration to stderr
+func printProgress(verb string) func(pgprometheus.MigrationProgress) {
+	begin := time.Now()
+
+	return func(p pgprometheus.MigrationProgress) {
+		elapsed := time.Since(begin)
+		fraction := p.Fraction()
+
+		var eta time.Duration
+		if fraction > 0 && fraction < 1 {
+			eta = time.Duration(float64(elapsed) * (1 - fraction) / fraction)
+		}
+
+		fmt.Fprintf(os.Stderr, "%s until %s (%.1f%%): %d samples, %.0f samples/s, %s left\n", verb, formatTime(&p.Done),
+			100*fraction, p.Samples, float64(p.Samples)/elapsed.Seconds(), eta.Round(time.Second))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// maxPooledBufferSize is the size beyond which request buffers are not reused,
+// so that one huge request does not keep its memory for good
+const maxPooledBufferSize = 32 << 20
+
+// requestBuffers are the buffers a request is read and decoded into, and the
+// samples of a write request, reused across requests instead of allocated for
+// each
+type requestBuffers struct {
+	compressed bytes.Buffer
+	decoded    []byte
+	samples    []model.Sample
+	pointers   model.Samples
+}
+
+var requestBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &requestBuffers{}
+	},
+}
+
+func getRequestBuffers() *requestBuffers {
+	return requestBufferPool.Get().(*requestBuffers)
+}
+
+// release returns the buffers to the pool. Neither the decoded request nor its
+// samples may be used afterwards.
+func (b *requestBuffers) release() {
+	if b.compressed.Cap() > maxPooledBufferSize || cap(b.decoded) > maxPooledBufferSize {
+		return
+	}
+
+	b.compressed.Reset()
+
+	// Drop the metrics, which are allocated for each request anyway
+	for i := range b.samples {
+		b.samples[i] = model.Sample{}
+	}
+	b.samples = b.samples[:0]
+	b.pointers = b.pointers[:0]
+
+	requestBufferPool.Put(b)
+}
+
+// readBody reads the compressed body of a request
+func (b *requestBuffers) readBody(body io.Reader) ([]byte, error) {
+	if _, err := b.compressed.ReadFrom(body); err != nil {
+		return nil, err
+	}
+	return b.compressed.Bytes(), nil
+}
+
+// decode decodes the snappy compressed request
+func (b *requestBuffers) decode(compressed []byte) ([]byte, error) {
+	decoded, err := snappy.Decode(b.decoded[:cap(b.decoded)], compressed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b.decoded = decoded
+	return decoded, nil
+}
+
+// toSamples converts the time series of a write request to samples, which
+// share the metric of their series
+func (b *requestBuffers) toSamples(req *prompb.WriteRequest) model.Samples {
+	var n int
+	for _, ts := range req.Timeseries {
+		n += len(ts.Samples)
+	}
+
+	if cap(b.samples) < n {
+		b.samples = make([]model.Sample, 0, n)
+	}
+
+	for _, ts := range req.Timeseries {
+		metric := make(model.Metric, len(ts.Labels))
+		for _, l := range ts.Labels {
+			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+
+		for _, s := range ts.Samples {
+			b.samples = append(b.samples, model.Sample{
+				Metric:    metric,
+				Value:     model.SampleValue(s.Value),
+				Timestamp: model.Time(s.Timestamp),
+			})
+			b.pointers = append(b.pointers, &b.samples[len(b.samples)-1])
+		}
+	}
+	return b.pointers
+}
@@ -0,0 +1,149 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	indexAdvisorReport = "report"
+	indexAdvisorCreate = "create"
+)
+
+// indexAdvisor counts how often each label is matched on by read queries
+type indexAdvisor struct {
+	lock    sync.Mutex
+	counts  map[string]int
+	advised map[string]bool
+}
+
+func newIndexAdvisor() *indexAdvisor {
+	return &indexAdvisor{
+		counts:  make(map[string]int),
+		advised: make(map[string]bool),
+	}
+}
+
+func (a *indexAdvisor) record(q *prompb.Query) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, m := range q.Matchers {
+		if m.Name != model.MetricNameLabel && model.LabelName(m.Name).IsValid() {
+			a.counts[m.Name]++
+		}
+	}
+}
+
+// candidates returns the labels matched on at least threshold times that
+// have not been advised yet, most frequent first
+func (a *indexAdvisor) candidates(threshold int) []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var labels []string
+
+	for label, count := range a.counts {
+		if count >= threshold && !a.advised[label] {
+			labels = append(labels, label)
+		}
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		if a.counts[labels[i]] != a.counts[labels[j]] {
+			return a.counts[labels[i]] > a.counts[labels[j]]
+		}
+		return labels[i] < labels[j]
+	})
+	return labels
+}
+
+func (a *indexAdvisor) markAdvised(label string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.advised[label] = true
+}
+
+func (c *Client) validateIndexAdvisor() error {
+	switch c.cfg.indexAdvisor {
+	case "", indexAdvisorReport, indexAdvisorCreate:
+	default:
+		return fmt.Errorf("unknown index advisor mode %q", c.cfg.indexAdvisor)
+	}
+
+	if len(c.cfg.indexAdvisor) > 0 && (c.cfg.indexAdvisorThreshold <= 0 || c.cfg.indexAdvisorInterval <= 0) {
+		return fmt.Errorf("the index advisor requires a positive threshold and interval")
+	}
+	return nil
+}
+
+// labelIndexStmt returns the statement creating an expression index on the
+// value of a label in the labels table of the given view
+func (c *Client) labelIndexStmt(table, label string) string {
+	if c.cfg.usePgPrometheus && !c.cfg.pgPrometheusNormalize {
+		// Raw samples are stored in a hypertable, which does not support
+		// building indexes concurrently
+		samplesTable := table + "_samples"
+		return fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s ((prom_labels(sample)->>'%s'))",
+			quoteIdent(limitIdentifier(unqualified(samplesTable), "_"+label+"_idx")), quoteIdent(samplesTable), escapeValue(label))
+	}
+
+	labelsTable := table + "_labels"
+	return fmt.Sprintf("CREATE INDEX CONCURRENTLY IF NOT EXISTS %s ON %s ((%s))",
+		quoteIdent(limitIdentifier(unqualified(labelsTable), "_"+label+"_idx")), quoteIdent(labelsTable), c.labelsFormat().value(label))
+}
+
+// runIndexAdvisor periodically reports, or creates, indexes on the labels
+// most frequently matched on by read queries
+func (c *Client) runIndexAdvisor() {
+	ticker := time.NewTicker(c.cfg.indexAdvisorInterval)
+
+	for range ticker.C {
+		for _, label := range c.advisor.candidates(c.cfg.indexAdvisorThreshold) {
+			err := c.adviseIndex(label)
+
+			if err != nil {
+				log.Error("msg", "Error creating label index", "label", label, "err", err)
+				continue
+			}
+			c.advisor.markAdvised(label)
+		}
+	}
+}
+
+func (c *Client) adviseIndex(label string) error {
+	tables := []string{c.cfg.table}
+
+	if c.cfg.tablePerMetric {
+		var err error
+		tables, err = c.lookupMetricTables(nil)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, table := range tables {
+		stmt := c.labelIndexStmt(table, label)
+
+		if c.cfg.indexAdvisor == indexAdvisorReport {
+			log.Info("msg", "Label is frequently matched on by queries, consider indexing it", "label", label, "stmt", stmt)
+			continue
+		}
+
+		if _, err := c.db.Exec(stmt); err != nil {
+			return err
+		}
+
+		log.Info("msg", "Created label index", "label", label, "table", table)
+	}
+	return nil
+}
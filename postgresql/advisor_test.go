@@ -0,0 +1,56 @@
+package pgprometheus
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestIndexAdvisorCandidates(t *testing.T) {
+	a := newIndexAdvisor()
+
+	q := &prompb.Query{
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "cpu_usage"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "nginx"},
+			{Type: prompb.LabelMatcher_RE, Name: "host", Value: "local.*"},
+			{Type: prompb.LabelMatcher_EQ, Name: "bad'label", Value: ""},
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		a.record(q)
+	}
+	a.record(&prompb.Query{Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"}}})
+
+	if candidates := a.candidates(3); !reflect.DeepEqual(candidates, []string{"job", "host"}) {
+		t.Errorf("Unexpected candidates %v", candidates)
+	}
+
+	a.markAdvised("job")
+
+	if candidates := a.candidates(3); !reflect.DeepEqual(candidates, []string{"host"}) {
+		t.Errorf("Unexpected candidates after advising %v", candidates)
+	}
+}
+
+func TestLabelIndexStmt(t *testing.T) {
+	c := &Client{cfg: &Config{usePgPrometheus: true, pgPrometheusNormalize: true, labelsFormat: labelsFormatJSONB}}
+
+	stmt := c.labelIndexStmt("metrics", "job")
+	expected := `CREATE INDEX CONCURRENTLY IF NOT EXISTS "metrics_labels_job_idx" ON "metrics_labels" ((labels->>'job'))`
+
+	if stmt != expected {
+		t.Errorf("Expected %q, got %q", expected, stmt)
+	}
+
+	c.cfg.pgPrometheusNormalize = false
+
+	stmt = c.labelIndexStmt("metrics", "job")
+	expected = `CREATE INDEX IF NOT EXISTS "metrics_samples_job_idx" ON "metrics_samples" ((prom_labels(sample)->>'job'))`
+
+	if stmt != expected {
+		t.Errorf("Expected %q, got %q", expected, stmt)
+	}
+}
@@ -0,0 +1,115 @@
+package pgprometheus
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// With AWS RDS IAM authentication the password is a token, which is an AWS
+// Signature Version 4 presigned request for the rds-db:connect action.
+// Tokens expire after 15 minutes, but are only checked when connecting, so a
+// fresh token is generated for every new connection.
+
+const (
+	rdsIAMService     = "rds-db"
+	rdsIAMTokenExpiry = 15 * time.Minute
+	awsSigV4Algorithm = "AWS4-HMAC-SHA256"
+)
+
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// awsEnvCredentials returns the AWS credentials of the environment, as set by
+// e.g. aws-vault or the ECS and EKS credential helpers
+func awsEnvCredentials() (*awsCredentials, error) {
+	creds := &awsCredentials{
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
+	if len(creds.accessKeyID) == 0 || len(creds.secretAccessKey) == 0 {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for RDS IAM authentication")
+	}
+	return creds, nil
+}
+
+// awsRegion returns the region of the database, defaulting to the region of
+// the environment
+func (cfg *Config) awsRegion() (string, error) {
+	for _, region := range []string{cfg.awsRegionName, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if len(region) > 0 {
+			return region, nil
+		}
+	}
+	return "", fmt.Errorf("-pg.aws-region or AWS_REGION must be set for RDS IAM authentication")
+}
+
+// rdsAuthToken returns an RDS IAM authentication token for user at the
+// host:port endpoint
+func rdsAuthToken(endpoint, region, user string, creds *awsCredentials, now time.Time) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, rdsIAMService)
+
+	query := url.Values{}
+	query.Set("Action", "connect")
+	query.Set("DBUser", user)
+	query.Set("X-Amz-Algorithm", awsSigV4Algorithm)
+	query.Set("X-Amz-Credential", creds.accessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int(rdsIAMTokenExpiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if len(creds.sessionToken) > 0 {
+		query.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	// The encoding of url.Values escapes spaces as +, SigV4 requires %20
+	canonicalQuery := strings.Replace(query.Encode(), "+", "%20", -1)
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		"/",
+		canonicalQuery,
+		"host:" + endpoint + "\n",
+		"host",
+		hex.EncodeToString(sha256Sum("")),
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		awsSigV4Algorithm,
+		now.Format("20060102T150405Z"),
+		scope,
+		hex.EncodeToString(sha256Sum(canonicalRequest)),
+	}, "\n")
+
+	signature := hmacSHA256(awsSigningKey(creds.secretAccessKey, date, region, rdsIAMService), stringToSign)
+
+	return fmt.Sprintf("%s/?%s&X-Amz-Signature=%s", endpoint, canonicalQuery, hex.EncodeToString(signature))
+}
+
+func awsSigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Sum(data string) []byte {
+	sum := sha256.Sum256([]byte(data))
+	return sum[:]
+}
@@ -0,0 +1,232 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The cardinality analysis counts the series in the labels tables, which keep
+// every series ever written, to find the metrics and label keys that cause
+// label explosions.
+
+const (
+	// cardinalityMinValues is the number of values below which a label is
+	// never suggested for dropping
+	cardinalityMinValues = 100
+	// cardinalityMetricShare is the share of all series above which dropping
+	// a metric is suggested
+	cardinalityMetricShare = 0.25
+)
+
+// CardinalityReport lists the metrics and label keys with the most series
+type CardinalityReport struct {
+	Series      int64               `json:"series"`
+	Metrics     []MetricCardinality `json:"metrics"`
+	Labels      []LabelCardinality  `json:"labels"`
+	Suggestions []RelabelSuggestion `json:"suggestions"`
+}
+
+// MetricCardinality is the number of series of a metric, and the label with
+// the most values among them
+type MetricCardinality struct {
+	Metric         string `json:"metric"`
+	Series         int64  `json:"series"`
+	TopLabel       string `json:"top_label,omitempty"`
+	TopLabelValues int64  `json:"top_label_values,omitempty"`
+}
+
+// LabelCardinality is the number of series with a label key and the number of
+// distinct values of the label
+type LabelCardinality struct {
+	Label  string `json:"label"`
+	Series int64  `json:"series"`
+	Values int64  `json:"values"`
+}
+
+// RelabelSuggestion is a Prometheus metric_relabel_configs entry that would
+// reduce the cardinality
+type RelabelSuggestion struct {
+	Reason        string `json:"reason"`
+	RelabelConfig string `json:"relabel_config"`
+}
+
+// Cardinality reports the limit metrics and label keys with the most series or
+// values, with suggested relabeling rules. It scans the labels tables.
+func (c *Client) Cardinality(limit int) (*CardinalityReport, error) {
+	if c.cfg.usePgPrometheus && !c.cfg.pgPrometheusNormalize {
+		return nil, fmt.Errorf("the cardinality analysis requires the normalized schema")
+	}
+
+	labels, err := c.labelsTablesQuery()
+
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CardinalityReport{Metrics: []MetricCardinality{}, Labels: []LabelCardinality{}}
+
+	if len(labels) == 0 {
+		report.Suggestions = []RelabelSuggestion{}
+		return report, nil
+	}
+
+	if err = c.metricCardinality(labels, limit, report); err != nil {
+		return nil, err
+	}
+
+	if err = c.labelCardinality(labels, limit, report); err != nil {
+		return nil, err
+	}
+
+	report.Suggestions = suggestRelabels(report)
+	return report, nil
+}
+
+// labelsTablesQuery returns a query of the metric name and labels of all
+// series, or an empty string if there are no labels tables
+func (c *Client) labelsTablesQuery() (string, error) {
+	tables := []string{c.cfg.table}
+
+	if c.cfg.tablePerMetric {
+		var err error
+		tables, err = c.lookupMetricTables(nil)
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	columns := strings.Join(c.labelsFormat().columns(), ", ")
+	selects := make([]string, 0, len(tables))
+
+	for _, table := range tables {
+		selects = append(selects, fmt.Sprintf("SELECT metric_name, %s FROM %s", columns, ident(table, "_labels")))
+	}
+	return strings.Join(selects, " UNION ALL "), nil
+}
+
+func (c *Client) metricCardinality(labels string, limit int, report *CardinalityReport) error {
+	rows, err := c.db.Query(fmt.Sprintf("SELECT metric_name, count(*) FROM (%s) l GROUP BY metric_name ORDER BY count(*) DESC, metric_name", labels))
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var m MetricCardinality
+
+		if err = rows.Scan(&m.Metric, &m.Series); err != nil {
+			return err
+		}
+
+		report.Series += m.Series
+
+		if len(report.Metrics) < limit {
+			report.Metrics = append(report.Metrics, m)
+		}
+	}
+
+	if err = rows.Err(); err != nil || len(report.Metrics) == 0 {
+		return err
+	}
+
+	names := make([]string, len(report.Metrics))
+	for i, m := range report.Metrics {
+		names[i] = m.Metric
+	}
+
+	topRows, err := c.db.Query(fmt.Sprintf(`SELECT DISTINCT ON (metric_name) metric_name, key, n FROM (
+		SELECT l.metric_name, p.key, count(DISTINCT p.value) AS n FROM (%s) l, LATERAL %s
+		WHERE l.metric_name = ANY(string_to_array($1, ',')) GROUP BY l.metric_name, p.key) t
+		ORDER BY metric_name, n DESC, key`, labels, c.labelsFormat().each()), strings.Join(names, ","))
+
+	if err != nil {
+		return err
+	}
+
+	defer topRows.Close()
+
+	top := make(map[string]LabelCardinality)
+
+	for topRows.Next() {
+		var (
+			metric string
+			label  LabelCardinality
+		)
+
+		if err = topRows.Scan(&metric, &label.Label, &label.Values); err != nil {
+			return err
+		}
+		top[metric] = label
+	}
+
+	for i := range report.Metrics {
+		label := top[report.Metrics[i].Metric]
+		report.Metrics[i].TopLabel, report.Metrics[i].TopLabelValues = label.Label, label.Values
+	}
+	return topRows.Err()
+}
+
+func (c *Client) labelCardinality(labels string, limit int, report *CardinalityReport) error {
+	rows, err := c.db.Query(fmt.Sprintf(`SELECT p.key, count(*), count(DISTINCT p.value) FROM (%s) l, LATERAL %s
+		GROUP BY p.key ORDER BY count(DISTINCT p.value) DESC, p.key LIMIT $1`, labels, c.labelsFormat().each()), limit)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var l LabelCardinality
+
+		if err = rows.Scan(&l.Label, &l.Series, &l.Values); err != nil {
+			return err
+		}
+		report.Labels = append(report.Labels, l)
+	}
+	return rows.Err()
+}
+
+// suggestRelabels suggests dropping labels with nearly a value per series,
+// e.g. request IDs, and metrics holding a large share of all series
+func suggestRelabels(report *CardinalityReport) []RelabelSuggestion {
+	suggestions := []RelabelSuggestion{}
+	dropped := make(map[string]bool)
+
+	for _, l := range report.Labels {
+		if l.Values < cardinalityMinValues || 2*l.Values < l.Series {
+			continue
+		}
+
+		dropped[l.Label] = true
+		suggestions = append(suggestions, RelabelSuggestion{
+			Reason:        fmt.Sprintf("label %s has %d values across %d series, nearly one per series", l.Label, l.Values, l.Series),
+			RelabelConfig: fmt.Sprintf("- action: labeldrop\n  regex: %s", l.Label),
+		})
+	}
+
+	for _, m := range report.Metrics {
+		switch {
+		case dropped[m.TopLabel]:
+			// Dropping the label already reduces the series of the metric
+		case len(m.TopLabel) > 0 && m.TopLabelValues >= cardinalityMinValues && 2*m.TopLabelValues >= m.Series:
+			// Replacing a label with an empty value removes it
+			suggestions = append(suggestions, RelabelSuggestion{
+				Reason: fmt.Sprintf("label %s of metric %s has %d values across %d series", m.TopLabel, m.Metric, m.TopLabelValues, m.Series),
+				RelabelConfig: fmt.Sprintf("- source_labels: [__name__]\n  regex: %s\n  target_label: %s\n  replacement: \"\"",
+					regexp.QuoteMeta(m.Metric), m.TopLabel),
+			})
+		case report.Series > 0 && float64(m.Series) >= cardinalityMetricShare*float64(report.Series) && m.Series >= cardinalityMinValues:
+			suggestions = append(suggestions, RelabelSuggestion{
+				Reason: fmt.Sprintf("metric %s has %d of all %d series, drop it if it is unused", m.Metric, m.Series, report.Series),
+				RelabelConfig: fmt.Sprintf("- source_labels: [__name__]\n  regex: %s\n  action: drop",
+					regexp.QuoteMeta(m.Metric)),
+			})
+		}
+	}
+	return suggestions
+}
@@ -0,0 +1,52 @@
+package pgprometheus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSuggestRelabels(t *testing.T) {
+	report := &CardinalityReport{
+		Series: 10000,
+		Metrics: []MetricCardinality{
+			{Metric: "http_requests_total", Series: 5000, TopLabel: "request_id", TopLabelValues: 4900},
+			{Metric: "node_cpu_seconds_total", Series: 3000, TopLabel: "cpu", TopLabelValues: 64},
+			{Metric: "rpc_duration_seconds", Series: 1500, TopLabel: "path", TopLabelValues: 1200},
+			{Metric: "up", Series: 50, TopLabel: "instance", TopLabelValues: 50},
+		},
+		Labels: []LabelCardinality{
+			{Label: "request_id", Series: 5000, Values: 4900},
+			{Label: "path", Series: 4000, Values: 1200},
+			{Label: "instance", Series: 10000, Values: 50},
+		},
+	}
+
+	expected := []string{
+		"- action: labeldrop\n  regex: request_id",
+		"- source_labels: [__name__]\n  regex: node_cpu_seconds_total\n  action: drop",
+		"- source_labels: [__name__]\n  regex: rpc_duration_seconds\n  target_label: path\n  replacement: \"\"",
+	}
+
+	var actual []string
+	for _, s := range suggestRelabels(report) {
+		actual = append(actual, s.RelabelConfig)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestLabelsTablesQuery(t *testing.T) {
+	c := &Client{cfg: &Config{table: "metrics", labelsFormat: labelsFormatArrays}}
+
+	actual, err := c.labelsTablesQuery()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := `SELECT metric_name, label_keys, label_values FROM "metrics_labels"`; actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
@@ -0,0 +1,349 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The config check verifies the configuration and the database without
+// changing anything, e.g. as a gate before a deployment. It stops at the first
+// failed check the others depend on, such as the connection.
+
+// checkPingTimeout bounds connecting to the database, which is not retried
+// like at startup
+const checkPingTimeout = 10 * time.Second
+
+// CheckStatus is the outcome of a check
+type CheckStatus string
+
+// Outcomes of a check
+const (
+	CheckOK CheckStatus = "OK"
+	// CheckWarn is a problem the adapter works around, e.g. by falling back
+	// to plain tables
+	CheckWarn CheckStatus = "WARN"
+	CheckFail CheckStatus = "FAIL"
+)
+
+// CheckResult is the outcome of a single check of CheckConfig
+type CheckResult struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+}
+
+// CheckResults are the outcomes of all checks
+type CheckResults []CheckResult
+
+// Failed tells whether any check failed
+func (r CheckResults) Failed() bool {
+	for _, result := range r {
+		if result.Status == CheckFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CheckResults) add(name string, status CheckStatus, format string, args ...interface{}) {
+	*r = append(*r, CheckResult{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+// addErr adds a failure if err is not nil, and a success with the given
+// detail otherwise. It returns whether the check succeeded.
+func (r *CheckResults) addErr(name string, err error, detail string) bool {
+	if err != nil {
+		r.add(name, CheckFail, "%v", err)
+		return false
+	}
+
+	r.add(name, CheckOK, "%s", detail)
+	return true
+}
+
+// CheckConfig parses the database configuration, connects once and verifies
+// the server, the extensions, the privileges of the role and the schema of
+// existing tables
+func CheckConfig(cfg *Config) CheckResults {
+	var results CheckResults
+
+	if !results.addErr("password", cfg.readPassword(), "read") {
+		return results
+	}
+
+	if !results.addErr("connection pool", cfg.validatePool(), "valid") {
+		return results
+	}
+
+	if !results.addErr("startup", cfg.validateStartup(), "valid") {
+		return results
+	}
+
+	connStr, err := cfg.connString()
+
+	if !results.addErr("connection string", err, redactPassword(connStr)) {
+		return results
+	}
+
+	db, err := openDB(cfg, connStr)
+
+	if err == nil {
+		defer db.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), checkPingTimeout)
+		err = db.PingContext(ctx)
+		cancel()
+	}
+
+	if !results.addErr("connection", err, "connected") {
+		return results
+	}
+
+	c := &Client{db: db, cfg: cfg}
+
+	if !c.checkConfiguration(&results) {
+		return results
+	}
+
+	if cfg.dialect != dialectPostgreSQL {
+		results.add("extensions", CheckOK, "skipped with the %s dialect", cfg.dialect)
+	} else {
+		c.checkExtensions(&results)
+		c.checkPrivileges(&results)
+	}
+
+	c.checkTables(&results)
+	return results
+}
+
+// checkConfiguration validates the flags as NewClient does
+func (c *Client) checkConfiguration(results *CheckResults) bool {
+	var version string
+
+	err := c.db.QueryRow("SELECT version()").Scan(&version)
+
+	if !results.addErr("server version", err, version) {
+		return false
+	}
+
+	if c.cfg.autoStorage && c.cfg.dialect == dialectPostgreSQL {
+		tx, err := c.db.Begin()
+
+		if err == nil {
+			err = c.detectStorage(tx)
+			tx.Rollback()
+		}
+
+		if !results.addErr("storage detection", err, fmt.Sprintf("pg_prometheus=%t timescaledb=%t partitioning=%q",
+			c.cfg.usePgPrometheus, c.cfg.useTimescaleDb, c.cfg.partitioning)) {
+			return false
+		}
+	}
+
+	ok := results.addErr("storage", c.validateStorage(), "labels format "+c.labelsFormat().name()+", value type "+c.valueType())
+
+	err = nil
+
+	if c.cfg.tenantMode != tenantTable && c.cfg.tenantMode != tenantSchema {
+		err = fmt.Errorf("invalid tenant mode %q", c.cfg.tenantMode)
+	}
+
+	if err == nil {
+		_, err = parseTenantTiers(c.cfg.tenantTiers)
+	}
+
+	if err == nil && len(c.cfg.tenantTemplate) > 0 {
+		_, err = loadTenantTemplate(c.cfg.tenantTemplate)
+	}
+
+	ok = results.addErr("tenants", err, "tenant mode "+c.cfg.tenantMode) && ok
+
+	if len(c.cfg.rulesFile) > 0 {
+		rules, err := loadRules(c.cfg.rulesFile, c.cfg.rulesInterval)
+		ok = results.addErr("recording rules", err, fmt.Sprintf("%d groups", len(rules))) && ok
+	}
+	return ok
+}
+
+// requiredExtensions returns the extensions the adapter creates at startup
+func (c *Client) requiredExtensions() []string {
+	var extensions []string
+
+	if c.cfg.usePgPrometheus {
+		extensions = append(extensions, "pg_prometheus")
+	} else if ext := c.labelsFormat().extension(); len(ext) > 0 {
+		extensions = append(extensions, ext)
+	}
+
+	if c.cfg.partitioning == partitioningPgPartman {
+		extensions = append(extensions, "pg_partman")
+	}
+
+	if c.cfg.citus {
+		extensions = append(extensions, "citus")
+	}
+
+	if c.cfg.useTimescaleDb {
+		extensions = append(extensions, "timescaledb")
+	}
+	return extensions
+}
+
+func (c *Client) checkExtensions(results *CheckResults) {
+	var superuser bool
+
+	if err := c.db.QueryRow("SELECT rolsuper FROM pg_roles WHERE rolname = current_user").Scan(&superuser); err != nil {
+		results.add("extensions", CheckFail, "%v", err)
+		return
+	}
+
+	for _, name := range c.requiredExtensions() {
+		var installed, available sql.NullString
+
+		err := c.db.QueryRow(`SELECT e.extversion, a.default_version FROM pg_available_extensions a
+			LEFT JOIN pg_extension e ON e.extname = a.name WHERE a.name = $1`, name).Scan(&installed, &available)
+
+		check := "extension " + name
+
+		switch {
+		case err == sql.ErrNoRows && name == "timescaledb" && c.cfg.autoStorage:
+			results.add(check, CheckWarn, "not available, plain tables are used")
+		case err == sql.ErrNoRows:
+			results.add(check, CheckFail, "not available on the database server")
+		case err != nil:
+			results.add(check, CheckFail, "%v", err)
+		case installed.Valid:
+			results.add(check, CheckOK, "version %s installed", installed.String)
+		case superuser || c.trustedExtension(name):
+			results.add(check, CheckOK, "version %s available, created at startup", available.String)
+		default:
+			results.add(check, CheckFail, "not installed, and the role may not create it; run CREATE EXTENSION %s as a superuser", name)
+		}
+	}
+}
+
+// trustedExtension tells whether a role with the CREATE privilege on the
+// database may create the extension, as of PostgreSQL 13
+func (c *Client) trustedExtension(name string) bool {
+	var trusted bool
+
+	err := c.db.QueryRow(`SELECT bool_or(trusted) AND has_database_privilege(current_database(), 'CREATE')
+		FROM pg_available_extension_versions WHERE name = $1`, name).Scan(&trusted)
+	return err == nil && trusted
+}
+
+func (c *Client) checkPrivileges(results *CheckResults) {
+	var (
+		schema                  string
+		createSchema, temporary bool
+	)
+
+	err := c.db.QueryRow(`SELECT current_schema(), has_schema_privilege(current_schema(), 'CREATE'),
+		has_database_privilege(current_database(), 'TEMPORARY')`).Scan(&schema, &createSchema, &temporary)
+
+	if err != nil {
+		results.add("privileges", CheckFail, "%v", err)
+		return
+	}
+
+	if createSchema {
+		results.add("schema privileges", CheckOK, "CREATE on schema %s", schema)
+	} else {
+		results.add("schema privileges", CheckFail, "the role may not create tables in schema %s", schema)
+	}
+
+	if temporary {
+		results.add("temporary tables", CheckOK, "TEMPORARY on the database")
+	} else {
+		results.add("temporary tables", CheckFail, "the role may not create the temporary tables samples are copied into")
+	}
+
+	if c.cfg.tenantMode == tenantSchema || c.cfg.partitioning == partitioningPgPartman {
+		var createDatabase bool
+
+		err = c.db.QueryRow("SELECT has_database_privilege(current_database(), 'CREATE')").Scan(&createDatabase)
+
+		switch {
+		case err != nil:
+			results.add("database privileges", CheckFail, "%v", err)
+		case createDatabase:
+			results.add("database privileges", CheckOK, "CREATE on the database")
+		default:
+			results.add("database privileges", CheckFail, "the role may not create the schemas of tenants or pg_partman")
+		}
+	}
+}
+
+// checkTables verifies the privileges on and the schema of the tables that
+// already exist. Missing tables are created at startup.
+func (c *Client) checkTables(results *CheckResults) {
+	expected := c.expectedColumns(c.cfg.table)
+
+	if c.cfg.tablePerMetric {
+		expected = map[string][]column{c.cfg.table + "_metric_tables": nil}
+	}
+
+	var existing []string
+
+	for table := range expected {
+		columns, err := c.tableColumns(table)
+
+		if err != nil {
+			results.add("tables", CheckFail, "%v", err)
+			return
+		}
+
+		if columns != nil {
+			existing = append(existing, table)
+		}
+	}
+
+	sort.Strings(existing)
+
+	if len(existing) == 0 {
+		results.add("tables", CheckOK, "%s does not exist yet, created at startup", c.cfg.table)
+		return
+	}
+
+	if c.cfg.dialect == dialectPostgreSQL {
+		var denied []string
+
+		for _, table := range existing {
+			var ok bool
+
+			err := c.db.QueryRow("SELECT has_table_privilege($1, 'SELECT, INSERT')", quoteIdent(table)).Scan(&ok)
+
+			if err != nil {
+				results.add("table privileges", CheckFail, "%v", err)
+				return
+			}
+
+			if !ok {
+				denied = append(denied, table)
+			}
+		}
+
+		if len(denied) > 0 {
+			results.add("table privileges", CheckFail, "the role may not select from or insert into %s", strings.Join(denied, ", "))
+		} else {
+			results.add("table privileges", CheckOK, "SELECT and INSERT on %s", strings.Join(existing, ", "))
+		}
+	}
+
+	drift, err := c.schemaDrift()
+
+	switch {
+	case err != nil:
+		results.add("schema", CheckFail, "%v", err)
+	case len(drift) > 0 && c.cfg.strictSchema:
+		results.add("schema", CheckFail, "%s", strings.Join(drift, "; "))
+	case len(drift) > 0:
+		results.add("schema", CheckWarn, "%s", strings.Join(drift, "; "))
+	default:
+		results.add("schema", CheckOK, "matches the storage mode")
+	}
+}
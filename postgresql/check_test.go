@@ -0,0 +1,83 @@
+package pgprometheus
+
+import (
+	"database/sql"
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestRequiredExtensions(t *testing.T) {
+	for i, c := range []struct {
+		cfg      Config
+		expected []string
+	}{
+		{Config{usePgPrometheus: true, useTimescaleDb: true}, []string{"pg_prometheus", "timescaledb"}},
+		{Config{labelsFormat: labelsFormatHstore}, []string{"hstore"}},
+		{Config{labelsFormat: labelsFormatJSONB, partitioning: partitioningPgPartman}, []string{"pg_partman"}},
+		{Config{labelsFormat: labelsFormatJSONB, citus: true}, []string{"citus"}},
+		{Config{labelsFormat: labelsFormatArrays}, nil},
+	} {
+		c := c
+		client := &Client{cfg: &c.cfg}
+
+		if actual := client.requiredExtensions(); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%d: expected %v, got %v", i, c.expected, actual)
+		}
+	}
+}
+
+func TestCheckResultsFailed(t *testing.T) {
+	results := CheckResults{{Name: "a", Status: CheckOK}, {Name: "b", Status: CheckWarn}}
+
+	if results.Failed() {
+		t.Error("expected warnings not to fail")
+	}
+
+	results.add("c", CheckFail, "%s", "broken")
+
+	if !results.Failed() {
+		t.Error("expected a failed check to fail")
+	}
+}
+
+func TestCheckConfigPassword(t *testing.T) {
+	results := CheckConfig(&Config{password: "secret", passwordFile: "/nonexistent"})
+
+	if len(results) != 1 || results[0].Status != CheckFail {
+		t.Errorf("expected the check to stop at the password, got %+v", results)
+	}
+}
+
+func TestCheckConfigStartup(t *testing.T) {
+	results := CheckConfig(&Config{dbConnectRetries: -1})
+
+	if last := results[len(results)-1]; last.Name != "startup" || last.Status != CheckFail {
+		t.Errorf("expected the check to stop at the startup settings, got %+v", results)
+	}
+}
+
+func TestCheckConfigDefaults(t *testing.T) {
+	fake := newFakeDB()
+	sql.Register("fake-check", fake)
+	drivers["fake-check"] = fake
+
+	cfg := &Config{}
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	RegisterFlags(fs, cfg)
+
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	cfg.driver = "fake-check"
+
+	// The server version is not answered by the fake database
+	results := CheckConfig(cfg)
+
+	for _, result := range results {
+		if result.Name == "connection" && result.Status == CheckOK {
+			return
+		}
+	}
+	t.Errorf("expected to connect with the default flags, got %+v", results)
+}
@@ -1,6 +1,7 @@
 package pgprometheus
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"flag"
@@ -8,10 +9,14 @@ import (
 	"os"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/timescale/prometheus-postgresql-adapter/log"
+	"github.com/timescale/prometheus-postgresql-adapter/trace"
 
 	"github.com/timescale/prometheus-postgresql-adapter/util"
 
@@ -23,267 +28,1297 @@ import (
 
 // Config for the database
 type Config struct {
-	host                      string
-	port                      int
-	user                      string
-	password                  string
-	database                  string
-	schema                    string
-	sslMode                   string
-	table                     string
-	copyTable                 string
-	maxOpenConns              int
-	maxIdleConns              int
-	pgPrometheusNormalize     bool
-	pgPrometheusLogSamples    bool
-	pgPrometheusChunkInterval time.Duration
-	useTimescaleDb            bool
-	dbConnectRetries          int
+	host                         string
+	port                         int
+	user                         string
+	password                     string
+	database                     string
+	schema                       string
+	sslMode                      string
+	table                        string
+	copyTable                    string
+	maxOpenConns                 int
+	maxIdleConns                 int
+	pgPrometheusNormalize        bool
+	pgPrometheusLogSamples       bool
+	pgPrometheusChunkInterval    time.Duration
+	pgPrometheusPartitions       int
+	useTimescaleDb               bool
+	tablePerMetric               bool
+	usePgPrometheus              bool
+	distributed                  bool
+	citus                        bool
+	citusShardCount              int
+	partitioning                 string
+	partitionPremake             int
+	partitionRetention           time.Duration
+	partitionMaintenance         time.Duration
+	replicationFactor            int
+	dataNodes                    string
+	labelsFormat                 string
+	valueType                    string
+	tablespace                   string
+	indexTablespace              string
+	timeIndex                    string
+	labelsIndex                  string
+	partialIndexMetrics          string
+	dbConnectRetries             int
+	dialect                      string
+	insertBatchSize              int
+	labelsCacheSize              int
+	writeConcurrency             int
+	readConcurrency              int
+	prepareStatements            bool
+	autoStorage                  bool
+	fillfactor                   int
+	autovacuumVacuumThreshold    int
+	autovacuumVacuumScaleFactor  float64
+	autovacuumAnalyzeScaleFactor float64
+	reorderChunks                bool
+	coldTablespace               string
+	coldIndexTablespace          string
+	coldAfter                    time.Duration
+	tieringInterval              time.Duration
+	indexAdvisor                 string
+	indexAdvisorThreshold        int
+	indexAdvisorInterval         time.Duration
+	rulesFile                    string
+	rulesInterval                time.Duration
+	retentionPolicies            string
+	retentionInterval            time.Duration
+	downsampleResolutions        string
+	downsampleInterval           time.Duration
+	downsamplePruneAfter         time.Duration
+	pgPrometheusUpgrade          bool
+	strictSchema                 bool
+	pgPrometheusTableOptions     string
+	timeZone                     string
+	timeFormat                   string
+	sslRootCert                  string
+	sslCert                      string
+	sslKey                       string
+	passwordFile                 string
+	url                          string
+	connMaxLifetime              time.Duration
+	driver                       string
+	pgBouncer                    bool
+	awsIAMAuth                   bool
+	awsRegionName                string
+	cloudSQLInstance             string
+	cloudSQLIPType               string
+	cloudSQLIAMAuth              bool
+	startupTimeout               time.Duration
+	healthCheckInterval          time.Duration
+	applicationName              string
+	queryComments                bool
+	targetSessionAttrs           string
+	statementTimeout             time.Duration
+	lockTimeout                  time.Duration
+	idleInTransactionTimeout     time.Duration
+	topMetrics                   int
+	recentQueries                int
+	selfTelemetryInterval        time.Duration
+	deepHealthCheck              bool
+	leaderElection               bool
+	leaderElectionInterval       time.Duration
+	leaderElectionBackend        string
+	leaderElectionEndpoint       string
+	leaderElectionLease          time.Duration
+	leaderElectionFailover       string
+	leaderElectionTolerance      time.Duration
+	replicaLabels                string
+	replicaDedupWindow           time.Duration
+	tenantMode                   string
+	tenantSchemaPrefix           string
+	tenantMaxOpenConns           int
+	tenantAutoProvision          bool
+	tenantTiers                  string
+	tenantTemplate               string
+	tenantRetention              string
+	tenantUsageInterval          time.Duration
+	singletonJobs                bool
 }
 
 // ParseFlags parses the configuration flags specific to PostgreSQL and TimescaleDB
 func ParseFlags(cfg *Config) *Config {
-	flag.StringVar(&cfg.host, "pg.host", "localhost", "The PostgreSQL host")
-	flag.IntVar(&cfg.port, "pg.port", 5432, "The PostgreSQL port")
-	flag.StringVar(&cfg.user, "pg.user", "postgres", "The PostgreSQL user")
-	flag.StringVar(&cfg.password, "pg.password", "", "The PostgreSQL password")
-	flag.StringVar(&cfg.database, "pg.database", "postgres", "The PostgreSQL database")
-	flag.StringVar(&cfg.schema, "pg.schema", "", "The PostgreSQL schema")
-	flag.StringVar(&cfg.sslMode, "pg.ssl-mode", "disable", "The PostgreSQL connection ssl mode")
-	flag.StringVar(&cfg.table, "pg.table", "metrics", "Override prefix for internal tables. It is also a view name used for querying")
-	flag.StringVar(&cfg.copyTable, "pg.copy-table", "", "Override default table to COPY data to")
-	flag.IntVar(&cfg.maxOpenConns, "pg.max-open-conns", 50, "The max number of open connections to the database")
-	flag.IntVar(&cfg.maxIdleConns, "pg.max-idle-conns", 10, "The max number of idle connections to the database")
-	flag.BoolVar(&cfg.pgPrometheusNormalize, "pg.prometheus-normalized-schema", true, "Insert metric samples into normalized schema")
-	flag.BoolVar(&cfg.pgPrometheusLogSamples, "pg.prometheus-log-samples", false, "Log raw samples to stdout")
-	flag.DurationVar(&cfg.pgPrometheusChunkInterval, "pg.prometheus-chunk-interval", time.Hour*12, "The size of a time-partition chunk in TimescaleDB")
-	flag.BoolVar(&cfg.useTimescaleDb, "pg.use-timescaledb", true, "Use timescaleDB")
-	flag.IntVar(&cfg.dbConnectRetries, "pg.db-connect-retries", 0, "How many times to retry connecting to the database")
+	RegisterFlags(flag.CommandLine, cfg)
 	return cfg
 }
 
+// RegisterFlags defines the configuration flags of cfg in the flag set
+func RegisterFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.host, "pg.host", "localhost", "The PostgreSQL host, or the directory of its Unix socket, e.g. /var/run/postgresql. Comma-separated hosts, optionally with ports, are tried in order")
+	fs.IntVar(&cfg.port, "pg.port", 5432, "The PostgreSQL port")
+	fs.StringVar(&cfg.user, "pg.user", "postgres", "The PostgreSQL user")
+	fs.StringVar(&cfg.password, "pg.password", "", "The PostgreSQL password. Defaults to the PGPASSWORD environment variable")
+	fs.StringVar(&cfg.driver, "pg.driver", driverPq, "The database/sql driver [ \"postgres\", \"pgx\" ]. pgx supports SCRAM-SHA-256 authentication, but writes samples with multi-row INSERTs instead of COPY")
+	fs.BoolVar(&cfg.pgBouncer, "pg.pgbouncer", false, "Connect through PgBouncer in transaction pooling mode. Avoids prepared statements and writes samples with multi-row INSERTs instead of COPY")
+	fs.BoolVar(&cfg.awsIAMAuth, "pg.aws-iam-auth", false, "Authenticate to AWS RDS with IAM authentication tokens instead of a password. The AWS credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN")
+	fs.StringVar(&cfg.awsRegionName, "pg.aws-region", "", "The AWS region of the RDS database. Defaults to AWS_REGION")
+	fs.StringVar(&cfg.cloudSQLInstance, "pg.cloud-sql-instance", "", "Connect to the Google Cloud SQL instance with this project:region:instance connection name instead of -pg.host, without the Cloud SQL Auth proxy. Requires the GCE metadata server")
+	fs.StringVar(&cfg.cloudSQLIPType, "pg.cloud-sql-ip-type", "PRIMARY", "The IP address of the Cloud SQL instance to connect to [ \"PRIMARY\", \"PRIVATE\" ]")
+	fs.BoolVar(&cfg.cloudSQLIAMAuth, "pg.cloud-sql-iam-auth", false, "Authenticate to Cloud SQL as an IAM database user with the access token of the service account, instead of a password")
+	fs.StringVar(&cfg.applicationName, "pg.application-name", "prometheus-postgresql-adapter", "The application_name of database connections, shown in pg_stat_activity")
+	fs.BoolVar(&cfg.queryComments, "pg.query-comments", true, "Prefix reads and writes with a comment naming the application, adapter version and endpoint, for attributing load in pg_stat_activity and pg_stat_statements")
+	fs.StringVar(&cfg.targetSessionAttrs, "pg.target-session-attrs", targetSessionAny, "Which servers new connections are accepted to [ \"any\", \"read-write\" ]. With read-write, standbys are skipped, so that the adapter follows the primary after a failover")
+	fs.DurationVar(&cfg.statementTimeout, "pg.statement-timeout", 0, "The statement_timeout of database connections. Also applies to maintenance statements such as retention and downsampling. 0 uses the server setting")
+	fs.DurationVar(&cfg.lockTimeout, "pg.lock-timeout", 0, "The lock_timeout of database connections. 0 uses the server setting")
+	fs.DurationVar(&cfg.idleInTransactionTimeout, "pg.idle-in-transaction-timeout", 0, "The idle_in_transaction_session_timeout of database connections. 0 uses the server setting")
+	fs.StringVar(&cfg.url, "pg.url", "", "A libpq connection string or postgres:// URL. Overrides -pg.host, -pg.port, -pg.user, -pg.database and -pg.ssl-mode")
+	fs.StringVar(&cfg.passwordFile, "pg.password-file", "", "A file containing the PostgreSQL password, so that it does not appear in process arguments")
+	fs.StringVar(&cfg.database, "pg.database", "postgres", "The PostgreSQL database")
+	fs.StringVar(&cfg.schema, "pg.schema", "", "The PostgreSQL schema of the tables, put before public on the search_path")
+	fs.StringVar(&cfg.sslMode, "pg.ssl-mode", "disable", "The PostgreSQL connection ssl mode [ \"disable\", \"require\", \"verify-ca\", \"verify-full\" ]")
+	fs.StringVar(&cfg.sslRootCert, "pg.ssl-root-cert", "", "The file of the CA certificates the PostgreSQL server certificate is verified against")
+	fs.StringVar(&cfg.sslCert, "pg.ssl-cert", "", "The client certificate file for PostgreSQL connections")
+	fs.StringVar(&cfg.sslKey, "pg.ssl-key", "", "The client private key file for PostgreSQL connections")
+	fs.StringVar(&cfg.table, "pg.table", "metrics", "Override prefix for internal tables. It is also a view name used for querying")
+	fs.StringVar(&cfg.copyTable, "pg.copy-table", "", "Override default table to COPY data to")
+	fs.IntVar(&cfg.maxOpenConns, "pg.max-open-conns", 50, "The max number of open connections to the database")
+	fs.IntVar(&cfg.maxIdleConns, "pg.max-idle-conns", 10, "The max number of idle connections to the database")
+	fs.DurationVar(&cfg.connMaxLifetime, "pg.conn-max-lifetime", 0, "The max time a connection to the database is reused, so that connections move to a new primary after a failover. 0 reuses connections forever")
+	fs.BoolVar(&cfg.pgPrometheusNormalize, "pg.prometheus-normalized-schema", true, "Insert metric samples into normalized schema")
+	fs.BoolVar(&cfg.pgPrometheusLogSamples, "pg.prometheus-log-samples", false, "Log raw samples to stdout")
+	fs.DurationVar(&cfg.pgPrometheusChunkInterval, "pg.prometheus-chunk-interval", time.Hour*12, "The size of a time-partition chunk in TimescaleDB")
+	fs.IntVar(&cfg.pgPrometheusPartitions, "pg.prometheus-space-partitions", 0, "The number of space partitions (hashed on the series id) of the TimescaleDB hypertable. 0 disables space partitioning")
+	fs.BoolVar(&cfg.useTimescaleDb, "pg.use-timescaledb", true, "Use timescaleDB")
+	fs.BoolVar(&cfg.usePgPrometheus, "pg.use-pg-prometheus", true, "Use the pg_prometheus extension. If disabled, the adapter creates and manages a normalized schema itself")
+	fs.BoolVar(&cfg.distributed, "pg.distributed-hypertable", false, "Create a distributed hypertable on a multi-node TimescaleDB cluster. The adapter must connect to the access node")
+	fs.IntVar(&cfg.replicationFactor, "pg.replication-factor", 1, "The number of data nodes each chunk of a distributed hypertable is replicated to")
+	fs.StringVar(&cfg.dataNodes, "pg.data-nodes", "", "Comma-separated data nodes of a distributed hypertable. Defaults to all data nodes attached to the access node")
+	fs.BoolVar(&cfg.citus, "pg.citus", false, "Distribute the values table across Citus workers by series. Requires -pg.use-timescaledb=false and -pg.use-pg-prometheus=false")
+	fs.IntVar(&cfg.citusShardCount, "pg.citus-shard-count", 0, "The number of shards of the values table. 0 uses the Citus default")
+	fs.StringVar(&cfg.partitioning, "pg.partitioning", "", "Partition the values table by time without TimescaleDB, using pg_partman or partitions managed by the adapter [ \"pg_partman\", \"native\" ]. Requires -pg.use-timescaledb=false and -pg.use-pg-prometheus=false")
+	fs.IntVar(&cfg.partitionPremake, "pg.partition-premake", 4, "The number of future time partitions to create in advance")
+	fs.DurationVar(&cfg.partitionRetention, "pg.partition-retention", 0, "Drop time partitions older than this. 0 keeps all partitions")
+	fs.DurationVar(&cfg.partitionMaintenance, "pg.partition-maintenance-interval", time.Hour, "How often to create and drop time partitions. 0 disables partition maintenance by the adapter")
+	fs.StringVar(&cfg.labelsFormat, "pg.labels-format", labelsFormatJSONB, "The column type of labels in the schema managed by the adapter [ \"jsonb\", \"hstore\", \"arrays\" ]. pg_prometheus only supports jsonb")
+	fs.StringVar(&cfg.valueType, "pg.value-type", valueTypeDouble, "The column type of sample values in the schema managed by the adapter [ \"double\", \"real\", \"numeric\" ]. real halves the storage at single precision, numeric keeps decimals exact but rejects infinities before PostgreSQL 14")
+	fs.BoolVar(&cfg.tablePerMetric, "pg.table-per-metric", false, "Store each metric in its own table, named after the metric, prefixed with the table name and suffixed with a hash of the metric name")
+	fs.StringVar(&cfg.tablespace, "pg.tablespace", "", "The tablespace for tables (and TimescaleDB chunks) created by the adapter. Defaults to the database default")
+	fs.StringVar(&cfg.indexTablespace, "pg.index-tablespace", "", "The tablespace for indexes on tables created by the adapter. Defaults to the table's tablespace")
+	fs.StringVar(&cfg.timeIndex, "pg.time-index", timeIndexBtree, "The index type on the time column of the values table [ \"btree\", \"brin\" ]. BRIN indexes are much smaller for append-only workloads")
+	fs.StringVar(&cfg.labelsIndex, "pg.labels-index", labelsIndexGin, "The index type on the labels column of the labels table [ \"gin\", \"gin-path\", \"none\" ]. gin-path only supports label equality matchers but is smaller")
+	fs.StringVar(&cfg.partialIndexMetrics, "pg.partial-index-metrics", "", "Comma-separated metric names whose series get a partial index of their own on the labels column, of the -pg.labels-index type, when the tables are created. Label matchers of these metrics then scan a much smaller index")
+	fs.StringVar(&cfg.dialect, "pg.dialect", dialectPostgreSQL, "The SQL dialect of the database [ \"postgresql\", \"cockroachdb\", \"yugabytedb\" ]. CockroachDB and YugabyteDB require -pg.use-timescaledb=false and -pg.use-pg-prometheus=false")
+	fs.IntVar(&cfg.insertBatchSize, "pg.insert-batch-size", 0, "The max number of samples per multi-row INSERT, for dialects that are not written with COPY. 0 uses the dialect default")
+	fs.IntVar(&cfg.writeConcurrency, "pg.write-concurrency", 1, "The max number of transactions, each on its own connection, a batch of samples is written with at once. With -pg.table-per-metric, the tables are written in separate transactions, and with -pg.prometheus-space-partitions, the series are split between them. A failed batch may have been stored in part, and Prometheus retries it whole")
+	fs.IntVar(&cfg.readConcurrency, "pg.read-concurrency", 4, "The max number of queries of a read request run at once, each on its own connection")
+	fs.BoolVar(&cfg.prepareStatements, "pg.prepare-statements", true, "Prepare the statements writing samples and the read queries once per connection, binding the time range of reads, so that PostgreSQL reuses their plans. Ignored with -pg.pgbouncer")
+	fs.IntVar(&cfg.labelsCacheSize, "pg.labels-cache-size", 100000, "The number of recently written series whose encoded labels are kept, so that they are not encoded again for every sample. 0 disables the cache")
+	fs.BoolVar(&cfg.autoStorage, "pg.auto-storage", false, "Select the storage mode from the server version and available extensions, preferring pg_prometheus, then TimescaleDB, then native partitioning. Overrides -pg.use-pg-prometheus, -pg.use-timescaledb and -pg.partitioning")
+	fs.IntVar(&cfg.fillfactor, "pg.fillfactor", 0, "The fillfactor of the table holding samples. 0 uses the PostgreSQL default")
+	fs.IntVar(&cfg.autovacuumVacuumThreshold, "pg.autovacuum-vacuum-threshold", -1, "The autovacuum_vacuum_threshold of the table holding samples. -1 uses the server setting")
+	fs.Float64Var(&cfg.autovacuumVacuumScaleFactor, "pg.autovacuum-vacuum-scale-factor", -1, "The autovacuum_vacuum_scale_factor of the table holding samples. -1 uses the server setting")
+	fs.Float64Var(&cfg.autovacuumAnalyzeScaleFactor, "pg.autovacuum-analyze-scale-factor", -1, "The autovacuum_analyze_scale_factor of the table holding samples. -1 uses the server setting")
+	fs.BoolVar(&cfg.reorderChunks, "pg.reorder-chunks", false, "Add a TimescaleDB policy that reorders closed chunks by series and time, for better compression and per-series reads")
+	fs.StringVar(&cfg.coldTablespace, "pg.cold-tablespace", "", "Move TimescaleDB chunks older than -pg.cold-after to this tablespace. Empty disables tiering")
+	fs.StringVar(&cfg.coldIndexTablespace, "pg.cold-index-tablespace", "", "The tablespace for indexes of chunks moved to the cold tablespace. Defaults to the cold tablespace")
+	fs.DurationVar(&cfg.coldAfter, "pg.cold-after", time.Hour*24*30, "The age after which chunks are moved to the cold tablespace")
+	fs.DurationVar(&cfg.tieringInterval, "pg.tiering-interval", time.Hour, "How often to move old chunks to the cold tablespace")
+	fs.StringVar(&cfg.indexAdvisor, "pg.index-advisor", "", "Track the labels matched on by read queries and log or create expression indexes on frequently matched ones [ \"report\", \"create\" ]. Empty disables the advisor")
+	fs.IntVar(&cfg.indexAdvisorThreshold, "pg.index-advisor-threshold", 100, "The number of read matchers on a label after which the index advisor reports or creates an index on it")
+	fs.DurationVar(&cfg.indexAdvisorInterval, "pg.index-advisor-interval", time.Minute*10, "How often the index advisor checks matcher counts")
+	fs.StringVar(&cfg.rulesFile, "pg.rules-file", "", "A Prometheus rules file whose recording rules are evaluated in the database and written back as new metrics. Only a subset of PromQL is supported")
+	fs.DurationVar(&cfg.rulesInterval, "pg.rules-interval", time.Minute, "The evaluation interval of rule groups that do not set one")
+	fs.StringVar(&cfg.retentionPolicies, "pg.retention-policies", "", "Comma-separated metric name patterns and how long to keep their samples, e.g. \"up=2y,container_*=30d\". The first matching pattern applies")
+	fs.DurationVar(&cfg.retentionInterval, "pg.retention-interval", time.Hour, "How often to delete samples older than their retention")
+	fs.StringVar(&cfg.downsampleResolutions, "pg.downsample-resolutions", "", "Comma-separated resolutions to roll samples up to with plain SQL, e.g. \"5m,1h\". Each resolution gets its own table and view")
+	fs.DurationVar(&cfg.downsampleInterval, "pg.downsample-interval", time.Minute*10, "How often to roll up samples")
+	fs.DurationVar(&cfg.downsamplePruneAfter, "pg.downsample-prune-after", 0, "Delete raw samples older than this once they have been rolled up to all resolutions. 0 keeps raw samples")
+	fs.BoolVar(&cfg.pgPrometheusUpgrade, "pg.prometheus-upgrade", false, "Update the pg_prometheus extension to the latest available version at startup")
+	fs.BoolVar(&cfg.strictSchema, "pg.strict-schema", false, "Refuse to start if the tables, indexes or functions in the database do not match the storage mode, instead of only logging the differences")
+	fs.StringVar(&cfg.pgPrometheusTableOptions, "pg.prometheus-table-options", "", "Comma-separated name=value options passed on to pg_prometheus' create_prometheus_table, e.g. \"keep_samples=false\"")
+	fs.StringVar(&cfg.timeZone, "pg.time-zone", "", "The session time zone of database connections. Defaults to the server's time zone")
+	fs.StringVar(&cfg.timeFormat, "pg.time-format", timeFormatRFC3339, "How times are written in generated query predicates [ \"rfc3339\", \"epoch\" ]. RFC 3339 times are written in UTC with millisecond precision")
+	fs.IntVar(&cfg.dbConnectRetries, "pg.db-connect-retries", 0, "How many times to retry connecting to the database at startup, with a backoff of up to 30s")
+	fs.DurationVar(&cfg.healthCheckInterval, "pg.health-check-interval", 10*time.Second, "How often to probe the database connections, closing idle connections after a failure so that a restarted or failed over database is reconnected to. 0 disables probing")
+	fs.IntVar(&cfg.topMetrics, "pg.top-metrics", 100, "The number of metrics with the most written samples to track, approximately, in memory. 0 disables tracking")
+	fs.IntVar(&cfg.recentQueries, "pg.recent-queries", 100, "The number of recent remote read queries kept for /debug/queries. 0 keeps none")
+	fs.DurationVar(&cfg.selfTelemetryInterval, "pg.self-telemetry-interval", 0, "How often to write the ingest rate, errors and in-progress writes of the adapter into the <table>_adapter_telemetry table. 0 disables self-telemetry")
+	fs.BoolVar(&cfg.deepHealthCheck, "pg.deep-health-check", false, "Check health by committing a row to, reading it from and deleting it from the <table>_heartbeat table, instead of SELECT 1, so that a database that accepts connections but cannot commit writes is reported unhealthy")
+	fs.BoolVar(&cfg.leaderElection, "pg.leader-election", false, "Only write samples while holding the leader election lock of the table, so that of the adapters receiving the same samples from an HA pair of Prometheus servers only one writes")
+	fs.StringVar(&cfg.leaderElectionBackend, "pg.leader-election-backend", electionAdvisoryLock, "Where the leader election lock is held [ \"advisory-lock\", \"etcd\", \"consul\" ]")
+	fs.StringVar(&cfg.leaderElectionEndpoint, "pg.leader-election-endpoint", "", "The HTTP address of etcd, e.g. http://localhost:2379, or Consul, e.g. http://localhost:8500, holding the leader election lock")
+	fs.DurationVar(&cfg.leaderElectionInterval, "pg.leader-election-interval", 5*time.Second, "How often followers try to take the leader election lock, and the leader checks the connection holding it")
+	fs.DurationVar(&cfg.leaderElectionLease, "pg.leader-election-lease", 0, "How long the etcd lease or Consul session of a leader that stopped renewing it is kept before a follower takes over, 0 for three election intervals and at least 10s. The advisory lock is released as soon as the connection of the leader is lost")
+	fs.StringVar(&cfg.leaderElectionFailover, "pg.leader-election-failover", failoverAccept, "What a new leader does with samples the previous leader may already have written [ \"accept\", \"drop\" ]. With \"drop\", samples older than the election minus -pg.leader-election-scrape-tolerance are dropped")
+	fs.DurationVar(&cfg.leaderElectionTolerance, "pg.leader-election-scrape-tolerance", time.Minute, "How far before its election a new leader still writes samples with -pg.leader-election-failover=drop, usually a scrape interval and the remote write delay, so that the samples in flight during the failover are not lost")
+	fs.StringVar(&cfg.replicaLabels, "pg.replica-labels", "", "Comma-separated labels telling apart the series of HA Prometheus replicas, e.g. \"__replica__\". They are stripped from read results, and the series of all replicas are merged into one")
+	fs.DurationVar(&cfg.replicaDedupWindow, "pg.replica-dedup-window", time.Minute, "How long a gap in the samples of a replica must be before merged series switch to another replica, usually a few scrape intervals")
+	fs.StringVar(&cfg.tenantMode, "pg.tenant-mode", tenantTable, "Where the samples of tenants are stored, if the adapter identifies tenants [ \"table\", \"schema\" ]. \"table\" suffixes the tables with the tenant, and \"schema\" creates the tables in a schema of the tenant, with a connection pool of its own")
+	fs.IntVar(&cfg.tenantMaxOpenConns, "pg.tenant-max-open-conns", 5, "The max number of open connections of the pool of each tenant with -pg.tenant-mode=schema, capped at -pg.max-open-conns")
+	fs.StringVar(&cfg.tenantSchemaPrefix, "pg.tenant-schema-prefix", "tenant_", "The prefix of the schema of each tenant with -pg.tenant-mode=schema")
+	fs.BoolVar(&cfg.tenantAutoProvision, "pg.tenant-auto-provision", true, "Create the tables of a tenant when it is first seen. If disabled, requests of tenants without tables fail")
+	fs.StringVar(&cfg.tenantTiers, "pg.tenant-tiers", "", "Comma-separated pattern=tier pairs assigning tenants to the tiers of -pg.tenant-template, e.g. \"acme=premium,team_*=standard\". Other tenants are in the \"default\" tier")
+	fs.StringVar(&cfg.tenantRetention, "pg.tenant-retention", "", "Comma-separated tenant patterns and how long to keep the samples of all metrics of matching tenants, e.g. \"acme=1y,*=30d\". The first matching pattern applies, and -pg.retention-policies also apply to the tables of tenants")
+	fs.DurationVar(&cfg.tenantUsageInterval, "pg.tenant-usage-interval", 5*time.Minute, "How often to estimate the series and storage of each tenant, for usage metrics and reports. 0 disables the estimates")
+	fs.StringVar(&cfg.tenantTemplate, "pg.tenant-template", "", "A file with a Go template of SQL statements run when the tables of a new tenant are created, e.g. to set the retention, chunk interval or compression of its tier. The template gets .Tenant, .Tier, .Table and .Schema")
+	fs.BoolVar(&cfg.singletonJobs, "pg.singleton-jobs", true, "Run retention, downsampling, tiering, partition maintenance and recording rules on a single adapter at a time among those writing to the same table, guarded by advisory locks")
+	fs.DurationVar(&cfg.startupTimeout, "pg.startup-timeout", 0, "How long to keep retrying to connect to the database at startup before giving up, regardless of -pg.db-connect-retries")
+}
+
 // Client sends Prometheus samples to PostgreSQL
 type Client struct {
 	db  *sql.DB
 	cfg *Config
+
+	metricTablesLock sync.RWMutex
+	metricTables     map[string]string
+
+	// poolLock guards the idle connection limit, which may be reloaded
+	poolLock     sync.Mutex
+	maxIdleConns int
+
+	advisor           *indexAdvisor
+	retentionLock     sync.RWMutex
+	retentionPolicies []retentionPolicy
+	tenantRetention   []retentionPolicy
+	retentionOnce     sync.Once
+	resolutions       []time.Duration
+
+	pgPrometheusVersion string
+	createTableArgs     map[string]bool
+
+	writeMetrics  *writeMetrics
+	readMetrics   *readMetrics
+	topMetrics    *topK
+	recentQueries *queryRing
+	elector       elector
+	replicaLabels []string
+	waitLatency   *latencyWindow
+	commitLatency *latencyWindow
+	labels        *labelsInterner
+	stmts         *stmtCache
+
+	createTmpTableStmt *sql.Stmt
+	skippedJobs        *prometheus.CounterVec
+	// numericInfinity is whether a numeric value column stores infinities
+	numericInfinity bool
+
+	tenantsLock    sync.RWMutex
+	tenants        map[string]*Client
+	tenantTiers    []tenantTier
+	tenantTemplate *template.Template
+	tenantMetrics  *tenantMetrics
+	// usage is the usage of a tenant client
+	usage tenantCounters
+	// provisioning are the tenants whose client is being set up
+	provisioning map[string]*tenantProvisioning
 }
 
 const (
-	sqlCreateTmpTable = "CREATE TEMPORARY TABLE IF NOT EXISTS %s_tmp(sample prom_sample) ON COMMIT DELETE ROWS;"
-	sqlCopyTable      = "COPY \"%s\" FROM STDIN"
-	sqlInsertLabels   = "INSERT INTO %s_labels (metric_name, labels) SELECT prom_name(tmp.sample), prom_labels(tmp.sample) FROM %s_tmp tmp ON CONFLICT (metric_name, labels) DO NOTHING;"
-	sqlInsertValues   = "INSERT INTO %s_values SELECT tmp.prom_time, tmp.prom_value, l.id FROM (SELECT prom_time(sample), prom_value(sample), prom_name(sample), prom_labels(sample) FROM %s_tmp) tmp INNER JOIN %s_labels l on tmp.prom_name=l.metric_name AND  tmp.prom_labels=l.labels;"
+	sqlCreateTmpTable   = "CREATE TEMPORARY TABLE IF NOT EXISTS %s(sample prom_sample) ON COMMIT DELETE ROWS;"
+	sqlInsertLabels     = "INSERT INTO %s (metric_name, labels) SELECT prom_name(tmp.sample), prom_labels(tmp.sample) FROM %s tmp ON CONFLICT (metric_name, labels) DO NOTHING;"
+	sqlTruncateTmpTable = "TRUNCATE %s"
+	sqlInsertValues     = "INSERT INTO %s SELECT tmp.prom_time, tmp.prom_value, l.id FROM (SELECT prom_time(sample), prom_value(sample), prom_name(sample), prom_labels(sample) FROM %s) tmp INNER JOIN %s l on tmp.prom_name=l.metric_name AND  tmp.prom_labels=l.labels;"
 )
 
-var (
-	createTmpTableStmt *sql.Stmt
+const (
+	timeIndexBtree = "btree"
+	timeIndexBrin  = "brin"
+
+	labelsIndexGin     = "gin"
+	labelsIndexGinPath = "gin-path"
+	labelsIndexNone    = "none"
+)
+
+const (
+	timeFormatRFC3339 = "rfc3339"
+	timeFormatEpoch   = "epoch"
+
+	rfc3339Milli = "2006-01-02T15:04:05.000Z07:00"
 )
 
 // NewClient creates a new PostgreSQL client
 func NewClient(cfg *Config) *Client {
-	connStr := fmt.Sprintf("host=%v port=%v user=%v dbname=%v password='%v' sslmode=%v connect_timeout=10",
-		cfg.host, cfg.port, cfg.user, cfg.database, cfg.password, cfg.sslMode)
+	if err := cfg.readPassword(); err != nil {
+		log.Error("err", err)
+		os.Exit(1)
+	}
 
-	wrappedDb, err := util.RetryWithFixedDelay(uint(cfg.dbConnectRetries), time.Second, func() (interface{}, error) {
-		return sql.Open("postgres", connStr)
-	})
+	if err := cfg.validatePool(); err != nil {
+		log.Error("msg", "Invalid connection pool configuration", "err", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.validateStartup(); err != nil {
+		log.Error("msg", "Invalid startup configuration", "err", err)
+		os.Exit(1)
+	}
+
+	connStr, err := cfg.connString()
+
+	if err != nil {
+		log.Error("err", err)
+		os.Exit(1)
+	}
 
-	log.Info("msg", connStr)
+	db, err := openDB(cfg, connStr)
+
+	log.Info("msg", redactPassword(connStr))
 
 	if err != nil {
 		log.Error("err", err)
 		os.Exit(1)
 	}
 
-	db := wrappedDb.(*sql.DB)
+	// Waits for a database that starts slower than the adapter
+	err = util.RetryWithBackoff(uint(cfg.dbConnectRetries), cfg.startupTimeout, time.Second, 30*time.Second, db.Ping)
+
+	if err != nil {
+		log.Error("msg", "Could not connect to the database", "err", err)
+		os.Exit(1)
+	}
+
+	db.SetMaxOpenConns(cfg.maxOpenConns)
+	db.SetMaxIdleConns(cfg.maxIdleConns)
+	db.SetConnMaxLifetime(cfg.connMaxLifetime)
+
+	client := &Client{
+		db:            db,
+		cfg:           cfg,
+		metricTables:  make(map[string]string),
+		maxIdleConns:  cfg.maxIdleConns,
+		writeMetrics:  newWriteMetrics(),
+		readMetrics:   newReadMetrics(),
+		tenants:       make(map[string]*Client),
+		tenantMetrics: newTenantMetrics(),
+		skippedJobs:   newSkippedJobs(),
+		waitLatency:   newLatencyWindow(),
+		commitLatency: newLatencyWindow(),
+		labels:        newLabelsInterner(cfg.labelsCacheSize),
+		stmts:         newStmtCache(db, cfg),
+	}
+
+	client.replicaLabels = parseReplicaLabels(cfg.replicaLabels)
+
+	if cfg.tenantMode != tenantTable && cfg.tenantMode != tenantSchema {
+		log.Error("msg", "Invalid tenant mode", "mode", cfg.tenantMode)
+		os.Exit(1)
+	}
+
+	if client.tenantTiers, err = parseTenantTiers(cfg.tenantTiers); err != nil {
+		log.Error("err", err)
+		os.Exit(1)
+	}
+
+	if len(cfg.tenantTemplate) > 0 {
+		if client.tenantTemplate, err = loadTenantTemplate(cfg.tenantTemplate); err != nil {
+			log.Error("msg", "Error loading the tenant template", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	err = client.setupPgPrometheus()
+
+	if err == nil {
+		err = client.checkSchema()
+	}
+
+	if err == nil && cfg.deepHealthCheck {
+		_, err = db.Exec(fmt.Sprintf(sqlCreateHeartbeatTable, ident(cfg.table, "_heartbeat")))
+	}
+
+	if err != nil {
+		log.Error("err", err)
+		os.Exit(1)
+	}
+
+	if client.useCopy() && !cfg.pgBouncer {
+		client.createTmpTableStmt, err = db.Prepare(client.createTmpTable())
+		if err != nil {
+			log.Error("msg", "Error on preparing create tmp table statement", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.topMetrics > 0 {
+		client.topMetrics = newTopK(cfg.topMetrics)
+	}
+
+	if cfg.recentQueries > 0 {
+		client.recentQueries = newQueryRing(cfg.recentQueries)
+	}
+
+	if cfg.healthCheckInterval > 0 {
+		go client.runHealthProbe()
+	}
+
+	if cfg.selfTelemetryInterval > 0 {
+		go client.runSelfTelemetry()
+	}
+
+	if cfg.leaderElection {
+		client.elector, err = newElector(cfg, db)
+
+		if err != nil {
+			log.Error("msg", "Error setting up leader election", "err", err)
+			os.Exit(1)
+		}
+		go runElection(client.elector, cfg.leaderElectionInterval)
+	}
+
+	if len(cfg.partitioning) > 0 && cfg.partitionMaintenance > 0 {
+		go client.runPartitionMaintenance()
+	}
+
+	if len(cfg.coldTablespace) > 0 {
+		go client.runTiering()
+	}
+
+	if client.hasRetention() {
+		client.startRetention()
+	}
+
+	if cfg.tenantUsageInterval > 0 {
+		go client.runTenantUsage()
+	}
+
+	if len(client.resolutions) > 0 {
+		go client.runDownsampling()
+	}
+
+	if len(cfg.rulesFile) > 0 {
+		rules, err := loadRules(cfg.rulesFile, cfg.rulesInterval)
+
+		if err != nil {
+			log.Error("msg", "Error loading recording rules", "err", err)
+			os.Exit(1)
+		}
+
+		for interval, group := range rules {
+			go client.runRules(interval, group)
+		}
+	}
+
+	if len(cfg.indexAdvisor) > 0 {
+		client.advisor = newIndexAdvisor()
+		go client.runIndexAdvisor()
+	}
+	return client
+}
+
+func (c *Client) setupPgPrometheus() error {
+	tx, err := c.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if c.cfg.autoStorage && c.cfg.dialect == dialectPostgreSQL {
+		err = c.detectStorage(tx)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.validateStorage()
+
+	if err != nil {
+		return err
+	}
+
+	if c.valueType() == valueTypes[valueTypeNumeric] {
+		var version int
+
+		if err = tx.QueryRow("SELECT current_setting('server_version_num')::int").Scan(&version); err != nil {
+			return err
+		}
+		c.numericInfinity = version >= minNumericInfinityVersion
+	}
+
+	if c.cfg.usePgPrometheus {
+		err = createExtension(tx, "pg_prometheus", "")
+
+		if err == nil {
+			err = c.checkPgPrometheus(tx)
+		}
+	} else if ext := c.labelsFormat().extension(); len(ext) > 0 {
+		err = createExtension(tx, ext, "")
+	}
+
+	if err == nil {
+		err = c.createPartitioningExtension(tx)
+	}
+
+	if err == nil && c.cfg.citus {
+		err = createExtension(tx, "citus", "")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if c.cfg.useTimescaleDb {
+		err = c.enableTimescaleDB(tx)
+
+		if err != nil {
+			return fmt.Errorf("could not enable TimescaleDB extension: %v", err)
+		}
+	}
+
+	if c.cfg.distributed {
+		err = checkDataNodes(tx)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.cfg.tablePerMetric {
+		_, err = tx.Exec(fmt.Sprintf(sqlCreateMetricTables, ident(c.cfg.table, "_metric_tables")))
+	} else {
+		var created bool
+		created, err = c.createTables(tx, c.cfg.table)
+
+		if err == nil && !created {
+			return nil
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return err
+	}
+
+	log.Info("msg", "Initialized tables", "pg_prometheus", c.cfg.usePgPrometheus, "labels_format", c.labelsFormat().name())
+
+	return nil
+}
+
+// enableTimescaleDB creates the TimescaleDB extension. Plain tables cannot
+// be turned into hypertables later, so the adapter only falls back to them
+// if it selects the storage mode itself.
+func (c *Client) enableTimescaleDB(tx *sql.Tx) error {
+	available, err := extensionAvailable(tx, "timescaledb")
+
+	if err != nil {
+		return err
+	}
+
+	if available {
+		_, err = tx.Exec("CREATE EXTENSION IF NOT EXISTS timescaledb CASCADE")
+		return err
+	}
+
+	if !c.cfg.autoStorage {
+		return fmt.Errorf("the extension is not available, use -pg.use-timescaledb=false to store plain tables")
+	}
+
+	log.Warn("msg", "TimescaleDB extension is not available, using plain tables")
+	c.cfg.useTimescaleDb = false
+	return nil
+}
+
+// extensionAvailable returns whether the server provides the extension
+func extensionAvailable(tx *sql.Tx, name string) (bool, error) {
+	var available bool
+
+	err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = $1)", name).Scan(&available)
+	return available, err
+}
+
+// createExtension creates the extension in the given schema, or the default
+// one. Availability is checked first, since managed and PostgreSQL-compatible
+// databases often lack extensions and a failed CREATE EXTENSION aborts the
+// transaction with a less helpful error.
+func createExtension(tx *sql.Tx, name, schema string) error {
+	available, err := extensionAvailable(tx, name)
+
+	if err != nil {
+		return err
+	}
+
+	if !available {
+		return fmt.Errorf("the %s extension is not available on the database server", name)
+	}
+
+	stmt := fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s", name)
+	if len(schema) > 0 {
+		stmt += fmt.Sprintf(" SCHEMA %s", schema)
+	}
+
+	_, err = tx.Exec(stmt)
+	return err
+}
+
+// validateStorage checks that the storage options can be combined
+func (c *Client) validateStorage() error {
+	if _, ok := labelsFormats[c.cfg.labelsFormat]; !ok {
+		return fmt.Errorf("unknown labels format %q", c.cfg.labelsFormat)
+	}
+
+	if c.cfg.usePgPrometheus && c.cfg.labelsFormat != labelsFormatJSONB {
+		return fmt.Errorf("the %s labels format requires -pg.use-pg-prometheus=false", c.cfg.labelsFormat)
+	}
+
+	if _, ok := valueTypes[c.cfg.valueType]; !ok && len(c.cfg.valueType) > 0 {
+		return fmt.Errorf("unknown value type %q", c.cfg.valueType)
+	}
+
+	if c.cfg.usePgPrometheus && c.valueType() != valueTypes[valueTypeDouble] {
+		return fmt.Errorf("the %s value type requires -pg.use-pg-prometheus=false", c.cfg.valueType)
+	}
+
+	if !c.cfg.usePgPrometheus && !c.cfg.pgPrometheusNormalize {
+		return fmt.Errorf("the raw samples schema requires pg_prometheus")
+	}
+
+	if c.cfg.distributed && (c.cfg.usePgPrometheus || !c.cfg.useTimescaleDb) {
+		return fmt.Errorf("distributed hypertables require TimescaleDB and -pg.use-pg-prometheus=false")
+	}
+
+	if c.cfg.citus && (c.cfg.usePgPrometheus || c.cfg.useTimescaleDb) {
+		return fmt.Errorf("Citus requires -pg.use-timescaledb=false and -pg.use-pg-prometheus=false")
+	}
+
+	if err := c.validatePartitioning(); err != nil {
+		return err
+	}
+
+	if err := c.validateIndexes(); err != nil {
+		return err
+	}
+
+	if err := c.validateStorageParameters(); err != nil {
+		return err
+	}
+
+	if err := c.validatePolicies(); err != nil {
+		return err
+	}
+
+	if err := c.validateIndexAdvisor(); err != nil {
+		return err
+	}
+
+	if err := c.validateRetention(); err != nil {
+		return err
+	}
+
+	if err := c.validateDownsampling(); err != nil {
+		return err
+	}
+
+	if c.cfg.writeConcurrency < 1 || c.cfg.readConcurrency < 1 {
+		return fmt.Errorf("the write and read concurrency must be at least 1")
+	}
+
+	if c.cfg.timeFormat != timeFormatRFC3339 && c.cfg.timeFormat != timeFormatEpoch && len(c.cfg.timeFormat) > 0 {
+		return fmt.Errorf("unknown time format %q", c.cfg.timeFormat)
+	}
+
+	return c.validateDialect()
+}
+
+// createTables creates the tables for the given view name. It returns false
+// if they already exist, in which case the transaction may be aborted and
+// should be rolled back.
+func (c *Client) createTables(tx *sql.Tx, table string) (bool, error) {
+	if len(c.cfg.tablespace) > 0 {
+		_, err := tx.Exec("SELECT set_config('default_tablespace', $1, true)", c.cfg.tablespace)
+
+		if err != nil {
+			return false, err
+		}
+	}
+
+	var (
+		created bool
+		err     error
+	)
+
+	if c.cfg.usePgPrometheus {
+		created, err = c.createPrometheusTable(tx, table)
+	} else {
+		created, err = c.createNativeTable(tx, table)
+	}
+
+	if err != nil || !created {
+		return false, err
+	}
+
+	// Distributed hypertables, and pg_prometheus tables if it supports it,
+	// are space partitioned on creation
+	spacePartitioned := c.cfg.distributed || (c.cfg.usePgPrometheus && c.createTableArgs["number_partitions"])
+
+	if c.cfg.useTimescaleDb && c.cfg.pgPrometheusPartitions > 0 && !spacePartitioned {
+		err = c.addSpacePartitioning(tx, table)
+
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if c.cfg.usePgPrometheus {
+		err = c.createIndexes(tx, table)
+
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = c.createPartialIndexes(tx, table)
+
+	if err != nil {
+		return false, err
+	}
+
+	if c.cfg.reorderChunks {
+		err = c.addReorderPolicy(tx, table)
+
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = c.setStorageParameters(tx, table)
+
+	if err != nil {
+		return false, err
+	}
+
+	err = c.setTablespaces(tx, table)
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// createPrometheusTable creates the pg_prometheus tables for the given view
+// name. It returns false if they already exist, in which case the
+// transaction is aborted.
+func (c *Client) createPrometheusTable(tx *sql.Tx, table string) (bool, error) {
+	call, args, err := c.createTableCall(table)
+
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := tx.Query(call, args...)
+
+	if err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			return false, nil
+		}
+		return false, err
+	}
+	rows.Close()
+
+	return true, nil
+}
+
+// createIndexes replaces the default pg_prometheus indexes according to the
+// configured index types
+func (c *Client) createIndexes(tx *sql.Tx, table string) error {
+	if c.cfg.timeIndex == timeIndexBtree && c.cfg.labelsIndex == labelsIndexGin {
+		return nil
+	}
+
+	if !c.cfg.pgPrometheusNormalize {
+		return fmt.Errorf("index options require the normalized schema")
+	}
+
+	valuesTable := table + "_values"
+	labelsTable := table + "_labels"
+
+	switch c.cfg.timeIndex {
+	case timeIndexBtree:
+	case timeIndexBrin:
+		err := dropIndexes(tx, valuesTable, "btree", "time")
+
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("CREATE INDEX ON %s USING BRIN (time)", quoteIdent(valuesTable)))
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown time index type %q", c.cfg.timeIndex)
+	}
+
+	switch c.cfg.labelsIndex {
+	case labelsIndexGin:
+	case labelsIndexGinPath, labelsIndexNone:
+		err := dropIndexes(tx, labelsTable, "gin", "labels")
+
+		if err == nil && c.cfg.labelsIndex == labelsIndexGinPath {
+			_, err = tx.Exec(fmt.Sprintf("CREATE INDEX ON %s USING GIN (labels jsonb_path_ops)", quoteIdent(labelsTable)))
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown labels index type %q", c.cfg.labelsIndex)
+	}
+
+	log.Info("msg", "Created indexes", "table", table, "time", c.cfg.timeIndex, "labels", c.cfg.labelsIndex)
+
+	return nil
+}
+
+// validateIndexes checks the index types, and that the tables have the labels
+// of the metrics given partial indexes
+func (c *Client) validateIndexes() error {
+	if c.cfg.timeIndex != timeIndexBtree && c.cfg.timeIndex != timeIndexBrin {
+		return fmt.Errorf("unknown time index type %q", c.cfg.timeIndex)
+	}
+
+	switch c.cfg.labelsIndex {
+	case labelsIndexGin, labelsIndexGinPath, labelsIndexNone:
+	default:
+		return fmt.Errorf("unknown labels index type %q", c.cfg.labelsIndex)
+	}
+
+	if _, err := c.labelsFormat().ginIndex(c.cfg.labelsIndex); err != nil {
+		return err
+	}
+
+	if (c.cfg.timeIndex != timeIndexBtree || c.cfg.labelsIndex != labelsIndexGin) && !c.cfg.pgPrometheusNormalize {
+		return fmt.Errorf("index options require the normalized schema")
+	}
+
+	metrics, err := parsePartialIndexMetrics(c.cfg.partialIndexMetrics)
+
+	switch {
+	case err != nil:
+		return err
+	case len(metrics) == 0:
+		return nil
+	case !c.cfg.pgPrometheusNormalize || c.cfg.tablePerMetric:
+		return fmt.Errorf("partial indexes require the normalized schema with a labels table shared by all metrics")
+	case c.cfg.labelsIndex == labelsIndexNone:
+		return fmt.Errorf("partial indexes require a GIN labels index")
+	}
+	return nil
+}
+
+// parsePartialIndexMetrics parses the comma-separated metric names given
+// partial indexes
+func parsePartialIndexMetrics(s string) ([]string, error) {
+	var metrics []string
+
+	for _, metric := range strings.Split(s, ",") {
+		metric = strings.TrimSpace(metric)
+		if len(metric) == 0 {
+			continue
+		}
+
+		if !model.IsValidMetricName(model.LabelValue(metric)) {
+			return nil, fmt.Errorf("invalid metric name %q for a partial index", metric)
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
+
+// createPartialIndexes creates an index on the labels of the series of each
+// metric given a partial index, restricted to the series of the metric
+func (c *Client) createPartialIndexes(tx *sql.Tx, table string) error {
+	metrics, err := parsePartialIndexMetrics(c.cfg.partialIndexMetrics)
+
+	if err != nil || len(metrics) == 0 {
+		return err
+	}
+
+	columns, err := c.labelsFormat().ginIndex(c.cfg.labelsIndex)
+
+	if err != nil {
+		return err
+	}
+
+	for _, metric := range metrics {
+		_, err = tx.Exec(fmt.Sprintf("CREATE INDEX ON %s USING GIN (%s) WHERE metric_name = '%s'",
+			ident(table, "_labels"), columns, escapeValue(metric)))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Info("msg", "Created partial indexes", "table", table, "metrics", len(metrics))
+
+	return nil
+}
+
+// dropIndexes drops the non-unique, single-column indexes of the given access
+// method on a column of the table
+func dropIndexes(tx *sql.Tx, table, method, column string) error {
+	return execGenerated(tx, `SELECT format('DROP INDEX %I.%I', n.nspname, i.relname)
+		FROM pg_index x
+		INNER JOIN pg_class i ON i.oid = x.indexrelid
+		INNER JOIN pg_class t ON t.oid = x.indrelid
+		INNER JOIN pg_namespace n ON n.oid = t.relnamespace
+		INNER JOIN pg_am am ON am.oid = i.relam
+		INNER JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = x.indkey[0]
+		WHERE n.nspname = current_schema() AND t.relname = $1 AND am.amname = $2 AND a.attname = $3
+		AND x.indnatts = 1 AND NOT x.indisunique`, table, method, column)
+}
+
+// setTablespaces moves the indexes of newly created tables to the index
+// tablespace and attaches the data tablespace to any hypertable, so that
+// TimescaleDB creates future chunks in it.
+func (c *Client) setTablespaces(tx *sql.Tx, table string) error {
+	tables := []interface{}{table, table + "_values", table + "_labels", table + "_samples"}
+
+	if len(c.cfg.indexTablespace) > 0 {
+		err := execGenerated(tx, "SELECT format('ALTER INDEX %I.%I SET TABLESPACE %I', schemaname, indexname, $1::text) FROM pg_indexes WHERE schemaname = current_schema() AND tablename IN ($2, $3, $4, $5)",
+			append([]interface{}{c.cfg.indexTablespace}, tables...)...)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.cfg.tablespace) > 0 && c.cfg.useTimescaleDb {
+		rows, err := tx.Query("SELECT attach_tablespace($1, format('%I.%I', schema_name, table_name)::regclass) FROM _timescaledb_catalog.hypertable WHERE schema_name = current_schema() AND table_name IN ($2, $3, $4, $5)",
+			append([]interface{}{c.cfg.tablespace}, tables...)...)
+
+		if err != nil {
+			return err
+		}
+		rows.Close()
+	}
+
+	return nil
+}
+
+// execGenerated executes all statements returned by the given query, which
+// allows DDL on identifiers to be generated with PostgreSQL's format().
+func execGenerated(tx *sql.Tx, query string, args ...interface{}) error {
+	rows, err := tx.Query(query, args...)
+
+	if err != nil {
+		return err
+	}
+
+	var stmts []string
+
+	for rows.Next() {
+		var stmt string
+
+		if err = rows.Scan(&stmt); err != nil {
+			rows.Close()
+			return err
+		}
+		stmts = append(stmts, stmt)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, stmt := range stmts {
+		log.Debug("msg", "Executing generated statement", "stmt", stmt)
+
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addSpacePartitioning adds a hash-partitioned space dimension to the values
+// hypertable. TimescaleDB only allows this while the hypertable is empty, so
+// it must run in the same transaction that created the table.
+func (c *Client) addSpacePartitioning(tx *sql.Tx, table string) error {
+	if !c.cfg.pgPrometheusNormalize {
+		return fmt.Errorf("space partitioning requires the normalized schema")
+	}
+
+	_, err := tx.Exec("SELECT add_dimension($1::regclass, 'labels_id', number_partitions => $2)",
+		ident(table, "_values"), c.cfg.pgPrometheusPartitions)
+
+	if err != nil {
+		return err
+	}
+
+	log.Info("msg", "Added space partitioning", "table", table, "partitions", c.cfg.pgPrometheusPartitions)
+
+	return nil
+}
+
+// Write implements the Writer interface and writes metric samples to the database
+func (c *Client) Write(samples model.Samples) error {
+	return c.WriteContext(context.Background(), samples)
+}
+
+// WriteContext writes metric samples to the database, tracing the write as
+// part of the trace in ctx. Samples of a tenant set with WithTenant are
+// written to the tables of the tenant.
+func (c *Client) WriteContext(ctx context.Context, samples model.Samples) (err error) {
+	if tenant := TenantFromContext(ctx); len(tenant) > 0 && c.tenants != nil {
+		client, err := c.tenantClient(tenant)
+
+		if err != nil {
+			return err
+		}
+
+		if err = client.WriteContext(ctx, samples); err != nil {
+			return err
+		}
+
+		client.usage.addWrite(len(samples))
+		return nil
+	}
+
+	begin := time.Now()
+
+	ctx, span := trace.Start(ctx, "write samples", trace.KindInternal)
+	span.SetAttribute("samples", len(samples))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	c.writeMetrics.receivedSamples.Add(float64(len(samples)))
+
+	if c.elector != nil {
+		if !c.elector.isLeader() {
+			c.writeMetrics.followerSamples.Add(float64(len(samples)))
+			return nil
+		}
+
+		if cutoff := failoverCutoff(c.elector, c.cfg.leaderElectionFailover, c.cfg.leaderElectionTolerance); !cutoff.IsZero() {
+			var dropped int
+			samples, dropped = dropBefore(samples, cutoff)
+			c.writeMetrics.failoverSamples.Add(float64(dropped))
+		}
+	}
+
+	if c.valueType() != valueTypes[valueTypeDouble] {
+		var dropped int
+		samples, dropped = c.dropUnstorable(samples)
+		c.writeMetrics.unstorable.Add(float64(dropped))
+	}
+
+	c.writeMetrics.batchSize.Observe(float64(len(samples)))
+	c.writeMetrics.batchesInFlight.Inc()
+
+	defer func() {
+		c.writeMetrics.batchesInFlight.Dec()
+
+		if err != nil {
+			c.writeMetrics.failedSamples.Add(float64(len(samples)))
+		} else {
+			c.writeMetrics.writtenSamples.Add(float64(len(samples)))
+		}
+
+		switch {
+		case err == nil:
+		case isAuthError(err) && len(c.cfg.passwordFile) > 0:
+			log.Warn("msg", "Database authentication failed, reconnecting with the password file", "err", err)
+			c.resetConnections()
+		case isConnectionError(err):
+			c.resetConnections()
+		case !isAuthError(err):
+			c.writeMetrics.droppedSamples.Add(float64(len(samples)))
+		}
+	}()
+
+	if err = c.writeTx(ctx, samples); err != nil {
+		return err
+	}
+
+	if c.topMetrics != nil {
+		c.topMetrics.addSamples(samples)
+	}
+
+	duration := time.Since(begin).Seconds()
+
+	log.Debug("msg", "Wrote samples", "count", len(samples), "duration", duration)
 
-	db.SetMaxOpenConns(cfg.maxOpenConns)
-	db.SetMaxIdleConns(cfg.maxIdleConns)
+	return nil
+}
 
-	client := &Client{
-		db:  db,
-		cfg: cfg,
-	}
+// writeTx writes samples to their tables in a single transaction, or in
+// concurrent ones with -pg.write-concurrency
+func (c *Client) writeTx(ctx context.Context, samples model.Samples) error {
+	batches := map[string]model.Samples{c.cfg.table: samples}
 
-	err = client.setupPgPrometheus()
+	if c.cfg.tablePerMetric {
+		var err error
+		batches, err = c.batchByMetricTable(samples)
 
-	if err != nil {
-		log.Error("err", err)
-		os.Exit(1)
+		if err != nil {
+			log.Error("msg", "Error resolving metric tables", "err", err)
+			return err
+		}
 	}
 
-	createTmpTableStmt, err = db.Prepare(fmt.Sprintf(sqlCreateTmpTable, cfg.table))
-	if err != nil {
-		log.Error("msg", "Error on preparing create tmp table statement", "err", err)
-		os.Exit(1)
+	if groups := c.writeGroups(batches); len(groups) > 1 {
+		return c.writeConcurrently(ctx, groups)
 	}
-	return client
+	return c.writeBatches(ctx, batches)
 }
 
-func (c *Client) setupPgPrometheus() error {
-	tx, err := c.db.Begin()
+// writeBatches writes the batches of samples of each table in a single
+// transaction
+func (c *Client) writeBatches(ctx context.Context, batches map[string]model.Samples) error {
+	// Begin waits for a connection of the pool
+	waitBegin := time.Now()
+	tx, err := c.db.BeginTx(ctx, nil)
+	c.waitLatency.observe(time.Now(), time.Since(waitBegin))
 
 	if err != nil {
+		log.Error("msg", "Error on Begin when writing samples", "err", err)
 		return err
 	}
 
 	defer tx.Rollback()
 
-	_, err = tx.Exec("CREATE EXTENSION IF NOT EXISTS pg_prometheus")
+	if c.useCopy() && c.cfg.pgBouncer {
+		_, err = tx.ExecContext(ctx, c.createTmpTable())
+	} else if c.useCopy() {
+		_, err = tx.StmtContext(ctx, c.createTmpTableStmt).ExecContext(ctx)
+	}
 
 	if err != nil {
+		log.Error("msg", "Error executing create tmp table", "err", err)
 		return err
 	}
 
-	if c.cfg.useTimescaleDb {
-		_, err = tx.Exec("CREATE EXTENSION IF NOT EXISTS timescaledb CASCADE")
-	}
-	if err != nil {
-		log.Info("msg", "Could not enable TimescaleDB extension", "err", err)
-	}
+	for table, batch := range batches {
+		_, tableSpan := trace.Start(ctx, "write table", trace.KindClient)
+		tableSpan.SetAttribute("db.sql.table", table)
+		tableSpan.SetAttribute("samples", len(batch))
 
-	var rows *sql.Rows
-	rows, err = tx.Query("SELECT create_prometheus_table($1, normalized_tables => $2, chunk_time_interval => $3,  use_timescaledb=> $4)",
-		c.cfg.table, c.cfg.pgPrometheusNormalize, c.cfg.pgPrometheusChunkInterval.String(), c.cfg.useTimescaleDb)
+		err = c.writeSamples(ctx, tx, table, batch)
 
-	if err != nil {
-		if strings.Contains(err.Error(), "already exists") {
-			return nil
+		tableSpan.SetError(err)
+		tableSpan.End()
+
+		if err != nil {
+			return err
 		}
-		return err
 	}
-	rows.Close()
 
+	_, commitSpan := trace.Start(ctx, "COMMIT", trace.KindClient)
+	commitBegin := time.Now()
 	err = tx.Commit()
+	c.writeMetrics.commitDuration.Observe(time.Since(commitBegin).Seconds())
+	c.commitLatency.observe(time.Now(), time.Since(commitBegin))
+	commitSpan.SetError(err)
+	commitSpan.End()
 
 	if err != nil {
+		log.Error("msg", "Error on Commit when writing samples", "err", err)
 		return err
 	}
 
-	log.Info("msg", "Initialized pg_prometheus extension")
-
+	// The connection of tx is released, so that preparing does not wait for
+	// a second one
+	c.stmts.prepareMissed(ctx)
 	return nil
 }
 
-func metricString(m model.Metric) string {
-	metricName, hasName := m[model.MetricNameLabel]
-	numLabels := len(m) - 1
-	if !hasName {
-		numLabels = len(m)
-	}
-	labelStrings := make([]string, 0, numLabels)
-	for label, value := range m {
-		if label != model.MetricNameLabel {
-			labelStrings = append(labelStrings, fmt.Sprintf("%s=%q", label, value))
-		}
-	}
-
-	switch numLabels {
-	case 0:
-		if hasName {
-			return string(metricName)
-		}
-		return "{}"
-	default:
-		sort.Strings(labelStrings)
-		return fmt.Sprintf("%s{%s}", metricName, strings.Join(labelStrings, ","))
+// createTmpTable returns the statement creating the temporary table samples
+// are copied into
+func (c *Client) createTmpTable() string {
+	if !c.cfg.usePgPrometheus {
+		return fmt.Sprintf(sqlCreateNativeTmpTable, c.tmpTable())
 	}
+	return fmt.Sprintf(sqlCreateTmpTable, c.tmpTable())
 }
 
-// Write implements the Writer interface and writes metric samples to the database
-func (c *Client) Write(samples model.Samples) error {
-	begin := time.Now()
-	tx, err := c.db.Begin()
+// tmpTable returns the quoted name of the temporary table samples are copied
+// into
+func (c *Client) tmpTable() string {
+	return ident(unqualified(c.cfg.table), "_tmp")
+}
 
-	if err != nil {
-		log.Error("msg", "Error on Begin when writing samples", "err", err)
-		return err
+// writeSamples copies samples into the given pg_prometheus table as part of
+// tx, cancelling the statements once ctx is done
+func (c *Client) writeSamples(ctx context.Context, tx *sql.Tx, table string, samples model.Samples) error {
+	if !c.useCopy() {
+		return c.writeInsertSamples(ctx, tx, table, samples)
 	}
 
-	defer tx.Rollback()
-
-	_, err = tx.Stmt(createTmpTableStmt).Exec()
-	if err != nil {
-		log.Error("msg", "Error executing create tmp table", "err", err)
-		return err
+	if !c.cfg.usePgPrometheus {
+		return c.writeNativeSamples(ctx, tx, table, samples)
 	}
 
 	var copyTable string
-	if len(c.cfg.copyTable) > 0 {
-		copyTable = c.cfg.copyTable
+	if len(c.cfg.copyTable) > 0 && !c.cfg.tablePerMetric {
+		copyTable = quoteIdent(c.cfg.copyTable)
 	} else if c.cfg.pgPrometheusNormalize {
-		copyTable = fmt.Sprintf("%s_tmp", c.cfg.table)
+		copyTable = c.tmpTable()
 	} else {
-		copyTable = fmt.Sprintf("%s_sample", c.cfg.table)
-	}
-	copyStmt, err := tx.Prepare(fmt.Sprintf(sqlCopyTable, copyTable))
-
-	if err != nil {
-		log.Error("msg", "Error on COPY prepare", "err", err)
-		return err
+		copyTable = ident(table, "_sample")
 	}
+	// The lines share a single string, and the rows a single slice of values
+	var buf []byte
+	ends := make([]int, 0, len(samples))
 
 	for _, sample := range samples {
 		milliseconds := sample.Timestamp.UnixNano() / 1000000
-		line := fmt.Sprintf("%v %v %v", metricString(sample.Metric), sample.Value, milliseconds)
+		metric, _ := c.labels.intern(sample.Metric, func(m model.Metric) (string, error) {
+			return metricString(m), nil
+		})
 
-		if c.cfg.pgPrometheusLogSamples {
-			fmt.Println(line)
-		}
+		buf = appendSampleLine(buf, metric, sample.Value, milliseconds)
+		ends = append(ends, len(buf))
+	}
 
-		_, err = copyStmt.Exec(line)
-		if err != nil {
-			log.Error("msg", "Error executing COPY statement", "stmt", line, "err", err)
-			return err
+	lines := string(buf)
+	values := make([]interface{}, len(samples))
+	rows := make([][]interface{}, len(samples))
+
+	var start int
+
+	for i, end := range ends {
+		values[i] = lines[start:end]
+		rows[i] = values[i : i+1]
+		start = end
+
+		if c.cfg.pgPrometheusLogSamples {
+			fmt.Println(values[i])
 		}
 	}
 
-	_, err = copyStmt.Exec()
+	err := c.copyFrom(ctx, tx, copyTable, nil, rows)
 	if err != nil {
-		log.Error("msg", "Error executing COPY statement", "err", err)
+		log.Error("msg", "Error copying samples", "err", err)
 		return err
 	}
 
-	stmtLabels, err := tx.Prepare(fmt.Sprintf(sqlInsertLabels, c.cfg.table, c.cfg.table))
-	if err != nil {
-		log.Error("msg", "Error on preparing labels statement", "err", err)
-		return err
-	}
-	_, err = stmtLabels.Exec()
+	_, err = c.execTx(ctx, tx, c.queryComment(endpointWrite)+fmt.Sprintf(sqlInsertLabels, ident(table, "_labels"), c.tmpTable()))
 	if err != nil {
 		log.Error("msg", "Error executing labels statement", "err", err)
 		return err
 	}
 
-	stmtValues, err := tx.Prepare(fmt.Sprintf(sqlInsertValues, c.cfg.table, c.cfg.table, c.cfg.table))
-	if err != nil {
-		log.Error("msg", "Error on preparing values statement", "err", err)
-		return err
-	}
-	_, err = stmtValues.Exec()
+	_, err = c.execTx(ctx, tx, c.queryComment(endpointWrite)+fmt.Sprintf(sqlInsertValues, ident(table, "_values"), c.tmpTable(), ident(table, "_labels")))
 	if err != nil {
 		log.Error("msg", "Error executing values statement", "err", err)
 		return err
 	}
 
-	err = copyStmt.Close()
-	if err != nil {
-		log.Error("msg", "Error on COPY Close when writing samples", "err", err)
-		return err
-	}
-
-	err = tx.Commit()
-
-	if err != nil {
-		log.Error("msg", "Error on Commit when writing samples", "err", err)
-		return err
+	if c.cfg.tablePerMetric && c.cfg.pgPrometheusNormalize {
+		// The temporary table is shared by all metric tables written in
+		// this transaction
+		_, err = c.execTx(ctx, tx, fmt.Sprintf(sqlTruncateTmpTable, c.tmpTable()))
+		if err != nil {
+			log.Error("msg", "Error truncating tmp table", "err", err)
+			return err
+		}
 	}
 
-	duration := time.Since(begin).Seconds()
-
-	log.Debug("msg", "Wrote samples", "count", len(samples), "duration", duration)
-
 	return nil
+
 }
 
 type sampleLabels struct {
@@ -308,6 +1343,9 @@ func (l *sampleLabels) Scan(value interface{}) error {
 	}
 
 	switch t := value.(type) {
+	case string:
+		// pgx passes JSONB as text
+		return l.Scan([]byte(t))
 	case []uint8:
 		m := make(map[string]string)
 		err := json.Unmarshal(t, &m)
@@ -347,74 +1385,67 @@ func (l *sampleLabels) len() int {
 	return len(l.OrderedKeys)
 }
 
+// sampleBlockSize is the number of samples of a read response allocated at once
+const sampleBlockSize = 1024
+
+// sampleBlocks allocates the samples of a read response in blocks instead of
+// one by one for every row scanned
+type sampleBlocks struct {
+	block []prompb.Sample
+}
+
+func (b *sampleBlocks) next(timestamp int64, value float64) *prompb.Sample {
+	if len(b.block) == cap(b.block) {
+		b.block = make([]prompb.Sample, 0, sampleBlockSize)
+	}
+
+	b.block = append(b.block, prompb.Sample{Timestamp: timestamp, Value: value})
+	return &b.block[len(b.block)-1]
+}
+
 // Read implements the Reader interface and reads metrics samples from the database
 func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
-	labelsToSeries := map[string]*prompb.TimeSeries{}
+	return c.ReadContext(context.Background(), req)
+}
 
-	for _, q := range req.Queries {
-		command, err := c.buildCommand(q)
+// ReadContext reads metrics samples from the database, tracing each query as
+// part of the trace in ctx. Only the tables of a tenant set with WithTenant
+// are read.
+func (c *Client) ReadContext(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	if tenant := TenantFromContext(ctx); len(tenant) > 0 && c.tenants != nil {
+		client, err := c.tenantClient(tenant)
 
 		if err != nil {
 			return nil, err
 		}
 
-		log.Debug("msg", "Executed query", "query", command)
-
-		rows, err := c.db.Query(command)
+		resp, err := client.ReadContext(ctx, req)
 
 		if err != nil {
 			return nil, err
 		}
 
-		defer rows.Close()
-
-		for rows.Next() {
-			var (
-				value  float64
-				name   string
-				labels sampleLabels
-				time   time.Time
-			)
-			err := rows.Scan(&time, &name, &value, &labels)
-
-			if err != nil {
-				return nil, err
-			}
+		client.usage.addRead(len(req.Queries), responseSamples(resp))
+		return resp, nil
+	}
 
-			key := labels.key(name)
-			ts, ok := labelsToSeries[key]
+	results, err := c.readQueries(ctx, req.Queries)
 
-			if !ok {
-				labelPairs := make([]*prompb.Label, 0, labels.len()+1)
-				labelPairs = append(labelPairs, &prompb.Label{
-					Name:  model.MetricNameLabel,
-					Value: name,
-				})
+	if err != nil {
+		return nil, err
+	}
 
-				for _, k := range labels.OrderedKeys {
-					labelPairs = append(labelPairs, &prompb.Label{
-						Name:  k,
-						Value: labels.Map[k],
-					})
-				}
+	// The series of all queries are merged into a single result, in the
+	// order of the queries
+	labelsToSeries := map[string]*prompb.TimeSeries{}
 
-				ts = &prompb.TimeSeries{
-					Labels:  labelPairs,
-					Samples: make([]*prompb.Sample, 0, 100),
-				}
+	for _, result := range results {
+		for key, ts := range result {
+			if merged, ok := labelsToSeries[key]; ok {
+				merged.Samples = append(merged.Samples, ts.Samples...)
+			} else {
 				labelsToSeries[key] = ts
 			}
-
-			ts.Samples = append(ts.Samples, &prompb.Sample{
-				Timestamp: time.UnixNano() / 1000000,
-				Value:     value,
-			})
-		}
-
-		err = rows.Err()
-
-		if err != nil {
-			return nil, err
 		}
 	}
 
@@ -425,20 +1456,205 @@ func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
 			},
 		},
 	}
+	var samples int
+
 	for _, ts := range labelsToSeries {
 		resp.Results[0].Timeseries = append(resp.Results[0].Timeseries, ts)
+	}
+
+	if len(c.replicaLabels) > 0 {
+		resp.Results[0].Timeseries = dedupReplicas(resp.Results[0].Timeseries, c.replicaLabels, c.cfg.replicaDedupWindow)
+	}
+
+	for _, ts := range resp.Results[0].Timeseries {
+		samples += len(ts.Samples)
 		if c.cfg.pgPrometheusLogSamples {
 			log.Debug("timeseries", ts.String())
 		}
 	}
 
-	log.Debug("msg", "Returned response", "#timeseries", len(labelsToSeries))
+	c.readMetrics.seriesReturned.Observe(float64(len(resp.Results[0].Timeseries)))
+	c.readMetrics.samplesReturned.Observe(float64(samples))
+
+	log.Debug("msg", "Returned response", "#timeseries", len(resp.Results[0].Timeseries))
 
 	return &resp, nil
 }
 
+// readQueries runs the queries of a read request, up to -pg.read-concurrency
+// at once, and returns the series of each query by their labels. Once a query
+// fails, the ones still running are cancelled.
+func (c *Client) readQueries(ctx context.Context, queries []*prompb.Query) ([]map[string]*prompb.TimeSeries, error) {
+	results := make([]map[string]*prompb.TimeSeries, len(queries))
+
+	if len(queries) == 1 || c.cfg.readConcurrency <= 1 {
+		for i, q := range queries {
+			result, err := c.readQuery(ctx, q)
+
+			if err != nil {
+				return nil, err
+			}
+			results[i] = result
+		}
+		return results, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errLock  sync.Mutex
+		firstErr error
+	)
+
+	slots := make(chan struct{}, c.cfg.readConcurrency)
+
+	for i, q := range queries {
+		slots <- struct{}{}
+		wg.Add(1)
+
+		go func(i int, q *prompb.Query) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			result, err := c.readQuery(ctx, q)
+
+			if err != nil {
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errLock.Unlock()
+
+				cancel()
+				return
+			}
+			results[i] = result
+		}(i, q)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return results, nil
+}
+
+// readQuery runs a query and returns its series by their labels
+func (c *Client) readQuery(ctx context.Context, q *prompb.Query) (map[string]*prompb.TimeSeries, error) {
+	labelsToSeries := map[string]*prompb.TimeSeries{}
+	var blocks sampleBlocks
+
+	if c.advisor != nil {
+		c.advisor.record(q)
+	}
+
+	command, args, err := c.buildStatement(q, c.stmts != nil)
+
+	if err != nil {
+		c.readMetrics.errors.WithLabelValues(readErrorBuild).Inc()
+		return nil, err
+	}
+
+	if command == "" {
+		return nil, nil
+	}
+
+	log.Debug("msg", "Executed query", "query", command)
+
+	_, span := trace.Start(ctx, "query", trace.KindClient)
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.statement", command)
+
+	begin := time.Now()
+	rows, err := c.queryRead(ctx, c.queryComment(endpointRead)+command, args)
+
+	if err != nil {
+		c.readMetrics.errors.WithLabelValues(readErrorQuery).Inc()
+		c.logQuery(q, command, begin, 0, err)
+		span.SetError(err)
+		span.End()
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var scanned int
+
+	for rows.Next() {
+		var (
+			value  float64
+			name   string
+			labels sampleLabels
+			time   time.Time
+		)
+		err := rows.Scan(&time, &name, &value, &labels)
+
+		if err != nil {
+			c.readMetrics.errors.WithLabelValues(readErrorScan).Inc()
+			c.logQuery(q, command, begin, scanned, err)
+			span.SetError(err)
+			span.End()
+			return nil, err
+		}
+
+		c.readMetrics.rowsScanned.Inc()
+		scanned++
+
+		key := labels.key(name)
+		ts, ok := labelsToSeries[key]
+
+		if !ok {
+			labelPairs := make([]*prompb.Label, 0, labels.len()+1)
+			labelPairs = append(labelPairs, &prompb.Label{
+				Name:  model.MetricNameLabel,
+				Value: name,
+			})
+
+			for _, k := range labels.OrderedKeys {
+				labelPairs = append(labelPairs, &prompb.Label{
+					Name:  k,
+					Value: labels.Map[k],
+				})
+			}
+
+			ts = &prompb.TimeSeries{
+				Labels:  labelPairs,
+				Samples: make([]*prompb.Sample, 0, 100),
+			}
+			labelsToSeries[key] = ts
+		}
+
+		ts.Samples = append(ts.Samples, blocks.next(time.UnixNano()/1000000, value))
+	}
+
+	err = rows.Err()
+
+	c.logQuery(q, command, begin, scanned, err)
+	span.SetAttribute("db.rows", scanned)
+	span.SetError(err)
+	span.End()
+
+	if err != nil {
+		c.readMetrics.errors.WithLabelValues(readErrorQuery).Inc()
+		return nil, err
+	}
+
+	c.readMetrics.queryDuration.Observe(time.Since(begin).Seconds())
+
+	return labelsToSeries, nil
+}
+
 // HealthCheck implements the healtcheck interface
 func (c *Client) HealthCheck() error {
+	if c.cfg.deepHealthCheck {
+		return c.checkWritePath()
+	}
+
 	rows, err := c.db.Query("SELECT 1")
 
 	if err != nil {
@@ -456,77 +1672,184 @@ func toTimestamp(milliseconds int64) time.Time {
 	return time.Unix(sec, nsec)
 }
 
-func (c *Client) buildQuery(q *prompb.Query) (string, error) {
+// timeLiteral returns an SQL expression of the given time that does not
+// depend on the session time zone
+func (c *Client) timeLiteral(milliseconds int64) string {
+	if c.cfg.timeFormat == timeFormatEpoch {
+		return fmt.Sprintf("to_timestamp(%s)", strconv.FormatFloat(float64(milliseconds)/1000, 'f', -1, 64))
+	}
+	return fmt.Sprintf("'%s'", toTimestamp(milliseconds).UTC().Format(rfc3339Milli))
+}
+
+func (c *Client) buildQuery(q *prompb.Query, params *queryParams) (string, error) {
+	_, predicates, err := c.buildPredicates(q, params)
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s WHERE %s ORDER BY time", c.selectSamples(c.cfg.table), predicates), nil
+}
+
+// selectSamples returns a SELECT of the time, name, value and JSON labels of
+// the samples stored under the given table name
+func (c *Client) selectSamples(table string) string {
+	if c.cfg.usePgPrometheus {
+		return fmt.Sprintf("SELECT time, name, value, labels FROM %s", quoteIdent(table))
+	}
+	return fmt.Sprintf("SELECT time, name, value, %s FROM %s", c.labelsFormat().toJSON(), c.nativeSamples(table))
+}
+
+// queryParams are the values bound to the parameters of a read query, so that
+// its SQL only depends on the shape of the selector and PostgreSQL reuses its
+// plan. Without bind, the values are written into the SQL as literals.
+type queryParams struct {
+	bind bool
+	args []interface{}
+}
+
+// newQueryParams returns the parameters of q, which bind its time range to $1
+// and $2 if bind is set
+func newQueryParams(q *prompb.Query, bind bool) *queryParams {
+	p := &queryParams{bind: bind}
+
+	if bind {
+		p.args = []interface{}{toTimestamp(q.StartTimestampMs), toTimestamp(q.EndTimestampMs)}
+	}
+	return p
+}
+
+// value returns the parameter bound to value, cast to the given type if any,
+// or value as a string literal
+func (p *queryParams) value(value string, cast string) string {
+	if !p.bind {
+		return fmt.Sprintf("'%s'", escapeValue(value))
+	}
+
+	p.args = append(p.args, value)
+
+	if len(cast) > 0 {
+		return fmt.Sprintf("$%d::%s", len(p.args), cast)
+	}
+	return fmt.Sprintf("$%d", len(p.args))
+}
+
+// buildPredicates translates the query matchers and time range into a WHERE
+// clause, with the values bound to params. The predicates on the metric name
+// are also returned separately, with their values as literals.
+func (c *Client) buildPredicates(q *prompb.Query, params *queryParams) ([]string, string, error) {
 	matchers := make([]string, 0, len(q.Matchers))
+	nameMatchers := make([]string, 0, 1)
 	labelEqualPredicates := make(map[string]string)
+	labels := c.labelsFormat()
 
 	for _, m := range q.Matchers {
-		escapedValue := escapeValue(m.Value)
-
 		if m.Name == model.MetricNameLabel {
-			switch m.Type {
-			case prompb.LabelMatcher_EQ:
-				if len(escapedValue) == 0 {
-					matchers = append(matchers, fmt.Sprintf("(name IS NULL OR name = '')"))
-				} else {
-					matchers = append(matchers, fmt.Sprintf("name = '%s'", escapedValue))
-				}
-			case prompb.LabelMatcher_NEQ:
-				matchers = append(matchers, fmt.Sprintf("name != '%s'", escapedValue))
-			case prompb.LabelMatcher_RE:
-				matchers = append(matchers, fmt.Sprintf("name ~ '%s'", anchorValue(escapedValue)))
-			case prompb.LabelMatcher_NRE:
-				matchers = append(matchers, fmt.Sprintf("name !~ '%s'", anchorValue(escapedValue)))
-			default:
-				return "", fmt.Errorf("unknown metric name match type %v", m.Type)
+			predicate, err := namePredicate(m, params)
+
+			if err != nil {
+				return nil, "", err
+			}
+			matchers = append(matchers, predicate)
+
+			if params.bind {
+				// Metric tables are looked up without parameters
+				predicate, _ = namePredicate(m, &queryParams{})
 			}
+			nameMatchers = append(nameMatchers, predicate)
 		} else {
+			value := labels.value(m.Name)
+
 			switch m.Type {
 			case prompb.LabelMatcher_EQ:
-				if len(escapedValue) == 0 {
+				if len(m.Value) == 0 {
 					// From the PromQL docs: "Label matchers that match
 					// empty label values also select all time series that
 					// do not have the specific label set at all."
-					matchers = append(matchers, fmt.Sprintf("((labels ? '%s') = false OR (labels->>'%s' = ''))",
-						m.Name, m.Name))
+					matchers = append(matchers, fmt.Sprintf("((%s) = false OR (%s = ''))",
+						labels.has(m.Name), value))
 				} else {
 					labelEqualPredicates[m.Name] = m.Value
 				}
 			case prompb.LabelMatcher_NEQ:
-				matchers = append(matchers, fmt.Sprintf("labels->>'%s' != '%s'", m.Name, escapedValue))
+				matchers = append(matchers, fmt.Sprintf("%s != %s", value, params.value(m.Value, "")))
 			case prompb.LabelMatcher_RE:
-				matchers = append(matchers, fmt.Sprintf("labels->>'%s' ~ '%s'", m.Name, anchorValue(escapedValue)))
+				matchers = append(matchers, fmt.Sprintf("%s ~ %s", value, params.value(anchorValue(m.Value), "")))
 			case prompb.LabelMatcher_NRE:
-				matchers = append(matchers, fmt.Sprintf("labels->>'%s' !~ '%s'", m.Name, anchorValue(escapedValue)))
+				matchers = append(matchers, fmt.Sprintf("%s !~ %s", value, params.value(anchorValue(m.Value), "")))
 			default:
-				return "", fmt.Errorf("unknown match type %v", m.Type)
+				return nil, "", fmt.Errorf("unknown match type %v", m.Type)
 			}
 		}
 	}
 	equalsPredicate := ""
 
 	if len(labelEqualPredicates) > 0 {
-		labelsJSON, err := json.Marshal(labelEqualPredicates)
+		predicate, err := labels.contains(labelEqualPredicates, params)
 
 		if err != nil {
-			return "", err
+			return nil, "", err
 		}
-		equalsPredicate = fmt.Sprintf(" AND labels @> '%s'", labelsJSON)
+		equalsPredicate = fmt.Sprintf(" AND %s", predicate)
+	}
+
+	start, end := c.timeLiteral(q.StartTimestampMs), c.timeLiteral(q.EndTimestampMs)
+	if params.bind {
+		start, end = "$1", "$2"
 	}
 
-	matchers = append(matchers, fmt.Sprintf("time >= '%v'", toTimestamp(q.StartTimestampMs).Format(time.RFC3339)))
-	matchers = append(matchers, fmt.Sprintf("time <= '%v'", toTimestamp(q.EndTimestampMs).Format(time.RFC3339)))
+	matchers = append(matchers, fmt.Sprintf("time >= %s", start))
+	matchers = append(matchers, fmt.Sprintf("time <= %s", end))
 
-	return fmt.Sprintf("SELECT time, name, value, labels FROM %s WHERE %s %s ORDER BY time",
-		c.cfg.table, strings.Join(matchers, " AND "), equalsPredicate), nil
+	return nameMatchers, fmt.Sprintf("%s %s", strings.Join(matchers, " AND "), equalsPredicate), nil
+}
+
+// namePredicate translates a matcher of the metric name
+func namePredicate(m *prompb.LabelMatcher, params *queryParams) (string, error) {
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		if len(m.Value) == 0 {
+			return "(name IS NULL OR name = '')", nil
+		}
+		return fmt.Sprintf("name = %s", params.value(m.Value, "")), nil
+	case prompb.LabelMatcher_NEQ:
+		return fmt.Sprintf("name != %s", params.value(m.Value, "")), nil
+	case prompb.LabelMatcher_RE:
+		return fmt.Sprintf("name ~ %s", params.value(anchorValue(m.Value), "")), nil
+	case prompb.LabelMatcher_NRE:
+		return fmt.Sprintf("name !~ %s", params.value(anchorValue(m.Value), "")), nil
+	}
+	return "", fmt.Errorf("unknown metric name match type %v", m.Type)
 }
 
 func (c *Client) buildCommand(q *prompb.Query) (string, error) {
-	return c.buildQuery(q)
+	command, _, err := c.buildStatement(q, false)
+	return command, err
+}
+
+// buildStatement builds the query of q and returns the arguments of its
+// parameters. If bind is set, the time range is bound to $1 and $2, and the
+// values of the matchers to the following parameters.
+func (c *Client) buildStatement(q *prompb.Query, bind bool) (string, []interface{}, error) {
+	params := newQueryParams(q, bind)
+
+	var command string
+	var err error
+
+	if c.cfg.tablePerMetric {
+		command, err = c.buildMetricTablesQuery(q, params)
+	} else {
+		command, err = c.buildQuery(q, params)
+	}
+	return command, params.args, err
 }
 
+// escapeValue escapes a value for a standard SQL string literal, in which
+// quotes are doubled and backslashes have no special meaning. connString
+// turns on standard_conforming_strings for every connection, so that the
+// server reads the literals that way.
 func escapeValue(str string) string {
-	return strings.Replace(str, `'`, `\'`, -1)
+	return strings.Replace(str, `'`, `''`, -1)
 }
 
 // anchorValue adds anchors to values in regexps since PromQL docs
@@ -549,16 +1872,14 @@ func anchorValue(str string) string {
 	return fmt.Sprintf("^%s$", str)
 }
 
-// Name identifies the client as a PostgreSQL client.
-func (c Client) Name() string {
-	return "PostgreSQL"
-}
-
-// Describe implements prometheus.Collector.
-func (c *Client) Describe(ch chan<- *prometheus.Desc) {
+// Close closes the connections to the database
+func (c *Client) Close() error {
+	c.closeTenants()
+	c.stmts.close()
+	return c.db.Close()
 }
 
-// Collect implements prometheus.Collector.
-func (c *Client) Collect(ch chan<- prometheus.Metric) {
-	//ch <- c.ignoredSamples
+// Name identifies the client as a PostgreSQL client.
+func (c *Client) Name() string {
+	return "PostgreSQL"
 }
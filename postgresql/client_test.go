@@ -1,13 +1,18 @@
 package pgprometheus
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"flag"
 	"fmt"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/timescale/prometheus-postgresql-adapter/log"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -57,6 +62,57 @@ func TestBuildCommand(t *testing.T) {
 	t.Log(cmd)
 }
 
+func TestTimeLiteral(t *testing.T) {
+	c := &Client{cfg: &Config{}}
+
+	if literal := c.timeLiteral(1234567); literal != "'1970-01-01T00:20:34.567Z'" {
+		t.Errorf("Unexpected RFC 3339 time literal %s", literal)
+	}
+
+	c.cfg.timeFormat = timeFormatEpoch
+
+	if literal := c.timeLiteral(1234567); literal != "to_timestamp(1234.567)" {
+		t.Errorf("Unexpected epoch time literal %s", literal)
+	}
+}
+
+func TestMetricString(t *testing.T) {
+	testCases := []struct {
+		metric   model.Metric
+		expected string
+	}{
+		{metric: model.Metric{model.MetricNameLabel: "up"}, expected: "up"},
+		{metric: model.Metric{}, expected: "{}"},
+		{
+			metric:   model.Metric{model.MetricNameLabel: "up", "job": "api", "instance": "a:9090"},
+			expected: `up{instance="a:9090",job="api"}`,
+		},
+		{
+			metric:   model.Metric{model.MetricNameLabel: "log_lines", "msg": "line one\nline two"},
+			expected: `log_lines{msg="line one\nline two"}`,
+		},
+		{
+			metric:   model.Metric{model.MetricNameLabel: "files", "path": `C:\temp\"new"`},
+			expected: `files{path="C:\\temp\\\"new\""}`,
+		},
+		{
+			// Tabs are escaped by the driver in the COPY stream
+			metric:   model.Metric{model.MetricNameLabel: "up", "sep": "a\tb"},
+			expected: "up{sep=\"a\tb\"}",
+		},
+		{
+			metric:   model.Metric{model.MetricNameLabel: "up", "city": "Zürich", "emoji": "☃"},
+			expected: `up{city="Zürich",emoji="☃"}`,
+		},
+	}
+
+	for _, c := range testCases {
+		if actual := metricString(c.metric); actual != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, actual)
+		}
+	}
+}
+
 func TestWriteCommand(t *testing.T) {
 	flag.Parse()
 	if len(*database) == 0 {
@@ -140,3 +196,349 @@ func TestWriteCommand(t *testing.T) {
 		t.Fatal("Wrong cnt: ", cnt)
 	}
 }
+
+func TestSampleBlocks(t *testing.T) {
+	var blocks sampleBlocks
+	samples := make([]*prompb.Sample, 0, 2*sampleBlockSize+1)
+
+	for i := 0; i < cap(samples); i++ {
+		samples = append(samples, blocks.next(int64(i), float64(i)))
+	}
+
+	for i, s := range samples {
+		if s.Timestamp != int64(i) || s.Value != float64(i) {
+			t.Fatalf("sample %d: expected %d, got %d=%g", i, i, s.Timestamp, s.Value)
+		}
+	}
+}
+
+func TestSampleLabelsScan(t *testing.T) {
+	for _, value := range []interface{}{`{"job":"api","env":"prod"}`, []byte(`{"job":"api","env":"prod"}`)} {
+		var labels sampleLabels
+
+		if err := labels.Scan(value); err != nil {
+			t.Fatalf("%T: unexpected error %v", value, err)
+		}
+
+		if labels.len() != 2 || labels.OrderedKeys[0] != "env" || labels.Map["job"] != "api" {
+			t.Errorf("%T: unexpected labels %v", value, labels.Map)
+		}
+	}
+}
+
+func TestAddSpacePartitioning(t *testing.T) {
+	fake := newFakeDB()
+
+	var dimension []driver.Value
+	fake.exec = func(query string, args []driver.Value) error {
+		if strings.Contains(query, "add_dimension") {
+			dimension = args
+		}
+		return nil
+	}
+
+	db := fake.open(1)
+	c := &Client{db: db, cfg: &Config{pgPrometheusNormalize: true, pgPrometheusPartitions: 4}}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.addSpacePartitioning(tx, "metrics"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	// Samples are partitioned on their series, without a function reading
+	// other tables
+	if len(fake.execs) != 1 {
+		t.Errorf("Expected only the dimension to be added, got %v", fake.execs)
+	}
+
+	if expected := []driver.Value{`"metrics_values"`, int64(4)}; !reflect.DeepEqual(dimension, expected) {
+		t.Errorf("Expected the dimension %v, got %v", expected, dimension)
+	}
+
+	c.cfg.pgPrometheusNormalize = false
+
+	if err = c.addSpacePartitioning(nil, "metrics"); err == nil {
+		t.Error("Expected an error for the raw schema")
+	}
+}
+
+func TestValidateIndexes(t *testing.T) {
+	testCases := []struct {
+		name    string
+		adjust  func(cfg *Config)
+		invalid bool
+	}{
+		{name: "defaults", adjust: func(cfg *Config) {}},
+		{name: "brin and gin-path", adjust: func(cfg *Config) { cfg.timeIndex, cfg.labelsIndex = timeIndexBrin, labelsIndexGinPath }},
+		{name: "unknown time index", adjust: func(cfg *Config) { cfg.timeIndex = "hash" }, invalid: true},
+		{name: "unknown labels index", adjust: func(cfg *Config) { cfg.labelsIndex = "gist" }, invalid: true},
+		{name: "gin-path on hstore", adjust: func(cfg *Config) {
+			cfg.usePgPrometheus, cfg.labelsFormat, cfg.labelsIndex = false, labelsFormatHstore, labelsIndexGinPath
+		}, invalid: true},
+		{name: "raw schema", adjust: func(cfg *Config) { cfg.pgPrometheusNormalize, cfg.timeIndex = false, timeIndexBrin }, invalid: true},
+		{name: "partial indexes", adjust: func(cfg *Config) { cfg.partialIndexMetrics = "up, node_cpu_seconds_total" }},
+		{name: "invalid metric", adjust: func(cfg *Config) { cfg.partialIndexMetrics = "up,node-cpu" }, invalid: true},
+		{name: "partial indexes without gin", adjust: func(cfg *Config) { cfg.partialIndexMetrics, cfg.labelsIndex = "up", labelsIndexNone }, invalid: true},
+		{name: "partial indexes per metric table", adjust: func(cfg *Config) { cfg.partialIndexMetrics, cfg.tablePerMetric = "up", true }, invalid: true},
+	}
+
+	for _, tc := range testCases {
+		cfg := &Config{}
+		RegisterFlags(flag.NewFlagSet("test", flag.ContinueOnError), cfg)
+		tc.adjust(cfg)
+
+		if err := (&Client{cfg: cfg}).validateIndexes(); (err != nil) != tc.invalid {
+			t.Errorf("%s: unexpected validation error %v", tc.name, err)
+		}
+	}
+}
+
+func TestCreatePartialIndexes(t *testing.T) {
+	fake := newFakeDB()
+	db := fake.open(1)
+
+	cfg := &Config{}
+	RegisterFlags(flag.NewFlagSet("test", flag.ContinueOnError), cfg)
+	cfg.labelsIndex, cfg.partialIndexMetrics = labelsIndexGinPath, "up,node_load1"
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = (&Client{db: db, cfg: cfg}).createPartialIndexes(tx, "metrics"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	expected := []string{
+		`CREATE INDEX ON "metrics_labels" USING GIN (labels jsonb_path_ops) WHERE metric_name = 'up'`,
+		`CREATE INDEX ON "metrics_labels" USING GIN (labels jsonb_path_ops) WHERE metric_name = 'node_load1'`,
+	}
+
+	if !reflect.DeepEqual(fake.execs, expected) {
+		t.Errorf("Expected %q, got %q", expected, fake.execs)
+	}
+}
+
+// readClient returns a client reading from fake, answering the query of each
+// metric with read
+func readClient(fake *fakeDB, read func(ctx context.Context, metric string) (driver.Rows, error)) *Client {
+	cfg := &Config{}
+	RegisterFlags(flag.NewFlagSet("test", flag.ContinueOnError), cfg)
+	cfg.readConcurrency = 4
+
+	fake.query = func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+		for _, metric := range []string{"first", "second", "third"} {
+			if strings.Contains(query, "'"+metric+"'") {
+				return read(ctx, metric)
+			}
+		}
+		return nil, fmt.Errorf("unexpected query %s", query)
+	}
+	return &Client{db: fake.open(4), cfg: cfg, readMetrics: newReadMetrics()}
+}
+
+func metricQuery(metric string) *prompb.Query {
+	return &prompb.Query{
+		EndTimestampMs: 20000,
+		Matchers:       []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: metric}},
+	}
+}
+
+func TestReadQueriesOrder(t *testing.T) {
+	c := readClient(newFakeDB(), func(ctx context.Context, metric string) (driver.Rows, error) {
+		// The first query finishes last
+		if metric == "first" {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return &fakeRows{
+			columns: []string{"time", "name", "value", "labels"},
+			rows:    [][]driver.Value{{time.Unix(10, 0), metric, float64(1), []byte(`{"job":"` + metric + `"}`)}},
+		}, nil
+	})
+
+	metrics := []string{"first", "second", "third"}
+	queries := make([]*prompb.Query, len(metrics))
+	for i, metric := range metrics {
+		queries[i] = metricQuery(metric)
+	}
+
+	results, err := c.readQueries(context.Background(), queries)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(metrics) {
+		t.Fatalf("Expected %d results, got %d", len(metrics), len(results))
+	}
+
+	for i, metric := range metrics {
+		if len(results[i]) != 1 {
+			t.Errorf("%s: expected 1 series, got %d", metric, len(results[i]))
+			continue
+		}
+
+		for _, ts := range results[i] {
+			if name := ts.Labels[0].Value; name != metric {
+				t.Errorf("Expected the series of %s in result %d, got %s", metric, i, name)
+			}
+		}
+	}
+}
+
+func TestReadQueriesError(t *testing.T) {
+	failed := fmt.Errorf("query failed")
+	started, canceled := make(chan struct{}), make(chan struct{})
+
+	c := readClient(newFakeDB(), func(ctx context.Context, metric string) (driver.Rows, error) {
+		switch metric {
+		case "second":
+			<-started
+			return nil, failed
+		case "third":
+			// Siblings of a failed query are canceled
+			close(started)
+			<-ctx.Done()
+			close(canceled)
+			return nil, ctx.Err()
+		}
+		return &fakeRows{columns: []string{"time", "name", "value", "labels"}}, nil
+	})
+
+	done := make(chan error)
+
+	go func() {
+		_, err := c.readQueries(context.Background(), []*prompb.Query{metricQuery("first"), metricQuery("third"), metricQuery("second")})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != failed {
+			t.Errorf("Expected the error of the failed query, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the sibling of the failed query to be canceled")
+	}
+
+	select {
+	case <-canceled:
+	default:
+		t.Error("Expected the sibling query to see its context canceled")
+	}
+}
+
+func TestSetTablespaces(t *testing.T) {
+	testCases := []struct {
+		name           string
+		cfg            *Config
+		execs          []string
+		attachedTables []driver.Value
+	}{
+		{name: "defaults", cfg: &Config{useTimescaleDb: true}},
+		{
+			name:  "index tablespace",
+			cfg:   &Config{indexTablespace: "fast"},
+			execs: []string{`ALTER INDEX public.metrics_labels_idx SET TABLESPACE fast`, `ALTER INDEX public.metrics_values_idx SET TABLESPACE fast`},
+		},
+		{
+			name:           "tablespace",
+			cfg:            &Config{tablespace: "big", useTimescaleDb: true},
+			attachedTables: []driver.Value{"big", "metrics", "metrics_values", "metrics_labels", "metrics_samples"},
+		},
+		// Plain tables are created in the default tablespace already
+		{name: "tablespace without TimescaleDB", cfg: &Config{tablespace: "big"}},
+	}
+
+	for _, tc := range testCases {
+		fake := newFakeDB()
+
+		var attachedTables []driver.Value
+		fake.query = func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+			switch {
+			case strings.Contains(query, "pg_indexes"):
+				rows := &fakeRows{columns: []string{"format"}}
+				for _, index := range []string{"metrics_labels_idx", "metrics_values_idx"} {
+					rows.rows = append(rows.rows, []driver.Value{fmt.Sprintf("ALTER INDEX public.%s SET TABLESPACE %s", index, args[0])})
+				}
+				return rows, nil
+			case strings.Contains(query, "attach_tablespace"):
+				attachedTables = args
+			}
+			return &fakeRows{}, nil
+		}
+
+		db := fake.open(1)
+		tx, err := db.Begin()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = (&Client{db: db, cfg: tc.cfg}).setTablespaces(tx, "metrics"); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		tx.Commit()
+
+		if !reflect.DeepEqual(fake.execs, tc.execs) {
+			t.Errorf("%s: expected the statements %v, got %v", tc.name, tc.execs, fake.execs)
+		}
+
+		if !reflect.DeepEqual(attachedTables, tc.attachedTables) {
+			t.Errorf("%s: expected the tablespace to be attached with %v, got %v", tc.name, tc.attachedTables, attachedTables)
+		}
+	}
+}
+
+func TestEnableTimescaleDB(t *testing.T) {
+	testCases := []struct {
+		name        string
+		available   bool
+		autoStorage bool
+		err         bool
+		timescaleDB bool
+	}{
+		{name: "available", available: true, timescaleDB: true},
+		{name: "missing", err: true, timescaleDB: true},
+		{name: "missing with auto storage", autoStorage: true, timescaleDB: false},
+	}
+
+	for _, tc := range testCases {
+		fake := newFakeDB()
+		fake.query = func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+			return &fakeRows{columns: []string{"exists"}, rows: [][]driver.Value{{tc.available}}}, nil
+		}
+
+		db := fake.open(1)
+		tx, err := db.Begin()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := &Client{db: db, cfg: &Config{useTimescaleDb: true, autoStorage: tc.autoStorage}}
+		err = c.enableTimescaleDB(tx)
+		tx.Rollback()
+
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+
+		if c.cfg.useTimescaleDb != tc.timescaleDB {
+			t.Errorf("%s: expected TimescaleDB to be used: %t", tc.name, tc.timescaleDB)
+		}
+
+		if created := len(fake.execs) > 0; created != tc.available {
+			t.Errorf("%s: expected the extension to be created: %t", tc.name, tc.available)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package pgprometheus
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cloud SQL instances are reached the way the Cloud SQL Auth proxy reaches
+// them: the SQL Admin API signs a short-lived client certificate for an
+// ephemeral key, and the PostgreSQL protocol runs inside a TLS connection to
+// the server-side proxy of the instance. Access tokens are requested from the
+// metadata server, so the adapter must run on GCE, GKE or Cloud Run.
+
+const (
+	cloudSQLPort        = "3307"
+	cloudSQLDialTimeout = 10 * time.Second
+	cloudSQLAdminURL    = "https://sqladmin.googleapis.com/sql/v1beta4/projects/%s/instances/%s"
+	gceTokenURL         = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+	// Certificates and tokens are renewed this long before they expire
+	cloudSQLRefreshBefore = 5 * time.Minute
+)
+
+type cloudSQLDialer struct {
+	project  string
+	instance string
+	ipType   string
+	iamAuth  bool
+	key      *rsa.PrivateKey
+	client   *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+	tlsConfig   *tls.Config
+	addr        string
+	certExpiry  time.Time
+}
+
+// newCloudSQLDialer returns a dialer for the Cloud SQL instance with the given
+// "project:region:instance" connection name
+func newCloudSQLDialer(connectionName, ipType string, iamAuth bool) (*cloudSQLDialer, error) {
+	parts := strings.Split(connectionName, ":")
+
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid Cloud SQL instance connection name %q, expected project:region:instance", connectionName)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &cloudSQLDialer{
+		project:  parts[0],
+		instance: parts[2],
+		ipType:   strings.ToUpper(ipType),
+		iamAuth:  iamAuth,
+		key:      key,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (d *cloudSQLDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialTimeout(network, address, cloudSQLDialTimeout)
+}
+
+// DialTimeout connects to the instance, ignoring the address of the
+// connection string
+func (d *cloudSQLDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	d.mu.Lock()
+	err := d.refreshCert()
+	tlsConfig, addr := d.tlsConfig, d.addr
+	d.mu.Unlock()
+
+	if err != nil {
+		return nil, fmt.Errorf("error refreshing the Cloud SQL client certificate: %v", err)
+	}
+
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, tlsConfig)
+}
+
+// password returns the access token, which is the password of IAM database
+// users
+func (d *cloudSQLDialer) password() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.accessToken()
+}
+
+func (d *cloudSQLDialer) accessToken() (string, error) {
+	if time.Now().Add(cloudSQLRefreshBefore).Before(d.tokenExpiry) {
+		return d.token, nil
+	}
+
+	req, err := http.NewRequest("GET", gceTokenURL, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+
+	if err = d.do(req, &token); err != nil {
+		return "", fmt.Errorf("error requesting an access token from the metadata server: %v", err)
+	}
+
+	d.token = token.AccessToken
+	d.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+
+	return d.token, nil
+}
+
+// refreshCert requests the address and CA certificate of the instance, and a
+// new client certificate, unless the current one is still valid
+func (d *cloudSQLDialer) refreshCert() error {
+	if time.Now().Add(cloudSQLRefreshBefore).Before(d.certExpiry) {
+		return nil
+	}
+
+	token, err := d.accessToken()
+
+	if err != nil {
+		return err
+	}
+
+	var settings struct {
+		ServerCaCert struct {
+			Cert string `json:"cert"`
+		} `json:"serverCaCert"`
+		IPAddresses []struct {
+			Type      string `json:"type"`
+			IPAddress string `json:"ipAddress"`
+		} `json:"ipAddresses"`
+	}
+
+	req, err := d.adminRequest("GET", "/connectSettings", token, nil)
+
+	if err == nil {
+		err = d.do(req, &settings)
+	}
+
+	if err != nil {
+		return fmt.Errorf("error requesting the connect settings of the instance: %v", err)
+	}
+
+	var addr string
+
+	for _, ip := range settings.IPAddresses {
+		if ip.Type == d.ipType {
+			addr = net.JoinHostPort(ip.IPAddress, cloudSQLPort)
+		}
+	}
+
+	if len(addr) == 0 {
+		return fmt.Errorf("the instance has no %s IP address", d.ipType)
+	}
+
+	roots := x509.NewCertPool()
+
+	if !roots.AppendCertsFromPEM([]byte(settings.ServerCaCert.Cert)) {
+		return fmt.Errorf("invalid server CA certificate")
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&d.key.PublicKey)
+
+	if err != nil {
+		return err
+	}
+
+	body := map[string]string{
+		"public_key": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})),
+	}
+
+	if d.iamAuth {
+		body["access_token"] = token
+	}
+
+	var ephemeral struct {
+		EphemeralCert struct {
+			Cert string `json:"cert"`
+		} `json:"ephemeralCert"`
+	}
+
+	req, err = d.adminRequest("POST", ":generateEphemeralCert", token, body)
+
+	if err == nil {
+		err = d.do(req, &ephemeral)
+	}
+
+	if err != nil {
+		return fmt.Errorf("error requesting a client certificate: %v", err)
+	}
+
+	block, _ := pem.Decode([]byte(ephemeral.EphemeralCert.Cert))
+
+	if block == nil {
+		return fmt.Errorf("invalid client certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+
+	if err != nil {
+		return err
+	}
+
+	serverName := d.project + ":" + d.instance
+
+	d.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{block.Bytes}, PrivateKey: d.key, Leaf: cert}},
+		// The server certificate names the instance rather than a host, so
+		// it is verified below instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyCloudSQLCert(rawCerts, roots, serverName)
+		},
+	}
+	d.addr = addr
+	d.certExpiry = cert.NotAfter
+
+	return nil
+}
+
+func verifyCloudSQLCert(rawCerts [][]byte, roots *x509.CertPool, serverName string) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no server certificate")
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = cert.Verify(x509.VerifyOptions{Roots: roots}); err != nil {
+		return err
+	}
+
+	if cert.Subject.CommonName != serverName {
+		return fmt.Errorf("server certificate is for %q, expected %q", cert.Subject.CommonName, serverName)
+	}
+	return nil
+}
+
+func (d *cloudSQLDialer) adminRequest(method, path, token string, body interface{}) (*http.Request, error) {
+	var data []byte
+
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf(cloudSQLAdminURL, d.project, d.instance)+path, bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	return req, nil
+}
+
+func (d *cloudSQLDialer) do(req *http.Request, v interface{}) error {
+	resp, err := d.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,21 @@
+package pgprometheus
+
+import "testing"
+
+func TestNewCloudSQLDialer(t *testing.T) {
+	d, err := newCloudSQLDialer("my-project:europe-west1:metrics", "private", true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.project != "my-project" || d.instance != "metrics" || d.ipType != "PRIVATE" {
+		t.Errorf("Unexpected dialer for my-project:europe-west1:metrics: %+v", d)
+	}
+
+	for _, name := range []string{"metrics", "my-project:metrics", "a:b:c:d"} {
+		if _, err := newCloudSQLDialer(name, "PRIMARY", false); err == nil {
+			t.Errorf("Expected an error for connection name %s", name)
+		}
+	}
+}
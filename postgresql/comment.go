@@ -0,0 +1,31 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Version and Commit describe the build of the adapter, set at build time
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+const (
+	endpointRead  = "read"
+	endpointWrite = "write"
+)
+
+// queryComment returns a comment prefix attributing a query to the adapter and
+// the endpoint that runs it, so that its load can be told apart in
+// pg_stat_activity and pg_stat_statements
+func (c *Client) queryComment(endpoint string) string {
+	if !c.cfg.queryComments {
+		return ""
+	}
+
+	// Keeps configured values from ending the comment
+	name := strings.Replace(c.cfg.applicationName, "*/", "* /", -1)
+
+	return fmt.Sprintf("/* %s version=%s endpoint=%s */ ", name, Version, endpoint)
+}
@@ -0,0 +1,17 @@
+package pgprometheus
+
+import "testing"
+
+func TestQueryComment(t *testing.T) {
+	c := &Client{cfg: &Config{applicationName: "adapter */ DROP TABLE metrics; /*", queryComments: true}}
+
+	expected := "/* adapter * / DROP TABLE metrics; /* version=" + Version + " endpoint=read */ "
+	if comment := c.queryComment(endpointRead); comment != expected {
+		t.Errorf("Expected %q, got %q", expected, comment)
+	}
+
+	c.cfg.queryComments = false
+	if comment := c.queryComment(endpointRead); comment != "" {
+		t.Errorf("Expected no comment, got %q", comment)
+	}
+}
@@ -0,0 +1,107 @@
+package pgprometheus
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+// A batch of samples is written in a single transaction, and thereby on a
+// single connection, by default. With -pg.write-concurrency, the tables of
+// -pg.table-per-metric, or the series of a space partitioned hypertable, are
+// written in concurrent transactions instead, each copying into its own
+// temporary table.
+
+// writeGroups splits the batches of samples of each table into the groups
+// written in concurrent transactions: a group per table with
+// -pg.table-per-metric, or the series hashed into as many groups as there are
+// space partitions, up to -pg.write-concurrency. Partitions are chosen by the
+// series id, which is only known once the labels are stored, so the groups do
+// not match the partitions exactly. A single group is not returned.
+func (c *Client) writeGroups(batches map[string]model.Samples) []map[string]model.Samples {
+	if c.cfg.writeConcurrency <= 1 {
+		return nil
+	}
+
+	if c.cfg.tablePerMetric {
+		groups := make([]map[string]model.Samples, 0, len(batches))
+
+		for table, batch := range batches {
+			groups = append(groups, map[string]model.Samples{table: batch})
+		}
+		return groups
+	}
+
+	n := c.cfg.pgPrometheusPartitions
+	if n > c.cfg.writeConcurrency {
+		n = c.cfg.writeConcurrency
+	}
+
+	if n <= 1 {
+		return nil
+	}
+
+	split := make([]map[string]model.Samples, n)
+
+	for table, batch := range batches {
+		for _, sample := range batch {
+			i := uint64(sample.Metric.FastFingerprint()) % uint64(n)
+
+			if split[i] == nil {
+				split[i] = make(map[string]model.Samples)
+			}
+			split[i][table] = append(split[i][table], sample)
+		}
+	}
+
+	groups := split[:0]
+
+	for _, group := range split {
+		if group != nil {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// writeConcurrently writes each group of batches in its own transaction, up
+// to -pg.write-concurrency at once. Once a transaction fails, the ones still
+// running are cancelled, but those committed already are kept.
+func (c *Client) writeConcurrently(ctx context.Context, groups []map[string]model.Samples) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errLock  sync.Mutex
+		firstErr error
+	)
+
+	slots := make(chan struct{}, c.cfg.writeConcurrency)
+
+	for _, group := range groups {
+		slots <- struct{}{}
+		wg.Add(1)
+
+		go func(batches map[string]model.Samples) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			if err := c.writeBatches(ctx, batches); err != nil {
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errLock.Unlock()
+
+				cancel()
+			}
+		}(group)
+	}
+
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,97 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestWriteGroups(t *testing.T) {
+	var samples model.Samples
+
+	for i := 0; i < 100; i++ {
+		metric := model.Metric{model.MetricNameLabel: "up", "instance": model.LabelValue(fmt.Sprintf("host%d", i))}
+		samples = append(samples, &model.Sample{Metric: metric, Timestamp: 1}, &model.Sample{Metric: metric, Timestamp: 2})
+	}
+
+	testCases := []struct {
+		name           string
+		cfg            Config
+		batches        map[string]model.Samples
+		expectedGroups int
+	}{
+		{
+			name:           "single transaction",
+			cfg:            Config{writeConcurrency: 1, tablePerMetric: true},
+			batches:        map[string]model.Samples{"metrics_up": samples, "metrics_down": samples},
+			expectedGroups: 0,
+		},
+		{
+			name:           "table per metric",
+			cfg:            Config{writeConcurrency: 4, tablePerMetric: true},
+			batches:        map[string]model.Samples{"metrics_up": samples, "metrics_down": samples},
+			expectedGroups: 2,
+		},
+		{
+			name:           "no space partitions",
+			cfg:            Config{writeConcurrency: 4},
+			batches:        map[string]model.Samples{"metrics": samples},
+			expectedGroups: 0,
+		},
+		{
+			name:           "space partitions",
+			cfg:            Config{writeConcurrency: 4, pgPrometheusPartitions: 3},
+			batches:        map[string]model.Samples{"metrics": samples},
+			expectedGroups: 3,
+		},
+		{
+			name:           "more space partitions than concurrency",
+			cfg:            Config{writeConcurrency: 2, pgPrometheusPartitions: 8},
+			batches:        map[string]model.Samples{"metrics": samples},
+			expectedGroups: 2,
+		},
+	}
+
+	for _, c := range testCases {
+		client := &Client{cfg: &c.cfg}
+		groups := client.writeGroups(c.batches)
+
+		if len(groups) != c.expectedGroups {
+			t.Errorf("%s: expected %d groups, got %d", c.name, c.expectedGroups, len(groups))
+			continue
+		}
+
+		if len(groups) == 0 {
+			continue
+		}
+
+		// Every sample is written once, and the samples of a series in
+		// the same group
+		seen := make(map[string]int)
+		var written int
+
+		for i, group := range groups {
+			for table, batch := range group {
+				for _, s := range batch {
+					key := table + "\xff" + s.Metric.String()
+
+					if g, ok := seen[key]; ok && g != i {
+						t.Errorf("%s: series %s of %s split between groups", c.name, s.Metric, table)
+					}
+					seen[key] = i
+					written++
+				}
+			}
+		}
+
+		var expected int
+		for _, batch := range c.batches {
+			expected += len(batch)
+		}
+
+		if written != expected {
+			t.Errorf("%s: expected %d samples, got %d", c.name, expected, written)
+		}
+	}
+}
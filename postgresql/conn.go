@@ -0,0 +1,204 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const passwordEnv = "PGPASSWORD"
+
+var passwordParam = regexp.MustCompile(`password=('(?:[^'\\]|\\.)*'|\S+)`)
+
+// connString returns the libpq keyword/value connection string of the
+// configuration. A -pg.url connection string or URL replaces the individual
+// connection flags, but options that were set explicitly still apply.
+func (cfg *Config) connString() (string, error) {
+	var params []string
+
+	if len(cfg.cloudSQLInstance) == 0 {
+		params = append(params, "connect_timeout=10")
+	}
+
+	if len(cfg.url) > 0 {
+		dsn := cfg.url
+
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			var err error
+			dsn, err = pq.ParseURL(dsn)
+
+			if err != nil {
+				return "", fmt.Errorf("invalid connection URL: %v", err)
+			}
+		}
+		params = append(params, dsn)
+	} else {
+		sslMode := cfg.sslMode
+		if strings.HasPrefix(cfg.host, "/") {
+			// The host is the directory of a Unix socket, which is not
+			// encrypted. lib/pq does the same, but pgx would try TLS.
+			sslMode = "disable"
+		}
+
+		params = append(params,
+			fmt.Sprintf("host=%s", quoteConnValue(cfg.host)),
+			fmt.Sprintf("port=%d", cfg.port),
+			fmt.Sprintf("user=%s", quoteConnValue(cfg.user)),
+			fmt.Sprintf("dbname=%s", quoteConnValue(cfg.database)),
+			fmt.Sprintf("sslmode=%s", quoteConnValue(sslMode)),
+		)
+	}
+
+	if len(cfg.cloudSQLInstance) > 0 {
+		// Cloud SQL connections are already encrypted by the dialer, which
+		// also applies the connect timeout
+		params = append(params, "sslmode=disable")
+	}
+
+	optional := []struct {
+		key   string
+		value string
+	}{
+		{"password", cfg.password},
+		{"sslrootcert", cfg.sslRootCert},
+		{"sslcert", cfg.sslCert},
+		{"sslkey", cfg.sslKey},
+		{"timezone", cfg.timeZone},
+		{"application_name", cfg.applicationName},
+		{"search_path", cfg.searchPath()},
+	}
+
+	for _, param := range optional {
+		if len(param.value) > 0 {
+			params = append(params, fmt.Sprintf("%s=%s", param.key, quoteConnValue(param.value)))
+		}
+	}
+
+	timeouts := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"statement_timeout", cfg.statementTimeout},
+		{"lock_timeout", cfg.lockTimeout},
+		{"idle_in_transaction_session_timeout", cfg.idleInTransactionTimeout},
+	}
+
+	for _, timeout := range timeouts {
+		if timeout.value > 0 {
+			params = append(params, fmt.Sprintf("%s=%d", timeout.key, timeout.value/time.Millisecond))
+		}
+	}
+
+	// Literals written by the adapter, e.g. of label names, escape quotes but
+	// not backslashes, which is only safe with standard conforming strings
+	params = append(params, "standard_conforming_strings=on")
+
+	if cfg.pgBouncer && cfg.driver != driverPgx {
+		// Makes lib/pq send queries with parameters in one round trip
+		params = append(params, "binary_parameters=yes")
+	}
+
+	return strings.Join(params, " "), nil
+}
+
+// searchPath puts the schema before the public schema, which usually holds
+// the extensions
+func (cfg *Config) searchPath() string {
+	if len(cfg.schema) == 0 {
+		return ""
+	}
+	return pq.QuoteIdentifier(cfg.schema) + ",public"
+}
+
+// validatePool checks the settings of the connection pool
+func (cfg *Config) validatePool() error {
+	if cfg.connMaxLifetime < 0 {
+		return fmt.Errorf("the connection max lifetime must not be negative, got %s", cfg.connMaxLifetime)
+	}
+	return nil
+}
+
+// validateStartup checks the retries of connecting at startup, since a
+// negative number would retry forever
+func (cfg *Config) validateStartup() error {
+	if cfg.dbConnectRetries < 0 {
+		return fmt.Errorf("the number of connect retries must not be negative, got %d", cfg.dbConnectRetries)
+	}
+
+	if cfg.startupTimeout < 0 {
+		return fmt.Errorf("the startup timeout must not be negative, got %s", cfg.startupTimeout)
+	}
+	return nil
+}
+
+// redactPassword masks the passwords in a connection string, for logging
+func redactPassword(connStr string) string {
+	return passwordParam.ReplaceAllString(connStr, "password=********")
+}
+
+// Redacted returns a copy of the config with the password masked, for logging
+func (cfg Config) Redacted() Config {
+	if len(cfg.password) > 0 {
+		cfg.password = "********"
+	}
+
+	if u, err := url.Parse(cfg.url); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "********")
+			cfg.url = u.String()
+		}
+	}
+
+	cfg.url = redactPassword(cfg.url)
+	return cfg
+}
+
+// readPassword sets the password from -pg.password-file, or else from the
+// PGPASSWORD environment variable, unless -pg.password is set. A -pg.url
+// without a password leaves PGPASSWORD to the driver.
+func (cfg *Config) readPassword() error {
+	if len(cfg.passwordFile) > 0 {
+		if len(cfg.password) > 0 {
+			return fmt.Errorf("-pg.password and -pg.password-file are mutually exclusive")
+		}
+
+		password, err := cfg.filePassword()
+
+		if err != nil {
+			return err
+		}
+
+		cfg.password = password
+		return nil
+	}
+
+	if len(cfg.password) == 0 && len(cfg.url) == 0 {
+		cfg.password = os.Getenv(passwordEnv)
+	}
+	return nil
+}
+
+// filePassword reads the password file. It is read again for every new
+// connection, so that a rotated password is used without a restart.
+func (cfg *Config) filePassword() (string, error) {
+	data, err := ioutil.ReadFile(cfg.passwordFile)
+
+	if err != nil {
+		return "", fmt.Errorf("error reading password file: %v", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// quoteConnValue quotes a connection string value, escaping backslashes and
+// single quotes
+func quoteConnValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return fmt.Sprintf("'%s'", value)
+}
@@ -0,0 +1,91 @@
+package pgprometheus
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+// consulMinTTL is the minimum TTL of Consul sessions
+const consulMinTTL = 10 * time.Second
+
+// The Consul elector acquires the leader key with a session that the leader
+// renews every election interval. Acquiring a key already held by the session
+// succeeds, so followers and the leader make the same calls.
+
+type consulElector struct {
+	leaderState
+	client   *electionClient
+	key      string
+	identity string
+	ttl      time.Duration
+
+	session string
+}
+
+func newConsulElector(endpoint, key string, interval, ttl time.Duration) (*consulElector, error) {
+	client, err := newElectionClient(endpoint, interval)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &consulElector{
+		client:   client,
+		key:      key,
+		identity: electionIdentity(),
+		ttl:      ttl,
+	}, nil
+}
+
+func (e *consulElector) elect() error {
+	if len(e.session) == 0 {
+		var session struct {
+			ID string `json:"ID"`
+		}
+
+		err := e.client.do("PUT", "/v1/session/create", map[string]string{
+			"Name":      e.identity,
+			"TTL":       e.ttl.String(),
+			"LockDelay": "0s",
+			"Behavior":  "release",
+		}, &session)
+
+		if err != nil {
+			return err
+		}
+		e.session = session.ID
+	} else if err := e.client.do("PUT", "/v1/session/renew/"+e.session, nil, nil); err != nil {
+		return err
+	}
+
+	var acquired bool
+
+	path := "/v1/kv/" + escapeKey(e.key) + "?acquire=" + url.QueryEscape(e.session)
+
+	if err := e.client.do("PUT", path, []byte(e.identity), &acquired); err != nil {
+		return err
+	}
+
+	e.setLeader(acquired)
+	return nil
+}
+
+// resign destroys the session, which releases the key
+func (e *consulElector) resign() {
+	e.setLeader(false)
+
+	if len(e.session) > 0 {
+		e.client.do("PUT", "/v1/session/destroy/"+e.session, nil, nil)
+		e.session = ""
+	}
+}
+
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
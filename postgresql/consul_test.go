@@ -0,0 +1,93 @@
+package pgprometheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul implements the session and KV endpoints used by consulElector
+type fakeConsul struct {
+	mu       sync.Mutex
+	sessions int
+	holder   string
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/v1/session/create":
+		f.sessions++
+		json.NewEncoder(w).Encode(map[string]string{"ID": fmt.Sprintf("session-%d", f.sessions)})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		json.NewEncoder(w).Encode([]interface{}{})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		if f.holder == strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/") {
+			f.holder = ""
+		}
+		json.NewEncoder(w).Encode(true)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		session := r.URL.Query().Get("acquire")
+
+		if len(f.holder) == 0 {
+			f.holder = session
+		}
+		json.NewEncoder(w).Encode(f.holder == session)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestConsulElector(t *testing.T) {
+	server := httptest.NewServer(&fakeConsul{})
+	defer server.Close()
+
+	first, err := newConsulElector(server.URL, electionKey("metrics"), time.Second, 10*time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := newConsulElector(server.URL, electionKey("metrics"), time.Second, 10*time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		e      *consulElector
+		resign bool
+		first  bool
+		second bool
+	}{
+		{e: first, first: true},
+		{e: second, first: true},
+		{e: first, first: true},
+		{e: first, resign: true},
+		{e: second, second: true},
+		{e: first, second: true},
+	} {
+		if step.resign {
+			step.e.resign()
+		} else if err := step.e.elect(); err != nil {
+			t.Fatal(err)
+		}
+
+		if first.isLeader() != step.first || second.isLeader() != step.second {
+			t.Errorf("Unexpected leaders %v and %v, expected %v and %v", first.isLeader(), second.isLeader(), step.first, step.second)
+		}
+	}
+}
+
+func TestNewConsulElector(t *testing.T) {
+	if _, err := newConsulElector("", electionKey("metrics"), time.Second, 10*time.Second); err == nil {
+		t.Error("Expected an error without an endpoint")
+	}
+}
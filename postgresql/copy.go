@@ -0,0 +1,69 @@
+package pgprometheus
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// WithTarget returns a copy of the config connecting to another database with
+// a connection string or URL, and writing to another table if table is not
+// empty, e.g. to copy samples into a bigger cluster. The password flags do not
+// apply to the other database, whose password is part of the URL or set with
+// PGPASSWORD.
+func (cfg Config) WithTarget(url, table string) Config {
+	cfg.url = url
+	cfg.password, cfg.passwordFile = "", ""
+
+	if len(table) > 0 {
+		cfg.table = table
+	}
+	return cfg
+}
+
+// Copy writes the samples of the series matching the matchers between start
+// and end into the tables of dst, one window of time at a time, in
+// transactions of up to batchSize samples, through the write path of dst.
+// Copying a window twice writes its samples twice, so an interrupted copy is
+// resumed from the end of the last reported window. Both the samples read and
+// written are of the tenant set with WithTenant if any.
+func (c *Client) Copy(ctx context.Context, dst *Client, matchers []*prompb.LabelMatcher, start, end time.Time, window time.Duration,
+	batchSize int, progress func(MigrationProgress)) error {
+	stats := &ImportStats{}
+	imp := dst.newImporter(ctx, ImportOptions{BatchSize: batchSize}, stats)
+
+	return c.Export(ctx, matchers, start, end, window, func(mint, maxt int64, series []*prompb.TimeSeries) error {
+		for _, s := range series {
+			metric := make(model.Metric, len(s.Labels))
+			for _, l := range s.Labels {
+				metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+			}
+
+			for _, sample := range s.Samples {
+				if err := imp.add(&model.Sample{Metric: metric, Value: model.SampleValue(sample.Value), Timestamp: model.Time(sample.Timestamp)}); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := imp.flush(); err != nil {
+			return err
+		}
+
+		done := toTimestamp(maxt)
+		if done.After(end) {
+			done = end
+		}
+
+		progress(MigrationProgress{
+			Done:         done,
+			Start:        start,
+			End:          end,
+			Samples:      stats.Samples,
+			Transactions: stats.Transactions,
+		})
+		return nil
+	})
+}
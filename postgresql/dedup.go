@@ -0,0 +1,147 @@
+package pgprometheus
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Two HA Prometheus servers writing the same targets produce series that only
+// differ in a replica label, e.g. __replica__. Read-time deduplication strips
+// the replica labels and merges the series of each replica into one. The
+// merged series follows one replica as long as it has no gap longer than the
+// dedup window, and switches to the replica with the next sample after a gap,
+// so a restart of one Prometheus is filled in by the other without
+// interleaving the slightly shifted scrapes of both.
+
+func parseReplicaLabels(s string) []string {
+	var labels []string
+
+	for _, l := range strings.Split(s, ",") {
+		l = strings.TrimSpace(l)
+		if len(l) > 0 {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
+
+// dedupReplicas strips the replica labels from the series and merges the
+// series left with the same labels
+func dedupReplicas(series []*prompb.TimeSeries, replicaLabels []string, window time.Duration) []*prompb.TimeSeries {
+	replica := make(map[string]bool, len(replicaLabels))
+	for _, l := range replicaLabels {
+		replica[l] = true
+	}
+
+	// Sorted so that ties between replicas are always won by the same one
+	sort.Slice(series, func(i, j int) bool { return seriesKey(series[i].Labels) < seriesKey(series[j].Labels) })
+
+	var keys []string
+	groups := make(map[string][]*prompb.TimeSeries)
+
+	for _, ts := range series {
+		labels := make([]*prompb.Label, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			if !replica[l.Name] {
+				labels = append(labels, l)
+			}
+		}
+
+		ts.Labels = labels
+		key := seriesKey(labels)
+
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], ts)
+	}
+
+	deduped := make([]*prompb.TimeSeries, 0, len(groups))
+
+	for _, key := range keys {
+		group := groups[key]
+
+		if len(group) == 1 {
+			deduped = append(deduped, group[0])
+			continue
+		}
+
+		deduped = append(deduped, &prompb.TimeSeries{
+			Labels:  group[0].Labels,
+			Samples: mergeReplicas(group, window.Nanoseconds()/int64(time.Millisecond)),
+		})
+	}
+	return deduped
+}
+
+func seriesKey(labels []*prompb.Label) string {
+	var b strings.Builder
+
+	for _, l := range labels {
+		b.WriteString(l.Name)
+		b.WriteByte(0)
+		b.WriteString(l.Value)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// mergeReplicas merges the samples of the replicas of a series, following one
+// replica until it has a gap longer than window milliseconds
+func mergeReplicas(replicas []*prompb.TimeSeries, window int64) []*prompb.Sample {
+	next := make([]int, len(replicas))
+
+	for _, ts := range replicas {
+		samples := ts.Samples
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+	}
+
+	var merged []*prompb.Sample
+
+	current := -1
+	last := int64(math.MinInt64)
+
+	for {
+		// Skips the samples up to the last merged one in every replica
+		for r, ts := range replicas {
+			for next[r] < len(ts.Samples) && ts.Samples[next[r]].Timestamp <= last {
+				next[r]++
+			}
+		}
+
+		// Stays with the current replica unless it has a gap
+		if current < 0 || next[current] == len(replicas[current].Samples) ||
+			replicas[current].Samples[next[current]].Timestamp-last > window {
+			current = earliestReplica(replicas, next)
+		}
+
+		if current < 0 {
+			return merged
+		}
+
+		s := replicas[current].Samples[next[current]]
+		merged = append(merged, s)
+		last = s.Timestamp
+	}
+}
+
+// earliestReplica returns the replica with the earliest next sample, or -1 if
+// all replicas are exhausted
+func earliestReplica(replicas []*prompb.TimeSeries, next []int) int {
+	earliest := -1
+
+	for r, ts := range replicas {
+		if next[r] == len(ts.Samples) {
+			continue
+		}
+
+		if earliest < 0 || ts.Samples[next[r]].Timestamp < replicas[earliest].Samples[next[earliest]].Timestamp {
+			earliest = r
+		}
+	}
+	return earliest
+}
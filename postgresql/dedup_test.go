@@ -0,0 +1,103 @@
+package pgprometheus
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func replicaSeries(replica string, timestamps ...int64) *prompb.TimeSeries {
+	ts := &prompb.TimeSeries{
+		Labels: []*prompb.Label{
+			{Name: "__name__", Value: "up"},
+			{Name: "__replica__", Value: replica},
+			{Name: "job", Value: "node"},
+		},
+	}
+
+	for _, t := range timestamps {
+		ts.Samples = append(ts.Samples, &prompb.Sample{Timestamp: t, Value: float64(len(replica))})
+	}
+	return ts
+}
+
+func timestamps(samples []*prompb.Sample) []int64 {
+	var ts []int64
+	for _, s := range samples {
+		ts = append(ts, s.Timestamp)
+	}
+	return ts
+}
+
+func TestParseReplicaLabels(t *testing.T) {
+	if labels := parseReplicaLabels(" __replica__, ,prometheus "); !reflect.DeepEqual(labels, []string{"__replica__", "prometheus"}) {
+		t.Errorf("Unexpected replica labels %v", labels)
+	}
+
+	if labels := parseReplicaLabels(""); labels != nil {
+		t.Errorf("Expected no replica labels, got %v", labels)
+	}
+}
+
+func TestDedupReplicas(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		series     []*prompb.TimeSeries
+		timestamps []int64
+	}{
+		{
+			name:       "single replica",
+			series:     []*prompb.TimeSeries{replicaSeries("a", 0, 15000, 30000)},
+			timestamps: []int64{0, 15000, 30000},
+		},
+		{
+			name:       "shifted scrapes",
+			series:     []*prompb.TimeSeries{replicaSeries("a", 0, 15000, 30000), replicaSeries("b", 5000, 20000, 35000)},
+			timestamps: []int64{0, 15000, 30000, 35000},
+		},
+		{
+			name:       "gap filled by the other replica",
+			series:     []*prompb.TimeSeries{replicaSeries("a", 0, 15000, 180000, 195000), replicaSeries("b", 5000, 20000, 35000, 50000, 185000)},
+			timestamps: []int64{0, 15000, 20000, 35000, 50000, 180000, 195000},
+		},
+		{
+			name:       "one replica ends",
+			series:     []*prompb.TimeSeries{replicaSeries("a", 0, 15000), replicaSeries("b", 5000, 20000, 35000)},
+			timestamps: []int64{0, 15000, 20000, 35000},
+		},
+		{
+			name:       "unsorted samples",
+			series:     []*prompb.TimeSeries{replicaSeries("a", 30000, 0, 15000), replicaSeries("b")},
+			timestamps: []int64{0, 15000, 30000},
+		},
+	} {
+		deduped := dedupReplicas(c.series, []string{"__replica__"}, 30*time.Second)
+
+		if len(deduped) != 1 {
+			t.Fatalf("%s: expected one series, got %d", c.name, len(deduped))
+		}
+
+		for _, l := range deduped[0].Labels {
+			if l.Name == "__replica__" {
+				t.Errorf("%s: replica label not stripped", c.name)
+			}
+		}
+
+		if ts := timestamps(deduped[0].Samples); !reflect.DeepEqual(ts, c.timestamps) {
+			t.Errorf("%s: expected samples at %v, got %v", c.name, c.timestamps, ts)
+		}
+	}
+}
+
+func TestDedupReplicasKeepsOtherSeries(t *testing.T) {
+	other := replicaSeries("a", 0)
+	other.Labels[2].Value = "prometheus"
+
+	deduped := dedupReplicas([]*prompb.TimeSeries{replicaSeries("a", 0), replicaSeries("b", 0), other}, []string{"__replica__"}, time.Minute)
+
+	if len(deduped) != 2 {
+		t.Errorf("Expected two series, got %d", len(deduped))
+	}
+}
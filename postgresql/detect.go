@@ -0,0 +1,70 @@
+package pgprometheus
+
+import (
+	"database/sql"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// Managed PostgreSQL services (Aurora, AlloyDB, Azure, ...) only offer a
+// subset of extensions. With automatic storage selection the adapter probes
+// the server and picks the best storage mode it supports.
+
+// minDefaultPartitionVersion is the first server version with DEFAULT
+// partitions, which native partitioning relies on
+const minDefaultPartitionVersion = 110000
+
+// detectStorage selects the storage mode from the server version and the
+// available extensions
+func (c *Client) detectStorage(tx *sql.Tx) error {
+	var version int
+
+	err := tx.QueryRow("SELECT current_setting('server_version_num')::int").Scan(&version)
+
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT name FROM pg_available_extensions WHERE name IN ('pg_prometheus', 'timescaledb')")
+
+	if err != nil {
+		return err
+	}
+
+	extensions := make(map[string]bool)
+
+	for rows.Next() {
+		var name string
+
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		extensions[name] = true
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	c.selectStorage(version, extensions)
+
+	log.Info("msg", "Selected storage mode", "server_version", version, "pg_prometheus", c.cfg.usePgPrometheus,
+		"timescaledb", c.cfg.useTimescaleDb, "partitioning", c.cfg.partitioning)
+
+	return nil
+}
+
+// selectStorage prefers pg_prometheus, then the adapter-managed schema on
+// TimescaleDB, then natively partitioned tables, then plain tables
+func (c *Client) selectStorage(version int, extensions map[string]bool) {
+	c.cfg.usePgPrometheus = extensions["pg_prometheus"] && c.cfg.labelsFormat == labelsFormatJSONB &&
+		c.valueType() == valueTypes[valueTypeDouble]
+	c.cfg.useTimescaleDb = extensions["timescaledb"]
+	c.cfg.partitioning = ""
+
+	if !c.cfg.useTimescaleDb && !c.cfg.usePgPrometheus && version >= minDefaultPartitionVersion {
+		c.cfg.partitioning = partitioningNative
+	}
+}
@@ -0,0 +1,71 @@
+package pgprometheus
+
+import "testing"
+
+func TestSelectStorage(t *testing.T) {
+	testCases := []struct {
+		name         string
+		version      int
+		extensions   map[string]bool
+		labelsFormat string
+		valueType    string
+		pgPrometheus bool
+		timescaleDb  bool
+		partitioning string
+	}{
+		{
+			name:         "pg_prometheus and TimescaleDB",
+			version:      100000,
+			extensions:   map[string]bool{"pg_prometheus": true, "timescaledb": true},
+			labelsFormat: labelsFormatJSONB,
+			pgPrometheus: true,
+			timescaleDb:  true,
+		},
+		{
+			name:         "pg_prometheus with hstore labels",
+			version:      100000,
+			extensions:   map[string]bool{"pg_prometheus": true, "timescaledb": true},
+			labelsFormat: labelsFormatHstore,
+			timescaleDb:  true,
+		},
+		{
+			name:         "pg_prometheus with numeric values",
+			version:      100000,
+			extensions:   map[string]bool{"pg_prometheus": true, "timescaledb": true},
+			labelsFormat: labelsFormatJSONB,
+			valueType:    valueTypeNumeric,
+			timescaleDb:  true,
+		},
+		{
+			name:         "TimescaleDB only",
+			version:      120000,
+			extensions:   map[string]bool{"timescaledb": true},
+			labelsFormat: labelsFormatJSONB,
+			timescaleDb:  true,
+		},
+		{
+			name:         "no extensions",
+			version:      130000,
+			extensions:   map[string]bool{},
+			labelsFormat: labelsFormatJSONB,
+			partitioning: partitioningNative,
+		},
+		{
+			name:         "no extensions on an old server",
+			version:      100000,
+			extensions:   map[string]bool{},
+			labelsFormat: labelsFormatJSONB,
+		},
+	}
+
+	for _, tc := range testCases {
+		c := &Client{cfg: &Config{labelsFormat: tc.labelsFormat, valueType: tc.valueType, usePgPrometheus: true, useTimescaleDb: true, partitioning: partitioningPgPartman}}
+
+		c.selectStorage(tc.version, tc.extensions)
+
+		if c.cfg.usePgPrometheus != tc.pgPrometheus || c.cfg.useTimescaleDb != tc.timescaleDb || c.cfg.partitioning != tc.partitioning {
+			t.Errorf("%s: unexpected storage mode pg_prometheus=%v timescaledb=%v partitioning=%q",
+				tc.name, c.cfg.usePgPrometheus, c.cfg.useTimescaleDb, c.cfg.partitioning)
+		}
+	}
+}
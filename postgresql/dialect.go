@@ -0,0 +1,145 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+
+	"github.com/prometheus/common/model"
+)
+
+// Databases that speak the PostgreSQL wire protocol, but lack extensions,
+// temporary tables or COPY, are written to with multi-row INSERTs into the
+// adapter-managed schema. YugabyteDB supports temporary tables, but creating
+// one in every write transaction is a distributed catalog change, so it is
+// written to the same way.
+
+const (
+	dialectPostgreSQL  = "postgresql"
+	dialectCockroachDB = "cockroachdb"
+	dialectYugabyteDB  = "yugabytedb"
+
+	sqlInsertLabelsRows = "INSERT INTO %[1]s (metric_name, %[2]s) SELECT DISTINCT v.name, %[3]s FROM (VALUES %[4]s) AS v (name, labels) ON CONFLICT DO NOTHING"
+	sqlInsertValuesRows = "INSERT INTO %[1]s (time, value, labels_id) SELECT v.time, v.value, l.id FROM (VALUES %[3]s) AS v (time, value, name, labels) INNER JOIN %[2]s l ON l.metric_name = v.name AND (%[4]s) = (%[5]s)"
+)
+
+func (c *Client) validateDialect() error {
+	switch c.cfg.dialect {
+	case dialectPostgreSQL:
+		return nil
+	case dialectCockroachDB, dialectYugabyteDB:
+	default:
+		return fmt.Errorf("unknown dialect %q", c.cfg.dialect)
+	}
+
+	if c.cfg.usePgPrometheus || c.cfg.useTimescaleDb {
+		return fmt.Errorf("the %s dialect requires -pg.use-timescaledb=false and -pg.use-pg-prometheus=false", c.cfg.dialect)
+	}
+
+	if c.cfg.labelsFormat != labelsFormatJSONB {
+		return fmt.Errorf("the %s dialect only supports the %s labels format", c.cfg.dialect, labelsFormatJSONB)
+	}
+
+	if c.cfg.citus || c.cfg.partitioning == partitioningPgPartman {
+		return fmt.Errorf("the %s dialect does not support Citus or pg_partman", c.cfg.dialect)
+	}
+
+	if c.cfg.timeIndex != timeIndexBtree {
+		return fmt.Errorf("the %s dialect only supports btree time indexes", c.cfg.dialect)
+	}
+
+	if c.cfg.dialect == dialectCockroachDB {
+		if len(c.cfg.partitioning) > 0 || len(c.cfg.tablespace) > 0 || len(c.cfg.indexTablespace) > 0 {
+			return fmt.Errorf("the %s dialect does not support partitioning or tablespaces", c.cfg.dialect)
+		}
+
+		if c.cfg.labelsIndex == labelsIndexGinPath {
+			return fmt.Errorf("the %s dialect does not support %s indexes", c.cfg.dialect, labelsIndexGinPath)
+		}
+	}
+
+	if c.cfg.insertBatchSize < 0 {
+		return fmt.Errorf("the insert batch size must not be negative")
+	}
+
+	return nil
+}
+
+// insertBatchSize returns the max number of samples per multi-row INSERT.
+// YugabyteDB gets smaller batches, since every row written by a statement
+// adds to the distributed transaction's intents.
+func (c *Client) insertBatchSize() int {
+	if c.cfg.insertBatchSize > 0 {
+		return c.cfg.insertBatchSize
+	}
+	if c.cfg.dialect == dialectYugabyteDB {
+		return 250
+	}
+	return 1000
+}
+
+// useCopy returns whether samples are copied into a temporary table, rather
+// than inserted with multi-row INSERTs
+func (c *Client) useCopy() bool {
+	return c.cfg.dialect != dialectCockroachDB && c.cfg.dialect != dialectYugabyteDB
+}
+
+// writeInsertSamples inserts samples into the given adapter-managed table as
+// part of tx, without COPY or temporary tables
+func (c *Client) writeInsertSamples(ctx context.Context, tx *sql.Tx, table string, samples model.Samples) error {
+	format := c.labelsFormat()
+	batchSize := c.insertBatchSize()
+
+	for start := 0; start < len(samples); start += batchSize {
+		end := start + batchSize
+		if end > len(samples) {
+			end = len(samples)
+		}
+
+		batch := samples[start:end]
+		labelsRows := make([]string, 0, len(batch))
+		labelsArgs := make([]interface{}, 0, 2*len(batch))
+		valuesRows := make([]string, 0, len(batch))
+		valuesArgs := make([]interface{}, 0, 4*len(batch))
+
+		for _, sample := range batch {
+			labels, err := c.labels.intern(sample.Metric, labelsJSON)
+
+			if err != nil {
+				log.Error("msg", "Error encoding labels", "metric", sample.Metric, "err", err)
+				return err
+			}
+
+			if c.cfg.pgPrometheusLogSamples {
+				fmt.Println(metricString(sample.Metric), sample.Value, sample.Timestamp.UnixNano()/1000000)
+			}
+
+			name := string(sample.Metric[model.MetricNameLabel])
+			n := len(valuesArgs)
+
+			labelsRows = append(labelsRows, fmt.Sprintf("($%d::text, $%d::jsonb)", len(labelsArgs)+1, len(labelsArgs)+2))
+			labelsArgs = append(labelsArgs, name, labels)
+			valuesRows = append(valuesRows, fmt.Sprintf("($%d::timestamptz, $%d::float8, $%d::text, $%d::jsonb)", n+1, n+2, n+3, n+4))
+			valuesArgs = append(valuesArgs, sample.Timestamp.Time(), float64(sample.Value), name, labels)
+		}
+
+		_, err := tx.ExecContext(ctx, c.queryComment(endpointWrite)+fmt.Sprintf(sqlInsertLabelsRows, ident(table, "_labels"),
+			strings.Join(format.columns(), ", "), format.fromJSON("v.labels"), strings.Join(labelsRows, ", ")), labelsArgs...)
+		if err != nil {
+			log.Error("msg", "Error executing labels statement", "err", err)
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, c.queryComment(endpointWrite)+fmt.Sprintf(sqlInsertValuesRows, ident(table, "_values"), ident(table, "_labels"), strings.Join(valuesRows, ", "),
+			qualifiedColumns("l", format.columns()), format.fromJSON("v.labels")), valuesArgs...)
+		if err != nil {
+			log.Error("msg", "Error executing values statement", "err", err)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package pgprometheus
+
+import "testing"
+
+func TestValidateDialect(t *testing.T) {
+	testCases := []struct {
+		name  string
+		cfg   Config
+		valid bool
+	}{
+		{
+			name:  "postgresql",
+			cfg:   Config{dialect: dialectPostgreSQL, usePgPrometheus: true, useTimescaleDb: true},
+			valid: true,
+		},
+		{
+			name:  "cockroachdb",
+			cfg:   Config{dialect: dialectCockroachDB, labelsFormat: labelsFormatJSONB, timeIndex: timeIndexBtree, labelsIndex: labelsIndexGin, insertBatchSize: 100},
+			valid: true,
+		},
+		{
+			name: "cockroachdb with pg_prometheus",
+			cfg:  Config{dialect: dialectCockroachDB, usePgPrometheus: true, labelsFormat: labelsFormatJSONB, timeIndex: timeIndexBtree, labelsIndex: labelsIndexGin, insertBatchSize: 100},
+		},
+		{
+			name: "cockroachdb with hstore",
+			cfg:  Config{dialect: dialectCockroachDB, labelsFormat: labelsFormatHstore, timeIndex: timeIndexBtree, labelsIndex: labelsIndexGin, insertBatchSize: 100},
+		},
+		{
+			name: "cockroachdb with BRIN",
+			cfg:  Config{dialect: dialectCockroachDB, labelsFormat: labelsFormatJSONB, timeIndex: timeIndexBrin, labelsIndex: labelsIndexGin, insertBatchSize: 100},
+		},
+		{
+			name:  "yugabytedb with native partitioning",
+			cfg:   Config{dialect: dialectYugabyteDB, labelsFormat: labelsFormatJSONB, timeIndex: timeIndexBtree, labelsIndex: labelsIndexGinPath, partitioning: partitioningNative},
+			valid: true,
+		},
+		{
+			name: "cockroachdb with native partitioning",
+			cfg:  Config{dialect: dialectCockroachDB, labelsFormat: labelsFormatJSONB, timeIndex: timeIndexBtree, labelsIndex: labelsIndexGin, partitioning: partitioningNative},
+		},
+		{
+			name: "unknown",
+			cfg:  Config{dialect: "mysql"},
+		},
+	}
+
+	for _, tc := range testCases {
+		cfg := tc.cfg
+		c := &Client{cfg: &cfg}
+
+		err := c.validateDialect()
+
+		if tc.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestInsertBatchSize(t *testing.T) {
+	testCases := []struct {
+		cfg      Config
+		expected int
+	}{
+		{cfg: Config{dialect: dialectCockroachDB}, expected: 1000},
+		{cfg: Config{dialect: dialectYugabyteDB}, expected: 250},
+		{cfg: Config{dialect: dialectYugabyteDB, insertBatchSize: 50}, expected: 50},
+	}
+
+	for _, tc := range testCases {
+		cfg := tc.cfg
+		c := &Client{cfg: &cfg}
+
+		if size := c.insertBatchSize(); size != tc.expected {
+			t.Errorf("%s: expected batch size %d, got %d", cfg.dialect, tc.expected, size)
+		}
+	}
+}
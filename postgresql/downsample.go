@@ -0,0 +1,201 @@
+package pgprometheus
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+
+	"github.com/prometheus/common/model"
+)
+
+// Downsampling rolls the values table up into one table per resolution with
+// plain SQL, so it works on PostgreSQL without TimescaleDB. Buckets are only
+// rolled up once they are a full resolution in the past, and the progress of
+// each rollup is tracked in the downsample state table.
+
+const (
+	sqlCreateDownsampleState = "CREATE TABLE IF NOT EXISTS %s (rollup_table NAME PRIMARY KEY, done_until TIMESTAMPTZ NOT NULL)"
+	sqlCreateRollupTable     = "CREATE TABLE IF NOT EXISTS %s (time TIMESTAMPTZ NOT NULL, labels_id INTEGER NOT NULL, value DOUBLE PRECISION, min DOUBLE PRECISION, max DOUBLE PRECISION, count BIGINT NOT NULL, PRIMARY KEY (labels_id, time))"
+	sqlCreateRollupView      = "CREATE OR REPLACE VIEW %[1]s AS SELECT r.time, l.metric_name AS name, r.value, %[3]s AS labels, r.min, r.max, r.count FROM %[2]s r INNER JOIN %[4]s l ON l.id = r.labels_id"
+	sqlRollup                = `INSERT INTO %[1]s (time, labels_id, value, min, max, count)
+		SELECT to_timestamp(floor(extract(epoch FROM time) / %[3]d) * %[3]d) AS bucket, labels_id, avg(value), min(value), max(value), count(*)
+		FROM %[2]s WHERE time >= $1 AND time < $2 GROUP BY bucket, labels_id
+		ON CONFLICT (labels_id, time) DO UPDATE SET value = excluded.value, min = excluded.min, max = excluded.max, count = excluded.count`
+)
+
+func parseResolutions(s string) ([]time.Duration, error) {
+	var resolutions []time.Duration
+
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if len(r) == 0 {
+			continue
+		}
+
+		resolution, err := model.ParseDuration(r)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid downsampling resolution %q: %v", r, err)
+		}
+
+		if time.Duration(resolution) < time.Second || time.Duration(resolution)%time.Second != 0 {
+			return nil, fmt.Errorf("downsampling resolution %q must be a whole number of seconds", r)
+		}
+		resolutions = append(resolutions, time.Duration(resolution))
+	}
+	return resolutions, nil
+}
+
+func (c *Client) validateDownsampling() error {
+	resolutions, err := parseResolutions(c.cfg.downsampleResolutions)
+
+	if err != nil {
+		return err
+	}
+
+	if len(resolutions) > 0 && (!c.cfg.pgPrometheusNormalize || c.cfg.downsampleInterval <= 0) {
+		return fmt.Errorf("downsampling requires the normalized schema and a positive interval")
+	}
+
+	if c.cfg.downsamplePruneAfter > 0 && len(resolutions) == 0 {
+		return fmt.Errorf("pruning downsampled data requires downsampling resolutions")
+	}
+
+	c.resolutions = resolutions
+	return nil
+}
+
+// rollupTable returns the rollup table and view of the given resolution
+func rollupTable(table string, resolution time.Duration) (string, string) {
+	suffix := "_" + model.Duration(resolution).String()
+	return limitIdentifier(table+"_values", suffix), limitIdentifier(table, suffix)
+}
+
+// runDownsampling periodically rolls up complete buckets and prunes raw
+// samples that have been rolled up
+func (c *Client) runDownsampling() {
+	ticker := time.NewTicker(c.cfg.downsampleInterval)
+
+	for range ticker.C {
+		c.runJob("downsampling", c.cfg.downsampleInterval, func(begin time.Time) error {
+			err := c.downsample(begin)
+
+			if err != nil {
+				log.Error("msg", "Error downsampling", "err", err)
+				return err
+			}
+
+			log.Debug("msg", "Downsampled samples", "duration", time.Since(begin).Seconds())
+			return nil
+		})
+	}
+}
+
+func (c *Client) downsample(now time.Time) error {
+	tables := []string{c.cfg.table}
+
+	if c.cfg.tablePerMetric {
+		var err error
+		tables, err = c.lookupMetricTables(nil)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, table := range tables {
+		prunable := now.Add(-c.cfg.downsamplePruneAfter)
+
+		for _, resolution := range c.resolutions {
+			doneUntil, err := c.rollup(table, resolution, now)
+
+			if err != nil {
+				return err
+			}
+
+			if doneUntil.Before(prunable) {
+				prunable = doneUntil
+			}
+		}
+
+		if c.cfg.downsamplePruneAfter > 0 {
+			result, err := c.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE time < $1", ident(table, "_values")), prunable)
+
+			if err != nil {
+				return err
+			}
+
+			deleted, _ := result.RowsAffected()
+			log.Debug("msg", "Pruned downsampled samples", "table", table, "older_than", prunable, "count", deleted)
+		}
+	}
+	return nil
+}
+
+// rollup rolls up all complete buckets of the resolution since the last run
+// and returns the time until which the raw samples have been rolled up
+func (c *Client) rollup(table string, resolution time.Duration, now time.Time) (time.Time, error) {
+	rollupTable, rollupView := rollupTable(table, resolution)
+
+	tx, err := c.db.Begin()
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	defer tx.Rollback()
+
+	stmts := []string{
+		fmt.Sprintf(sqlCreateDownsampleState, ident(c.cfg.table, "_downsample_state")),
+		fmt.Sprintf(sqlCreateRollupTable, quoteIdent(rollupTable)),
+		fmt.Sprintf(sqlCreateRollupView, quoteIdent(rollupView), quoteIdent(rollupTable), c.labelsFormat().toJSON(), ident(table, "_labels")),
+	}
+
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(stmt); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	var from sql.NullString
+
+	err = tx.QueryRow(fmt.Sprintf("SELECT done_until FROM %s WHERE rollup_table = $1 FOR UPDATE", ident(c.cfg.table, "_downsample_state")), rollupTable).Scan(&from)
+
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow(fmt.Sprintf("SELECT min(time) FROM %s", ident(table, "_values"))).Scan(&from)
+	}
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// Leave one bucket of grace for samples that arrive late
+	until := now.Truncate(resolution).Add(-resolution)
+
+	if !from.Valid {
+		// Nothing to roll up yet
+		return until, tx.Commit()
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(sqlRollup, quoteIdent(rollupTable), ident(table, "_values"), int64(resolution.Seconds())), from.String, until)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO %s (rollup_table, done_until) VALUES ($1, $2)
+		ON CONFLICT (rollup_table) DO UPDATE SET done_until = excluded.done_until`, ident(c.cfg.table, "_downsample_state")), rollupTable, until)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return time.Time{}, err
+	}
+
+	return until, nil
+}
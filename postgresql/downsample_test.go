@@ -0,0 +1,33 @@
+package pgprometheus
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseResolutions(t *testing.T) {
+	resolutions, err := parseResolutions("5m, 1h,1d")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []time.Duration{5 * time.Minute, time.Hour, 24 * time.Hour}; !reflect.DeepEqual(resolutions, expected) {
+		t.Errorf("Expected %v, got %v", expected, resolutions)
+	}
+
+	for _, invalid := range []string{"5x", "0s", "1500ms"} {
+		if _, err := parseResolutions(invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+func TestRollupTable(t *testing.T) {
+	table, view := rollupTable("metrics", 5*time.Minute)
+
+	if table != "metrics_values_5m" || view != "metrics_5m" {
+		t.Errorf("Unexpected rollup table %s and view %s", table, view)
+	}
+}
@@ -0,0 +1,294 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/stdlib"
+	"github.com/lib/pq"
+)
+
+// The adapter talks to the database through database/sql with either lib/pq
+// or pgx. pgx supports SCRAM authentication and reports more error details,
+// but its database/sql driver cannot COPY FROM STDIN, so rows that would be
+// copied are inserted with multi-row INSERTs instead.
+//
+// PgBouncer in transaction pooling mode may run each round trip outside a
+// transaction on a different server connection, so in PgBouncer mode nothing
+// is prepared beyond a single round trip and rows are inserted rather than
+// copied.
+
+const (
+	driverPq  = "postgres"
+	driverPgx = "pgx"
+)
+
+var drivers = map[string]driver.Driver{
+	driverPq:  &pq.Driver{},
+	driverPgx: stdlib.GetDefaultDriver(),
+}
+
+// connector opens every connection with a connection string built for it,
+// e.g. to include an authentication token that expires
+type connector struct {
+	driver  driver.Driver
+	connStr func() (string, error)
+	// open opens a connection with a custom dialer, if set
+	open func(connStr string) (driver.Conn, error)
+	// hosts are tried in order, if set
+	hosts     []hostPort
+	readWrite bool
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	connStr, err := c.connStr()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.hosts) == 0 {
+		return c.connect(connStr)
+	}
+
+	var errs []string
+
+	for _, host := range c.hosts {
+		conn, err := c.connect(connStr + " " + host.connParams())
+
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", host, err))
+			continue
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("could not connect to any host: %s", strings.Join(errs, "; "))
+}
+
+func (c *connector) connect(connStr string) (driver.Conn, error) {
+	var conn driver.Conn
+	var err error
+
+	if c.open != nil {
+		conn, err = c.open(connStr)
+	} else {
+		conn, err = c.driver.Open(connStr)
+	}
+
+	if err != nil || !c.readWrite {
+		return conn, err
+	}
+
+	readOnly, err := isReadOnly(conn)
+
+	if err == nil && readOnly {
+		err = fmt.Errorf("the server only accepts read-only transactions")
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// openDB opens the database with the configured driver
+func openDB(cfg *Config, connStr string) (*sql.DB, error) {
+	drv, ok := drivers[cfg.driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown driver %q", cfg.driver)
+	}
+
+	var (
+		pgxConfig pgx.ConnConfig
+		password  func() (string, error)
+		open      func(connStr string) (driver.Conn, error)
+	)
+
+	// Sends queries with parameters without preparing them
+	pgxConfig.PreferSimpleProtocol = cfg.pgBouncer
+
+	if len(cfg.passwordFile) > 0 {
+		password = cfg.filePassword
+	}
+
+	if len(cfg.cloudSQLInstance) > 0 {
+		dialer, err := newCloudSQLDialer(cfg.cloudSQLInstance, cfg.cloudSQLIPType, cfg.cloudSQLIAMAuth)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pgxConfig.Dial = dialer.Dial
+		if cfg.driver == driverPq {
+			open = func(connStr string) (driver.Conn, error) {
+				return pq.DialOpen(dialer, connStr)
+			}
+		}
+
+		if cfg.cloudSQLIAMAuth {
+			password = dialer.password
+		}
+	}
+
+	switch cfg.targetSessionAttrs {
+	case targetSessionAny, targetSessionReadWrite:
+	default:
+		return nil, fmt.Errorf("unknown target session attributes %q", cfg.targetSessionAttrs)
+	}
+
+	if cfg.awsIAMAuth {
+		if len(cfg.url) > 0 || cfg.sslMode == "disable" || strings.Contains(cfg.host, ",") {
+			return nil, fmt.Errorf("RDS IAM authentication requires a single -pg.host instead of -pg.url, and a -pg.ssl-mode other than disable")
+		}
+
+		region, err := cfg.awsRegion()
+
+		if err != nil {
+			return nil, err
+		}
+
+		endpoint := net.JoinHostPort(cfg.host, strconv.Itoa(cfg.port))
+
+		password = func() (string, error) {
+			// Credentials are read on every connection, since they may be
+			// temporary as well
+			creds, err := awsEnvCredentials()
+
+			if err != nil {
+				return "", err
+			}
+			return rdsAuthToken(endpoint, region, cfg.user, creds, time.Now()), nil
+		}
+	}
+
+	if cfg.driver == driverPgx && (pgxConfig.PreferSimpleProtocol || pgxConfig.Dial != nil) {
+		driverConfig := &stdlib.DriverConfig{ConnConfig: pgxConfig}
+		stdlib.RegisterDriverConfig(driverConfig)
+		connStr = driverConfig.ConnectionString(connStr)
+	}
+
+	var hosts []hostPort
+
+	if len(cfg.url) == 0 && len(cfg.cloudSQLInstance) == 0 && strings.Contains(cfg.host, ",") {
+		var err error
+		hosts, err = parseHosts(cfg.host, cfg.port)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	readWrite := cfg.targetSessionAttrs == targetSessionReadWrite
+
+	if password == nil && open == nil && len(hosts) == 0 && !readWrite {
+		return sql.Open(cfg.driver, connStr)
+	}
+
+	return sql.OpenDB(&connector{
+		driver:    drv,
+		hosts:     hosts,
+		readWrite: readWrite,
+		connStr: func() (string, error) {
+			if password == nil {
+				return connStr, nil
+			}
+
+			p, err := password()
+
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s password=%s", connStr, quoteConnValue(p)), nil
+		},
+		open: open,
+	}), nil
+}
+
+// copyFrom writes rows into table as part of tx. The columns may be empty
+// to write all columns of the table.
+func (c *Client) copyFrom(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	begin := time.Now()
+	defer func() {
+		c.writeMetrics.copyDuration.Observe(time.Since(begin).Seconds())
+	}()
+
+	if c.cfg.driver != driverPgx && !c.cfg.pgBouncer {
+		return copyIn(ctx, tx, table, columns, rows)
+	}
+	return insertRows(ctx, tx, table, columns, rows, c.insertBatchSize())
+}
+
+// copyIn copies rows with COPY FROM STDIN. The driver encodes each value in
+// the COPY text format, escaping backslashes, tabs and newlines.
+func copyIn(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	stmt := fmt.Sprintf("COPY %s FROM STDIN", table)
+	if len(columns) > 0 {
+		stmt = fmt.Sprintf("COPY %s (%s) FROM STDIN", table, strings.Join(columns, ", "))
+	}
+
+	copyStmt, err := tx.PrepareContext(ctx, stmt)
+
+	if err != nil {
+		return &stmtError{msg: "error on COPY prepare", err: err}
+	}
+
+	defer copyStmt.Close()
+
+	for _, row := range rows {
+		if _, err = copyStmt.ExecContext(ctx, row...); err != nil {
+			return &stmtError{msg: "error executing COPY statement", err: err}
+		}
+	}
+
+	if _, err = copyStmt.ExecContext(ctx); err != nil {
+		return &stmtError{msg: "error executing COPY statement", err: err}
+	}
+
+	return copyStmt.Close()
+}
+
+func insertRows(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]interface{}, batchSize int) error {
+	var columnList string
+	if len(columns) > 0 {
+		columnList = fmt.Sprintf(" (%s)", strings.Join(columns, ", "))
+	}
+
+	for start := 0; start < len(rows); start += batchSize {
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		values := make([]string, 0, end-start)
+		var args []interface{}
+
+		for _, row := range rows[start:end] {
+			params := make([]string, len(row))
+			for i := range row {
+				params[i] = fmt.Sprintf("$%d", len(args)+i+1)
+			}
+			values = append(values, fmt.Sprintf("(%s)", strings.Join(params, ", ")))
+			args = append(args, row...)
+		}
+
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s%s VALUES %s", table, columnList, strings.Join(values, ", ")), args...)
+
+		if err != nil {
+			return &stmtError{msg: "error inserting rows into " + table, err: err}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package pgprometheus
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// Prometheus re-sends samples after failed writes, which the values tables
+// store again since they have no unique constraint. The duplicates are found
+// and removed one chunk interval at a time. Rows of the same series and time
+// share a chunk, so their ctid tells them apart; a higher ctid is usually a
+// later insert.
+
+const sqlDeleteDuplicates = `DELETE FROM %[1]s v USING (
+	SELECT ctid, labels_id, time, row_number() OVER (PARTITION BY labels_id, time ORDER BY ctid %[2]s) AS n
+	FROM %[1]s WHERE time >= $1 AND time < $2) d
+	WHERE d.n > 1 AND v.ctid = d.ctid AND v.labels_id = d.labels_id AND v.time = d.time`
+
+const sqlCountDuplicates = "SELECT count(*) - count(DISTINCT (labels_id, time)) FROM %s WHERE time >= $1 AND time < $2"
+
+// Vacuum modes after removing duplicates
+const (
+	VacuumNone  = ""
+	VacuumPlain = "plain"
+	// VacuumFull rewrites the tables to return the space to the operating
+	// system, and locks them meanwhile
+	VacuumFull = "full"
+)
+
+// DuplicateOptions control the removal of duplicate samples
+type DuplicateOptions struct {
+	// KeepLatest keeps the value inserted last instead of the first one
+	KeepLatest bool
+	// DryRun only counts the duplicates
+	DryRun bool
+	// Vacuum is the vacuum run on each table after removing duplicates
+	Vacuum string
+}
+
+// DuplicateStats are the duplicate samples of a table, and its size before
+// and after the vacuum
+type DuplicateStats struct {
+	Table       string
+	Duplicates  int64
+	BytesBefore int64
+	BytesAfter  int64
+}
+
+// RemoveDuplicates removes the rows with the same series and time as another
+// row from the values tables, keeping the first or the latest inserted, and
+// reports the space reclaimed by the vacuum if any. Compressed chunks must be
+// decompressed first. The tables of the tenant set with WithTenant are
+// deduplicated if any.
+func (c *Client) RemoveDuplicates(ctx context.Context, opts DuplicateOptions) ([]DuplicateStats, error) {
+	if tenant := TenantFromContext(ctx); len(tenant) > 0 && c.tenants != nil {
+		client, err := c.tenantClient(tenant)
+
+		if err != nil {
+			return nil, err
+		}
+		return client.RemoveDuplicates(ctx, opts)
+	}
+
+	if c.cfg.usePgPrometheus && !c.cfg.pgPrometheusNormalize {
+		return nil, fmt.Errorf("removing duplicates requires the normalized schema")
+	}
+
+	if opts.Vacuum != VacuumNone && opts.Vacuum != VacuumPlain && opts.Vacuum != VacuumFull {
+		return nil, fmt.Errorf("unknown vacuum %q", opts.Vacuum)
+	}
+
+	tables := []string{c.cfg.table}
+
+	if c.cfg.tablePerMetric {
+		var err error
+		tables, err = c.lookupMetricTables(nil)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var results []DuplicateStats
+
+	for _, table := range tables {
+		stats, err := c.removeDuplicates(ctx, c.samplesTable(table), opts)
+
+		if err != nil {
+			return results, err
+		}
+		results = append(results, *stats)
+	}
+	return results, nil
+}
+
+func (c *Client) removeDuplicates(ctx context.Context, table string, opts DuplicateOptions) (*DuplicateStats, error) {
+	before, err := c.tableStats(table)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &DuplicateStats{Table: table, BytesBefore: before.TotalBytes, BytesAfter: before.TotalBytes}
+
+	if before.Oldest == nil {
+		return stats, nil
+	}
+
+	order := "ASC"
+	if opts.KeepLatest {
+		order = "DESC"
+	}
+
+	for _, w := range importWindows(timestamp(*before.Oldest), timestamp(*before.Newest)+1, c.cfg.pgPrometheusChunkInterval) {
+		start, end := toTimestamp(w.start), toTimestamp(w.end)
+
+		var duplicates int64
+
+		if opts.DryRun {
+			err = c.db.QueryRowContext(ctx, fmt.Sprintf(sqlCountDuplicates, quoteIdent(table)), start, end).Scan(&duplicates)
+		} else {
+			duplicates, err = c.deleteDuplicates(ctx, fmt.Sprintf(sqlDeleteDuplicates, quoteIdent(table), order), start, end)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if duplicates > 0 {
+			log.Debug("msg", "Found duplicate samples", "table", table, "start", start, "end", end, "count", duplicates, "removed", !opts.DryRun)
+		}
+		stats.Duplicates += duplicates
+	}
+
+	if opts.DryRun || opts.Vacuum == VacuumNone {
+		return stats, nil
+	}
+
+	vacuum := "VACUUM ANALYZE " + quoteIdent(table)
+	if opts.Vacuum == VacuumFull {
+		vacuum = "VACUUM FULL ANALYZE " + quoteIdent(table)
+	}
+
+	if _, err = c.db.ExecContext(ctx, vacuum); err != nil {
+		return nil, err
+	}
+
+	after, err := c.tableStats(table)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stats.BytesAfter = after.TotalBytes
+	return stats, nil
+}
+
+func (c *Client) deleteDuplicates(ctx context.Context, query string, start, end time.Time) (int64, error) {
+	res, err := c.db.ExecContext(ctx, query, start, end)
+
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,20 @@
+package pgprometheus
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRemoveDuplicatesOptions(t *testing.T) {
+	c := &Client{cfg: &Config{table: "metrics", pgPrometheusNormalize: true}}
+
+	if _, err := c.RemoveDuplicates(context.Background(), DuplicateOptions{Vacuum: "analyze"}); err == nil {
+		t.Error("expected an unknown vacuum to fail")
+	}
+
+	c.cfg.usePgPrometheus, c.cfg.pgPrometheusNormalize = true, false
+
+	if _, err := c.RemoveDuplicates(context.Background(), DuplicateOptions{}); err == nil {
+		t.Error("expected the raw schema to fail")
+	}
+}
@@ -0,0 +1,346 @@
+package pgprometheus
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// With leader election, replicas of the adapter that receive the same samples
+// from a pair of HA Prometheus servers compete for a lock, and only the
+// replica holding it writes. The lock is either a session-level advisory lock
+// of the database, or a key in etcd or Consul bound to a lease or session
+// that expires when the leader stops renewing it, so that another replica
+// takes over within a few election intervals.
+
+const (
+	electionAdvisoryLock = "advisory-lock"
+	electionEtcd         = "etcd"
+	electionConsul       = "consul"
+
+	// A new leader writes all samples it receives, including those the
+	// previous leader may already have written
+	failoverAccept = "accept"
+	// A new leader drops samples older than its election, minus the scrape
+	// tolerance, which the previous leader has likely written
+	failoverDrop = "drop"
+)
+
+// LeaderStatus is the outcome of the leader election
+type LeaderStatus struct {
+	Leader bool `json:"leader"`
+	// Since is when the adapter last became the leader
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// elector elects the replica that writes samples
+type elector interface {
+	isLeader() bool
+	leaderSince() time.Time
+	leaderChanges() int64
+	// elect tries to become the leader, or checks that the lock is still
+	// held, and is called every election interval
+	elect() error
+	// resign gives up the lock after an error
+	resign()
+}
+
+func newElector(cfg *Config, db *sql.DB) (elector, error) {
+	if cfg.leaderElectionFailover != failoverAccept && cfg.leaderElectionFailover != failoverDrop {
+		return nil, fmt.Errorf("invalid leader election failover %q", cfg.leaderElectionFailover)
+	}
+
+	ttl := cfg.leaderElectionLease
+	if ttl == 0 {
+		ttl = electionTTL(cfg.leaderElectionInterval)
+	}
+
+	if ttl <= cfg.leaderElectionInterval {
+		return nil, fmt.Errorf("the leader election lease of %v must be longer than the election interval of %v", ttl, cfg.leaderElectionInterval)
+	}
+
+	switch cfg.leaderElectionBackend {
+	case electionAdvisoryLock:
+		return newAdvisoryLockElector(db, advisoryLockID(cfg.table), cfg.leaderElectionInterval), nil
+	case electionEtcd:
+		return newEtcdElector(cfg.leaderElectionEndpoint, electionKey(cfg.table), cfg.leaderElectionInterval, ttl)
+	case electionConsul:
+		if ttl < consulMinTTL {
+			return nil, fmt.Errorf("the leader election lease of %v is shorter than the minimum Consul session TTL of %v", ttl, consulMinTTL)
+		}
+		return newConsulElector(cfg.leaderElectionEndpoint, electionKey(cfg.table), cfg.leaderElectionInterval, ttl)
+	}
+	return nil, fmt.Errorf("invalid leader election backend %q", cfg.leaderElectionBackend)
+}
+
+func runElection(e elector, interval time.Duration) {
+	for {
+		if err := e.elect(); err != nil {
+			log.Warn("msg", "Error in leader election", "err", err)
+			e.resign()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// leaderState is the outcome of the last election
+type leaderState struct {
+	leader  int32
+	since   int64
+	changes int64
+}
+
+func (s *leaderState) isLeader() bool {
+	return atomic.LoadInt32(&s.leader) == 1
+}
+
+// leaderSince returns when the adapter last became the leader
+func (s *leaderState) leaderSince() time.Time {
+	since := atomic.LoadInt64(&s.since)
+
+	if since == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, since)
+}
+
+func (s *leaderState) leaderChanges() int64 {
+	return atomic.LoadInt64(&s.changes)
+}
+
+func (s *leaderState) setLeader(leader bool) {
+	var v int32
+	if leader {
+		v = 1
+		// Set before the leader flag, so that writes never see a leader
+		// without its election time
+		if atomic.LoadInt32(&s.leader) == 0 {
+			atomic.StoreInt64(&s.since, time.Now().UnixNano())
+		}
+	}
+
+	if atomic.SwapInt32(&s.leader, v) != v {
+		atomic.AddInt64(&s.changes, 1)
+		log.Info("msg", "Leader election changed", "leader", leader)
+	}
+}
+
+// advisoryLockElector elects a leader among replicas with pg_try_advisory_lock.
+// The lock is held on a connection reserved from the pool, so it is released
+// by the database as soon as the leader dies or loses its connection.
+type advisoryLockElector struct {
+	leaderState
+	db       *sql.DB
+	lockID   int64
+	interval time.Duration
+
+	conn *sql.Conn
+}
+
+// advisoryLockID derives the lock of replicas writing to the same table
+func advisoryLockID(table string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("prometheus-postgresql-adapter:" + table))
+	return int64(h.Sum64())
+}
+
+// electionKey is the etcd or Consul key of replicas writing to the same table
+func electionKey(table string) string {
+	return "prometheus-postgresql-adapter/" + table + "/leader"
+}
+
+func newAdvisoryLockElector(db *sql.DB, lockID int64, interval time.Duration) *advisoryLockElector {
+	return &advisoryLockElector{db: db, lockID: lockID, interval: interval}
+}
+
+func (e *advisoryLockElector) elect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), e.interval)
+	defer cancel()
+
+	if e.conn == nil {
+		conn, err := e.db.Conn(ctx)
+
+		if err != nil {
+			return err
+		}
+		e.conn = conn
+	}
+
+	if e.isLeader() {
+		_, err := e.conn.ExecContext(ctx, "SELECT 1")
+		return err
+	}
+
+	var locked bool
+
+	err := e.conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", e.lockID).Scan(&locked)
+
+	if err != nil {
+		return err
+	}
+
+	e.setLeader(locked)
+	return nil
+}
+
+// resign closes the connection, which releases the lock
+func (e *advisoryLockElector) resign() {
+	e.setLeader(false)
+
+	if e.conn != nil {
+		e.conn.Close()
+		e.conn = nil
+	}
+}
+
+// electionTTL is the default of how long the lock of a leader that stopped
+// renewing it outlives the leader
+func electionTTL(interval time.Duration) time.Duration {
+	ttl := 3 * interval
+
+	if ttl < consulMinTTL {
+		ttl = consulMinTTL
+	}
+	return ttl
+}
+
+// failoverCutoff returns the time before which samples are dropped, or the
+// zero time if all samples are written
+func failoverCutoff(e elector, failover string, tolerance time.Duration) time.Time {
+	if failover != failoverDrop {
+		return time.Time{}
+	}
+
+	since := e.leaderSince()
+
+	if since.IsZero() {
+		return since
+	}
+	return since.Add(-tolerance)
+}
+
+// dropBefore removes the samples older than cutoff, and returns the number of
+// removed samples
+func dropBefore(samples model.Samples, cutoff time.Time) (model.Samples, int) {
+	ts := model.TimeFromUnixNano(cutoff.UnixNano())
+
+	var kept model.Samples
+
+	for i, s := range samples {
+		if s.Timestamp >= ts {
+			if kept != nil {
+				kept = append(kept, s)
+			}
+			continue
+		}
+
+		// Only copies the samples once the first one is dropped
+		if kept == nil {
+			kept = make(model.Samples, i, len(samples))
+			copy(kept, samples[:i])
+		}
+	}
+
+	if kept == nil {
+		return samples, 0
+	}
+	return kept, len(samples) - len(kept)
+}
+
+// LeaderElection returns the outcome of the leader election, or nil if
+// leader election is disabled
+func (c *Client) LeaderElection() *LeaderStatus {
+	if c.elector == nil {
+		return nil
+	}
+
+	status := &LeaderStatus{Leader: c.elector.isLeader()}
+
+	if since := c.elector.leaderSince(); !since.IsZero() {
+		status.Since = &since
+	}
+	return status
+}
+
+// electionIdentity identifies the leader in the value of the key
+func electionIdentity() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// electionClient calls the JSON HTTP API of etcd or Consul
+type electionClient struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newElectionClient(endpoint string, interval time.Duration) (*electionClient, error) {
+	if len(endpoint) == 0 {
+		return nil, fmt.Errorf("the leader election endpoint is not set")
+	}
+
+	return &electionClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   &http.Client{Timeout: interval},
+	}, nil
+}
+
+func (c *electionClient) do(method, path string, body, v interface{}) error {
+	var data []byte
+
+	switch body := body.(type) {
+	case nil:
+	case []byte:
+		data = body
+	default:
+		var err error
+		data, err = json.Marshal(body)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.endpoint+path, bytes.NewReader(data))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	data, err = ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
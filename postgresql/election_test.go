@@ -0,0 +1,160 @@
+package pgprometheus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestAdvisoryLockID(t *testing.T) {
+	if advisoryLockID("metrics") != advisoryLockID("metrics") {
+		t.Error("expected the same lock for the same table")
+	}
+
+	if advisoryLockID("metrics") == advisoryLockID("other") {
+		t.Error("expected different locks for different tables")
+	}
+}
+
+func TestElectorLeader(t *testing.T) {
+	var e leaderState
+
+	if e.isLeader() || !e.leaderSince().IsZero() {
+		t.Error("expected to start as a follower")
+	}
+
+	e.setLeader(true)
+
+	if !e.isLeader() || e.leaderSince().IsZero() {
+		t.Error("expected to be the leader")
+	}
+
+	since := e.leaderSince()
+	e.setLeader(true)
+
+	if e.leaderSince() != since || e.leaderChanges() != 1 {
+		t.Errorf("expected staying the leader to keep the election time, got %v and %d changes", e.leaderSince(), e.leaderChanges())
+	}
+
+	e.setLeader(false)
+
+	if e.isLeader() {
+		t.Error("expected to be a follower")
+	}
+}
+
+func TestNewElector(t *testing.T) {
+	cfg := &Config{table: "metrics", leaderElectionInterval: time.Second, leaderElectionFailover: failoverAccept}
+
+	for backend, valid := range map[string]bool{
+		electionAdvisoryLock: true,
+		electionEtcd:         false,
+		electionConsul:       false,
+		"zookeeper":          false,
+	} {
+		cfg.leaderElectionBackend = backend
+
+		if _, err := newElector(cfg, nil); (err == nil) != valid {
+			t.Errorf("Unexpected error for backend %s without an endpoint: %v", backend, err)
+		}
+	}
+
+	cfg.leaderElectionEndpoint = "http://localhost:2379"
+
+	for _, backend := range []string{electionEtcd, electionConsul} {
+		cfg.leaderElectionBackend = backend
+
+		if _, err := newElector(cfg, nil); err != nil {
+			t.Errorf("Unexpected error for backend %s: %v", backend, err)
+		}
+	}
+}
+
+func TestNewElectorLease(t *testing.T) {
+	for _, c := range []struct {
+		backend string
+		lease   time.Duration
+		valid   bool
+	}{
+		{electionAdvisoryLock, 0, true},
+		{electionEtcd, 0, true},
+		{electionEtcd, 5 * time.Second, true},
+		{electionEtcd, time.Second, false},
+		{electionConsul, 10 * time.Second, true},
+		{electionConsul, 5 * time.Second, false},
+	} {
+		cfg := &Config{
+			table:                  "metrics",
+			leaderElectionBackend:  c.backend,
+			leaderElectionEndpoint: "http://localhost:2379",
+			leaderElectionInterval: time.Second,
+			leaderElectionLease:    c.lease,
+			leaderElectionFailover: failoverAccept,
+		}
+
+		if _, err := newElector(cfg, nil); (err == nil) != c.valid {
+			t.Errorf("Unexpected error for backend %s and lease %v: %v", c.backend, c.lease, err)
+		}
+	}
+
+	cfg := &Config{table: "metrics", leaderElectionBackend: electionAdvisoryLock, leaderElectionInterval: time.Second, leaderElectionFailover: "ignore"}
+
+	if _, err := newElector(cfg, nil); err == nil {
+		t.Error("Expected an error for an invalid failover")
+	}
+}
+
+func TestFailoverCutoff(t *testing.T) {
+	e := &advisoryLockElector{}
+
+	if cutoff := failoverCutoff(e, failoverDrop, time.Minute); !cutoff.IsZero() {
+		t.Errorf("Expected no cutoff before the election, got %v", cutoff)
+	}
+
+	e.setLeader(true)
+
+	if cutoff := failoverCutoff(e, failoverAccept, time.Minute); !cutoff.IsZero() {
+		t.Errorf("Expected no cutoff when accepting samples, got %v", cutoff)
+	}
+
+	if cutoff := failoverCutoff(e, failoverDrop, time.Minute); cutoff != e.leaderSince().Add(-time.Minute) {
+		t.Errorf("Unexpected cutoff %v, elected at %v", cutoff, e.leaderSince())
+	}
+}
+
+func TestDropBefore(t *testing.T) {
+	cutoff := time.Unix(100, 0)
+
+	samples := func(timestamps ...int64) model.Samples {
+		var s model.Samples
+		for _, ts := range timestamps {
+			s = append(s, &model.Sample{Timestamp: model.Time(ts * 1000)})
+		}
+		return s
+	}
+
+	for _, c := range []struct {
+		samples model.Samples
+		kept    int
+		dropped int
+	}{
+		{samples(), 0, 0},
+		{samples(100, 101), 2, 0},
+		{samples(99, 100, 98, 101), 2, 2},
+		{samples(101, 50), 1, 1},
+		{samples(1, 2), 0, 2},
+	} {
+		kept, dropped := dropBefore(c.samples, cutoff)
+
+		if len(kept) != c.kept || dropped != c.dropped {
+			t.Errorf("Expected %d kept and %d dropped samples, got %d and %d", c.kept, c.dropped, len(kept), dropped)
+		}
+
+		for _, s := range kept {
+			if s.Timestamp.Time().Before(cutoff) {
+				t.Errorf("Unexpected sample at %v kept", s.Timestamp)
+			}
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestAppendSampleLine(t *testing.T) {
+	values := []float64{0, 1, -1.5, 123.456, 1e-7, 1e21, math.MaxFloat64, math.Inf(1), math.Inf(-1), math.NaN()}
+
+	for _, v := range values {
+		expected := fmt.Sprintf("%v %v %v", "up{job=\"api\"}", model.SampleValue(v), int64(1234567))
+
+		if actual := string(appendSampleLine(nil, `up{job="api"}`, model.SampleValue(v), 1234567)); actual != expected {
+			t.Errorf("%v: expected %s, got %s", v, expected, actual)
+		}
+	}
+}
+
+func TestAppendMetric(t *testing.T) {
+	metric := model.Metric{model.MetricNameLabel: "up", "a0": "x", "a": "y", "b": `q"`}
+	expected := `up{a="y",a0="x",b="q\""}`
+
+	// Appends to what the buffer holds already
+	if actual := string(appendMetric([]byte("prefix "), metric)); actual != "prefix "+expected {
+		t.Errorf("expected prefix %s, got %s", expected, actual)
+	}
+}
@@ -0,0 +1,56 @@
+package pgprometheus
+
+import (
+	"strings"
+
+	"github.com/jackc/pgx"
+	"github.com/lib/pq"
+)
+
+// Failed writes are classified by the SQLSTATE of the database error, so that
+// the remote write endpoint can tell Prometheus whether to retry them.
+
+// stmtError is an error of the database annotated with the statement that
+// failed, keeping the error of the driver for its SQLSTATE
+type stmtError struct {
+	msg string
+	err error
+}
+
+func (e *stmtError) Error() string {
+	return e.msg + ": " + e.err.Error()
+}
+
+// sqlState returns the SQLSTATE of an error of the database, or an empty
+// string if err is not one
+func sqlState(err error) string {
+	if e, ok := err.(*stmtError); ok {
+		err = e.err
+	}
+
+	switch e := err.(type) {
+	case *pq.Error:
+		return string(e.Code)
+	case pgx.PgError:
+		return e.Code
+	case *pgx.PgError:
+		return e.Code
+	}
+	return ""
+}
+
+// IsInvalidData returns whether err means that the database rejected the
+// samples for their content, e.g. a character the database encoding lacks, so
+// that writing them again fails again. Integrity constraint violations, e.g.
+// unique violations of concurrent writes, may well succeed when retried.
+func IsInvalidData(err error) bool {
+	// data_exception
+	return strings.HasPrefix(sqlState(err), "22")
+}
+
+// IsOverloaded returns whether err means that the database is out of
+// connections, memory or disk space, so that writes should be retried later
+func IsOverloaded(err error) bool {
+	// insufficient_resources, including too_many_connections
+	return strings.HasPrefix(sqlState(err), "53")
+}
@@ -0,0 +1,42 @@
+package pgprometheus
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx"
+	"github.com/lib/pq"
+)
+
+func TestWriteErrorClasses(t *testing.T) {
+	testCases := []struct {
+		err         error
+		invalidData bool
+		overloaded  bool
+		connection  bool
+	}{
+		{err: &pq.Error{Code: "22003"}, invalidData: true},
+		{err: pgx.PgError{Code: "22P05"}, invalidData: true},
+		{err: &stmtError{msg: "error executing COPY statement", err: &pq.Error{Code: "22021"}}, invalidData: true},
+		{err: &pq.Error{Code: "23505"}},
+		{err: &pq.Error{Code: "53300"}, overloaded: true},
+		{err: &pgx.PgError{Code: "53100"}, overloaded: true},
+		{err: &stmtError{msg: "error on COPY prepare", err: &pq.Error{Code: "57P01"}}, connection: true},
+		{err: &stmtError{msg: "error on COPY prepare", err: driver.ErrBadConn}, connection: true},
+		{err: &pq.Error{Code: "42P01"}},
+		{err: fmt.Errorf("the tenant has no tables and auto-provisioning is disabled")},
+	}
+
+	for _, c := range testCases {
+		if actual := IsInvalidData(c.err); actual != c.invalidData {
+			t.Errorf("%v: expected invalid data %v, got %v", c.err, c.invalidData, actual)
+		}
+		if actual := IsOverloaded(c.err); actual != c.overloaded {
+			t.Errorf("%v: expected overloaded %v, got %v", c.err, c.overloaded, actual)
+		}
+		if actual := isConnectionError(c.err); actual != c.connection {
+			t.Errorf("%v: expected connection error %v, got %v", c.err, c.connection, actual)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package pgprometheus
+
+import (
+	"encoding/base64"
+	"strconv"
+	"time"
+)
+
+// The etcd elector uses the JSON gateway of the etcd v3 API. The leader key is
+// created in a transaction only if it does not exist, attached to a lease that
+// the leader keeps alive every election interval.
+
+type etcdElector struct {
+	leaderState
+	client   *electionClient
+	key      string
+	identity string
+	ttl      time.Duration
+
+	lease int64
+}
+
+func newEtcdElector(endpoint, key string, interval, ttl time.Duration) (*etcdElector, error) {
+	client, err := newElectionClient(endpoint, interval)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdElector{
+		client:   client,
+		key:      key,
+		identity: electionIdentity(),
+		ttl:      ttl,
+	}, nil
+}
+
+type etcdKeyValue struct {
+	Lease string `json:"lease"`
+}
+
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+	Responses []struct {
+		ResponseRange struct {
+			Kvs []etcdKeyValue `json:"kvs"`
+		} `json:"response_range"`
+	} `json:"responses"`
+}
+
+func (e *etcdElector) elect() error {
+	if e.lease == 0 {
+		var grant struct {
+			ID string `json:"ID"`
+		}
+
+		err := e.client.do("POST", "/v3/lease/grant", map[string]interface{}{"TTL": int64(e.ttl / time.Second)}, &grant)
+
+		if err != nil {
+			return err
+		}
+
+		if e.lease, err = strconv.ParseInt(grant.ID, 10, 64); err != nil {
+			return err
+		}
+	} else {
+		var keepAlive struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+
+		err := e.client.do("POST", "/v3/lease/keepalive", map[string]interface{}{"ID": e.leaseID()}, &keepAlive)
+
+		if err != nil {
+			return err
+		}
+
+		// An expired lease is kept alive with a TTL of 0
+		if ttl, _ := strconv.ParseInt(keepAlive.Result.TTL, 10, 64); ttl <= 0 {
+			e.lease = 0
+			e.setLeader(false)
+			return nil
+		}
+	}
+
+	key := base64.StdEncoding.EncodeToString([]byte(e.key))
+
+	txn := map[string]interface{}{
+		"compare": []interface{}{map[string]interface{}{
+			"key":             key,
+			"target":          "CREATE",
+			"result":          "EQUAL",
+			"create_revision": "0",
+		}},
+		"success": []interface{}{map[string]interface{}{
+			"request_put": map[string]interface{}{
+				"key":   key,
+				"value": base64.StdEncoding.EncodeToString([]byte(e.identity)),
+				"lease": e.leaseID(),
+			},
+		}},
+		"failure": []interface{}{map[string]interface{}{
+			"request_range": map[string]interface{}{"key": key},
+		}},
+	}
+
+	var resp etcdTxnResponse
+
+	if err := e.client.do("POST", "/v3/kv/txn", txn, &resp); err != nil {
+		return err
+	}
+
+	e.setLeader(resp.Succeeded || resp.heldBy(e.leaseID()))
+	return nil
+}
+
+// heldBy tells whether the existing key is attached to the lease
+func (r etcdTxnResponse) heldBy(lease string) bool {
+	for _, resp := range r.Responses {
+		for _, kv := range resp.ResponseRange.Kvs {
+			if kv.Lease == lease {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *etcdElector) leaseID() string {
+	return strconv.FormatInt(e.lease, 10)
+}
+
+// resign revokes the lease, which deletes the key
+func (e *etcdElector) resign() {
+	e.setLeader(false)
+
+	if e.lease != 0 {
+		e.client.do("POST", "/v3/lease/revoke", map[string]interface{}{"ID": e.leaseID()}, nil)
+		e.lease = 0
+	}
+}
@@ -0,0 +1,97 @@
+package pgprometheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd implements the lease and txn endpoints used by etcdElector
+type fakeEtcd struct {
+	mu     sync.Mutex
+	leases int
+	holder string
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var req map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	switch r.URL.Path {
+	case "/v3/lease/grant":
+		f.leases++
+		json.NewEncoder(w).Encode(map[string]string{"ID": fmt.Sprint(f.leases), "TTL": "10"})
+	case "/v3/lease/keepalive":
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]string{"ID": req["ID"].(string), "TTL": "10"}})
+	case "/v3/lease/revoke":
+		if f.holder == req["ID"] {
+			f.holder = ""
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{})
+	case "/v3/kv/txn":
+		if len(f.holder) == 0 {
+			put := req["success"].([]interface{})[0].(map[string]interface{})["request_put"].(map[string]interface{})
+			f.holder = put["lease"].(string)
+			json.NewEncoder(w).Encode(map[string]interface{}{"succeeded": true})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"responses": []interface{}{map[string]interface{}{
+				"response_range": map[string]interface{}{
+					"kvs": []interface{}{map[string]string{"lease": f.holder}},
+				},
+			}},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEtcdElector(t *testing.T) {
+	server := httptest.NewServer(&fakeEtcd{})
+	defer server.Close()
+
+	first, err := newEtcdElector(server.URL, electionKey("metrics"), time.Second, 10*time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := newEtcdElector(server.URL, electionKey("metrics"), time.Second, 10*time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		e      *etcdElector
+		resign bool
+		first  bool
+		second bool
+	}{
+		{e: first, first: true},
+		{e: second, first: true},
+		{e: first, first: true},
+		{e: first, resign: true},
+		{e: second, second: true},
+		{e: first, second: true},
+	} {
+		if step.resign {
+			step.e.resign()
+		} else if err := step.e.elect(); err != nil {
+			t.Fatal(err)
+		}
+
+		if first.isLeader() != step.first || second.isLeader() != step.second {
+			t.Errorf("Unexpected leaders %v and %v, expected %v and %v", first.isLeader(), second.isLeader(), step.first, step.second)
+		}
+	}
+}
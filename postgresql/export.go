@@ -0,0 +1,192 @@
+package pgprometheus
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// ParseSelector parses a series selector, e.g. up{job=~"node.*"}
+func ParseSelector(s string) ([]*prompb.LabelMatcher, error) {
+	p := &ruleParser{input: s}
+	p.skipSpace()
+
+	e, err := p.parseSelector(p.ident())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.skipSpace(); p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos:], p.pos)
+	}
+	return e.matchers, nil
+}
+
+// Export reads the samples of the series matching the matchers between start
+// and end, one window at a time so that large ranges are streamed, and calls fn
+// with the series of each window. Windows are aligned on their duration and
+// given as milliseconds, end excluded.
+func (c *Client) Export(ctx context.Context, matchers []*prompb.LabelMatcher, start, end time.Time, window time.Duration,
+	fn func(mint, maxt int64, series []*prompb.TimeSeries) error) error {
+	for _, w := range importWindows(timestamp(start), timestamp(end)+1, window) {
+		req := &prompb.ReadRequest{
+			Queries: []*prompb.Query{{StartTimestampMs: w.start, EndTimestampMs: w.end - 1, Matchers: matchers}},
+		}
+
+		resp, err := c.ReadContext(ctx, req)
+
+		if err != nil {
+			return err
+		}
+
+		series := resp.Results[0].Timeseries
+
+		if len(series) == 0 {
+			continue
+		}
+
+		sortSeries(series)
+
+		if err = fn(w.start, w.end, series); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortSeries sorts series by labels, and the samples of each series by time
+func sortSeries(series []*prompb.TimeSeries) {
+	for _, s := range series {
+		sort.Slice(s.Labels, func(i, j int) bool { return s.Labels[i].Name < s.Labels[j].Name })
+		sort.SliceStable(s.Samples, func(i, j int) bool { return s.Samples[i].Timestamp < s.Samples[j].Timestamp })
+	}
+
+	keys := make(map[*prompb.TimeSeries]string, len(series))
+	for _, s := range series {
+		keys[s] = seriesKey(s.Labels)
+	}
+
+	sort.Slice(series, func(i, j int) bool { return keys[series[i]] < keys[series[j]] })
+}
+
+// WriteOpenMetrics writes series in the OpenMetrics text format, without the
+// terminating # EOF
+func WriteOpenMetrics(w io.Writer, series []*prompb.TimeSeries) error {
+	bw := bufio.NewWriter(w)
+
+	for _, s := range series {
+		var (
+			name   string
+			labels []string
+		)
+
+		for _, l := range s.Labels {
+			if l.Name == "__name__" {
+				name = l.Value
+				continue
+			}
+			labels = append(labels, l.Name+`="`+escapeLabelValue(l.Value)+`"`)
+		}
+
+		prefix := name
+		if len(labels) > 0 {
+			prefix += "{" + strings.Join(labels, ",") + "}"
+		}
+
+		for _, sample := range s.Samples {
+			fmt.Fprintf(bw, "%s %s %s\n", prefix, formatValue(sample.Value), strconv.FormatFloat(float64(sample.Timestamp)/1000, 'f', -1, 64))
+		}
+	}
+	return bw.Flush()
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteBlock writes series as a Prometheus TSDB block covering the time range
+// of milliseconds [mint, maxt) in dir, and returns the ULID of the block
+func WriteBlock(ctx context.Context, dir string, mint, maxt int64, series []*prompb.TimeSeries) (string, error) {
+	// The head only accepts samples within half its chunk range of the newest
+	// sample
+	head, err := tsdb.NewHead(nil, nil, nil, 2*(maxt-mint)+1)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer head.Close()
+
+	app := head.Appender()
+
+	for _, s := range series {
+		lset := make([]labels.Label, 0, len(s.Labels))
+		for _, l := range s.Labels {
+			lset = append(lset, labels.Label{Name: l.Name, Value: l.Value})
+		}
+
+		var ref uint64
+
+		for _, sample := range s.Samples {
+			if sample.Timestamp < mint || sample.Timestamp >= maxt {
+				continue
+			}
+
+			if ref == 0 {
+				ref, err = app.Add(labels.New(lset...), sample.Timestamp, sample.Value)
+			} else {
+				err = app.AddFast(ref, sample.Timestamp, sample.Value)
+			}
+
+			if err == tsdb.ErrOutOfOrderSample || err == tsdb.ErrAmendSample {
+				// Duplicate timestamps are written once
+				continue
+			}
+
+			if err != nil {
+				app.Rollback()
+				return "", err
+			}
+		}
+	}
+
+	if err = app.Commit(); err != nil {
+		return "", err
+	}
+
+	compactor, err := tsdb.NewLeveledCompactor(ctx, nil, nil, []int64{maxt - mint}, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	id, err := compactor.Write(dir, head, mint, maxt, nil)
+
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
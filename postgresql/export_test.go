@@ -0,0 +1,167 @@
+package pgprometheus
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestParseSelector(t *testing.T) {
+	for i, c := range []struct {
+		selector string
+		expected []*prompb.LabelMatcher
+		err      bool
+	}{
+		{
+			selector: `up`,
+			expected: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+		},
+		{
+			selector: ` up{job=~"node.*", instance!="a"} `,
+			expected: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				{Type: prompb.LabelMatcher_RE, Name: "job", Value: "node.*"},
+				{Type: prompb.LabelMatcher_NEQ, Name: "instance", Value: "a"},
+			},
+		},
+		{
+			selector: `{__name__=~"node_.*"}`,
+			expected: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "node_.*"}},
+		},
+		{selector: ``, err: true},
+		{selector: `up{job="a"} or down`, err: true},
+		{selector: `sum(up)`, err: true},
+	} {
+		actual, err := ParseSelector(c.selector)
+
+		if c.err {
+			if err == nil {
+				t.Errorf("%d: expected an error, got %v", i, actual)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%d: unexpected error %v", i, err)
+		} else if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%d: expected %v, got %v", i, c.expected, actual)
+		}
+	}
+}
+
+func exportedSeries() []*prompb.TimeSeries {
+	return []*prompb.TimeSeries{
+		{
+			Labels:  []*prompb.Label{{Name: "job", Value: "b\"\n"}, {Name: "__name__", Value: "up"}},
+			Samples: []*prompb.Sample{{Timestamp: 2000, Value: 1}, {Timestamp: 1500, Value: 0}},
+		},
+		{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+			Samples: []*prompb.Sample{{Timestamp: 1000, Value: math.Inf(1)}},
+		},
+	}
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	series := exportedSeries()
+	sortSeries(series)
+
+	var buf bytes.Buffer
+	if err := WriteOpenMetrics(&buf, series); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `up{job="a"} +Inf 1
+up{job="b\"\n"} 0 1.5
+up{job="b\"\n"} 1 2
+`
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if _, err := parseSampleLine(line, FormatOpenMetrics); err != nil {
+			t.Errorf("expected exported line %q to be imported, got %v", line, err)
+		}
+	}
+}
+
+func TestWriteBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	series := exportedSeries()
+	sortSeries(series)
+
+	id, err := WriteBlock(context.Background(), dir, 0, 7200000, series)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := filepath.Join(dir, id)
+	if !IsBlock(block) {
+		t.Fatalf("expected a block in %s", block)
+	}
+
+	ir, err := index.NewFileReader(filepath.Join(block, "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ir.Close()
+
+	cr, err := chunks.NewDirReader(filepath.Join(block, "chunks"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+
+	b := &blockImport{importer: &importer{stats: &ImportStats{}}, index: ir, chunks: cr}
+
+	p, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p.Next() {
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		if err = ir.Series(p.At(), &lset, &chks); err != nil {
+			t.Fatal(err)
+		}
+		if err = b.importSeries(importWindow{0, 7200000}, lset, chks); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var actual []string
+	for _, s := range b.batch {
+		actual = append(actual, s.String())
+	}
+
+	expected := []string{
+		(&model.Sample{Metric: model.Metric{"__name__": "up", "job": "a"}, Value: model.SampleValue(math.Inf(1)), Timestamp: 1000}).String(),
+		(&model.Sample{Metric: model.Metric{"__name__": "up", "job": "b\"\n"}, Value: 0, Timestamp: 1500}).String(),
+		(&model.Sample{Metric: model.Metric{"__name__": "up", "job": "b\"\n"}, Value: 1, Timestamp: 2000}).String(),
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
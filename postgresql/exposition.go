@@ -0,0 +1,231 @@
+package pgprometheus
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// Formats of the text files read by ImportText
+const (
+	// FormatOpenMetrics has timestamps in seconds and ends with # EOF
+	FormatOpenMetrics = "openmetrics"
+	// FormatPrometheus is the Prometheus text format, with timestamps in
+	// milliseconds
+	FormatPrometheus = "prometheus"
+)
+
+// maxLineLength is the longest exposition line ImportText reads
+const maxLineLength = 1 << 20
+
+// ImportText bulk-loads the samples of an OpenMetrics or Prometheus text file.
+// Every sample must have a timestamp. Samples are written in transactions of
+// up to BatchSize samples, and samples older than the retention of their
+// metric are skipped.
+func (c *Client) ImportText(ctx context.Context, r io.Reader, format string, opts ImportOptions) (*ImportStats, error) {
+	if format != FormatOpenMetrics && format != FormatPrometheus {
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	stats := &ImportStats{}
+	imp := c.newImporter(ctx, opts, stats)
+	series := make(map[model.Fingerprint]struct{})
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+
+		if format == FormatOpenMetrics && text == "# EOF" {
+			break
+		}
+
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+
+		sample, err := parseSampleLine(text, format)
+
+		if err != nil {
+			return stats, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		ts := sample.Timestamp.Time()
+
+		if (!opts.MinTime.IsZero() && ts.Before(opts.MinTime)) || (!opts.MaxTime.IsZero() && ts.After(opts.MaxTime)) {
+			continue
+		}
+
+		if oldest, ok := imp.oldest(sample.Metric); ok && int64(sample.Timestamp) < oldest {
+			stats.Expired++
+			continue
+		}
+
+		fp := sample.Metric.Fingerprint()
+
+		if _, ok := series[fp]; !ok {
+			series[fp] = struct{}{}
+			stats.Series++
+		}
+
+		if stats.MinTime.IsZero() || ts.Before(stats.MinTime) {
+			stats.MinTime = ts
+		}
+		if ts.After(stats.MaxTime) {
+			stats.MaxTime = ts
+		}
+
+		if err = imp.add(sample); err != nil {
+			return stats, err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+	return stats, imp.flush()
+}
+
+// parseSampleLine parses a sample line of the text format, e.g.
+// http_requests_total{method="post",code="200"} 1027 1395066363000
+// OpenMetrics exemplars are ignored.
+func parseSampleLine(line, format string) (*model.Sample, error) {
+	end := strings.IndexAny(line, "{ \t")
+
+	if end < 0 {
+		return nil, fmt.Errorf("missing value")
+	}
+
+	name := line[:end]
+
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return nil, fmt.Errorf("invalid metric name %q", name)
+	}
+
+	metric := model.Metric{model.MetricNameLabel: model.LabelValue(name)}
+	rest := line[end:]
+
+	if rest[0] == '{' {
+		var err error
+
+		if rest, err = parseLabels(rest[1:], metric); err != nil {
+			return nil, err
+		}
+	}
+
+	if i := strings.Index(rest, " # "); i >= 0 && format == FormatOpenMetrics {
+		rest = rest[:i]
+	}
+
+	fields := strings.Fields(rest)
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing value")
+	}
+
+	if len(fields) == 1 {
+		return nil, fmt.Errorf("missing timestamp")
+	}
+
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("unexpected %q after the timestamp", fields[2])
+	}
+
+	value, err := strconv.ParseFloat(fields[0], 64)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", fields[0])
+	}
+
+	var ts int64
+
+	if format == FormatOpenMetrics {
+		var seconds float64
+		seconds, err = strconv.ParseFloat(fields[1], 64)
+		ts = int64(math.Round(seconds * 1000))
+	} else {
+		ts, err = strconv.ParseInt(fields[1], 10, 64)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q", fields[1])
+	}
+
+	return &model.Sample{Metric: metric, Value: model.SampleValue(value), Timestamp: model.Time(ts)}, nil
+}
+
+// parseLabels parses the labels following the opening brace into metric and
+// returns what follows the closing brace
+func parseLabels(s string, metric model.Metric) (string, error) {
+	for {
+		s = strings.TrimLeft(s, " \t,")
+
+		if len(s) == 0 {
+			return "", fmt.Errorf("unterminated labels")
+		}
+
+		if s[0] == '}' {
+			return s[1:], nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+
+		if eq < 0 || eq+1 >= len(s) || s[eq+1] != '"' {
+			return "", fmt.Errorf("invalid labels %q", s)
+		}
+
+		name := model.LabelName(strings.TrimSpace(s[:eq]))
+
+		if !name.IsValid() || name == model.MetricNameLabel {
+			return "", fmt.Errorf("invalid label name %q", name)
+		}
+
+		if _, ok := metric[name]; ok {
+			return "", fmt.Errorf("duplicate label %q", name)
+		}
+
+		var (
+			value   strings.Builder
+			escaped bool
+			closed  = -1
+		)
+
+		for i := eq + 2; i < len(s); i++ {
+			c := s[i]
+
+			switch {
+			case escaped && c == 'n':
+				value.WriteByte('\n')
+			case escaped:
+				value.WriteByte(c)
+			case c == '\\':
+				escaped = true
+				continue
+			case c == '"':
+				closed = i
+			default:
+				value.WriteByte(c)
+			}
+
+			escaped = false
+
+			if closed >= 0 {
+				break
+			}
+		}
+
+		if closed < 0 {
+			return "", fmt.Errorf("unterminated value of label %q", name)
+		}
+
+		metric[name] = model.LabelValue(value.String())
+		s = s[closed+1:]
+	}
+}
@@ -0,0 +1,59 @@
+package pgprometheus
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestParseSampleLine(t *testing.T) {
+	for i, c := range []struct {
+		line     string
+		format   string
+		expected *model.Sample
+		err      bool
+	}{
+		{
+			line:     `http_requests_total{method="post",code="200"} 1027 1395066363000`,
+			format:   FormatPrometheus,
+			expected: &model.Sample{Metric: model.Metric{"__name__": "http_requests_total", "method": "post", "code": "200"}, Value: 1027, Timestamp: 1395066363000},
+		},
+		{
+			line:     `up 1 1395066363.5`,
+			format:   FormatOpenMetrics,
+			expected: &model.Sample{Metric: model.Metric{"__name__": "up"}, Value: 1, Timestamp: 1395066363500},
+		},
+		{
+			line:     `foo_total{path="a \"b\"\\c\nd",} +Inf 1395066363 # {trace_id="abc"} 1 1395066363`,
+			format:   FormatOpenMetrics,
+			expected: &model.Sample{Metric: model.Metric{"__name__": "foo_total", "path": "a \"b\"\\c\nd"}, Value: model.SampleValue(math.Inf(1)), Timestamp: 1395066363000},
+		},
+		{line: `up 1`, format: FormatPrometheus, err: true},
+		{line: `up{job="a",job="b"} 1 1`, format: FormatPrometheus, err: true},
+		{line: `up{job="a} 1 1`, format: FormatPrometheus, err: true},
+		{line: `up{0job="a"} 1 1`, format: FormatPrometheus, err: true},
+		{line: `0up 1 1`, format: FormatPrometheus, err: true},
+		{line: `up one 1`, format: FormatPrometheus, err: true},
+		{line: `up 1 1.5`, format: FormatPrometheus, err: true},
+		{line: `up 1 1 1`, format: FormatPrometheus, err: true},
+	} {
+		actual, err := parseSampleLine(c.line, c.format)
+
+		if c.err {
+			if err == nil {
+				t.Errorf("%d: expected an error, got %v", i, actual)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%d: unexpected error %v", i, err)
+			continue
+		}
+
+		if !actual.Equal(c.expected) {
+			t.Errorf("%d: expected %v, got %v", i, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package pgprometheus
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+var validOptionName = regexp.MustCompile("^[a-z_][a-z0-9_]*$")
+
+// checkPgPrometheus detects the installed pg_prometheus version, updates it
+// if allowed, and records the arguments its create_prometheus_table accepts,
+// which differ between versions.
+func (c *Client) checkPgPrometheus(tx *sql.Tx) error {
+	var installed, available string
+
+	err := tx.QueryRow(`SELECT e.extversion, a.default_version FROM pg_extension e
+		INNER JOIN pg_available_extensions a ON a.name = e.extname
+		WHERE e.extname = 'pg_prometheus'`).Scan(&installed, &available)
+
+	if err != nil {
+		return fmt.Errorf("could not determine the pg_prometheus version: %v", err)
+	}
+
+	if compareVersions(installed, available) < 0 {
+		if !c.cfg.pgPrometheusUpgrade {
+			log.Warn("msg", "A newer pg_prometheus version is available, enable -pg.prometheus-upgrade to update", "installed", installed, "available", available)
+		} else {
+			_, err = tx.Exec("ALTER EXTENSION pg_prometheus UPDATE")
+
+			if err != nil {
+				return fmt.Errorf("could not update pg_prometheus from %s to %s: %v", installed, available, err)
+			}
+
+			log.Info("msg", "Updated pg_prometheus", "from", installed, "to", available)
+			installed = available
+		}
+	}
+
+	rows, err := tx.Query("SELECT DISTINCT unnest(proargnames) FROM pg_proc WHERE proname = 'create_prometheus_table'")
+
+	if err != nil {
+		return err
+	}
+
+	args := make(map[string]bool)
+
+	for rows.Next() {
+		var arg string
+
+		if err = rows.Scan(&arg); err != nil {
+			rows.Close()
+			return err
+		}
+		args[arg] = true
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("pg_prometheus %s does not provide create_prometheus_table", installed)
+	}
+
+	c.pgPrometheusVersion = installed
+	c.createTableArgs = args
+
+	log.Info("msg", "Using pg_prometheus", "version", installed)
+
+	return nil
+}
+
+// createTableCall returns the call of create_prometheus_table for the given
+// table, with the named arguments that the installed version supports.
+// Options passed through with -pg.prometheus-table-options must be
+// supported.
+func (c *Client) createTableCall(table string) (string, []interface{}, error) {
+	named := []struct {
+		name  string
+		value interface{}
+		cast  string
+		set   bool
+	}{
+		{"normalized_tables", c.cfg.pgPrometheusNormalize, "", true},
+		{"chunk_time_interval", c.cfg.pgPrometheusChunkInterval.String(), "::interval", true},
+		{"use_timescaledb", c.cfg.useTimescaleDb, "", true},
+		{"number_partitions", c.cfg.pgPrometheusPartitions, "", c.cfg.pgPrometheusPartitions > 0},
+		{"replication_factor", c.cfg.replicationFactor, "", c.cfg.replicationFactor > 1},
+	}
+
+	params := []string{"$1"}
+	args := []interface{}{table}
+
+	for _, arg := range named {
+		if !arg.set {
+			continue
+		}
+
+		if !c.supportsTableArg(arg.name) {
+			log.Warn("msg", "The installed pg_prometheus does not support an option, ignoring it", "version", c.pgPrometheusVersion, "option", arg.name)
+			continue
+		}
+
+		args = append(args, arg.value)
+		params = append(params, fmt.Sprintf("%s => $%d%s", arg.name, len(args), arg.cast))
+	}
+
+	options, err := parseTableOptions(c.cfg.pgPrometheusTableOptions)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !c.supportsTableArg(name) {
+			return "", nil, fmt.Errorf("pg_prometheus %s does not support the create_prometheus_table option %s", c.pgPrometheusVersion, name)
+		}
+
+		args = append(args, options[name])
+		params = append(params, fmt.Sprintf("%s => $%d", name, len(args)))
+	}
+
+	return fmt.Sprintf("SELECT create_prometheus_table(%s)", strings.Join(params, ", ")), args, nil
+}
+
+// supportsTableArg returns whether create_prometheus_table takes the named
+// argument. All arguments are assumed to be supported if the version has
+// not been checked.
+func (c *Client) supportsTableArg(name string) bool {
+	return c.createTableArgs == nil || c.createTableArgs[name]
+}
+
+// parseTableOptions parses comma-separated name=value pairs
+func parseTableOptions(s string) (map[string]string, error) {
+	options := make(map[string]string)
+
+	for _, option := range strings.Split(s, ",") {
+		option = strings.TrimSpace(option)
+		if len(option) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(option, "=", 2)
+		name := strings.TrimSpace(parts[0])
+
+		if len(parts) != 2 || !validOptionName.MatchString(name) {
+			return nil, fmt.Errorf("invalid create_prometheus_table option %q, expected name=value", option)
+		}
+
+		switch name {
+		case "table_name", "normalized_tables", "chunk_time_interval", "use_timescaledb", "number_partitions", "replication_factor":
+			return nil, fmt.Errorf("the create_prometheus_table option %s is set by its own flag", name)
+		}
+		options[name] = strings.TrimSpace(parts[1])
+	}
+	return options, nil
+}
+
+// compareVersions compares dotted version numbers, treating non-numeric
+// parts as 0
+func compareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,82 @@
+package pgprometheus
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompareVersions(t *testing.T) {
+	testCases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"0.2", "0.2.0", 0},
+		{"0.0.1", "0.2", -1},
+		{"0.2.2", "0.2.1", 1},
+		{"0.10", "0.9", 1},
+	}
+
+	for _, tc := range testCases {
+		if result := compareVersions(tc.a, tc.b); result != tc.expected {
+			t.Errorf("compareVersions(%s, %s): expected %d, got %d", tc.a, tc.b, tc.expected, result)
+		}
+	}
+}
+
+func TestCreateTableCall(t *testing.T) {
+	c := &Client{
+		cfg: &Config{pgPrometheusNormalize: true, pgPrometheusChunkInterval: time.Hour, useTimescaleDb: true},
+		createTableArgs: map[string]bool{
+			"table_name":        true,
+			"normalized_tables": true,
+			"use_timescaledb":   true,
+		},
+	}
+
+	call, args, err := c.createTableCall("metrics")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "SELECT create_prometheus_table($1, normalized_tables => $2, use_timescaledb => $3)"; call != expected {
+		t.Errorf("Expected %q, got %q", expected, call)
+	}
+
+	if expected := []interface{}{"metrics", true, true}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected arguments %v, got %v", expected, args)
+	}
+}
+
+func TestCreateTableCallOptions(t *testing.T) {
+	c := &Client{
+		cfg: &Config{pgPrometheusNormalize: true, pgPrometheusChunkInterval: time.Hour, pgPrometheusPartitions: 4,
+			pgPrometheusTableOptions: "keep_samples=false"},
+	}
+
+	call, args, err := c.createTableCall("metrics")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "SELECT create_prometheus_table($1, normalized_tables => $2, chunk_time_interval => $3::interval, use_timescaledb => $4, number_partitions => $5, keep_samples => $6)"
+	if call != expected {
+		t.Errorf("Expected %q, got %q", expected, call)
+	}
+	if len(args) != 6 || args[5] != "false" {
+		t.Errorf("Unexpected arguments %v", args)
+	}
+
+	c.createTableArgs = map[string]bool{"table_name": true}
+	if _, _, err = c.createTableCall("metrics"); err == nil {
+		t.Error("Expected an error for an unsupported option")
+	}
+
+	for _, invalid := range []string{"keep_samples", "chunk_time_interval=1h", "bad name=1"} {
+		if _, err := parseTableOptions(invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
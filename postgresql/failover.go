@@ -0,0 +1,100 @@
+package pgprometheus
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Like libpq, the adapter accepts a list of hosts and tries them in order
+// for every new connection. With target_session_attrs=read-write, hosts that
+// only accept read-only transactions, i.e. standbys, are skipped, so that
+// new connections follow the primary after a failover.
+
+const (
+	targetSessionAny       = "any"
+	targetSessionReadWrite = "read-write"
+)
+
+type hostPort struct {
+	host string
+	port int
+}
+
+// parseHosts parses a comma-separated list of hosts, each optionally with
+// its own port
+func parseHosts(hosts string, defaultPort int) ([]hostPort, error) {
+	var parsed []hostPort
+
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		port := defaultPort
+
+		if len(host) == 0 {
+			return nil, fmt.Errorf("empty host in %q", hosts)
+		}
+
+		// Unix socket directories are never followed by a port
+		if !strings.HasPrefix(host, "/") && strings.Contains(host, ":") {
+			h, p, err := net.SplitHostPort(host)
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid host %q: %v", host, err)
+			}
+
+			if port, err = strconv.Atoi(p); err != nil {
+				return nil, fmt.Errorf("invalid port of host %q", host)
+			}
+			host = h
+		}
+
+		parsed = append(parsed, hostPort{host, port})
+	}
+	return parsed, nil
+}
+
+func (h hostPort) connParams() string {
+	return fmt.Sprintf("host=%s port=%d", quoteConnValue(h.host), h.port)
+}
+
+func (h hostPort) String() string {
+	return net.JoinHostPort(h.host, strconv.Itoa(h.port))
+}
+
+// isReadOnly returns whether the connection only accepts read-only
+// transactions
+func isReadOnly(conn driver.Conn) (bool, error) {
+	queryer, ok := conn.(driver.Queryer)
+
+	if !ok {
+		return false, fmt.Errorf("the driver does not support checking target_session_attrs")
+	}
+
+	rows, err := queryer.Query("SHOW transaction_read_only", nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer rows.Close()
+
+	dest := make([]driver.Value, 1)
+
+	if err = rows.Next(dest); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("no transaction_read_only setting")
+		}
+		return false, err
+	}
+
+	switch v := dest[0].(type) {
+	case []byte:
+		return string(v) == "on", nil
+	case string:
+		return v == "on", nil
+	}
+	return false, fmt.Errorf("unexpected transaction_read_only value %v", dest[0])
+}
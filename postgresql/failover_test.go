@@ -0,0 +1,37 @@
+package pgprometheus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHosts(t *testing.T) {
+	testCases := []struct {
+		hosts    string
+		expected []hostPort
+		err      bool
+	}{
+		{hosts: "localhost", expected: []hostPort{{"localhost", 5432}}},
+		{hosts: "pg1, pg2:5433", expected: []hostPort{{"pg1", 5432}, {"pg2", 5433}}},
+		{hosts: "[::1]:5433,/var/run/postgresql", expected: []hostPort{{"::1", 5433}, {"/var/run/postgresql", 5432}}},
+		{hosts: "pg1,", err: true},
+		{hosts: "pg1:port", err: true},
+	}
+
+	for _, c := range testCases {
+		hosts, err := parseHosts(c.hosts, 5432)
+
+		if c.err {
+			if err == nil {
+				t.Errorf("Expected an error for %s", c.hosts)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", c.hosts, err)
+		} else if !reflect.DeepEqual(hosts, c.expected) {
+			t.Errorf("Expected %v for %s, got %v", c.expected, c.hosts, hosts)
+		}
+	}
+}
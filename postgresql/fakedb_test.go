@@ -0,0 +1,176 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+)
+
+// fakeDB is a database/sql driver for tests, which executes statements with
+// exec and answers queries with query, and counts the statements prepared and
+// closed
+type fakeDB struct {
+	exec  func(query string, args []driver.Value) error
+	query func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error)
+
+	mu       sync.Mutex
+	prepared map[string]int
+	closed   int
+	execs    []string
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{prepared: make(map[string]int)}
+}
+
+// open opens the database, with a pool of up to maxOpenConns connections
+func (f *fakeDB) open(maxOpenConns int) *sql.DB {
+	db := sql.OpenDB(f)
+	db.SetMaxOpenConns(maxOpenConns)
+	return db
+}
+
+func (f *fakeDB) preparedCount(query string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.prepared[query]
+}
+
+func (f *fakeDB) closedCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *fakeDB) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeConn{db: f}, nil
+}
+
+func (f *fakeDB) Driver() driver.Driver {
+	return f
+}
+
+func (f *fakeDB) Open(name string) (driver.Conn, error) {
+	return &fakeConn{db: f}, nil
+}
+
+func (f *fakeDB) execQuery(query string, args []driver.Value) (driver.Result, error) {
+	f.mu.Lock()
+	f.execs = append(f.execs, query)
+	f.mu.Unlock()
+
+	if f.exec != nil {
+		if err := f.exec(query, args); err != nil {
+			return nil, err
+		}
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (f *fakeDB) queryRows(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+	if f.query == nil {
+		return &fakeRows{}, nil
+	}
+	return f.query(ctx, query, args)
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	c.db.mu.Lock()
+	c.db.prepared[query]++
+	c.db.mu.Unlock()
+
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.db.execQuery(query, values(args))
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.db.queryRows(ctx, query, values(args))
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	s.db.mu.Lock()
+	s.db.closed++
+	s.db.mu.Unlock()
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.db.execQuery(s.query, args)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("use QueryContext")
+}
+
+func (s *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.db.queryRows(ctx, s.query, values(args))
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error {
+	return nil
+}
+
+func (fakeTx) Rollback() error {
+	return nil
+}
+
+// fakeRows are the rows of a query, each with the values of columns
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func values(args []driver.NamedValue) []driver.Value {
+	vals := make([]driver.Value, len(args))
+	for i, arg := range args {
+		vals[i] = arg.Value
+	}
+	return vals
+}
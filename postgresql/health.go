@@ -0,0 +1,140 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// database/sql only discards connections the driver reports as broken. After
+// the database restarts or fails over, connections may instead fail with
+// other errors, or keep reaching a demoted primary, so the pool is probed in
+// the background and its idle connections are closed when the probe or a
+// write fails. New connections resolve the host again, and read the password
+// file again, so that a rotated password is picked up once the old one is
+// rejected.
+
+const healthProbeTimeout = 5 * time.Second
+
+func (c *Client) runHealthProbe() {
+	healthy := true
+
+	for range time.Tick(c.cfg.healthCheckInterval) {
+		err := c.probe()
+
+		switch {
+		case err != nil:
+			if healthy {
+				log.Warn("msg", "Database health probe failed, resetting connections", "err", err)
+			}
+			healthy = false
+			c.resetConnections()
+		case !healthy:
+			log.Info("msg", "Database is reachable again")
+			healthy = true
+
+			if err = c.checkSchema(); err != nil {
+				log.Error("msg", "Error checking the schema", "err", err)
+			}
+		}
+	}
+}
+
+func (c *Client) probe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthProbeTimeout)
+	defer cancel()
+
+	var one int
+	return c.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+const (
+	sqlCreateHeartbeatTable = "CREATE TABLE IF NOT EXISTS %s (instance text NOT NULL, time timestamptz NOT NULL)"
+	sqlInsertHeartbeat      = "INSERT INTO %s (instance, time) VALUES ($1, $2)"
+	sqlSelectHeartbeat      = "SELECT count(*) FROM %s WHERE instance = $1 AND time = $2"
+	sqlDeleteHeartbeat      = "DELETE FROM %s WHERE instance = $1"
+)
+
+// checkWritePath commits a heartbeat row, reads it back and deletes it
+func (c *Client) checkWritePath() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthProbeTimeout)
+	defer cancel()
+
+	instance, _ := os.Hostname()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	_, err := c.db.ExecContext(ctx, fmt.Sprintf(sqlInsertHeartbeat, ident(c.cfg.table, "_heartbeat")), instance, now)
+
+	if err != nil {
+		return fmt.Errorf("error writing heartbeat: %v", err)
+	}
+
+	var count int
+
+	err = c.db.QueryRowContext(ctx, fmt.Sprintf(sqlSelectHeartbeat, ident(c.cfg.table, "_heartbeat")), instance, now).Scan(&count)
+
+	if err == nil && count == 0 {
+		err = fmt.Errorf("the written row is missing")
+	}
+
+	if err != nil {
+		return fmt.Errorf("error reading heartbeat: %v", err)
+	}
+
+	_, err = c.db.ExecContext(ctx, fmt.Sprintf(sqlDeleteHeartbeat, ident(c.cfg.table, "_heartbeat")), instance)
+
+	if err != nil {
+		return fmt.Errorf("error deleting heartbeat: %v", err)
+	}
+	return nil
+}
+
+// resetConnections closes the idle connections of the pool
+func (c *Client) resetConnections() {
+	c.poolLock.Lock()
+	defer c.poolLock.Unlock()
+
+	c.db.SetMaxIdleConns(0)
+	c.db.SetMaxIdleConns(c.maxIdleConns)
+}
+
+// isAuthError returns whether err means that the credentials were rejected,
+// e.g. after a password rotation
+func isAuthError(err error) bool {
+	return strings.HasPrefix(sqlState(err), "28")
+}
+
+// isConnectionError returns whether err means that the connection is broken
+// or reaches a server that cannot be written to
+func isConnectionError(err error) bool {
+	if e, ok := err.(*stmtError); ok {
+		err = e.err
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	if state := sqlState(err); len(state) > 0 {
+		return isConnectionErrorCode(state)
+	}
+	return err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+func isConnectionErrorCode(code string) bool {
+	switch code {
+	case "57P01", "57P02", "57P03": // admin_shutdown, crash_shutdown, cannot_connect_now
+		return true
+	case "25006": // read_only_sql_transaction, e.g. on a demoted primary
+		return true
+	}
+	// connection_exception
+	return strings.HasPrefix(code, "08")
+}
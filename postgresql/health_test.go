@@ -0,0 +1,46 @@
+package pgprometheus
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgx"
+	"github.com/lib/pq"
+)
+
+func TestIsConnectionError(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected bool
+	}{
+		{err: driver.ErrBadConn, expected: true},
+		{err: io.ErrUnexpectedEOF, expected: true},
+		{err: &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}, expected: true},
+		{err: &pq.Error{Code: "57P01"}, expected: true},
+		{err: &pq.Error{Code: "08006"}, expected: true},
+		{err: &pq.Error{Code: "25006"}, expected: true},
+		{err: pgx.PgError{Code: "57P03"}, expected: true},
+		{err: &pq.Error{Code: "23505"}, expected: false},
+		{err: pgx.PgError{Code: "42P01"}, expected: false},
+		{err: fmt.Errorf("invalid labels"), expected: false},
+	}
+
+	for _, c := range testCases {
+		if actual := isConnectionError(c.err); actual != c.expected {
+			t.Errorf("Expected %v for %#v, got %v", c.expected, c.err, actual)
+		}
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	if !isAuthError(&pq.Error{Code: "28P01"}) || !isAuthError(pgx.PgError{Code: "28000"}) {
+		t.Error("Expected invalid_password and invalid_authorization_specification to be auth errors")
+	}
+
+	if isAuthError(&pq.Error{Code: "08006"}) || isAuthError(driver.ErrBadConn) {
+		t.Error("Expected connection errors not to be auth errors")
+	}
+}
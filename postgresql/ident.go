@@ -0,0 +1,39 @@
+package pgprometheus
+
+import (
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Table names are kept as given, e.g. with -pg.table, and quoted wherever they
+// are put into SQL, so that mixed-case names, reserved words and names
+// qualified with a schema work. Names passed as regclass values are quoted
+// too, since PostgreSQL parses them like identifiers.
+
+// quoteIdent quotes a table name, which may be qualified with a schema, e.g.
+// Metrics_values becomes "Metrics_values" and monitoring.metrics becomes
+// "monitoring"."metrics"
+func quoteIdent(name string) string {
+	parts := strings.SplitN(name, ".", 2)
+
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// unqualified returns a table name without its schema, e.g. for indexes and
+// temporary tables, which cannot be created in another schema than their table
+func unqualified(name string) string {
+	if i := strings.Index(name, "."); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// ident quotes the name of a table derived from the table name, e.g. the
+// labels table with the suffix _labels
+func ident(table, suffix string) string {
+	return quoteIdent(table + suffix)
+}
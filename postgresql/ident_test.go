@@ -0,0 +1,44 @@
+package pgprometheus
+
+import (
+	"testing"
+)
+
+func TestQuoteIdent(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected string
+	}{
+		{name: "metrics_values", expected: `"metrics_values"`},
+		{name: "Metrics", expected: `"Metrics"`},
+		{name: "select", expected: `"select"`},
+		{name: `my"table`, expected: `"my""table"`},
+		{name: "monitoring.metrics", expected: `"monitoring"."metrics"`},
+		{name: "Monitoring.Metrics.values", expected: `"Monitoring"."Metrics.values"`},
+	}
+
+	for _, c := range testCases {
+		if actual := quoteIdent(c.name); actual != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, actual)
+		}
+	}
+}
+
+func TestTmpTable(t *testing.T) {
+	testCases := []struct {
+		table    string
+		expected string
+	}{
+		{table: "metrics", expected: `"metrics_tmp"`},
+		{table: "Metrics", expected: `"Metrics_tmp"`},
+		{table: "monitoring.metrics", expected: `"metrics_tmp"`},
+	}
+
+	for _, c := range testCases {
+		client := &Client{cfg: &Config{table: c.table}}
+
+		if actual := client.tmpTable(); actual != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.table, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package pgprometheus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// ImportOptions control the import of Prometheus TSDB blocks
+type ImportOptions struct {
+	// BatchSize is the maximum number of samples written per transaction
+	BatchSize int
+	// MinTime and MaxTime restrict the imported samples when not zero
+	MinTime time.Time
+	MaxTime time.Time
+}
+
+// ImportStats summarize the import of a block
+type ImportStats struct {
+	MinTime      time.Time
+	MaxTime      time.Time
+	Series       int
+	Samples      int
+	Expired      int
+	Transactions int
+}
+
+// blockMeta is the part of the meta.json of a block the import needs
+type blockMeta struct {
+	ULID    string `json:"ulid"`
+	MinTime int64  `json:"minTime"`
+	MaxTime int64  `json:"maxTime"`
+	Version int    `json:"version"`
+}
+
+// IsBlock tells whether dir is a Prometheus TSDB block
+func IsBlock(dir string) bool {
+	_, err := readBlockMeta(dir)
+	return err == nil
+}
+
+func readBlockMeta(dir string) (*blockMeta, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "meta.json"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var meta blockMeta
+
+	if err = json.Unmarshal(b, &meta); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(dir, "meta.json"), err)
+	}
+
+	if meta.Version != 1 {
+		return nil, fmt.Errorf("%s: unsupported block version %d", dir, meta.Version)
+	}
+	return &meta, nil
+}
+
+// importWindow is a time range of milliseconds, end excluded
+type importWindow struct {
+	start, end int64
+}
+
+// importWindows splits the time range of milliseconds [mint, maxt) into
+// windows aligned on the chunk interval, so that each transaction of an import
+// fills a single TimescaleDB chunk
+func importWindows(mint, maxt int64, interval time.Duration) []importWindow {
+	step := int64(interval / time.Millisecond)
+
+	if step <= 0 || mint >= maxt {
+		return []importWindow{{start: mint, end: maxt}}
+	}
+
+	var windows []importWindow
+
+	start := mint - mint%step
+	if mint < 0 && mint%step != 0 {
+		start -= step
+	}
+
+	for ; start < maxt; start += step {
+		w := importWindow{start: start, end: start + step}
+
+		if w.start < mint {
+			w.start = mint
+		}
+		if w.end > maxt {
+			w.end = maxt
+		}
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+// ImportBlock bulk-loads the samples of a Prometheus TSDB block directory.
+// Samples are written one chunk interval at a time, in transactions of up to
+// BatchSize samples, and samples older than the retention of their metric are
+// skipped.
+func (c *Client) ImportBlock(ctx context.Context, dir string, opts ImportOptions) (*ImportStats, error) {
+	meta, err := readBlockMeta(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mint, maxt := meta.MinTime, meta.MaxTime
+
+	if !opts.MinTime.IsZero() && timestamp(opts.MinTime) > mint {
+		mint = timestamp(opts.MinTime)
+	}
+
+	if !opts.MaxTime.IsZero() && timestamp(opts.MaxTime)+1 < maxt {
+		maxt = timestamp(opts.MaxTime) + 1
+	}
+
+	stats := &ImportStats{MinTime: toTimestamp(mint), MaxTime: toTimestamp(maxt)}
+
+	if mint >= maxt {
+		return stats, nil
+	}
+
+	ir, err := index.NewFileReader(filepath.Join(dir, "index"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer ir.Close()
+
+	cr, err := chunks.NewDirReader(filepath.Join(dir, "chunks"), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer cr.Close()
+
+	imp := &blockImport{importer: c.newImporter(ctx, opts, stats), index: ir, chunks: cr}
+
+	for i, w := range importWindows(mint, maxt, c.cfg.pgPrometheusChunkInterval) {
+		if err = imp.importWindow(w, i == 0); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// importer batches imported samples into transactions
+type importer struct {
+	client    *Client
+	ctx       context.Context
+	policies  []retentionPolicy
+	now       time.Time
+	batchSize int
+	stats     *ImportStats
+
+	batch model.Samples
+}
+
+func (c *Client) newImporter(ctx context.Context, opts ImportOptions, stats *ImportStats) *importer {
+	return &importer{
+		client:    c,
+		ctx:       ctx,
+		policies:  c.currentRetentionPolicies(),
+		now:       time.Now(),
+		batchSize: opts.BatchSize,
+		stats:     stats,
+	}
+}
+
+// oldest returns the timestamp of the oldest sample of the metric within its
+// retention, and false if the metric is kept forever
+func (imp *importer) oldest(metric model.Metric) (int64, bool) {
+	retention, ok := metricRetention(imp.policies, string(metric[model.MetricNameLabel]))
+
+	if !ok {
+		return 0, false
+	}
+	return timestamp(imp.now.Add(-retention)), true
+}
+
+// add queues a sample, writing the batch once full
+func (imp *importer) add(s *model.Sample) error {
+	imp.batch = append(imp.batch, s)
+
+	if len(imp.batch) >= imp.batchSize && imp.batchSize > 0 {
+		return imp.flush()
+	}
+	return nil
+}
+
+// flush writes the pending samples in a transaction
+func (imp *importer) flush() error {
+	if len(imp.batch) == 0 {
+		return nil
+	}
+
+	begin := time.Now()
+
+	if err := imp.client.importTx(imp.ctx, imp.batch); err != nil {
+		return err
+	}
+
+	log.Debug("msg", "Imported samples", "count", len(imp.batch), "duration", time.Since(begin).Seconds())
+
+	imp.stats.Samples += len(imp.batch)
+	imp.stats.Transactions++
+	imp.batch = imp.batch[:0]
+	return nil
+}
+
+// importTx writes imported samples in a transaction, to the tables of the
+// tenant set with WithTenant if any. Unlike WriteContext, it writes regardless
+// of leader election.
+func (c *Client) importTx(ctx context.Context, samples model.Samples) error {
+	if tenant := TenantFromContext(ctx); len(tenant) > 0 && c.tenants != nil {
+		client, err := c.tenantClient(tenant)
+
+		if err != nil {
+			return err
+		}
+		return client.writeTx(ctx, samples)
+	}
+	return c.writeTx(ctx, samples)
+}
+
+// blockImport is the state of the import of a block
+type blockImport struct {
+	*importer
+	index  *index.Reader
+	chunks *chunks.Reader
+	iter   chunkenc.Iterator
+}
+
+// importWindow imports the samples of all series within the window. The
+// series are counted on the first window.
+func (b *blockImport) importWindow(w importWindow, first bool) error {
+	p, err := b.index.Postings(index.AllPostingsKey())
+
+	if err != nil {
+		return err
+	}
+
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+
+	for p.Next() {
+		if err = b.index.Series(p.At(), &lset, &chks); err != nil {
+			return err
+		}
+
+		if first {
+			b.stats.Series++
+		}
+
+		if err = b.importSeries(w, lset, chks); err != nil {
+			return err
+		}
+	}
+
+	if err = p.Err(); err != nil {
+		return err
+	}
+	return b.flush()
+}
+
+func (b *blockImport) importSeries(w importWindow, lset labels.Labels, chks []chunks.Meta) error {
+	var metric model.Metric
+	oldest := w.start
+
+	for _, chk := range chks {
+		if chk.MaxTime < w.start || chk.MinTime >= w.end {
+			continue
+		}
+
+		chunk, err := b.chunks.Chunk(chk.Ref)
+
+		if err != nil {
+			return err
+		}
+
+		if metric == nil {
+			metric = make(model.Metric, len(lset))
+			for _, l := range lset {
+				metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+			}
+
+			if expired, ok := b.oldest(metric); ok && expired > oldest {
+				oldest = expired
+			}
+		}
+
+		b.iter = chunk.Iterator(b.iter)
+
+		for b.iter.Next() {
+			t, v := b.iter.At()
+
+			if t < w.start || t >= w.end {
+				continue
+			}
+
+			if t < oldest {
+				b.stats.Expired++
+				continue
+			}
+
+			if err = b.add(&model.Sample{Metric: metric, Value: model.SampleValue(v), Timestamp: model.Time(t)}); err != nil {
+				return err
+			}
+		}
+
+		if err = b.iter.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,133 @@
+package pgprometheus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestImportWindows(t *testing.T) {
+	hour := int64(time.Hour / time.Millisecond)
+
+	for i, c := range []struct {
+		mint, maxt int64
+		interval   time.Duration
+		expected   []importWindow
+	}{
+		{0, 2 * hour, 12 * time.Hour, []importWindow{{0, 2 * hour}}},
+		{11 * hour, 13 * hour, 12 * time.Hour, []importWindow{{11 * hour, 12 * hour}, {12 * hour, 13 * hour}}},
+		{hour, 25 * hour, 12 * time.Hour, []importWindow{{hour, 12 * hour}, {12 * hour, 24 * hour}, {24 * hour, 25 * hour}}},
+		{-hour, hour, 12 * time.Hour, []importWindow{{-hour, 0}, {0, hour}}},
+		{0, 2 * hour, 0, []importWindow{{0, 2 * hour}}},
+	} {
+		if actual := importWindows(c.mint, c.maxt, c.interval); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%d: expected %v, got %v", i, c.expected, actual)
+		}
+	}
+}
+
+func TestReadBlockMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if IsBlock(dir) {
+		t.Error("expected a directory without meta.json not to be a block")
+	}
+
+	meta := `{"ulid": "01BKGV7JBM69T2G1BGBGM6KB12", "minTime": 1000, "maxTime": 2000, "version": 1}`
+	if err = ioutil.WriteFile(filepath.Join(dir, "meta.json"), []byte(meta), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := readBlockMeta(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.MinTime != 1000 || m.MaxTime != 2000 {
+		t.Errorf("unexpected time range %d-%d", m.MinTime, m.MaxTime)
+	}
+}
+
+func TestImportSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	chunk := chunkenc.NewXORChunk()
+	app, err := chunk.Appender()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(100000, 0)
+	for ts := int64(0); ts < 10; ts++ {
+		app.Append(timestamp(now.Add(time.Duration(ts-10)*time.Hour)), float64(ts))
+	}
+
+	w, err := chunks.NewWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chks := []chunks.Meta{{Chunk: chunk, MinTime: timestamp(now.Add(-10 * time.Hour)), MaxTime: timestamp(now.Add(-time.Hour))}}
+	if err = w.WriteChunks(chks...); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := chunks.NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	b := &blockImport{
+		importer: &importer{
+			policies: []retentionPolicy{{pattern: "up", retention: 5 * time.Hour}},
+			now:      now,
+			stats:    &ImportStats{},
+		},
+		chunks: r,
+	}
+
+	// The window excludes the last two samples, and the retention the first
+	// five
+	window := importWindow{start: timestamp(now.Add(-10 * time.Hour)), end: timestamp(now.Add(-2 * time.Hour))}
+	lset := labels.Labels{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}}
+
+	if err = b.importSeries(window, lset, chks); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.stats.Expired != 5 {
+		t.Errorf("expected 5 expired samples, got %d", b.stats.Expired)
+	}
+
+	var values []model.SampleValue
+	for _, s := range b.batch {
+		if s.Metric["job"] != "node" {
+			t.Errorf("unexpected metric %v", s.Metric)
+		}
+		values = append(values, s.Value)
+	}
+
+	if expected := []model.SampleValue{5, 6, 7}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+}
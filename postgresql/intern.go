@@ -0,0 +1,86 @@
+package pgprometheus
+
+import (
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+// Prometheus sends the samples of a series every scrape interval, each time
+// with the same labels, which were encoded again for every sample. The
+// encoded labels of recently written series are kept instead.
+
+// internedLabels are the encoded labels of a series
+type internedLabels struct {
+	metric  model.Metric
+	encoded string
+}
+
+// labelsInterner keeps the encoded labels of up to size series in the current
+// generation, and those of the previous generation until the current one is
+// full, so that series no longer written are forgotten without tracking when
+// each was last used. A nil interner encodes the labels of every sample.
+type labelsInterner struct {
+	size int
+
+	mu       sync.Mutex
+	current  map[model.Fingerprint]internedLabels
+	previous map[model.Fingerprint]internedLabels
+}
+
+// newLabelsInterner returns an interner of size series, or nil if size is not
+// positive
+func newLabelsInterner(size int) *labelsInterner {
+	if size <= 0 {
+		return nil
+	}
+	return &labelsInterner{size: size, current: make(map[model.Fingerprint]internedLabels)}
+}
+
+// intern returns the labels of m encoded with encode, encoding them only if
+// they are not kept yet. Clients write with a single encoding, so the kept
+// labels are not told apart by it.
+func (i *labelsInterner) intern(m model.Metric, encode func(model.Metric) (string, error)) (string, error) {
+	if i == nil {
+		return encode(m)
+	}
+
+	fp := m.FastFingerprint()
+
+	i.mu.Lock()
+	labels, ok := i.current[fp]
+
+	if !ok {
+		if labels, ok = i.previous[fp]; ok {
+			i.add(fp, labels)
+		}
+	}
+	i.mu.Unlock()
+
+	// Fast fingerprints may collide
+	if ok && labels.metric.Equal(m) {
+		return labels.encoded, nil
+	}
+
+	encoded, err := encode(m)
+
+	if err != nil {
+		return "", err
+	}
+
+	i.mu.Lock()
+	i.add(fp, internedLabels{metric: m, encoded: encoded})
+	i.mu.Unlock()
+
+	return encoded, nil
+}
+
+// add keeps labels in the current generation, starting a new one if it is
+// full. It must be called with mu held.
+func (i *labelsInterner) add(fp model.Fingerprint, labels internedLabels) {
+	if len(i.current) >= i.size {
+		i.previous = i.current
+		i.current = make(map[model.Fingerprint]internedLabels, i.size)
+	}
+	i.current[fp] = labels
+}
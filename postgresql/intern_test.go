@@ -0,0 +1,55 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestLabelsInterner(t *testing.T) {
+	var encoded int
+
+	encode := func(m model.Metric) (string, error) {
+		encoded++
+		return metricString(m), nil
+	}
+
+	metric := func(instance int) model.Metric {
+		return model.Metric{model.MetricNameLabel: "up", "instance": model.LabelValue(fmt.Sprintf("host%d", instance))}
+	}
+
+	testCases := []struct {
+		name      string
+		size      int
+		instances []int
+		encoded   int
+	}{
+		{name: "disabled", size: 0, instances: []int{1, 1, 1}, encoded: 3},
+		{name: "repeated series", size: 10, instances: []int{1, 2, 1, 2, 1}, encoded: 2},
+		{name: "previous generation", size: 2, instances: []int{1, 2, 3, 1, 2}, encoded: 3},
+		{name: "forgotten series", size: 1, instances: []int{1, 2, 3, 1}, encoded: 4},
+	}
+
+	for _, c := range testCases {
+		encoded = 0
+		interner := newLabelsInterner(c.size)
+
+		for _, instance := range c.instances {
+			m := metric(instance)
+			actual, err := interner.intern(m, encode)
+
+			if err != nil {
+				t.Fatalf("%s: unexpected error %v", c.name, err)
+			}
+
+			if expected := metricString(m); actual != expected {
+				t.Errorf("%s: expected %s, got %s", c.name, expected, actual)
+			}
+		}
+
+		if encoded != c.encoded {
+			t.Errorf("%s: expected %d encodings, got %d", c.name, c.encoded, encoded)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+const (
+	sqlCreateJobsTable = "CREATE TABLE IF NOT EXISTS %s (job TEXT PRIMARY KEY, last_run TIMESTAMPTZ NOT NULL, instance TEXT NOT NULL)"
+	sqlLastJobRun      = "SELECT last_run FROM %s WHERE job = $1"
+	sqlRecordJobRun    = "INSERT INTO %s (job, last_run, instance) VALUES ($1, $2, $3) ON CONFLICT (job) DO UPDATE SET last_run = excluded.last_run, instance = excluded.instance"
+)
+
+// jobLockID is the advisory lock of a maintenance job on the given table
+func jobLockID(table, job string) int64 {
+	return advisoryLockID(table + ":" + job)
+}
+
+// sameRun tells whether two runs of a job fall in the same interval
+func sameRun(last, now time.Time, interval time.Duration) bool {
+	return !last.IsZero() && last.Truncate(interval).Equal(now.Truncate(interval))
+}
+
+// runJob runs a maintenance job, unless another adapter writing to the same
+// table is running it or already ran it during the current interval. The job
+// is guarded by an advisory lock held on a dedicated connection, so it is
+// released if the adapter dies halfway.
+func (c *Client) runJob(job string, interval time.Duration, run func(now time.Time) error) {
+	if !c.cfg.singletonJobs {
+		run(time.Now())
+		return
+	}
+
+	ctx := context.Background()
+	conn, err := c.db.Conn(ctx)
+
+	if err != nil {
+		log.Error("msg", "Error locking maintenance job", "job", job, "err", err)
+		return
+	}
+
+	defer conn.Close()
+
+	var locked bool
+	lockID := jobLockID(c.cfg.table, job)
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockID).Scan(&locked)
+
+	if err != nil {
+		log.Error("msg", "Error locking maintenance job", "job", job, "err", err)
+		return
+	}
+
+	if !locked {
+		c.skippedJobs.WithLabelValues(job).Inc()
+		log.Debug("msg", "Skipped maintenance job running on another adapter", "job", job)
+		return
+	}
+
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", lockID)
+
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(sqlCreateJobsTable, ident(c.cfg.table, "_jobs")))
+
+	if err != nil {
+		log.Error("msg", "Error creating maintenance jobs table", "err", err)
+		return
+	}
+
+	var lastRun time.Time
+	err = conn.QueryRowContext(ctx, fmt.Sprintf(sqlLastJobRun, ident(c.cfg.table, "_jobs")), job).Scan(&lastRun)
+
+	if err != nil && err != sql.ErrNoRows {
+		log.Error("msg", "Error reading last run of maintenance job", "job", job, "err", err)
+		return
+	}
+
+	now := time.Now()
+
+	if sameRun(lastRun, now, interval) {
+		c.skippedJobs.WithLabelValues(job).Inc()
+		log.Debug("msg", "Skipped maintenance job already run by another adapter", "job", job, "last_run", lastRun)
+		return
+	}
+
+	if run(now) != nil {
+		// Failed runs are left for the next adapter to retry
+		return
+	}
+
+	instance, _ := os.Hostname()
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(sqlRecordJobRun, ident(c.cfg.table, "_jobs")), job, now, instance)
+
+	if err != nil {
+		log.Error("msg", "Error recording run of maintenance job", "job", job, "err", err)
+	}
+}
@@ -0,0 +1,41 @@
+package pgprometheus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobLockID(t *testing.T) {
+	if jobLockID("metrics", "retention") == jobLockID("metrics", "downsampling") {
+		t.Error("expected different locks for different jobs")
+	}
+
+	if jobLockID("metrics", "retention") == jobLockID("other", "retention") {
+		t.Error("expected different locks for different tables")
+	}
+
+	if jobLockID("metrics", "retention") == advisoryLockID("metrics") {
+		t.Error("expected jobs not to share the leader election lock")
+	}
+}
+
+func TestSameRun(t *testing.T) {
+	base := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	for i, c := range []struct {
+		last     time.Time
+		now      time.Time
+		interval time.Duration
+		expected bool
+	}{
+		{time.Time{}, base, time.Minute, false},
+		{base.Add(5 * time.Second), base.Add(35 * time.Second), time.Minute, true},
+		{base.Add(55 * time.Second), base.Add(65 * time.Second), time.Minute, false},
+		{base.Add(-time.Hour), base, time.Hour, false},
+		{base.Add(10 * time.Minute), base.Add(50 * time.Minute), time.Hour, true},
+	} {
+		if actual := sameRun(c.last, c.now, c.interval); actual != c.expected {
+			t.Errorf("%d: expected %v, got %v", i, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package pgprometheus
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWindowSize is the number of recent writes latency quantiles are
+	// estimated from
+	latencyWindowSize = 1024
+	// latencyWindowAge is the age beyond which writes no longer count, so
+	// that a recovered database is noticed even if few writes get through
+	latencyWindowAge = time.Minute
+)
+
+// latencyObservation is the duration of a step of a write
+type latencyObservation struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// latencyWindow keeps the durations of the most recent writes to estimate
+// their quantiles. A nil window ignores observations.
+type latencyWindow struct {
+	mu           sync.Mutex
+	observations []latencyObservation
+	next         int
+}
+
+func newLatencyWindow() *latencyWindow {
+	return &latencyWindow{observations: make([]latencyObservation, 0, latencyWindowSize)}
+}
+
+func (w *latencyWindow) observe(now time.Time, d time.Duration) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.observations) < cap(w.observations) {
+		w.observations = append(w.observations, latencyObservation{at: now, duration: d})
+		return
+	}
+
+	w.observations[w.next] = latencyObservation{at: now, duration: d}
+	w.next = (w.next + 1) % len(w.observations)
+}
+
+// quantile returns the q quantile of the durations observed since
+// latencyWindowAge before now, or 0 if there are none
+func (w *latencyWindow) quantile(now time.Time, q float64) time.Duration {
+	if w == nil {
+		return 0
+	}
+
+	w.mu.Lock()
+	durations := make([]time.Duration, 0, len(w.observations))
+
+	for _, o := range w.observations {
+		if now.Sub(o.at) <= latencyWindowAge {
+			durations = append(durations, o.duration)
+		}
+	}
+	w.mu.Unlock()
+
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[int(q*float64(len(durations)-1))]
+}
+
+// WriteLatency returns the 99th percentile of the time writes of the last
+// minute waited for a database connection, and took to commit
+func (c *Client) WriteLatency() (wait, commit time.Duration) {
+	now := time.Now()
+	return c.waitLatency.quantile(now, 0.99), c.commitLatency.quantile(now, 0.99)
+}
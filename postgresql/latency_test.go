@@ -0,0 +1,47 @@
+package pgprometheus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	now := time.Date(2018, 3, 14, 12, 0, 0, 0, time.UTC)
+	w := newLatencyWindow()
+
+	if q := w.quantile(now, 0.99); q != 0 {
+		t.Errorf("Expected no latency without writes, got %v", q)
+	}
+
+	// Old writes were slow, the latest ones are fast
+	for i := 0; i < 100; i++ {
+		w.observe(now.Add(-2*time.Minute), 10*time.Second)
+	}
+	for i := 1; i <= 100; i++ {
+		w.observe(now, time.Duration(i)*time.Millisecond)
+	}
+
+	if q := w.quantile(now, 0.99); q != 99*time.Millisecond {
+		t.Errorf("Expected a 99th percentile of 99ms, got %v", q)
+	}
+
+	if q := w.quantile(now, 0.5); q != 50*time.Millisecond {
+		t.Errorf("Expected a median of 50ms, got %v", q)
+	}
+
+	// The oldest observations are replaced once the window is full
+	for i := 0; i < latencyWindowSize; i++ {
+		w.observe(now, time.Second)
+	}
+
+	if q := w.quantile(now, 0.01); q != time.Second {
+		t.Errorf("Expected only the latest observations, got %v", q)
+	}
+
+	var nilWindow *latencyWindow
+	nilWindow.observe(now, time.Second)
+
+	if q := nilWindow.quantile(now, 0.99); q != 0 {
+		t.Errorf("Expected no latency of a nil window, got %v", q)
+	}
+}
@@ -0,0 +1,231 @@
+package pgprometheus
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	sqlCreateMetricTables = "CREATE TABLE IF NOT EXISTS %s (metric_name TEXT PRIMARY KEY, table_name NAME NOT NULL UNIQUE)"
+	sqlInsertMetricTable  = "INSERT INTO %s (metric_name, table_name) VALUES ($1, $2)"
+	sqlSelectMetricTables = "SELECT table_name FROM (SELECT metric_name AS name, table_name FROM %s) t"
+	sqlSelectMetricTable  = "SELECT table_name FROM %s WHERE metric_name = $1"
+	sqlSelectTableMetric  = "SELECT metric_name FROM %s WHERE table_name = $1"
+
+	// pg_prometheus appends suffixes of up to 8 characters (e.g., "_samples")
+	// to the table name, which must fit in PostgreSQL's 63 byte identifiers.
+	maxMetricTableLen = 55
+)
+
+var invalidTableChars = regexp.MustCompile("[^a-z0-9_]")
+
+// metricTableName returns the name of the table storing the given metric: the
+// metric name made an unquoted identifier, and a hash of the metric name. The
+// tables derived from a metric table, e.g. its _values and _labels tables, and
+// those of the adapter, e.g. the _metric_tables registry, never end in such a
+// hash, so that no metric is stored in the tables of another, whatever its
+// name.
+func metricTableName(prefix, metric string) string {
+	h := fnv.New32a()
+	h.Write([]byte(metric))
+	suffix := fmt.Sprintf("_%08x", h.Sum32())
+
+	name := fmt.Sprintf("%s_%s", prefix, invalidTableChars.ReplaceAllString(strings.ToLower(metric), "_"))
+
+	if len(name)+len(suffix) > maxMetricTableLen {
+		name = name[:maxMetricTableLen-len(suffix)]
+	}
+	return name + suffix
+}
+
+// batchByMetricTable splits samples by the table of their metric, creating
+// tables for metrics that have not been seen before.
+func (c *Client) batchByMetricTable(samples model.Samples) (map[string]model.Samples, error) {
+	batches := make(map[string]model.Samples)
+
+	for _, sample := range samples {
+		table, err := c.metricTable(string(sample.Metric[model.MetricNameLabel]))
+
+		if err != nil {
+			return nil, err
+		}
+		batches[table] = append(batches[table], sample)
+	}
+	return batches, nil
+}
+
+// metricTable returns the table of the given metric, creating it if needed
+func (c *Client) metricTable(metric string) (string, error) {
+	c.metricTablesLock.RLock()
+	table, ok := c.metricTables[metric]
+	c.metricTablesLock.RUnlock()
+
+	if ok {
+		return table, nil
+	}
+
+	table, err := c.createMetricTable(metric)
+
+	if err != nil {
+		return "", err
+	}
+
+	c.metricTablesLock.Lock()
+	c.metricTables[metric] = table
+	c.metricTablesLock.Unlock()
+
+	return table, nil
+}
+
+// createMetricTable creates the tables of the given metric and registers
+// them, unless the metric is registered already. A table that exists without
+// being registered to the metric, e.g. after a hash collision, is an error
+// rather than written into.
+func (c *Client) createMetricTable(metric string) (string, error) {
+	registry := ident(c.cfg.table, "_metric_tables")
+
+	// Metrics keep the table they were registered with, e.g. one named
+	// without a hash by earlier versions
+	table, err := c.registeredTable(metric)
+
+	if err != nil || len(table) > 0 {
+		return table, err
+	}
+
+	table = metricTableName(c.cfg.table, metric)
+
+	tx, err := c.db.Begin()
+
+	if err != nil {
+		return "", err
+	}
+
+	defer tx.Rollback()
+
+	var owner string
+	err = tx.QueryRow(fmt.Sprintf(sqlSelectTableMetric, registry), table).Scan(&owner)
+
+	if err == nil {
+		return "", fmt.Errorf("table %s of metric %q is registered to metric %q", table, metric, owner)
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	created, err := c.createTables(tx, table)
+
+	if err != nil {
+		return "", err
+	}
+
+	if !created {
+		// Another adapter may have created and registered the table in
+		// the meantime
+		registered, err := c.registeredTable(metric)
+
+		if err != nil {
+			return "", err
+		}
+
+		if registered != table {
+			return "", fmt.Errorf("table %s of metric %q exists, but is not registered to the metric in %s", table, metric, registry)
+		}
+		return table, nil
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(sqlInsertMetricTable, registry), metric, table)
+
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return "", err
+	}
+
+	log.Info("msg", "Created metric table", "metric", metric, "table", table)
+
+	return table, nil
+}
+
+// registeredTable returns the table registered to the given metric, or an
+// empty name if there is none
+func (c *Client) registeredTable(metric string) (string, error) {
+	var table string
+
+	err := c.db.QueryRow(fmt.Sprintf(sqlSelectMetricTable, ident(c.cfg.table, "_metric_tables")), metric).Scan(&table)
+
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return table, err
+}
+
+// buildMetricTablesQuery builds a query over the tables of all metrics
+// matching the query's metric name matchers. An empty query is returned if
+// no table matches.
+func (c *Client) buildMetricTablesQuery(q *prompb.Query, params *queryParams) (string, error) {
+	nameMatchers, predicates, err := c.buildPredicates(q, params)
+
+	if err != nil {
+		return "", err
+	}
+
+	tables, err := c.lookupMetricTables(nameMatchers)
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(tables) == 0 {
+		return "", nil
+	}
+
+	selects := make([]string, 0, len(tables))
+
+	for _, table := range tables {
+		selects = append(selects, fmt.Sprintf("%s WHERE %s", c.selectSamples(table), predicates))
+	}
+
+	return fmt.Sprintf("%s ORDER BY time", strings.Join(selects, " UNION ALL ")), nil
+}
+
+func (c *Client) lookupMetricTables(nameMatchers []string) ([]string, error) {
+	query := fmt.Sprintf(sqlSelectMetricTables, ident(c.cfg.table, "_metric_tables"))
+
+	if len(nameMatchers) > 0 {
+		query = fmt.Sprintf("%s WHERE %s", query, strings.Join(nameMatchers, " AND "))
+	}
+
+	rows, err := c.db.Query(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var tables []string
+
+	for rows.Next() {
+		var table string
+
+		err = rows.Scan(&table)
+
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+
+	return tables, rows.Err()
+}
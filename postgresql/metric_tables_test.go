@@ -0,0 +1,116 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+func TestMetricTableName(t *testing.T) {
+	testCases := []struct {
+		metric   string
+		expected string
+	}{
+		{metric: "cpu_usage", expected: "metrics_cpu_usage_"},
+		{metric: "", expected: "metrics__"},
+		{metric: "job:cpu_usage:rate5m", expected: "metrics_job_cpu_usage_rate5m_"},
+	}
+
+	for _, c := range testCases {
+		name := metricTableName("metrics", c.metric)
+
+		if !strings.HasPrefix(name, c.expected) || len(name) != len(c.expected)+8 {
+			t.Errorf("Expected table %s followed by a hash for metric %q, got %s", c.expected, c.metric, name)
+		}
+	}
+
+	if metricTableName("metrics", "CPU") == metricTableName("metrics", "cpu") {
+		t.Error("Metrics differing in case must not share a table")
+	}
+
+	long := metricTableName("metrics", strings.Repeat("a", 100))
+	if len(long) > maxMetricTableLen {
+		t.Errorf("Table name too long: %s", long)
+	}
+
+	if long == metricTableName("metrics", strings.Repeat("a", 101)) {
+		t.Error("Truncated table names must not collide")
+	}
+}
+
+func TestMetricTableNameCollisions(t *testing.T) {
+	// The tables derived from the table of metric foo, and those of the
+	// adapter
+	foo := metricTableName("metrics", "foo")
+	derived := []string{
+		foo + "_values",
+		foo + "_labels",
+		foo + "_samples",
+		foo + "_sample",
+		foo + "_tmp",
+		"metrics_metric_tables",
+		"metrics_jobs",
+		"metrics_tenants",
+	}
+
+	metrics := []string{"foo_values", "foo_labels", "foo_samples", "foo_sample", "foo_tmp", "metric_tables", "jobs", "tenants"}
+
+	for _, metric := range metrics {
+		name := metricTableName("metrics", metric)
+
+		for _, table := range derived {
+			if name == table {
+				t.Errorf("Table of metric %s collides with %s", metric, table)
+			}
+		}
+	}
+}
+
+func TestCreateMetricTableRegistered(t *testing.T) {
+	fake := newFakeDB()
+	fake.query = func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+		switch {
+		case strings.Contains(query, "WHERE metric_name") && args[0] == "registered":
+			return &fakeRows{columns: []string{"table_name"}, rows: [][]driver.Value{{"metrics_registered"}}}, nil
+		case strings.Contains(query, "WHERE table_name"):
+			return &fakeRows{columns: []string{"metric_name"}, rows: [][]driver.Value{{"other"}}}, nil
+		}
+		return &fakeRows{columns: []string{"table_name"}}, nil
+	}
+
+	db := fake.open(1)
+	defer db.Close()
+
+	c := &Client{db: db, cfg: &Config{table: "metrics"}}
+
+	testCases := []struct {
+		metric   string
+		expected string
+		err      string
+	}{
+		// Named by an earlier version
+		{metric: "registered", expected: "metrics_registered"},
+		// The table of the metric is registered to another one
+		{metric: "colliding", err: `is registered to metric "other"`},
+	}
+
+	for _, tc := range testCases {
+		table, err := c.createMetricTable(tc.metric)
+
+		if len(tc.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error %q, got %v", tc.metric, tc.err, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tc.metric, err)
+		}
+
+		if table != tc.expected {
+			t.Errorf("%s: expected table %s, got %s", tc.metric, tc.expected, table)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package pgprometheus
+
+import (
+	"database/sql"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writeMetrics instrument the write path of the client
+type writeMetrics struct {
+	receivedSamples prometheus.Counter
+	writtenSamples  prometheus.Counter
+	failedSamples   prometheus.Counter
+	droppedSamples  prometheus.Counter
+	followerSamples prometheus.Counter
+	failoverSamples prometheus.Counter
+	unstorable      prometheus.Counter
+	batchSize       prometheus.Histogram
+	copyDuration    prometheus.Histogram
+	commitDuration  prometheus.Histogram
+	batchesInFlight prometheus.Gauge
+}
+
+func newWriteMetrics() *writeMetrics {
+	return &writeMetrics{
+		receivedSamples: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pg_write_received_samples_total",
+			Help: "Total number of samples received for writing to the database.",
+		}),
+		writtenSamples: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pg_write_written_samples_total",
+			Help: "Total number of samples committed to the database.",
+		}),
+		failedSamples: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pg_write_failed_samples_total",
+			Help: "Total number of samples whose write failed.",
+		}),
+		droppedSamples: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pg_write_dropped_samples_total",
+			Help: "Total number of samples whose write failed for a reason other than the database connection, so that retrying would fail again.",
+		}),
+		followerSamples: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pg_write_follower_samples_total",
+			Help: "Total number of samples not written because another adapter is the elected leader.",
+		}),
+		failoverSamples: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pg_write_failover_dropped_samples_total",
+			Help: "Total number of samples dropped by a new leader because the previous leader has likely written them.",
+		}),
+		unstorable: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pg_write_unstorable_samples_total",
+			Help: "Total number of samples dropped because the value column of -pg.value-type cannot store their value.",
+		}),
+		batchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "pg_write_batch_size_samples",
+			Help:    "Number of samples per write to the database.",
+			Buckets: prometheus.ExponentialBuckets(10, 4, 8),
+		}),
+		copyDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "pg_write_copy_duration_seconds",
+			Help:    "Duration of copying, or inserting, the rows of a batch into a table.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		commitDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "pg_write_commit_duration_seconds",
+			Help:    "Duration of committing the transaction of a write.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		batchesInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pg_write_batches_in_progress",
+			Help: "Number of writes waiting for a connection or in progress.",
+		}),
+	}
+}
+
+// readMetrics instrument the read path of the client
+type readMetrics struct {
+	queryDuration   prometheus.Histogram
+	rowsScanned     prometheus.Counter
+	seriesReturned  prometheus.Histogram
+	samplesReturned prometheus.Histogram
+	errors          *prometheus.CounterVec
+}
+
+const (
+	readErrorBuild = "build"
+	readErrorQuery = "query"
+	readErrorScan  = "scan"
+)
+
+func newReadMetrics() *readMetrics {
+	return &readMetrics{
+		queryDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "pg_read_query_duration_seconds",
+			Help:    "Duration of the SQL query of a remote read query, including reading its rows.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		rowsScanned: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pg_read_rows_scanned_total",
+			Help: "Total number of rows read from the database for remote read queries.",
+		}),
+		seriesReturned: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "pg_read_series_returned",
+			Help:    "Number of series returned per remote read request.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}),
+		samplesReturned: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "pg_read_samples_returned",
+			Help:    "Number of samples returned per remote read request.",
+			Buckets: prometheus.ExponentialBuckets(10, 4, 10),
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pg_read_errors_total",
+			Help: "Total number of failed remote read requests by the step that failed.",
+		}, []string{"type"}),
+	}
+}
+
+func (m *readMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.queryDuration, m.rowsScanned, m.seriesReturned, m.samplesReturned, m.errors}
+}
+
+func (m *writeMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.receivedSamples, m.writtenSamples, m.failedSamples, m.droppedSamples, m.followerSamples, m.failoverSamples,
+		m.unstorable, m.batchSize, m.copyDuration, m.commitDuration, m.batchesInFlight}
+}
+
+// tenantMetrics instrument the tenants of the client
+type tenantMetrics struct {
+	tenants     prometheus.Gauge
+	provisioned prometheus.Counter
+	errors      prometheus.Counter
+}
+
+func newTenantMetrics() *tenantMetrics {
+	return &tenantMetrics{
+		tenants: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pg_tenants",
+			Help: "Number of tenants seen since the adapter started.",
+		}),
+		provisioned: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pg_tenant_provisioned_total",
+			Help: "Total number of tenants whose tables were created.",
+		}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pg_tenant_setup_errors_total",
+			Help: "Total number of failures to set up the tables of a tenant, including tenants without tables when auto-provisioning is disabled.",
+		}),
+	}
+}
+
+func (m *tenantMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.tenants, m.provisioned, m.errors}
+}
+
+func newSkippedJobs() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pg_maintenance_skipped_runs_total",
+		Help: "Total number of maintenance job runs skipped because another adapter was running or already ran the job.",
+	}, []string{"job"})
+}
+
+// poolCollector exports the stats of the connection pool
+type poolCollector struct {
+	db *sql.DB
+}
+
+var (
+	poolMaxOpenDesc           = prometheus.NewDesc("pg_pool_max_open_connections", "Maximum number of open connections to the database.", nil, nil)
+	poolOpenDesc              = prometheus.NewDesc("pg_pool_open_connections", "Number of established connections, both in use and idle.", nil, nil)
+	poolInUseDesc             = prometheus.NewDesc("pg_pool_in_use_connections", "Number of connections currently in use.", nil, nil)
+	poolIdleDesc              = prometheus.NewDesc("pg_pool_idle_connections", "Number of idle connections.", nil, nil)
+	poolWaitCountDesc         = prometheus.NewDesc("pg_pool_wait_count_total", "Total number of connections waited for.", nil, nil)
+	poolWaitDurationDesc      = prometheus.NewDesc("pg_pool_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", nil, nil)
+	poolMaxIdleClosedDesc     = prometheus.NewDesc("pg_pool_max_idle_closed_total", "Total number of connections closed due to the max idle connections.", nil, nil)
+	poolMaxLifetimeClosedDesc = prometheus.NewDesc("pg_pool_max_lifetime_closed_total", "Total number of connections closed due to the max connection lifetime.", nil, nil)
+)
+
+func (p poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolMaxOpenDesc
+	ch <- poolOpenDesc
+	ch <- poolInUseDesc
+	ch <- poolIdleDesc
+	ch <- poolWaitCountDesc
+	ch <- poolWaitDurationDesc
+	ch <- poolMaxIdleClosedDesc
+	ch <- poolMaxLifetimeClosedDesc
+}
+
+func (p poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := p.db.Stats()
+
+	ch <- prometheus.MustNewConstMetric(poolMaxOpenDesc, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(poolOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(poolInUseDesc, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(poolWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(poolWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(poolMaxIdleClosedDesc, prometheus.CounterValue, float64(stats.MaxIdleClosed))
+	ch <- prometheus.MustNewConstMetric(poolMaxLifetimeClosedDesc, prometheus.CounterValue, float64(stats.MaxLifetimeClosed))
+}
+
+// topMetricsCollector exports the samples of the metrics with the most
+// written samples
+type topMetricsCollector struct {
+	topMetrics *topK
+}
+
+var topMetricSamplesDesc = prometheus.NewDesc("pg_write_top_metric_samples", "Approximate number of samples written for each of the metrics with the most written samples.", []string{"metric"}, nil)
+
+func (t topMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- topMetricSamplesDesc
+}
+
+func (t topMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, count := range t.topMetrics.top() {
+		ch <- prometheus.MustNewConstMetric(topMetricSamplesDesc, prometheus.GaugeValue, float64(count.Samples), count.Metric)
+	}
+}
+
+var (
+	leaderDesc = prometheus.NewDesc("pg_leader",
+		"Whether the adapter is the elected leader that writes samples.", nil, nil)
+	leaderSinceDesc = prometheus.NewDesc("pg_leader_since_timestamp_seconds",
+		"When the adapter last became the elected leader, 0 if it never was.", nil, nil)
+	leaderChangesDesc = prometheus.NewDesc("pg_leader_changes_total",
+		"Total number of times the adapter became the leader or a follower.", nil, nil)
+)
+
+// electionCollector exports the outcome of the leader election
+type electionCollector struct {
+	elector elector
+}
+
+func (e electionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- leaderDesc
+	ch <- leaderSinceDesc
+	ch <- leaderChangesDesc
+}
+
+func (e electionCollector) Collect(ch chan<- prometheus.Metric) {
+	var leader, since float64
+
+	if e.elector.isLeader() {
+		leader = 1
+	}
+
+	if t := e.elector.leaderSince(); !t.IsZero() {
+		since = float64(t.UnixNano()) / 1e9
+	}
+
+	ch <- prometheus.MustNewConstMetric(leaderDesc, prometheus.GaugeValue, leader)
+	ch <- prometheus.MustNewConstMetric(leaderSinceDesc, prometheus.GaugeValue, since)
+	ch <- prometheus.MustNewConstMetric(leaderChangesDesc, prometheus.CounterValue, float64(e.elector.leaderChanges()))
+}
+
+func (c *Client) collectors() []prometheus.Collector {
+	collectors := append(c.writeMetrics.collectors(), c.readMetrics.collectors()...)
+	collectors = append(collectors, poolCollector{db: c.db})
+
+	if c.skippedJobs != nil {
+		collectors = append(collectors, c.skippedJobs)
+	}
+
+	if c.tenantMetrics != nil {
+		collectors = append(collectors, c.tenantMetrics.collectors()...)
+		collectors = append(collectors, tenantUsageCollector{client: c})
+	}
+
+	if c.topMetrics != nil {
+		collectors = append(collectors, topMetricsCollector{topMetrics: c.topMetrics})
+	}
+
+	if c.elector != nil {
+		collectors = append(collectors, electionCollector{elector: c.elector})
+	}
+	return collectors
+}
+
+// Describe implements prometheus.Collector.
+func (c *Client) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range c.collectors() {
+		m.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Client) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.collectors() {
+		m.Collect(ch)
+	}
+}
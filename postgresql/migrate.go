@@ -0,0 +1,156 @@
+package pgprometheus
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+const (
+	sqlRawTimeRange = "SELECT min(prom_time(sample)), max(prom_time(sample)) FROM %s"
+	sqlRawSamples   = "SELECT prom_time(sample), prom_name(sample), prom_value(sample), prom_labels(sample) FROM %s WHERE prom_time(sample) >= $1 AND prom_time(sample) < $2"
+)
+
+// MigrationProgress reports the progress of a migration after each window
+type MigrationProgress struct {
+	// Done is the end of the last migrated window
+	Done         time.Time
+	Start        time.Time
+	End          time.Time
+	Samples      int
+	Transactions int
+}
+
+// Fraction returns the migrated fraction of the time range
+func (p MigrationProgress) Fraction() float64 {
+	total := p.End.Sub(p.Start)
+
+	if total <= 0 {
+		return 1
+	}
+	return float64(p.Done.Sub(p.Start)) / float64(total)
+}
+
+// checkMigration checks that the raw pg_prometheus table from can be migrated
+// into the tables of the client
+func (c *Client) checkMigration(from string) error {
+	if from == c.cfg.table {
+		return fmt.Errorf("the raw table %s must be migrated into a table of another name", from)
+	}
+
+	if c.cfg.usePgPrometheus && !c.cfg.pgPrometheusNormalize {
+		return fmt.Errorf("%s uses the raw samples schema, enable -pg.prometheus-normalized-schema or disable -pg.use-pg-prometheus", c.cfg.table)
+	}
+
+	columns, err := c.tableColumns(from + "_samples")
+
+	if err != nil {
+		return err
+	}
+
+	if columns["sample"] != "prom_sample" {
+		return fmt.Errorf("%s_samples is not a raw pg_prometheus table", from)
+	}
+	return nil
+}
+
+// RawTimeRange returns the time range of the samples of a raw pg_prometheus
+// table
+func (c *Client) RawTimeRange(from string) (time.Time, time.Time, error) {
+	if err := c.checkMigration(from); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	var start, end *time.Time
+
+	if err := c.db.QueryRow(fmt.Sprintf(sqlRawTimeRange, ident(from, "_samples"))).Scan(&start, &end); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if start == nil || end == nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("%s_samples is empty", from)
+	}
+	return *start, *end, nil
+}
+
+// MigrateRaw copies the samples of the raw pg_prometheus table from into the
+// normalized tables of the client, one window of time at a time, in
+// transactions of up to batchSize samples. Migrating a window twice writes its
+// samples twice, so an interrupted migration is resumed from the end of the
+// last reported window.
+func (c *Client) MigrateRaw(ctx context.Context, from string, start, end time.Time, window time.Duration, batchSize int,
+	progress func(MigrationProgress)) error {
+	if err := c.checkMigration(from); err != nil {
+		return err
+	}
+
+	stats := &ImportStats{}
+	imp := c.newImporter(ctx, ImportOptions{BatchSize: batchSize}, stats)
+
+	for _, w := range importWindows(timestamp(start), timestamp(end)+1, window) {
+		begin := time.Now()
+
+		if err := c.migrateWindow(imp, from, toTimestamp(w.start), toTimestamp(w.end)); err != nil {
+			return err
+		}
+
+		if err := imp.flush(); err != nil {
+			return err
+		}
+
+		log.Debug("msg", "Migrated raw samples", "from", from, "start", toTimestamp(w.start), "end", toTimestamp(w.end), "duration", time.Since(begin).Seconds())
+
+		done := toTimestamp(w.end)
+		if done.After(end) {
+			done = end
+		}
+
+		progress(MigrationProgress{
+			Done:         done,
+			Start:        start,
+			End:          end,
+			Samples:      stats.Samples,
+			Transactions: stats.Transactions,
+		})
+	}
+	return nil
+}
+
+func (c *Client) migrateWindow(imp *importer, from string, start, end time.Time) error {
+	rows, err := c.db.QueryContext(imp.ctx, fmt.Sprintf(sqlRawSamples, ident(from, "_samples")), start, end)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			ts     time.Time
+			name   string
+			value  float64
+			labels sampleLabels
+		)
+
+		if err = rows.Scan(&ts, &name, &value, &labels); err != nil {
+			return err
+		}
+
+		metric := make(model.Metric, len(labels.Map)+1)
+		for k, v := range labels.Map {
+			metric[model.LabelName(k)] = model.LabelValue(v)
+		}
+		metric[model.MetricNameLabel] = model.LabelValue(name)
+
+		err = imp.add(&model.Sample{Metric: metric, Value: model.SampleValue(value), Timestamp: model.TimeFromUnixNano(ts.UnixNano())})
+
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
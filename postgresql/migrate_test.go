@@ -0,0 +1,41 @@
+package pgprometheus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMigrationProgress(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, c := range []struct {
+		done, end time.Time
+		expected  float64
+	}{
+		{start.Add(time.Hour), start.Add(4 * time.Hour), 0.25},
+		{start.Add(4 * time.Hour), start.Add(4 * time.Hour), 1},
+		{start, start, 1},
+	} {
+		p := MigrationProgress{Done: c.done, Start: start, End: c.end}
+
+		if actual := p.Fraction(); actual != c.expected {
+			t.Errorf("%d: expected %v, got %v", i, c.expected, actual)
+		}
+	}
+}
+
+func TestCheckMigration(t *testing.T) {
+	for i, c := range []struct {
+		cfg  Config
+		from string
+	}{
+		{Config{table: "metrics", usePgPrometheus: true, pgPrometheusNormalize: true}, "metrics"},
+		{Config{table: "metrics_v2", usePgPrometheus: true, pgPrometheusNormalize: false}, "metrics"},
+	} {
+		client := &Client{cfg: &c.cfg}
+
+		if err := client.checkMigration(c.from); err == nil {
+			t.Errorf("%d: expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+
+	"github.com/prometheus/common/model"
+)
+
+// The native schema mirrors the normalized pg_prometheus schema, but is
+// created and written by the adapter itself so that it works without the
+// pg_prometheus extension and can store labels in other formats than JSONB.
+
+const (
+	labelsFormatJSONB  = "jsonb"
+	labelsFormatHstore = "hstore"
+	labelsFormatArrays = "arrays"
+
+	valueTypeDouble  = "double"
+	valueTypeReal    = "real"
+	valueTypeNumeric = "numeric"
+
+	sqlCreateNativeTmpTable = "CREATE TEMPORARY TABLE IF NOT EXISTS %s(time TIMESTAMPTZ, name TEXT, value DOUBLE PRECISION, labels JSONB) ON COMMIT DELETE ROWS;"
+	sqlInsertNativeLabels   = "INSERT INTO %[1]s (metric_name, %[3]s) SELECT tmp.name, %[4]s FROM (SELECT DISTINCT name, labels FROM %[2]s) tmp ON CONFLICT DO NOTHING"
+	sqlInsertNativeValues   = "INSERT INTO %[1]s (time, value, labels_id) SELECT tmp.time, tmp.value, l.id FROM %[2]s tmp INNER JOIN %[3]s l ON l.metric_name = tmp.name AND (%[4]s) = (%[5]s)"
+)
+
+// labelsFormat generates the SQL for a particular representation of the
+// labels of a series
+type labelsFormat interface {
+	name() string
+	// extension returns the extension required by the format, if any
+	extension() string
+	columnDefs() string
+	columns() []string
+	// fromJSON converts a JSONB expression into values for the columns
+	fromJSON(expr string) string
+	// toJSON converts the columns into a JSONB object
+	toJSON() string
+	// ginIndex returns the columns of a GIN index of the given type
+	ginIndex(indexType string) (string, error)
+	value(label string) string
+	has(label string) string
+	// each returns a set-returning expression of the labels as rows of
+	// p(key, value)
+	each() string
+	// contains returns a predicate on the labels including all of labels,
+	// with their names and values bound to params
+	contains(labels map[string]string, params *queryParams) (string, error)
+}
+
+var labelsFormats = map[string]labelsFormat{
+	labelsFormatJSONB:  jsonbLabels{},
+	labelsFormatHstore: hstoreLabels{},
+	labelsFormatArrays: arrayLabels{},
+}
+
+func (c *Client) labelsFormat() labelsFormat {
+	if format, ok := labelsFormats[c.cfg.labelsFormat]; ok {
+		return format
+	}
+	return jsonbLabels{}
+}
+
+// valueTypes are the SQL types of the value column, as reported by
+// format_type
+var valueTypes = map[string]string{
+	valueTypeDouble:  "double precision",
+	valueTypeReal:    "real",
+	valueTypeNumeric: "numeric",
+}
+
+func (c *Client) valueType() string {
+	if valueType, ok := valueTypes[c.cfg.valueType]; ok {
+		return valueType
+	}
+	return valueTypes[valueTypeDouble]
+}
+
+// minNumericInfinityVersion is the first server version whose numeric type
+// stores infinities
+const minNumericInfinityVersion = 140000
+
+// storable returns whether the value column stores v. real overflows beyond
+// and underflows below single precision, and numeric stores no infinities
+// before PostgreSQL 14.
+func (c *Client) storable(v float64) bool {
+	switch c.valueType() {
+	case valueTypes[valueTypeReal]:
+		f := float32(v)
+		return !(math.IsInf(float64(f), 0) && !math.IsInf(v, 0)) && !(f == 0 && v != 0)
+	case valueTypes[valueTypeNumeric]:
+		return c.numericInfinity || !math.IsInf(v, 0)
+	}
+	return true
+}
+
+// dropUnstorable drops the samples whose value the value column does not
+// store, which would fail the whole batch otherwise. It returns the samples
+// kept and the number dropped.
+func (c *Client) dropUnstorable(samples model.Samples) (model.Samples, int) {
+	var kept model.Samples
+
+	for i, s := range samples {
+		if c.storable(float64(s.Value)) {
+			if kept != nil {
+				kept = append(kept, s)
+			}
+			continue
+		}
+
+		// Only copies the samples once the first one is dropped
+		if kept == nil {
+			kept = make(model.Samples, i, len(samples))
+			copy(kept, samples[:i])
+		}
+	}
+
+	if kept == nil {
+		return samples, 0
+	}
+	return kept, len(samples) - len(kept)
+}
+
+// valueColumn returns the value column of the values table v as double
+// precision, which samples are read as
+func (c *Client) valueColumn() string {
+	if c.valueType() == valueTypes[valueTypeDouble] {
+		return "v.value"
+	}
+	return "v.value::float8 AS value"
+}
+
+type jsonbLabels struct{}
+
+func (jsonbLabels) name() string                { return labelsFormatJSONB }
+func (jsonbLabels) extension() string           { return "" }
+func (jsonbLabels) columnDefs() string          { return "labels JSONB NOT NULL" }
+func (jsonbLabels) columns() []string           { return []string{"labels"} }
+func (jsonbLabels) fromJSON(expr string) string { return expr }
+func (jsonbLabels) toJSON() string              { return "labels" }
+
+func (jsonbLabels) ginIndex(indexType string) (string, error) {
+	switch indexType {
+	case labelsIndexGin:
+		return "labels", nil
+	case labelsIndexGinPath:
+		return "labels jsonb_path_ops", nil
+	}
+	return "", nil
+}
+
+func (jsonbLabels) value(label string) string {
+	return fmt.Sprintf("labels->>'%s'", escapeValue(label))
+}
+
+func (jsonbLabels) each() string {
+	return "jsonb_each_text(labels) AS p(key, value)"
+}
+
+func (jsonbLabels) has(label string) string {
+	return fmt.Sprintf("labels ? '%s'", escapeValue(label))
+}
+
+func (jsonbLabels) contains(labels map[string]string, params *queryParams) (string, error) {
+	labelsJSON, err := json.Marshal(labels)
+
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("labels @> %s", params.value(string(labelsJSON), "jsonb")), nil
+}
+
+type hstoreLabels struct{}
+
+func (hstoreLabels) name() string       { return labelsFormatHstore }
+func (hstoreLabels) extension() string  { return "hstore" }
+func (hstoreLabels) columnDefs() string { return "labels HSTORE NOT NULL" }
+func (hstoreLabels) columns() []string  { return []string{"labels"} }
+func (hstoreLabels) toJSON() string     { return "hstore_to_jsonb(labels)" }
+
+func (hstoreLabels) fromJSON(expr string) string {
+	return fmt.Sprintf("hstore(%s, %s)", jsonKeys(expr), jsonValues(expr))
+}
+
+func (hstoreLabels) ginIndex(indexType string) (string, error) {
+	switch indexType {
+	case labelsIndexGin:
+		return "labels", nil
+	case labelsIndexGinPath:
+		return "", fmt.Errorf("%s indexes are not supported with the %s labels format", labelsIndexGinPath, labelsFormatHstore)
+	}
+	return "", nil
+}
+
+func (hstoreLabels) value(label string) string {
+	return fmt.Sprintf("labels->'%s'", escapeValue(label))
+}
+
+func (hstoreLabels) each() string {
+	return "each(labels) AS p(key, value)"
+}
+
+func (hstoreLabels) has(label string) string {
+	return fmt.Sprintf("labels ? '%s'", escapeValue(label))
+}
+
+func (hstoreLabels) contains(labels map[string]string, params *queryParams) (string, error) {
+	keys, values := sortedLabelArrays(labels, params)
+	return fmt.Sprintf("labels @> hstore(%s, %s)", keys, values), nil
+}
+
+// arrayLabels stores label names and values in two parallel arrays, sorted
+// by label name
+type arrayLabels struct{}
+
+func (arrayLabels) name() string      { return labelsFormatArrays }
+func (arrayLabels) extension() string { return "" }
+func (arrayLabels) columnDefs() string {
+	return "label_keys TEXT[] NOT NULL, label_values TEXT[] NOT NULL"
+}
+func (arrayLabels) columns() []string { return []string{"label_keys", "label_values"} }
+func (arrayLabels) toJSON() string    { return "jsonb_object(label_keys, label_values)" }
+
+func (arrayLabels) fromJSON(expr string) string {
+	return fmt.Sprintf("%s, %s", jsonKeys(expr), jsonValues(expr))
+}
+
+func (arrayLabels) ginIndex(indexType string) (string, error) {
+	switch indexType {
+	case labelsIndexGin:
+		return "label_keys, label_values", nil
+	case labelsIndexGinPath:
+		return "", fmt.Errorf("%s indexes are not supported with the %s labels format", labelsIndexGinPath, labelsFormatArrays)
+	}
+	return "", nil
+}
+
+func (arrayLabels) value(label string) string {
+	return fmt.Sprintf("label_values[array_position(label_keys, '%s')]", escapeValue(label))
+}
+
+func (arrayLabels) each() string {
+	return "unnest(label_keys, label_values) AS p(key, value)"
+}
+
+func (arrayLabels) has(label string) string {
+	return fmt.Sprintf("'%s' = ANY(label_keys)", escapeValue(label))
+}
+
+func (f arrayLabels) contains(labels map[string]string, params *queryParams) (string, error) {
+	keys, values := sortedLabelArrays(labels, params)
+	// The containment checks can use the GIN index, but do not check that
+	// keys and values are paired up
+	predicates := []string{fmt.Sprintf("label_keys @> %s AND label_values @> %s", keys, values)}
+
+	for _, k := range createOrderedKeys(&labels) {
+		predicates = append(predicates, fmt.Sprintf("%s = %s", f.value(k), params.value(labels[k], "")))
+	}
+	return strings.Join(predicates, " AND "), nil
+}
+
+func jsonKeys(expr string) string {
+	return fmt.Sprintf("ARRAY(SELECT key FROM jsonb_each_text(%s) ORDER BY key)", expr)
+}
+
+func jsonValues(expr string) string {
+	return fmt.Sprintf("ARRAY(SELECT value FROM jsonb_each_text(%s) ORDER BY key)", expr)
+}
+
+// sortedLabelArrays returns ARRAY expressions of the label names and their
+// values bound to params, in label name order
+func sortedLabelArrays(labels map[string]string, params *queryParams) (string, string) {
+	keys := createOrderedKeys(&labels)
+	quotedKeys := make([]string, 0, len(keys))
+	quotedValues := make([]string, 0, len(keys))
+
+	for _, k := range keys {
+		quotedKeys = append(quotedKeys, params.value(k, "text"))
+	}
+
+	for _, k := range keys {
+		quotedValues = append(quotedValues, params.value(labels[k], "text"))
+	}
+	return fmt.Sprintf("ARRAY[%s]", strings.Join(quotedKeys, ", ")),
+		fmt.Sprintf("ARRAY[%s]", strings.Join(quotedValues, ", "))
+}
+
+func qualifiedColumns(alias string, columns []string) string {
+	qualified := make([]string, 0, len(columns))
+
+	for _, column := range columns {
+		qualified = append(qualified, fmt.Sprintf("%s.%s", alias, column))
+	}
+	return strings.Join(qualified, ", ")
+}
+
+// nativeSamples returns a FROM item joining the values and labels tables
+func (c *Client) nativeSamples(table string) string {
+	return fmt.Sprintf("(SELECT v.time, %s, l.metric_name AS name, %s FROM %s v INNER JOIN %s l ON l.id = v.labels_id) AS samples",
+		c.valueColumn(), qualifiedColumns("l", c.labelsFormat().columns()), ident(table, "_values"), ident(table, "_labels"))
+}
+
+// createNativeTable creates the adapter-managed tables for the given view
+// name. It returns false if they already exist.
+func (c *Client) createNativeTable(tx *sql.Tx, table string) (bool, error) {
+	var exists bool
+
+	err := tx.QueryRow("SELECT to_regclass($1) IS NOT NULL", ident(table, "_values")).Scan(&exists)
+
+	if err != nil || exists {
+		return false, err
+	}
+
+	labels := c.labelsFormat()
+	ginColumns, err := labels.ginIndex(c.cfg.labelsIndex)
+
+	if err != nil {
+		return false, err
+	}
+
+	labelsTable, valuesTable := ident(table, "_labels"), ident(table, "_values")
+
+	stmts := []string{
+		fmt.Sprintf("CREATE TABLE %s (id SERIAL PRIMARY KEY, metric_name TEXT NOT NULL, %s, UNIQUE (metric_name, %s))",
+			labelsTable, labels.columnDefs(), strings.Join(labels.columns(), ", ")),
+		fmt.Sprintf("CREATE TABLE %s (time TIMESTAMPTZ NOT NULL, value %s, labels_id INTEGER NOT NULL)%s",
+			valuesTable, strings.ToUpper(c.valueType()), c.partitionClause()),
+		fmt.Sprintf("CREATE INDEX ON %s (labels_id, time DESC)", valuesTable),
+		fmt.Sprintf("CREATE VIEW %s AS SELECT v.time, l.metric_name AS name, v.value, %s AS labels FROM %s v INNER JOIN %s l ON l.id = v.labels_id",
+			quoteIdent(table), labels.toJSON(), valuesTable, labelsTable),
+	}
+
+	if len(ginColumns) > 0 {
+		stmts = append(stmts, fmt.Sprintf("CREATE INDEX ON %s USING GIN (%s)", labelsTable, ginColumns))
+	}
+
+	switch c.cfg.timeIndex {
+	case timeIndexBtree:
+		stmts = append(stmts, fmt.Sprintf("CREATE INDEX ON %s (time DESC)", valuesTable))
+	case timeIndexBrin:
+		stmts = append(stmts, fmt.Sprintf("CREATE INDEX ON %s USING BRIN (time)", valuesTable))
+	default:
+		return false, fmt.Errorf("unknown time index type %q", c.cfg.timeIndex)
+	}
+
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(stmt); err != nil {
+			return false, err
+		}
+	}
+
+	if c.cfg.useTimescaleDb {
+		var rows *sql.Rows
+
+		if c.cfg.distributed {
+			var partitions interface{}
+			if c.cfg.pgPrometheusPartitions > 0 {
+				partitions = c.cfg.pgPrometheusPartitions
+			}
+
+			rows, err = tx.Query(`SELECT create_distributed_hypertable($1, 'time', 'labels_id',
+				number_partitions => $2, chunk_time_interval => $3::interval, create_default_indexes => false,
+				replication_factor => $4, data_nodes => string_to_array(NULLIF($5, ''), ',')::name[])`,
+				valuesTable, partitions, c.cfg.pgPrometheusChunkInterval.String(),
+				c.cfg.replicationFactor, c.cfg.dataNodes)
+		} else {
+			rows, err = tx.Query("SELECT create_hypertable($1, 'time', chunk_time_interval => $2::interval, create_default_indexes => false)",
+				valuesTable, c.cfg.pgPrometheusChunkInterval.String())
+		}
+
+		if err != nil {
+			return false, err
+		}
+		rows.Close()
+	}
+
+	err = c.createPartitions(tx, table)
+
+	if err == nil && c.cfg.citus {
+		err = c.distributeCitusTables(tx, table)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	log.Info("msg", "Created tables", "table", table, "labels_format", labels.name(), "value_type", c.valueType())
+
+	return true, nil
+}
+
+// distributeCitusTables shards the values table by series across the Citus
+// workers, and replicates the labels table to all of them so that joins
+// between the two, and hence all read queries, run on the workers.
+func (c *Client) distributeCitusTables(tx *sql.Tx, table string) error {
+	if c.cfg.citusShardCount > 0 {
+		_, err := tx.Exec("SELECT set_config('citus.shard_count', $1, true)", strconv.Itoa(c.cfg.citusShardCount))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query("SELECT create_reference_table($1)", ident(table, "_labels"))
+
+	if err != nil {
+		return err
+	}
+	rows.Close()
+
+	rows, err = tx.Query("SELECT create_distributed_table($1, 'labels_id')", ident(table, "_values"))
+
+	if err != nil {
+		return err
+	}
+	rows.Close()
+
+	log.Info("msg", "Distributed tables with Citus", "table", table)
+
+	return nil
+}
+
+// checkDataNodes verifies that the database is the access node of a
+// multi-node TimescaleDB cluster
+func checkDataNodes(tx *sql.Tx) error {
+	var dataNodes int
+
+	err := tx.QueryRow("SELECT count(*) FROM timescaledb_information.data_nodes").Scan(&dataNodes)
+
+	if err != nil {
+		return fmt.Errorf("could not list data nodes, is this a multi-node TimescaleDB access node? %v", err)
+	}
+
+	if dataNodes == 0 {
+		return fmt.Errorf("no data nodes are attached to the access node")
+	}
+
+	log.Info("msg", "Using distributed hypertables", "data_nodes", dataNodes)
+
+	return nil
+}
+
+// writeNativeSamples copies samples into the given adapter-managed table as
+// part of tx
+func (c *Client) writeNativeSamples(ctx context.Context, tx *sql.Tx, table string, samples model.Samples) error {
+	rows := make([][]interface{}, 0, len(samples))
+
+	for _, sample := range samples {
+		labels, err := c.labels.intern(sample.Metric, labelsJSON)
+
+		if err != nil {
+			log.Error("msg", "Error encoding labels", "metric", sample.Metric, "err", err)
+			return err
+		}
+
+		if c.cfg.pgPrometheusLogSamples {
+			fmt.Println(metricString(sample.Metric), sample.Value, sample.Timestamp.UnixNano()/1000000)
+		}
+
+		rows = append(rows, []interface{}{sample.Timestamp.Time(), string(sample.Metric[model.MetricNameLabel]), float64(sample.Value), labels})
+	}
+
+	err := c.copyFrom(ctx, tx, c.tmpTable(), []string{"time", "name", "value", "labels"}, rows)
+	if err != nil {
+		log.Error("msg", "Error copying samples", "err", err)
+		return err
+	}
+
+	format := c.labelsFormat()
+
+	_, err = c.execTx(ctx, tx, c.queryComment(endpointWrite)+fmt.Sprintf(sqlInsertNativeLabels, ident(table, "_labels"), c.tmpTable(),
+		strings.Join(format.columns(), ", "), format.fromJSON("tmp.labels")))
+	if err != nil {
+		log.Error("msg", "Error executing labels statement", "err", err)
+		return err
+	}
+
+	_, err = c.execTx(ctx, tx, c.queryComment(endpointWrite)+fmt.Sprintf(sqlInsertNativeValues, ident(table, "_values"), c.tmpTable(), ident(table, "_labels"),
+		qualifiedColumns("l", format.columns()), format.fromJSON("tmp.labels")))
+	if err != nil {
+		log.Error("msg", "Error executing values statement", "err", err)
+		return err
+	}
+
+	if c.cfg.tablePerMetric {
+		_, err = c.execTx(ctx, tx, fmt.Sprintf(sqlTruncateTmpTable, c.tmpTable()))
+		if err != nil {
+			log.Error("msg", "Error truncating tmp table", "err", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// labelsJSON encodes all labels except the metric name as a JSON object
+func labelsJSON(m model.Metric) (string, error) {
+	labels := make(map[string]string, len(m))
+
+	for name, value := range m {
+		if name != model.MetricNameLabel {
+			labels[string(name)] = string(value)
+		}
+	}
+
+	labelsJSON, err := json.Marshal(labels)
+	return string(labelsJSON), err
+}
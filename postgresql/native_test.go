@@ -0,0 +1,251 @@
+package pgprometheus
+
+import (
+	"encoding/json"
+	"flag"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestBuildCommandLabelsFormats(t *testing.T) {
+	q := &prompb.Query{
+		StartTimestampMs: 0,
+		EndTimestampMs:   20000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "cpu_usage"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "nginx"},
+			{Type: prompb.LabelMatcher_RE, Name: "host", Value: "local.*"},
+			{Type: prompb.LabelMatcher_EQ, Name: "mode", Value: ""},
+		},
+	}
+
+	testCases := []struct {
+		format   string
+		expected []string
+	}{
+		{
+			format: labelsFormatJSONB,
+			expected: []string{
+				"SELECT time, name, value, labels FROM (SELECT v.time, v.value, l.metric_name AS name, l.labels FROM \"metrics_values\" v",
+				"labels->>'host' ~ '^local.*$'",
+				"((labels ? 'mode') = false OR (labels->>'mode' = ''))",
+				`labels @> '{"job":"nginx"}'`,
+			},
+		},
+		{
+			format: labelsFormatHstore,
+			expected: []string{
+				"SELECT time, name, value, hstore_to_jsonb(labels) FROM",
+				"labels->'host' ~ '^local.*$'",
+				"((labels ? 'mode') = false OR (labels->'mode' = ''))",
+				"labels @> hstore(ARRAY['job'], ARRAY['nginx'])",
+			},
+		},
+		{
+			format: labelsFormatArrays,
+			expected: []string{
+				"SELECT time, name, value, jsonb_object(label_keys, label_values) FROM (SELECT v.time, v.value, l.metric_name AS name, l.label_keys, l.label_values FROM",
+				"label_values[array_position(label_keys, 'host')] ~ '^local.*$'",
+				"(('mode' = ANY(label_keys)) = false OR (label_values[array_position(label_keys, 'mode')] = ''))",
+				"label_keys @> ARRAY['job'] AND label_values @> ARRAY['nginx'] AND label_values[array_position(label_keys, 'job')] = 'nginx'",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		c := &Client{
+			cfg: &Config{
+				table:                 "metrics",
+				pgPrometheusNormalize: true,
+				labelsFormat:          tc.format,
+			},
+		}
+
+		cmd, err := c.buildCommand(q)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range tc.expected {
+			if !strings.Contains(cmd, e) {
+				t.Errorf("%s: expected %q in command %s", tc.format, e, cmd)
+			}
+		}
+	}
+}
+
+func TestBuildCommandExoticLabelValues(t *testing.T) {
+	q := &prompb.Query{
+		StartTimestampMs: 0,
+		EndTimestampMs:   20000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "requests_total"},
+			{Type: prompb.LabelMatcher_EQ, Name: "city", Value: "Zürich"},
+			{Type: prompb.LabelMatcher_EQ, Name: "owner", Value: "O'Brien"},
+			{Type: prompb.LabelMatcher_EQ, Name: "path", Value: `C:\temp "new"`},
+			{Type: prompb.LabelMatcher_NEQ, Name: "team", Value: "it's"},
+			{Type: prompb.LabelMatcher_RE, Name: "region", Value: "東京.*"},
+		},
+	}
+
+	testCases := []struct {
+		format   string
+		expected []string
+	}{
+		{
+			format: labelsFormatJSONB,
+			expected: []string{
+				`labels->>'team' != 'it''s'`,
+				`labels->>'region' ~ '^東京.*$'`,
+				`labels @> '{"city":"Zürich","owner":"O''Brien","path":"C:\\temp \"new\""}'`,
+			},
+		},
+		{
+			format: labelsFormatHstore,
+			expected: []string{
+				`labels->'team' != 'it''s'`,
+				`labels @> hstore(ARRAY['city', 'owner', 'path'], ARRAY['Zürich', 'O''Brien', 'C:\temp "new"'])`,
+			},
+		},
+		{
+			format: labelsFormatArrays,
+			expected: []string{
+				`label_values[array_position(label_keys, 'team')] != 'it''s'`,
+				`label_values @> ARRAY['Zürich', 'O''Brien', 'C:\temp "new"']`,
+				`label_values[array_position(label_keys, 'owner')] = 'O''Brien'`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		c := &Client{
+			cfg: &Config{
+				table:                 "metrics",
+				pgPrometheusNormalize: true,
+				labelsFormat:          tc.format,
+			},
+		}
+
+		cmd, err := c.buildCommand(q)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range tc.expected {
+			if !strings.Contains(cmd, e) {
+				t.Errorf("%s: expected %q in command %s", tc.format, e, cmd)
+			}
+		}
+	}
+}
+
+func TestLabelsJSONRoundTrip(t *testing.T) {
+	metric := model.Metric{
+		model.MetricNameLabel: "requests_total",
+		"city":                "Zürich",
+		"owner":               "O'Brien",
+		"path":                `C:\temp "new"`,
+		"note":                "line one\nline two\t<b>&</b>",
+		"emoji":               "☃",
+	}
+
+	labels, err := labelsJSON(metric)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]string
+
+	if err = json.Unmarshal([]byte(labels), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range metric {
+		if name == model.MetricNameLabel {
+			continue
+		}
+		if decoded[string(name)] != string(value) {
+			t.Errorf("label %s: expected %q, got %q", name, value, decoded[string(name)])
+		}
+	}
+}
+
+func TestValueType(t *testing.T) {
+	testCases := []struct {
+		valueType string
+		column    string
+		valid     bool
+	}{
+		{valueType: "", column: "v.value", valid: true},
+		{valueType: valueTypeDouble, column: "v.value", valid: true},
+		{valueType: valueTypeReal, column: "v.value::float8 AS value", valid: true},
+		{valueType: valueTypeNumeric, column: "v.value::float8 AS value", valid: true},
+		{valueType: "decimal", column: "v.value", valid: false},
+	}
+
+	for _, tc := range testCases {
+		cfg := &Config{}
+		RegisterFlags(flag.NewFlagSet("test", flag.ContinueOnError), cfg)
+		cfg.usePgPrometheus, cfg.valueType = false, tc.valueType
+
+		c := &Client{cfg: cfg}
+
+		if column := c.valueColumn(); column != tc.column {
+			t.Errorf("%q: expected value column %s, got %s", tc.valueType, tc.column, column)
+		}
+
+		if err := c.validateStorage(); (err == nil) != tc.valid {
+			t.Errorf("%q: unexpected validation error %v", tc.valueType, err)
+		}
+
+		c.cfg.usePgPrometheus = true
+
+		if err := c.validateStorage(); (err == nil) != (tc.valid && tc.column == "v.value") {
+			t.Errorf("%q: unexpected validation error with pg_prometheus %v", tc.valueType, err)
+		}
+	}
+}
+
+func TestDropUnstorable(t *testing.T) {
+	values := []float64{1.5, math.Inf(1), math.Inf(-1), math.NaN(), 1e300, -1e300, 1e-300, 0, math.MaxFloat32}
+
+	testCases := []struct {
+		valueType       string
+		numericInfinity bool
+		kept            int
+	}{
+		{valueType: valueTypeDouble, kept: 9},
+		// Infinities and NaN are stored, but not beyond single precision
+		{valueType: valueTypeReal, kept: 6},
+		{valueType: valueTypeNumeric, kept: 7},
+		{valueType: valueTypeNumeric, numericInfinity: true, kept: 9},
+	}
+
+	for _, tc := range testCases {
+		c := &Client{cfg: &Config{valueType: tc.valueType}, numericInfinity: tc.numericInfinity}
+
+		samples := make(model.Samples, 0, len(values))
+		for _, v := range values {
+			samples = append(samples, &model.Sample{Value: model.SampleValue(v)})
+		}
+
+		kept, dropped := c.dropUnstorable(samples)
+
+		if len(kept) != tc.kept || dropped != len(values)-tc.kept {
+			t.Errorf("%s: expected %d samples kept, got %d kept and %d dropped", tc.valueType, tc.kept, len(kept), dropped)
+		}
+
+		for _, s := range kept {
+			if !c.storable(float64(s.Value)) {
+				t.Errorf("%s: unexpected value %v kept", tc.valueType, s.Value)
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package pgprometheus
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+const (
+	partitioningPgPartman = "pg_partman"
+	partitioningNative    = "native"
+
+	partitionTimeFormat = "20060102_1504"
+	maxIdentifierLen    = 63
+)
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (c *Client) validatePartitioning() error {
+	switch c.cfg.partitioning {
+	case "":
+		return nil
+	case partitioningPgPartman, partitioningNative:
+	default:
+		return fmt.Errorf("unknown partitioning %q", c.cfg.partitioning)
+	}
+
+	if c.cfg.usePgPrometheus || c.cfg.useTimescaleDb {
+		return fmt.Errorf("%s partitioning requires -pg.use-timescaledb=false and -pg.use-pg-prometheus=false", c.cfg.partitioning)
+	}
+
+	return nil
+}
+
+// partitionClause returns the PARTITION BY clause of the values table
+func (c *Client) partitionClause() string {
+	if len(c.cfg.partitioning) == 0 {
+		return ""
+	}
+	return " PARTITION BY RANGE (time)"
+}
+
+func (c *Client) createPartitioningExtension(tx *sql.Tx) error {
+	if c.cfg.partitioning != partitioningPgPartman {
+		return nil
+	}
+
+	_, err := tx.Exec("CREATE SCHEMA IF NOT EXISTS partman")
+
+	if err == nil {
+		err = createExtension(tx, "pg_partman", "partman")
+	}
+	return err
+}
+
+// createPartitions sets up the time partitions of a newly created values table
+func (c *Client) createPartitions(tx *sql.Tx, table string) error {
+	parent := table + "_values"
+
+	switch c.cfg.partitioning {
+	case partitioningPgPartman:
+		return c.createPartmanParent(tx, parent)
+	case partitioningNative:
+		_, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s PARTITION OF %s DEFAULT%s", ident(parent, "_default"), quoteIdent(parent), c.partitionParameters()))
+
+		if err != nil {
+			return err
+		}
+		return c.createNativePartitions(tx, parent, time.Now())
+	}
+	return nil
+}
+
+func (c *Client) createPartmanParent(tx *sql.Tx, parent string) error {
+	rows, err := tx.Query("SELECT partman.create_parent(p_parent_table => current_schema() || '.' || $1, p_control => 'time', p_type => 'native', p_interval => $2, p_premake => $3)",
+		parent, c.cfg.pgPrometheusChunkInterval.String(), c.cfg.partitionPremake)
+
+	if err != nil {
+		return err
+	}
+	rows.Close()
+
+	if c.cfg.partitionRetention > 0 {
+		_, err = tx.Exec("UPDATE partman.part_config SET retention = $2, retention_keep_table = false WHERE parent_table = current_schema() || '.' || $1",
+			parent, c.cfg.partitionRetention.String())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// partitionName returns the name of the partition starting at the given
+// time
+func partitionName(parent string, start time.Time) string {
+	return limitIdentifier(parent, fmt.Sprintf("_p%s", start.UTC().Format(partitionTimeFormat)))
+}
+
+// limitIdentifier appends the suffix to the name, shortening the name if
+// needed to stay within PostgreSQL's identifier length
+func limitIdentifier(name, suffix string) string {
+	if len(name)+len(suffix) > maxIdentifierLen {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		hash := fmt.Sprintf("_%08x", h.Sum32())
+		name = name[:maxIdentifierLen-len(suffix)-len(hash)] + hash
+	}
+	return name + suffix
+}
+
+// createNativePartitions creates the partition covering now and the
+// configured number of future partitions
+func (c *Client) createNativePartitions(e execer, parent string, now time.Time) error {
+	interval := c.cfg.pgPrometheusChunkInterval
+	start := now.Truncate(interval)
+
+	for i := 0; i <= c.cfg.partitionPremake; i++ {
+		end := start.Add(interval)
+
+		_, err := e.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')%s",
+			quoteIdent(partitionName(parent, start)), quoteIdent(parent), start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339), c.partitionParameters()))
+
+		if err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// dropNativePartitions drops all partitions that only hold data older than
+// the retention period
+func (c *Client) dropNativePartitions(parent string, now time.Time) error {
+	// The partitions are returned as regclass text, which is quoted and
+	// qualified as needed
+	rows, err := c.db.Query(`SELECT p.oid::regclass::text FROM pg_inherits i
+		INNER JOIN pg_class p ON p.oid = i.inhrelid
+		WHERE i.inhparent = $1::regclass
+		AND (regexp_match(pg_get_expr(p.relpartbound, p.oid), 'TO \(''([^'']+)''\)'))[1]::timestamptz <= $2`,
+		quoteIdent(parent), now.Add(-c.cfg.partitionRetention))
+
+	if err != nil {
+		return err
+	}
+
+	var partitions []string
+
+	for rows.Next() {
+		var partition string
+
+		if err = rows.Scan(&partition); err != nil {
+			rows.Close()
+			return err
+		}
+		partitions = append(partitions, partition)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, partition := range partitions {
+		_, err = c.db.Exec(fmt.Sprintf("DROP TABLE %s", partition))
+
+		if err != nil {
+			return err
+		}
+
+		log.Info("msg", "Dropped expired partition", "partition", partition)
+	}
+	return nil
+}
+
+// runPartitionMaintenance periodically creates upcoming and drops expired
+// time partitions
+func (c *Client) runPartitionMaintenance() {
+	ticker := time.NewTicker(c.cfg.partitionMaintenance)
+
+	for range ticker.C {
+		c.runJob("partition_maintenance", c.cfg.partitionMaintenance, func(begin time.Time) error {
+			err := c.maintainPartitions()
+
+			if err != nil {
+				log.Error("msg", "Error running partition maintenance", "err", err)
+				return err
+			}
+
+			log.Debug("msg", "Ran partition maintenance", "duration", time.Since(begin).Seconds())
+			return nil
+		})
+	}
+}
+
+func (c *Client) maintainPartitions() error {
+	if c.cfg.partitioning == partitioningPgPartman {
+		_, err := c.db.Exec("SELECT partman.run_maintenance(p_analyze => false)")
+		return err
+	}
+
+	tables := []string{c.cfg.table}
+
+	if c.cfg.tablePerMetric {
+		var err error
+		tables, err = c.lookupMetricTables(nil)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+
+	for _, table := range tables {
+		parent := table + "_values"
+
+		err := c.createNativePartitions(c.db, parent, now)
+
+		if err == nil && c.cfg.partitionRetention > 0 {
+			err = c.dropNativePartitions(parent, now)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package pgprometheus
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPartitionName(t *testing.T) {
+	start := time.Date(2018, 3, 14, 12, 0, 0, 0, time.UTC)
+
+	name := partitionName("metrics_values", start)
+	if name != "metrics_values_p20180314_1200" {
+		t.Errorf("Unexpected partition name %s", name)
+	}
+
+	long := partitionName(metricTableName("metrics", strings.Repeat("a", 100))+"_values", start)
+	if len(long) > maxIdentifierLen {
+		t.Errorf("Partition name too long: %s", long)
+	}
+	if !strings.HasSuffix(long, "_p20180314_1200") {
+		t.Errorf("Partition name lost its time suffix: %s", long)
+	}
+}
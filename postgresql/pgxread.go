@@ -0,0 +1,81 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/stdlib"
+)
+
+// With the pgx driver, read queries run directly on a pgx connection taken
+// from the pool, which receives times and values in the binary format and
+// decodes them without the reflection of database/sql.
+
+// sampleRows are the rows of a read query
+type sampleRows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close() error
+}
+
+// pgxRows are the rows of a query on a pgx connection, which is returned to
+// the pool once they are closed
+type pgxRows struct {
+	*pgx.Rows
+	db   *sql.DB
+	conn *pgx.Conn
+}
+
+func (r *pgxRows) Close() error {
+	r.Rows.Close()
+	return stdlib.ReleaseConn(r.db, r.conn)
+}
+
+// queryPgx runs query on a pgx connection of the pool
+func (c *Client) queryPgx(ctx context.Context, query string, args []interface{}) (sampleRows, error) {
+	conn, err := acquirePgxConn(ctx, c.db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryEx(ctx, query, nil, args...)
+
+	if err != nil {
+		stdlib.ReleaseConn(c.db, conn)
+		return nil, err
+	}
+	return &pgxRows{Rows: rows, db: c.db, conn: conn}, nil
+}
+
+// acquirePgxConn takes a pgx connection of the pool, or gives up once ctx is
+// done. The pgx connection is only reachable through stdlib.AcquireConn, which
+// waits for a connection of an exhausted pool without a context, so the
+// connection it takes after ctx is done is released right away.
+func acquirePgxConn(ctx context.Context, db *sql.DB) (*pgx.Conn, error) {
+	type acquired struct {
+		conn *pgx.Conn
+		err  error
+	}
+
+	result := make(chan acquired, 1)
+
+	go func() {
+		conn, err := stdlib.AcquireConn(db)
+		result <- acquired{conn: conn, err: err}
+	}()
+
+	select {
+	case a := <-result:
+		return a.conn, a.err
+	case <-ctx.Done():
+		go func() {
+			if a := <-result; a.err == nil {
+				stdlib.ReleaseConn(db, a.conn)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
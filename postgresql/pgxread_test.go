@@ -0,0 +1,60 @@
+package pgprometheus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/stdlib"
+)
+
+func TestAcquirePgxConn(t *testing.T) {
+	db := newFakeDB().open(1)
+
+	// Connections of other drivers are not pgx connections
+	if _, err := acquirePgxConn(context.Background(), db); err != stdlib.ErrNotPgx {
+		t.Errorf("Expected %v, got %v", stdlib.ErrNotPgx, err)
+	}
+
+	held, err := db.Conn(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads give up on an exhausted pool once their context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err = acquirePgxConn(ctx, db); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	held.Close()
+
+	// The connection taken after the read gave up goes back to the pool
+	for i := 0; db.Stats().InUse > 0; i++ {
+		if i == 100 {
+			t.Fatal("Expected the connection to be released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueryReadPgxCanceled(t *testing.T) {
+	c := &Client{db: newFakeDB().open(1), cfg: &Config{driver: driverPgx}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	held, err := c.db.Conn(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	if _, err = c.queryRead(ctx, "SELECT 1", nil); err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+}
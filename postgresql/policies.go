@@ -0,0 +1,174 @@
+package pgprometheus
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// samplesTable returns the unquoted name of the table holding the samples of
+// the given view
+func (c *Client) samplesTable(table string) string {
+	if c.cfg.usePgPrometheus && !c.cfg.pgPrometheusNormalize {
+		return table + "_samples"
+	}
+	return table + "_values"
+}
+
+func (c *Client) validatePolicies() error {
+	if c.cfg.reorderChunks && (!c.cfg.useTimescaleDb || !c.cfg.pgPrometheusNormalize || c.cfg.distributed) {
+		return fmt.Errorf("reordering chunks requires TimescaleDB, the normalized schema and a hypertable that is not distributed")
+	}
+
+	if len(c.cfg.coldTablespace) > 0 {
+		if !c.cfg.useTimescaleDb || c.cfg.distributed {
+			return fmt.Errorf("moving chunks to a cold tablespace requires TimescaleDB and a hypertable that is not distributed")
+		}
+		if c.cfg.coldAfter <= 0 || c.cfg.tieringInterval <= 0 {
+			return fmt.Errorf("moving chunks to a cold tablespace requires a positive age and interval")
+		}
+	}
+	return nil
+}
+
+// addReorderPolicy has TimescaleDB cluster closed chunks of the values
+// hypertable by series and time, so that each series is stored contiguously
+func (c *Client) addReorderPolicy(tx *sql.Tx, table string) error {
+	valuesTable := ident(table, "_values")
+	index, err := seriesIndex(tx, valuesTable)
+
+	if err != nil {
+		return err
+	}
+
+	if len(index) == 0 {
+		_, err = tx.Exec(fmt.Sprintf("CREATE INDEX ON %s (labels_id, time DESC)", valuesTable))
+
+		if err == nil {
+			index, err = seriesIndex(tx, valuesTable)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query("SELECT add_reorder_policy($1, $2, if_not_exists => true)", valuesTable, index)
+
+	if err != nil {
+		return err
+	}
+	rows.Close()
+
+	log.Info("msg", "Added reorder policy", "table", valuesTable, "index", index)
+
+	return nil
+}
+
+// seriesIndex returns the name of the (labels_id, time DESC) index of the
+// quoted values table, if any
+func seriesIndex(tx *sql.Tx, valuesTable string) (string, error) {
+	var index string
+
+	err := tx.QueryRow(`SELECT i.relname FROM pg_index x
+		INNER JOIN pg_class i ON i.oid = x.indexrelid
+		WHERE x.indrelid = $1::regclass AND x.indnatts = 2
+		AND pg_get_indexdef(x.indexrelid) LIKE '%(labels_id, "time" DESC)'
+		LIMIT 1`, valuesTable).Scan(&index)
+
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return index, err
+}
+
+// runTiering periodically moves chunks older than the configured age to the
+// cold tablespace
+func (c *Client) runTiering() {
+	ticker := time.NewTicker(c.cfg.tieringInterval)
+
+	for range ticker.C {
+		c.runJob("tiering", c.cfg.tieringInterval, func(begin time.Time) error {
+			moved, err := c.moveColdChunks(begin.Add(-c.cfg.coldAfter))
+
+			if err != nil {
+				log.Error("msg", "Error moving chunks to the cold tablespace", "err", err)
+				return err
+			}
+
+			log.Debug("msg", "Moved chunks to the cold tablespace", "count", moved, "duration", time.Since(begin).Seconds())
+			return nil
+		})
+	}
+}
+
+func (c *Client) moveColdChunks(olderThan time.Time) (int, error) {
+	tables := []string{c.cfg.table}
+
+	if c.cfg.tablePerMetric {
+		var err error
+		tables, err = c.lookupMetricTables(nil)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	indexTablespace := c.cfg.coldIndexTablespace
+	if len(indexTablespace) == 0 {
+		indexTablespace = c.cfg.coldTablespace
+	}
+
+	moved := 0
+
+	for _, table := range tables {
+		chunks, err := c.warmChunks(c.samplesTable(table), olderThan)
+
+		if err != nil {
+			return moved, err
+		}
+
+		for _, chunk := range chunks {
+			// Each chunk is moved in its own transaction, since move_chunk
+			// locks the chunk for the duration of the copy
+			_, err = c.db.Exec("SELECT move_chunk(chunk => $1::regclass, destination_tablespace => $2, index_destination_tablespace => $3)",
+				chunk, c.cfg.coldTablespace, indexTablespace)
+
+			if err != nil {
+				return moved, err
+			}
+
+			log.Info("msg", "Moved chunk to the cold tablespace", "chunk", chunk, "tablespace", c.cfg.coldTablespace)
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// warmChunks returns the chunks of the hypertable older than the given time
+// that are not yet in the cold tablespace
+func (c *Client) warmChunks(hypertable string, olderThan time.Time) ([]string, error) {
+	rows, err := c.db.Query(`SELECT chunk::text FROM show_chunks($1::regclass, older_than => $2::timestamptz) chunk
+		INNER JOIN pg_class r ON r.oid = chunk
+		LEFT JOIN pg_tablespace t ON t.oid = r.reltablespace
+		WHERE t.spcname IS DISTINCT FROM $3`, quoteIdent(hypertable), olderThan, c.cfg.coldTablespace)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var chunks []string
+
+	for rows.Next() {
+		var chunk string
+
+		if err = rows.Scan(&chunk); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
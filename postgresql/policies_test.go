@@ -0,0 +1,51 @@
+package pgprometheus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidatePolicies(t *testing.T) {
+	testCases := []struct {
+		name  string
+		cfg   Config
+		valid bool
+	}{
+		{
+			name:  "reorder on TimescaleDB",
+			cfg:   Config{reorderChunks: true, useTimescaleDb: true, pgPrometheusNormalize: true},
+			valid: true,
+		},
+		{
+			name: "reorder without TimescaleDB",
+			cfg:  Config{reorderChunks: true, pgPrometheusNormalize: true},
+		},
+		{
+			name: "reorder on a distributed hypertable",
+			cfg:  Config{reorderChunks: true, useTimescaleDb: true, pgPrometheusNormalize: true, distributed: true},
+		},
+		{
+			name:  "cold tablespace",
+			cfg:   Config{coldTablespace: "slow", coldAfter: time.Hour, tieringInterval: time.Minute, useTimescaleDb: true},
+			valid: true,
+		},
+		{
+			name: "cold tablespace without an age",
+			cfg:  Config{coldTablespace: "slow", tieringInterval: time.Minute, useTimescaleDb: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		cfg := tc.cfg
+		c := &Client{cfg: &cfg}
+
+		err := c.validatePolicies()
+
+		if tc.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
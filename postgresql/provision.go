@@ -0,0 +1,137 @@
+package pgprometheus
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// The tables of a new tenant are created like the default tables, and then
+// adjusted by the statements of the tenant template, e.g. to set the
+// retention, chunk interval or compression of the tier of the tenant:
+//
+//   {{if eq .Tier "premium"}}
+//   SELECT set_chunk_time_interval('{{.Table}}_values', INTERVAL '1 day');
+//   {{else}}
+//   SELECT add_retention_policy('{{.Table}}_values', INTERVAL '30 days');
+//   {{end}}
+//
+// The template only runs when the tables of the tenant do not exist yet.
+
+const defaultTenantTier = "default"
+
+// tenantTier assigns the tenants matching the glob pattern to the tier
+type tenantTier struct {
+	pattern string
+	tier    string
+}
+
+// tenantTemplateData is passed to the tenant template
+type tenantTemplateData struct {
+	Tenant string
+	Tier   string
+	// Table is the name of the view of the tenant, and the prefix of its
+	// tables
+	Table string
+	// Schema is the schema of the tenant, or empty with -pg.tenant-mode=table
+	Schema string
+}
+
+// parseTenantTiers parses comma-separated pattern=tier pairs, e.g.
+// "acme=premium,team_*=standard"
+func parseTenantTiers(s string) ([]tenantTier, error) {
+	var tiers []tenantTier
+
+	for _, tier := range strings.Split(s, ",") {
+		tier = strings.TrimSpace(tier)
+		if len(tier) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(tier, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[1])) == 0 {
+			return nil, fmt.Errorf("invalid tenant tier %q, expected pattern=tier", tier)
+		}
+
+		pattern := strings.TrimSpace(parts[0])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid tenant pattern %q: %v", pattern, err)
+		}
+
+		tiers = append(tiers, tenantTier{pattern: pattern, tier: strings.TrimSpace(parts[1])})
+	}
+	return tiers, nil
+}
+
+// tierOf returns the tier of the first pattern matching the tenant
+func tierOf(tiers []tenantTier, tenant string) string {
+	for _, t := range tiers {
+		if ok, _ := path.Match(t.pattern, tenant); ok {
+			return t.tier
+		}
+	}
+	return defaultTenantTier
+}
+
+func loadTenantTemplate(filename string) (*template.Template, error) {
+	data, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return nil, err
+	}
+	return template.New(path.Base(filename)).Option("missingkey=error").Parse(string(data))
+}
+
+// tenantExists tells whether the tables of the tenant client config exist
+func (c *Client) tenantExists(cfg *Config) (bool, error) {
+	var exists bool
+
+	if c.cfg.tenantMode == tenantSchema {
+		err := c.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_class c INNER JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE n.nspname = $1 AND c.relname = $2)`, cfg.schema, cfg.table).Scan(&exists)
+		return exists, err
+	}
+
+	err := c.db.QueryRow("SELECT to_regclass($1) IS NOT NULL", quoteIdent(cfg.table)).Scan(&exists)
+	return exists, err
+}
+
+// provisionTenant runs the tenant template on the new tables of the tenant
+func (c *Client) provisionTenant(client *Client, tenant string) error {
+	if c.tenantTemplate == nil {
+		return nil
+	}
+
+	var stmts bytes.Buffer
+
+	err := c.tenantTemplate.Execute(&stmts, tenantTemplateData{
+		Tenant: tenant,
+		Tier:   tierOf(c.tenantTiers, tenant),
+		Table:  client.cfg.table,
+		Schema: client.cfg.schema,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(strings.TrimSpace(stmts.String())) == 0 {
+		return nil
+	}
+
+	tx, err := client.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(stmts.String()); err != nil {
+		return fmt.Errorf("error running the tenant template: %v", err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,70 @@
+package pgprometheus
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseTenantTiers(t *testing.T) {
+	tiers, err := parseTenantTiers("acme=premium, team_*=standard,")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for tenant, tier := range map[string]string{
+		"acme":    "premium",
+		"team_a":  "standard",
+		"acme_eu": defaultTenantTier,
+	} {
+		if got := tierOf(tiers, tenant); got != tier {
+			t.Errorf("Expected tier %s for tenant %s, got %s", tier, tenant, got)
+		}
+	}
+
+	for _, s := range []string{"acme", "acme=", "[=premium"} {
+		if _, err := parseTenantTiers(s); err == nil {
+			t.Errorf("Expected an error for tenant tiers %q", s)
+		}
+	}
+}
+
+func TestLoadTenantTemplate(t *testing.T) {
+	f, err := ioutil.TempFile("", "tenant-template")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{{if eq .Tier "premium"}}SELECT set_chunk_time_interval('{{.Table}}_values', INTERVAL '1 day');{{end}}`)
+	f.Close()
+
+	tmpl, err := loadTenantTemplate(f.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for tier, expected := range map[string]string{
+		"premium":         "SELECT set_chunk_time_interval('metrics_acme_values', INTERVAL '1 day');",
+		defaultTenantTier: "",
+	} {
+		var stmts bytes.Buffer
+
+		if err := tmpl.Execute(&stmts, tenantTemplateData{Tenant: "acme", Tier: tier, Table: "metrics_acme"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if stmts.String() != expected {
+			t.Errorf("Expected %q for tier %s, got %q", expected, tier, stmts.String())
+		}
+	}
+
+	if _, err := loadTenantTemplate(f.Name() + ".missing"); err == nil {
+		t.Error("Expected an error for a missing template")
+	}
+}
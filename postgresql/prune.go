@@ -0,0 +1,210 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// PruneResult is what Prune deletes, or would delete, from a table
+type PruneResult struct {
+	Table string
+	// Metric is empty if the samples of all metrics of the table are pruned
+	Metric string
+	// Rows is the number of samples older than the cutoff. Dropping chunks
+	// keeps those of the chunk spanning the cutoff.
+	Rows int64
+	// Chunks are the TimescaleDB chunks dropped whole
+	Chunks []string
+}
+
+// pruneTarget is a table, or the samples of a metric in a shared table
+type pruneTarget struct {
+	table  string
+	metric string
+}
+
+// Prune deletes samples older than olderThan on demand, like the retention
+// policies do, of all metrics or of those whose name matches the anchored
+// regular expression metric. With TimescaleDB, whole tables are pruned by
+// dropping the chunks entirely older than olderThan. With dryRun, it only
+// reports what would be deleted. Samples are pruned in the tables of the tenant
+// set with WithTenant if any.
+func (c *Client) Prune(ctx context.Context, olderThan time.Time, metric string, dryRun bool) ([]PruneResult, error) {
+	if tenant := TenantFromContext(ctx); len(tenant) > 0 && c.tenants != nil {
+		client, err := c.tenantClient(tenant)
+
+		if err != nil {
+			return nil, err
+		}
+		return client.prune(ctx, olderThan, metric, dryRun)
+	}
+	return c.prune(ctx, olderThan, metric, dryRun)
+}
+
+func (c *Client) prune(ctx context.Context, olderThan time.Time, metric string, dryRun bool) ([]PruneResult, error) {
+	targets, err := c.pruneTargets(metric)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var results []PruneResult
+
+	for _, t := range targets {
+		result, err := c.pruneTarget(ctx, t, olderThan, dryRun)
+
+		if err != nil {
+			return results, err
+		}
+		results = append(results, *result)
+	}
+	return results, nil
+}
+
+// pruneTargets returns the tables, or the metrics of the shared table, whose
+// samples the metric regular expression selects
+func (c *Client) pruneTargets(metric string) ([]pruneTarget, error) {
+	if len(metric) == 0 && !c.cfg.tablePerMetric {
+		return []pruneTarget{{table: c.cfg.table}}, nil
+	}
+
+	re, err := regexp.Compile("^(?:" + metric + ")$")
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid metric regular expression: %v", err)
+	}
+
+	if c.cfg.usePgPrometheus && !c.cfg.pgPrometheusNormalize {
+		return nil, fmt.Errorf("pruning single metrics requires the normalized schema")
+	}
+
+	var targets []pruneTarget
+
+	if c.cfg.tablePerMetric {
+		tables, err := c.metricTablesByName()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for table, name := range tables {
+			if re.MatchString(name) {
+				targets = append(targets, pruneTarget{table: table})
+			}
+		}
+	} else {
+		rows, err := c.db.Query(fmt.Sprintf("SELECT DISTINCT metric_name FROM %s", ident(c.cfg.table, "_labels")))
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var name string
+
+			if err = rows.Scan(&name); err != nil {
+				return nil, err
+			}
+
+			if re.MatchString(name) {
+				targets = append(targets, pruneTarget{table: c.cfg.table, metric: name})
+			}
+		}
+
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].table != targets[j].table {
+			return targets[i].table < targets[j].table
+		}
+		return targets[i].metric < targets[j].metric
+	})
+	return targets, nil
+}
+
+func (c *Client) pruneTarget(ctx context.Context, t pruneTarget, olderThan time.Time, dryRun bool) (*PruneResult, error) {
+	table := c.samplesTable(t.table)
+	result := &PruneResult{Table: table, Metric: t.metric}
+
+	count := fmt.Sprintf("SELECT count(*) FROM %s WHERE time < $1", quoteIdent(table))
+	args := []interface{}{olderThan}
+
+	if len(t.metric) > 0 {
+		count = fmt.Sprintf("SELECT count(*) FROM %s v INNER JOIN %s l ON l.id = v.labels_id WHERE l.metric_name = $2 AND v.time < $1",
+			ident(t.table, "_values"), ident(t.table, "_labels"))
+		args = append(args, t.metric)
+	}
+
+	dropChunks := c.cfg.useTimescaleDb && len(t.metric) == 0
+
+	if dropChunks || dryRun {
+		if err := c.db.QueryRowContext(ctx, count, args...).Scan(&result.Rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if dropChunks {
+		query, err := c.chunksQuery(ctx, dryRun)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := c.db.QueryContext(ctx, query, quoteIdent(table), olderThan)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			// drop_chunks of TimescaleDB 0.x returns nothing
+			var chunk sql.NullString
+
+			if err = rows.Scan(&chunk); err != nil {
+				return nil, err
+			}
+
+			if chunk.Valid {
+				result.Chunks = append(result.Chunks, chunk.String)
+			}
+		}
+
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	} else if !dryRun {
+		query := fmt.Sprintf("DELETE FROM %s WHERE time < $1", quoteIdent(table))
+		if len(t.metric) > 0 {
+			query = fmt.Sprintf("DELETE FROM %s v USING %s l WHERE l.id = v.labels_id AND l.metric_name = $2 AND v.time < $1",
+				ident(t.table, "_values"), ident(t.table, "_labels"))
+		}
+
+		res, err := c.db.ExecContext(ctx, query, args...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if result.Rows, err = res.RowsAffected(); err != nil {
+			return nil, err
+		}
+	}
+
+	if !dryRun {
+		log.Info("msg", "Pruned samples", "table", table, "metric", t.metric, "older_than", olderThan, "rows", result.Rows, "chunks", len(result.Chunks))
+	}
+	return result, nil
+}
@@ -0,0 +1,73 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneTargets(t *testing.T) {
+	c := &Client{cfg: &Config{table: "metrics", pgPrometheusNormalize: true}}
+
+	targets, err := c.pruneTargets("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []pruneTarget{{table: "metrics"}}; !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected %v, got %v", expected, targets)
+	}
+
+	if _, err = c.pruneTargets("node_("); err == nil {
+		t.Error("expected an invalid regular expression to fail")
+	}
+
+	c.cfg.usePgPrometheus, c.cfg.pgPrometheusNormalize = true, false
+
+	if _, err = c.pruneTargets("node_.*"); err == nil {
+		t.Error("expected pruning single metrics of the raw schema to fail")
+	}
+}
+
+func TestPruneTargetDropChunks(t *testing.T) {
+	testCases := []struct {
+		version string
+		dryRun  bool
+		chunk   driver.Value
+		chunks  []string
+		err     bool
+	}{
+		{version: "0.12.1", chunk: nil},
+		{version: "0.12.1", dryRun: true, err: true},
+		{version: "1.7.5", chunk: "_hyper_1_1_chunk", chunks: []string{"_hyper_1_1_chunk"}},
+		{version: "2.11.2", dryRun: true, chunk: "_hyper_1_1_chunk", chunks: []string{"_hyper_1_1_chunk"}},
+	}
+
+	for _, c := range testCases {
+		fake := newFakeDB()
+		fake.query = func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+			switch {
+			case strings.Contains(query, "extversion"):
+				return &fakeRows{columns: []string{"extversion"}, rows: [][]driver.Value{{c.version}}}, nil
+			case strings.Contains(query, "count(*)"):
+				return &fakeRows{columns: []string{"count"}, rows: [][]driver.Value{{int64(10)}}}, nil
+			}
+			return &fakeRows{columns: []string{"chunk"}, rows: [][]driver.Value{{c.chunk}}}, nil
+		}
+
+		client := &Client{db: fake.open(1), cfg: &Config{table: "metrics", useTimescaleDb: true}}
+		result, err := client.pruneTarget(context.Background(), pruneTarget{table: "metrics"}, time.Now(), c.dryRun)
+
+		if (err != nil) != c.err {
+			t.Errorf("%s: unexpected error %v", c.version, err)
+		}
+
+		if err == nil && !reflect.DeepEqual(result.Chunks, c.chunks) {
+			t.Errorf("%s: expected chunks %v, got %v", c.version, c.chunks, result.Chunks)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// QueryLog describes a recent remote read query
+type QueryLog struct {
+	Time     time.Time     `json:"time"`
+	Matchers string        `json:"matchers"`
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	SQL      string        `json:"sql"`
+	Duration time.Duration `json:"duration_ns"`
+	Rows     int           `json:"rows"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// queryRing keeps the most recent queries
+type queryRing struct {
+	lock    sync.Mutex
+	queries []QueryLog
+	next    int
+	full    bool
+}
+
+func newQueryRing(size int) *queryRing {
+	return &queryRing{queries: make([]QueryLog, size)}
+}
+
+func (r *queryRing) add(q QueryLog) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.queries[r.next] = q
+	r.next = (r.next + 1) % len(r.queries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// recent returns the queries, newest first
+func (r *queryRing) recent() []QueryLog {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.queries)
+	}
+
+	queries := make([]QueryLog, 0, n)
+	for i := 1; i <= n; i++ {
+		queries = append(queries, r.queries[(r.next-i+len(r.queries))%len(r.queries)])
+	}
+	return queries
+}
+
+// RecentQueries returns the most recent remote read queries, newest first,
+// if they are kept
+func (c *Client) RecentQueries() []QueryLog {
+	if c.recentQueries == nil {
+		return nil
+	}
+	return c.recentQueries.recent()
+}
+
+func (c *Client) logQuery(q *prompb.Query, sql string, begin time.Time, rows int, err error) {
+	if c.recentQueries == nil {
+		return
+	}
+
+	entry := QueryLog{
+		Time:     begin,
+		Matchers: formatMatchers(q.Matchers),
+		Start:    toTimestamp(q.StartTimestampMs),
+		End:      toTimestamp(q.EndTimestampMs),
+		SQL:      sql,
+		Duration: time.Since(begin),
+		Rows:     rows,
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	c.recentQueries.add(entry)
+}
+
+// formatMatchers formats matchers as a PromQL selector
+func formatMatchers(matchers []*prompb.LabelMatcher) string {
+	formatted := make([]string, 0, len(matchers))
+
+	for _, m := range matchers {
+		var op string
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			op = "="
+		case prompb.LabelMatcher_NEQ:
+			op = "!="
+		case prompb.LabelMatcher_RE:
+			op = "=~"
+		case prompb.LabelMatcher_NRE:
+			op = "!~"
+		}
+		formatted = append(formatted, fmt.Sprintf("%s%s%q", m.Name, op, m.Value))
+	}
+	return "{" + strings.Join(formatted, ", ") + "}"
+}
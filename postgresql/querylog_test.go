@@ -0,0 +1,55 @@
+package pgprometheus
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestQueryRing(t *testing.T) {
+	ring := newQueryRing(3)
+
+	if queries := ring.recent(); len(queries) != 0 {
+		t.Errorf("expected no queries, got %v", queries)
+	}
+
+	for _, sql := range []string{"a", "b"} {
+		ring.add(QueryLog{SQL: sql})
+	}
+
+	if sqls := querySQLs(ring.recent()); !reflect.DeepEqual(sqls, []string{"b", "a"}) {
+		t.Errorf("expected [b a], got %v", sqls)
+	}
+
+	for _, sql := range []string{"c", "d", "e"} {
+		ring.add(QueryLog{SQL: sql})
+	}
+
+	if sqls := querySQLs(ring.recent()); !reflect.DeepEqual(sqls, []string{"e", "d", "c"}) {
+		t.Errorf("expected [e d c], got %v", sqls)
+	}
+}
+
+func querySQLs(queries []QueryLog) []string {
+	sqls := make([]string, len(queries))
+	for i, q := range queries {
+		sqls[i] = q.SQL
+	}
+	return sqls
+}
+
+func TestFormatMatchers(t *testing.T) {
+	matchers := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+		{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "node"},
+		{Type: prompb.LabelMatcher_RE, Name: "instance", Value: "db.*"},
+		{Type: prompb.LabelMatcher_NRE, Name: "env", Value: "dev|test"},
+	}
+
+	expected := `{__name__="up", job!="node", instance=~"db.*", env!~"dev|test"}`
+
+	if formatted := formatMatchers(matchers); formatted != expected {
+		t.Errorf("expected %s, got %s", expected, formatted)
+	}
+}
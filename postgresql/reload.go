@@ -0,0 +1,31 @@
+package pgprometheus
+
+import (
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// Reload applies the settings of cfg that can change while the adapter runs:
+// the connection pool limits and the retention policies. Changes to other
+// settings take effect on restart.
+func (c *Client) Reload(cfg *Config) error {
+	policies, tenantPolicies, err := c.parseRetention(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	c.poolLock.Lock()
+	c.maxIdleConns = cfg.maxIdleConns
+	c.db.SetMaxOpenConns(cfg.maxOpenConns)
+	c.db.SetMaxIdleConns(cfg.maxIdleConns)
+	c.poolLock.Unlock()
+
+	c.setRetentionPolicies(policies, tenantPolicies)
+	if c.hasRetention() {
+		c.startRetention()
+	}
+
+	log.Info("msg", "Reloaded configuration", "max_open_conns", cfg.maxOpenConns, "max_idle_conns", cfg.maxIdleConns,
+		"retention_policies", len(policies), "tenant_retention_policies", len(tenantPolicies))
+	return nil
+}
@@ -0,0 +1,348 @@
+package pgprometheus
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+
+	"github.com/prometheus/common/model"
+)
+
+// TimescaleDB 2 changed drop_chunks(older_than, table_name, schema_name) to
+// drop_chunks(relation, older_than). The calls below drop, or list, the chunks
+// of the hypertable $1 older than $2, and earlier versions get the name and
+// schema of the hypertable from its regclass.
+const (
+	sqlDropChunks       = "SELECT drop_chunks($1::regclass, older_than => $2::timestamptz)"
+	sqlDropChunksLegacy = `SELECT drop_chunks(older_than => $2::timestamptz, table_name => c.relname, schema_name => n.nspname)
+		FROM pg_class c INNER JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.oid = $1::regclass`
+	sqlShowChunks = "SELECT show_chunks($1::regclass, older_than => $2::timestamptz)"
+
+	// show_chunks was added by TimescaleDB 1.0
+	minShowChunksVersion = "1.0"
+	dropChunksVersion    = "2.0"
+)
+
+// chunksQuery returns the call of the installed TimescaleDB dropping the
+// chunks of a hypertable, or listing them if show is set
+func (c *Client) chunksQuery(ctx context.Context, show bool) (string, error) {
+	var version string
+
+	err := c.db.QueryRowContext(ctx, "SELECT extversion FROM pg_extension WHERE extname = 'timescaledb'").Scan(&version)
+
+	if err != nil {
+		return "", fmt.Errorf("could not determine the TimescaleDB version: %v", err)
+	}
+
+	return chunksQueryOf(version, show)
+}
+
+func chunksQueryOf(version string, show bool) (string, error) {
+	switch {
+	case show && compareVersions(version, minShowChunksVersion) < 0:
+		return "", fmt.Errorf("listing chunks requires TimescaleDB %s or later, got %s", minShowChunksVersion, version)
+	case show:
+		return sqlShowChunks, nil
+	case compareVersions(version, dropChunksVersion) < 0:
+		return sqlDropChunksLegacy, nil
+	default:
+		return sqlDropChunks, nil
+	}
+}
+
+// retentionPolicy keeps samples of metrics whose name matches the glob
+// pattern for the retention period
+type retentionPolicy struct {
+	pattern   string
+	retention time.Duration
+}
+
+// parseRetentionPolicies parses comma-separated pattern=retention pairs,
+// e.g. "up=2y,container_*=30d"
+func parseRetentionPolicies(s string) ([]retentionPolicy, error) {
+	var policies []retentionPolicy
+
+	for _, policy := range strings.Split(s, ",") {
+		policy = strings.TrimSpace(policy)
+		if len(policy) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(policy, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid retention policy %q, expected pattern=retention", policy)
+		}
+
+		pattern := strings.TrimSpace(parts[0])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid retention pattern %q: %v", pattern, err)
+		}
+
+		retention, err := model.ParseDuration(strings.TrimSpace(parts[1]))
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention of %q: %v", pattern, err)
+		}
+
+		if retention <= 0 {
+			return nil, fmt.Errorf("the retention of %q must be positive", pattern)
+		}
+
+		policies = append(policies, retentionPolicy{pattern: pattern, retention: time.Duration(retention)})
+	}
+	return policies, nil
+}
+
+// metricRetention returns the retention of the first policy matching the
+// metric name
+func metricRetention(policies []retentionPolicy, metric string) (time.Duration, bool) {
+	for _, p := range policies {
+		if ok, _ := path.Match(p.pattern, metric); ok {
+			return p.retention, true
+		}
+	}
+	return 0, false
+}
+
+// parseRetention parses the retention policies of metrics and of tenants,
+// whose patterns match tenants instead of metric names
+func (c *Client) parseRetention(cfg *Config) ([]retentionPolicy, []retentionPolicy, error) {
+	policies, err := parseRetentionPolicies(cfg.retentionPolicies)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tenantPolicies, err := parseRetentionPolicies(cfg.tenantRetention)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid tenant retention: %v", err)
+	}
+
+	if len(policies)+len(tenantPolicies) > 0 && (!c.cfg.pgPrometheusNormalize || c.cfg.retentionInterval <= 0) {
+		return nil, nil, fmt.Errorf("retention policies require the normalized schema and a positive interval")
+	}
+	return policies, tenantPolicies, nil
+}
+
+func (c *Client) validateRetention() error {
+	policies, tenantPolicies, err := c.parseRetention(c.cfg)
+
+	if err != nil {
+		return err
+	}
+
+	c.setRetentionPolicies(policies, tenantPolicies)
+	return nil
+}
+
+func (c *Client) setRetentionPolicies(policies, tenantPolicies []retentionPolicy) {
+	c.retentionLock.Lock()
+	c.retentionPolicies = policies
+	c.tenantRetention = tenantPolicies
+	c.retentionLock.Unlock()
+}
+
+func (c *Client) currentRetentionPolicies() []retentionPolicy {
+	c.retentionLock.RLock()
+	defer c.retentionLock.RUnlock()
+
+	return c.retentionPolicies
+}
+
+func (c *Client) currentTenantRetention() []retentionPolicy {
+	c.retentionLock.RLock()
+	defer c.retentionLock.RUnlock()
+
+	return c.tenantRetention
+}
+
+// hasRetention tells whether any retention policy is set
+func (c *Client) hasRetention() bool {
+	return len(c.currentRetentionPolicies())+len(c.currentTenantRetention()) > 0
+}
+
+// startRetention starts enforcing retention policies, unless it already has
+func (c *Client) startRetention() {
+	c.retentionOnce.Do(func() {
+		go c.runRetention()
+	})
+}
+
+// runRetention periodically deletes samples older than the retention of
+// their metric
+func (c *Client) runRetention() {
+	ticker := time.NewTicker(c.cfg.retentionInterval)
+
+	for range ticker.C {
+		c.runJob("retention", c.cfg.retentionInterval, func(begin time.Time) error {
+			err := c.enforceRetention(begin)
+
+			if err == nil && c.tenants != nil {
+				err = c.enforceTenantRetention(begin)
+			}
+
+			if err != nil {
+				log.Error("msg", "Error enforcing retention policies", "err", err)
+				return err
+			}
+
+			log.Debug("msg", "Enforced retention policies", "duration", time.Since(begin).Seconds())
+			return nil
+		})
+	}
+}
+
+func (c *Client) enforceRetention(now time.Time) error {
+	policies := c.currentRetentionPolicies()
+
+	if len(policies) == 0 {
+		return nil
+	}
+
+	query := fmt.Sprintf("SELECT DISTINCT metric_name, '' FROM %s", ident(c.cfg.table, "_labels"))
+	if c.cfg.tablePerMetric {
+		query = fmt.Sprintf("SELECT metric_name, table_name FROM %s", ident(c.cfg.table, "_metric_tables"))
+	}
+
+	rows, err := c.db.Query(query)
+
+	if err != nil {
+		return err
+	}
+
+	expired := make(map[string]time.Time)
+	tables := make(map[string]string)
+
+	for rows.Next() {
+		var metric, table string
+
+		if err = rows.Scan(&metric, &table); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if retention, ok := metricRetention(policies, metric); ok {
+			expired[metric] = now.Add(-retention)
+			tables[metric] = table
+		}
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var dropChunks string
+
+	if c.cfg.tablePerMetric && c.cfg.useTimescaleDb && len(expired) > 0 {
+		if dropChunks, err = c.chunksQuery(context.Background(), false); err != nil {
+			return err
+		}
+	}
+
+	for metric, olderThan := range expired {
+		if c.cfg.tablePerMetric && c.cfg.useTimescaleDb {
+			_, err = c.db.Exec(dropChunks, quoteIdent(c.samplesTable(tables[metric])), olderThan)
+		} else if c.cfg.tablePerMetric {
+			_, err = c.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE time < $1", quoteIdent(c.samplesTable(tables[metric]))), olderThan)
+		} else {
+			_, err = c.db.Exec(fmt.Sprintf("DELETE FROM %s v USING %s l WHERE l.id = v.labels_id AND l.metric_name = $1 AND v.time < $2",
+				ident(c.cfg.table, "_values"), ident(c.cfg.table, "_labels")), metric, olderThan)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		log.Debug("msg", "Dropped expired samples", "metric", metric, "older_than", olderThan)
+	}
+	return nil
+}
+
+// enforceTenantRetention deletes the samples of each tenant older than the
+// retention of the tenant, and applies the retention policies of metrics to
+// the tables of the tenant
+func (c *Client) enforceTenantRetention(now time.Time) error {
+	policies, tenantPolicies := c.currentRetentionPolicies(), c.currentTenantRetention()
+
+	if len(policies)+len(tenantPolicies) == 0 {
+		return nil
+	}
+
+	tenants, err := c.registeredTenants()
+
+	if err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		client, err := c.tenantClient(tenant)
+
+		if err != nil {
+			log.Warn("msg", "Error enforcing the retention of a tenant", "tenant", tenant, "err", err)
+			continue
+		}
+
+		client.setRetentionPolicies(policies, nil)
+
+		if err = client.enforceRetention(now); err != nil {
+			return err
+		}
+
+		if retention, ok := metricRetention(tenantPolicies, tenant); ok {
+			if err = client.expireSamples(now.Add(-retention)); err != nil {
+				return err
+			}
+
+			log.Debug("msg", "Dropped expired samples of a tenant", "tenant", tenant, "older_than", now.Add(-retention))
+		}
+	}
+	return nil
+}
+
+// expireSamples deletes the samples of all metrics older than olderThan
+func (c *Client) expireSamples(olderThan time.Time) error {
+	tables := []string{quoteIdent(c.samplesTable(c.cfg.table))}
+
+	if c.cfg.tablePerMetric {
+		metricTables, err := c.metricTablesByName()
+
+		if err != nil {
+			return err
+		}
+
+		tables = tables[:0]
+		for table := range metricTables {
+			tables = append(tables, quoteIdent(c.samplesTable(table)))
+		}
+	}
+
+	var dropChunks string
+
+	if c.cfg.useTimescaleDb {
+		var err error
+		if dropChunks, err = c.chunksQuery(context.Background(), false); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range tables {
+		var err error
+
+		if c.cfg.useTimescaleDb {
+			_, err = c.db.Exec(dropChunks, table, olderThan)
+		} else {
+			_, err = c.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE time < $1", table), olderThan)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPolicies(t *testing.T) {
+	policies, err := parseRetentionPolicies("up=2y, container_*=30d,node_?=12h")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		metric    string
+		retention time.Duration
+		ok        bool
+	}{
+		{metric: "up", retention: 2 * 365 * 24 * time.Hour, ok: true},
+		{metric: "container_cpu_usage", retention: 30 * 24 * time.Hour, ok: true},
+		{metric: "node_a", retention: 12 * time.Hour, ok: true},
+		{metric: "node_load1"},
+	}
+
+	for _, tc := range testCases {
+		retention, ok := metricRetention(policies, tc.metric)
+
+		if ok != tc.ok || retention != tc.retention {
+			t.Errorf("%s: expected retention %v (%v), got %v (%v)", tc.metric, tc.retention, tc.ok, retention, ok)
+		}
+	}
+
+	for _, invalid := range []string{"up", "up=forever", "[=1d", "up=0s"} {
+		if _, err := parseRetentionPolicies(invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	testCases := []struct {
+		cfg     Config
+		tenants int
+		valid   bool
+	}{
+		{cfg: Config{pgPrometheusNormalize: true, retentionInterval: time.Hour, tenantRetention: "acme=1y,*=30d"}, tenants: 2, valid: true},
+		{cfg: Config{pgPrometheusNormalize: true, retentionInterval: time.Hour}, valid: true},
+		{cfg: Config{pgPrometheusNormalize: false, retentionInterval: time.Hour, tenantRetention: "*=30d"}},
+		{cfg: Config{pgPrometheusNormalize: true, tenantRetention: "*=30d"}},
+		{cfg: Config{pgPrometheusNormalize: true, retentionInterval: time.Hour, tenantRetention: "acme"}},
+	}
+
+	for _, tc := range testCases {
+		c := &Client{cfg: &tc.cfg}
+		_, tenantPolicies, err := c.parseRetention(&tc.cfg)
+
+		if (err == nil) != tc.valid || len(tenantPolicies) != tc.tenants {
+			t.Errorf("%q: expected %d tenant policies (valid %v), got %d: %v", tc.cfg.tenantRetention, tc.tenants, tc.valid, len(tenantPolicies), err)
+		}
+	}
+}
+
+func TestChunksQueryOf(t *testing.T) {
+	testCases := []struct {
+		version  string
+		show     bool
+		expected string
+		err      bool
+	}{
+		{version: "0.12.1", expected: sqlDropChunksLegacy},
+		{version: "1.7.5", expected: sqlDropChunksLegacy},
+		{version: "2.0.0-rc4", expected: sqlDropChunks},
+		{version: "2.11.2", expected: sqlDropChunks},
+		{version: "0.12.1", show: true, err: true},
+		{version: "1.7.5", show: true, expected: sqlShowChunks},
+		{version: "2.11.2", show: true, expected: sqlShowChunks},
+	}
+
+	for _, c := range testCases {
+		query, err := chunksQueryOf(c.version, c.show)
+
+		if (err != nil) != c.err {
+			t.Errorf("%s: unexpected error %v", c.version, err)
+		}
+
+		if query != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.version, c.expected, query)
+		}
+	}
+}
+
+func TestExpireSamplesDropChunks(t *testing.T) {
+	for version, expected := range map[string]string{"1.7.5": sqlDropChunksLegacy, "2.11.2": sqlDropChunks} {
+		fake := newFakeDB()
+		fake.query = func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+			return &fakeRows{columns: []string{"extversion"}, rows: [][]driver.Value{{version}}}, nil
+		}
+
+		c := &Client{db: fake.open(1), cfg: &Config{table: "metrics", useTimescaleDb: true}}
+
+		if err := c.expireSamples(time.Now()); err != nil {
+			t.Fatalf("%s: %v", version, err)
+		}
+
+		if len(fake.execs) != 1 || fake.execs[0] != expected {
+			t.Errorf("%s: expected %q, got %q", version, expected, fake.execs)
+		}
+	}
+}
@@ -0,0 +1,553 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v2"
+)
+
+// Recording rules are read from a Prometheus rules file and evaluated in the
+// database, so that they also run against archived data without a
+// Prometheus server. Only a subset of PromQL is supported:
+//
+//   selector                              metric{label="value", ...}
+//   function(selector[range])             rate, increase, <agg>_over_time
+//   aggregation [by (labels)] (expr)      sum, avg, min, max, count
+//
+// rate and increase take counter resets into account, but do not
+// extrapolate to the edges of the range like Prometheus does.
+
+// lookbackDelta is how far back an instant selector looks for the latest
+// sample of a series, as in Prometheus
+const lookbackDelta = 5 * time.Minute
+
+var (
+	ruleAggregations = map[string]string{
+		"sum":   "sum(value)",
+		"avg":   "avg(value)",
+		"min":   "min(value)",
+		"max":   "max(value)",
+		"count": "count(*)::float8",
+	}
+
+	increaseExpr  = "sum(CASE WHEN prev IS NULL THEN 0 WHEN value >= prev THEN value - prev ELSE value END)"
+	ruleFunctions = map[string]string{
+		"increase":        increaseExpr,
+		"rate":            increaseExpr + " / %f",
+		"avg_over_time":   "avg(value)",
+		"min_over_time":   "min(value)",
+		"max_over_time":   "max(value)",
+		"sum_over_time":   "sum(value)",
+		"count_over_time": "count(*)::float8",
+	}
+)
+
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name     string         `yaml:"name"`
+	Interval model.Duration `yaml:"interval"`
+	Rules    []ruleConfig   `yaml:"rules"`
+}
+
+type ruleConfig struct {
+	Record string            `yaml:"record"`
+	Alert  string            `yaml:"alert"`
+	Expr   string            `yaml:"expr"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+// recordingRule is a parsed recording rule
+type recordingRule struct {
+	record string
+	labels map[string]string
+	expr   *ruleExpr
+}
+
+// ruleExpr is a parsed expression of the supported PromQL subset
+type ruleExpr struct {
+	aggregation string
+	by          []string
+	function    string
+	rng         time.Duration
+	matchers    []*prompb.LabelMatcher
+}
+
+// loadRules reads the recording rules of a Prometheus rules file, grouped
+// by evaluation interval. Alerting rules are skipped.
+func loadRules(filename string, defaultInterval time.Duration) (map[time.Duration][]*recordingRule, error) {
+	content, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var file ruleFile
+
+	if err = yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, fmt.Errorf("could not parse rules file %s: %v", filename, err)
+	}
+
+	rules := make(map[time.Duration][]*recordingRule)
+
+	for _, group := range file.Groups {
+		interval := time.Duration(group.Interval)
+		if interval <= 0 {
+			interval = defaultInterval
+		}
+
+		for _, r := range group.Rules {
+			if len(r.Record) == 0 {
+				log.Info("msg", "Skipping alerting rule", "group", group.Name, "alert", r.Alert)
+				continue
+			}
+
+			if !model.IsValidMetricName(model.LabelValue(r.Record)) {
+				return nil, fmt.Errorf("group %s: invalid metric name %q", group.Name, r.Record)
+			}
+
+			expr, err := parseRuleExpr(r.Expr)
+
+			if err != nil {
+				return nil, fmt.Errorf("group %s, rule %s: %v", group.Name, r.Record, err)
+			}
+
+			rules[interval] = append(rules[interval], &recordingRule{record: r.Record, labels: r.Labels, expr: expr})
+		}
+	}
+	return rules, nil
+}
+
+// runRules evaluates the rules at the end of each interval and writes the
+// results back as new metrics
+func (c *Client) runRules(interval time.Duration, rules []*recordingRule) {
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		// Rules of the same interval are evaluated once for all adapters, so
+		// that their results are not written twice
+		c.runJob("rules_"+interval.String(), interval, func(now time.Time) error {
+			ts := now.Truncate(interval)
+
+			for _, r := range rules {
+				begin := time.Now()
+				samples, err := c.evaluateRule(r, ts)
+
+				if err == nil && len(samples) > 0 {
+					err = c.Write(samples)
+				}
+
+				if err != nil {
+					log.Error("msg", "Error evaluating recording rule", "record", r.record, "err", err)
+					continue
+				}
+
+				log.Debug("msg", "Evaluated recording rule", "record", r.record, "samples", len(samples), "duration", time.Since(begin).Seconds())
+			}
+			return nil
+		})
+	}
+}
+
+func (c *Client) evaluateRule(r *recordingRule, ts time.Time) (model.Samples, error) {
+	query, err := c.buildRuleQuery(r.expr, ts)
+
+	if err != nil || len(query) == 0 {
+		return nil, err
+	}
+
+	log.Debug("msg", "Executing recording rule query", "query", query)
+
+	rows, err := c.db.Query(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var samples model.Samples
+
+	for rows.Next() {
+		var (
+			labels sampleLabels
+			value  float64
+		)
+
+		if err = rows.Scan(&labels, &value); err != nil {
+			return nil, err
+		}
+
+		metric := make(model.Metric, len(labels.Map)+len(r.labels)+1)
+		for k, v := range labels.Map {
+			metric[model.LabelName(k)] = model.LabelValue(v)
+		}
+		for k, v := range r.labels {
+			metric[model.LabelName(k)] = model.LabelValue(v)
+		}
+		metric[model.MetricNameLabel] = model.LabelValue(r.record)
+
+		samples = append(samples, &model.Sample{
+			Metric:    metric,
+			Value:     model.SampleValue(value),
+			Timestamp: model.TimeFromUnixNano(ts.UnixNano()),
+		})
+	}
+	return samples, rows.Err()
+}
+
+// buildRuleQuery returns a query of the labels and value of each result
+// series of the expression evaluated at ts, or "" if no table can match
+func (c *Client) buildRuleQuery(e *ruleExpr, ts time.Time) (string, error) {
+	start := ts.Add(-lookbackDelta)
+	if len(e.function) > 0 {
+		start = ts.Add(-e.rng)
+	}
+
+	command, err := c.buildCommand(&prompb.Query{
+		StartTimestampMs: start.UnixNano() / 1000000,
+		EndTimestampMs:   ts.UnixNano() / 1000000,
+		Matchers:         e.matchers,
+	})
+
+	if err != nil || len(command) == 0 {
+		return "", err
+	}
+
+	samples := fmt.Sprintf("(%s) AS s (time, name, value, labels)", command)
+
+	var series string
+
+	if len(e.function) == 0 {
+		series = fmt.Sprintf("SELECT DISTINCT ON (name, labels) labels, value FROM %s ORDER BY name, labels, time DESC", samples)
+	} else {
+		value := ruleFunctions[e.function]
+		if e.function == "rate" {
+			value = fmt.Sprintf(value, e.rng.Seconds())
+		}
+		series = fmt.Sprintf("SELECT labels, %s AS value FROM (SELECT name, labels, value, lag(value) OVER (PARTITION BY name, labels ORDER BY time) AS prev FROM %s) s GROUP BY name, labels",
+			value, samples)
+	}
+
+	if len(e.aggregation) == 0 {
+		return series, nil
+	}
+
+	groupLabels := "'{}'::jsonb"
+	if len(e.by) > 0 {
+		pairs := make([]string, 0, 2*len(e.by))
+		for _, label := range e.by {
+			pairs = append(pairs, fmt.Sprintf("'%s'", label), fmt.Sprintf("labels->'%s'", label))
+		}
+		groupLabels = fmt.Sprintf("jsonb_strip_nulls(jsonb_build_object(%s))", strings.Join(pairs, ", "))
+	}
+
+	return fmt.Sprintf("SELECT %s AS labels, %s AS value FROM (%s) series GROUP BY 1",
+		groupLabels, ruleAggregations[e.aggregation], series), nil
+}
+
+// ruleParser is a recursive descent parser of the supported PromQL subset
+type ruleParser struct {
+	input string
+	pos   int
+}
+
+func parseRuleExpr(input string) (*ruleExpr, error) {
+	p := &ruleParser{input: input}
+	e, err := p.parseExpr(true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.skipSpace(); p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos:], p.pos)
+	}
+	return e, nil
+}
+
+func (p *ruleParser) parseExpr(allowAggregation bool) (*ruleExpr, error) {
+	p.skipSpace()
+
+	if p.peek() == '{' {
+		return p.parseSelector("")
+	}
+
+	ident := p.ident()
+
+	if _, ok := ruleAggregations[ident]; ok && allowAggregation {
+		return p.parseAggregation(ident)
+	}
+
+	if _, ok := ruleFunctions[ident]; ok {
+		return p.parseFunction(ident)
+	}
+
+	if len(ident) == 0 {
+		return nil, fmt.Errorf("expected an expression at position %d", p.pos)
+	}
+	return p.parseSelector(ident)
+}
+
+func (p *ruleParser) parseAggregation(aggregation string) (*ruleExpr, error) {
+	by, err := p.parseBy()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.expect('('); err != nil {
+		return nil, err
+	}
+
+	e, err := p.parseExpr(false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.expect(')'); err != nil {
+		return nil, err
+	}
+
+	if by == nil {
+		if by, err = p.parseBy(); err != nil {
+			return nil, err
+		}
+	}
+
+	e.aggregation = aggregation
+	e.by = by
+	return e, nil
+}
+
+// parseBy parses an optional by clause
+func (p *ruleParser) parseBy() ([]string, error) {
+	p.skipSpace()
+	pos := p.pos
+
+	switch p.ident() {
+	case "by":
+	case "without":
+		return nil, fmt.Errorf("without clauses are not supported")
+	default:
+		p.pos = pos
+		return nil, nil
+	}
+
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+
+	by := []string{}
+
+	for {
+		p.skipSpace()
+		if p.peek() == ')' {
+			p.pos++
+			return by, nil
+		}
+
+		label := p.ident()
+		if !model.LabelName(label).IsValid() {
+			return nil, fmt.Errorf("invalid label name at position %d", p.pos)
+		}
+		by = append(by, label)
+
+		p.skipSpace()
+		if p.peek() == ',' {
+			p.pos++
+		}
+	}
+}
+
+func (p *ruleParser) parseFunction(function string) (*ruleExpr, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+
+	var name string
+	if p.peek() != '{' {
+		name = p.ident()
+	}
+
+	e, err := p.parseSelector(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.expect('['); err != nil {
+		return nil, err
+	}
+
+	end := strings.IndexByte(p.input[p.pos:], ']')
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated range at position %d", p.pos)
+	}
+
+	rng, err := model.ParseDuration(strings.TrimSpace(p.input[p.pos : p.pos+end]))
+
+	if err != nil {
+		return nil, err
+	}
+	p.pos += end + 1
+
+	if err = p.expect(')'); err != nil {
+		return nil, err
+	}
+
+	e.function = function
+	e.rng = time.Duration(rng)
+	return e, nil
+}
+
+func (p *ruleParser) parseSelector(name string) (*ruleExpr, error) {
+	e := &ruleExpr{}
+
+	if len(name) > 0 {
+		e.matchers = append(e.matchers, &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: name})
+	}
+
+	p.skipSpace()
+
+	if p.peek() == '{' {
+		p.pos++
+
+		for {
+			p.skipSpace()
+			if p.peek() == '}' {
+				p.pos++
+				break
+			}
+
+			m, err := p.parseMatcher()
+
+			if err != nil {
+				return nil, err
+			}
+			e.matchers = append(e.matchers, m)
+
+			p.skipSpace()
+			if p.peek() == ',' {
+				p.pos++
+			}
+		}
+	}
+
+	if len(e.matchers) == 0 {
+		return nil, fmt.Errorf("empty selector at position %d", p.pos)
+	}
+	return e, nil
+}
+
+func (p *ruleParser) parseMatcher() (*prompb.LabelMatcher, error) {
+	name := p.ident()
+
+	if !model.LabelName(name).IsValid() {
+		return nil, fmt.Errorf("invalid label name at position %d", p.pos)
+	}
+
+	p.skipSpace()
+
+	var matchType prompb.LabelMatcher_Type
+
+	switch {
+	case strings.HasPrefix(p.input[p.pos:], "=~"):
+		matchType = prompb.LabelMatcher_RE
+	case strings.HasPrefix(p.input[p.pos:], "!~"):
+		matchType = prompb.LabelMatcher_NRE
+	case strings.HasPrefix(p.input[p.pos:], "!="):
+		matchType = prompb.LabelMatcher_NEQ
+	case strings.HasPrefix(p.input[p.pos:], "="):
+		matchType = prompb.LabelMatcher_EQ
+		p.pos--
+	default:
+		return nil, fmt.Errorf("expected a match operator at position %d", p.pos)
+	}
+	p.pos += 2
+	p.skipSpace()
+
+	value, err := p.str()
+
+	if err != nil {
+		return nil, err
+	}
+	return &prompb.LabelMatcher{Type: matchType, Name: name, Value: value}, nil
+}
+
+// str parses a single or double quoted string
+func (p *ruleParser) str() (string, error) {
+	quote := p.peek()
+
+	if quote != '"' && quote != '\'' {
+		return "", fmt.Errorf("expected a string at position %d", p.pos)
+	}
+
+	for i := p.pos + 1; i < len(p.input); i++ {
+		switch p.input[i] {
+		case '\\':
+			i++
+		case quote:
+			raw := p.input[p.pos+1 : i]
+			p.pos = i + 1
+
+			if quote == '\'' {
+				raw = strings.Replace(raw, `\'`, `'`, -1)
+				raw = strings.Replace(raw, `"`, `\"`, -1)
+			}
+			return strconv.Unquote(`"` + raw + `"`)
+		}
+	}
+	return "", fmt.Errorf("unterminated string at position %d", p.pos)
+}
+
+func (p *ruleParser) ident() string {
+	start := p.pos
+
+	for p.pos < len(p.input) {
+		b := p.input[p.pos]
+		letter := b == '_' || b == ':' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+		if !letter && !(b >= '0' && b <= '9' && p.pos > start) {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *ruleParser) expect(b byte) error {
+	p.skipSpace()
+
+	if p.peek() != b {
+		return fmt.Errorf("expected %q at position %d", b, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *ruleParser) peek() byte {
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *ruleParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
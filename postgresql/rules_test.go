@@ -0,0 +1,143 @@
+package pgprometheus
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestParseRuleExpr(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected *ruleExpr
+	}{
+		{
+			input: `up`,
+			expected: &ruleExpr{matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+			}},
+		},
+		{
+			input: `sum by (job, mode) (rate(node_cpu{mode!="idle", host=~'web.*'}[5m]))`,
+			expected: &ruleExpr{
+				aggregation: "sum",
+				by:          []string{"job", "mode"},
+				function:    "rate",
+				rng:         5 * time.Minute,
+				matchers: []*prompb.LabelMatcher{
+					{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "node_cpu"},
+					{Type: prompb.LabelMatcher_NEQ, Name: "mode", Value: "idle"},
+					{Type: prompb.LabelMatcher_RE, Name: "host", Value: "web.*"},
+				},
+			},
+		},
+		{
+			input: `max(max_over_time({__name__="temp", room="a\"b"}[1h])) by (room)`,
+			expected: &ruleExpr{
+				aggregation: "max",
+				by:          []string{"room"},
+				function:    "max_over_time",
+				rng:         time.Hour,
+				matchers: []*prompb.LabelMatcher{
+					{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "temp"},
+					{Type: prompb.LabelMatcher_EQ, Name: "room", Value: `a"b`},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		e, err := parseRuleExpr(tc.input)
+
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.input, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(e, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.input, tc.expected, e)
+		}
+	}
+
+	for _, input := range []string{`sum(sum(up))`, `rate(up)`, `up + 1`, `sum without (job) (up)`, `{}`, `histogram_quantile(0.9, up)`} {
+		if _, err := parseRuleExpr(input); err == nil {
+			t.Errorf("%s: expected an error", input)
+		}
+	}
+}
+
+func TestBuildRuleQuery(t *testing.T) {
+	c := &Client{cfg: &Config{table: "metrics", usePgPrometheus: true, pgPrometheusNormalize: true, labelsFormat: labelsFormatJSONB}}
+
+	e, err := parseRuleExpr(`sum by (job) (rate(http_requests_total[5m]))`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := c.buildRuleQuery(e, time.Unix(3600, 0))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"SELECT jsonb_strip_nulls(jsonb_build_object('job', labels->'job')) AS labels, sum(value) AS value FROM",
+		"/ 300.000000 AS value",
+		"lag(value) OVER (PARTITION BY name, labels ORDER BY time)",
+		"name = 'http_requests_total'",
+		"AS s (time, name, value, labels)",
+	} {
+		if !strings.Contains(query, expected) {
+			t.Errorf("Expected %q in query %s", expected, query)
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	f, err := ioutil.TempFile("", "rules")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`groups:
+- name: example
+  interval: 5m
+  rules:
+  - record: job:up:sum
+    expr: sum by (job) (up)
+    labels:
+      source: adapter
+  - alert: Down
+    expr: up == 0
+- name: default
+  rules:
+  - record: instance:load:avg1h
+    expr: avg_over_time(node_load1[1h])
+`)
+	f.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := loadRules(f.Name(), time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules[5*time.Minute]) != 1 || rules[5*time.Minute][0].labels["source"] != "adapter" {
+		t.Errorf("Unexpected rules with a 5m interval: %v", rules[5*time.Minute])
+	}
+	if len(rules[time.Minute]) != 1 || rules[time.Minute][0].record != "instance:load:avg1h" {
+		t.Errorf("Unexpected rules with the default interval: %v", rules[time.Minute])
+	}
+}
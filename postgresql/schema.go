@@ -0,0 +1,245 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// The schema check verifies at startup that the tables, indexes and
+// functions match what the configured storage mode writes to, so that a
+// schema that drifted, e.g. after a manual change or with a different
+// pg_prometheus version, is reported before writes fail.
+
+type column struct {
+	name     string
+	dataType string
+}
+
+var pgPrometheusFunctions = []string{"prom_time", "prom_value", "prom_name", "prom_labels", "create_prometheus_table"}
+
+// expectedColumns returns the columns each table of the given view must have
+func (c *Client) expectedColumns(table string) map[string][]column {
+	if c.cfg.usePgPrometheus && !c.cfg.pgPrometheusNormalize {
+		return map[string][]column{
+			table + "_samples": {{"sample", "prom_sample"}},
+		}
+	}
+
+	labels := []column{{"id", "integer"}, {"metric_name", "text"}}
+
+	switch c.labelsFormat().name() {
+	case labelsFormatHstore:
+		labels = append(labels, column{"labels", "hstore"})
+	case labelsFormatArrays:
+		labels = append(labels, column{"label_keys", "text[]"}, column{"label_values", "text[]"})
+	default:
+		labels = append(labels, column{"labels", "jsonb"})
+	}
+
+	return map[string][]column{
+		table + "_values": {{"time", "timestamp with time zone"}, {"value", c.valueType()}, {"labels_id", "integer"}},
+		table + "_labels": labels,
+	}
+}
+
+// compareColumns reports missing columns and columns of the wrong type
+func compareColumns(table string, expected []column, actual map[string]string) []string {
+	var drift []string
+
+	for _, col := range expected {
+		dataType, ok := actual[col.name]
+
+		switch {
+		case !ok:
+			drift = append(drift, fmt.Sprintf("table %s: missing column %s %s", table, col.name, col.dataType))
+		case dataType != col.dataType:
+			drift = append(drift, fmt.Sprintf("table %s: column %s has type %s, expected %s", table, col.name, dataType, col.dataType))
+		}
+	}
+	return drift
+}
+
+// checkSchema logs the differences between the schema of the database and
+// the configured storage mode, and fails with -pg.strict-schema
+func (c *Client) checkSchema() error {
+	if c.cfg.dialect != dialectPostgreSQL {
+		return nil
+	}
+
+	drift, err := c.schemaDrift()
+
+	if err != nil {
+		return err
+	}
+
+	for _, d := range drift {
+		log.Warn("msg", "Schema drift", "drift", d)
+	}
+
+	if len(drift) > 0 && c.cfg.strictSchema {
+		return fmt.Errorf("the schema does not match the storage mode: %s", strings.Join(drift, "; "))
+	}
+
+	if len(drift) == 0 {
+		log.Debug("msg", "Schema matches the storage mode")
+	}
+	return nil
+}
+
+func (c *Client) schemaDrift() ([]string, error) {
+	var drift []string
+
+	if c.cfg.usePgPrometheus {
+		missing, err := c.missingFunctions(pgPrometheusFunctions)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range missing {
+			drift = append(drift, fmt.Sprintf("missing pg_prometheus function %s", f))
+		}
+	}
+
+	tables := []string{c.cfg.table}
+
+	if c.cfg.tablePerMetric {
+		var err error
+		tables, err = c.lookupMetricTables(nil)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, table := range tables {
+		tableDrift, err := c.tableDrift(table)
+
+		if err != nil {
+			return nil, err
+		}
+		drift = append(drift, tableDrift...)
+	}
+	return drift, nil
+}
+
+func (c *Client) tableDrift(table string) ([]string, error) {
+	var drift []string
+
+	expected := c.expectedColumns(table)
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		actual, err := c.tableColumns(name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if actual == nil {
+			drift = append(drift, fmt.Sprintf("missing table %s", name))
+			continue
+		}
+		drift = append(drift, compareColumns(name, expected[name], actual)...)
+	}
+
+	if _, ok := expected[table+"_labels"]; !ok || len(drift) > 0 {
+		return drift, nil
+	}
+
+	// Labels are upserted with ON CONFLICT, which requires a unique index
+	unique := append([]string{"metric_name"}, c.labelsFormat().columns()...)
+	ok, err := c.hasUniqueIndex(table+"_labels", unique)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		drift = append(drift, fmt.Sprintf("table %s_labels: missing unique index on (%s)", table, strings.Join(unique, ", ")))
+	}
+	return drift, nil
+}
+
+// tableColumns returns the type of each column of the table, or nil if the
+// table does not exist
+func (c *Client) tableColumns(table string) (map[string]string, error) {
+	var exists bool
+
+	err := c.db.QueryRow("SELECT to_regclass($1) IS NOT NULL", quoteIdent(table)).Scan(&exists)
+
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	rows, err := c.db.Query(`SELECT attname, format_type(atttypid, atttypmod) FROM pg_attribute
+		WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped`, quoteIdent(table))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	columns := make(map[string]string)
+
+	for rows.Next() {
+		var name, dataType string
+
+		if err = rows.Scan(&name, &dataType); err != nil {
+			return nil, err
+		}
+		columns[name] = dataType
+	}
+	return columns, rows.Err()
+}
+
+func (c *Client) hasUniqueIndex(table string, columns []string) (bool, error) {
+	var ok bool
+
+	err := c.db.QueryRow(`SELECT EXISTS (
+		SELECT 1 FROM pg_index x
+		WHERE x.indrelid = $1::regclass AND x.indisunique
+		AND (SELECT array_agg(a.attname::text ORDER BY k.ord) FROM unnest(x.indkey::int2[]) WITH ORDINALITY k(attnum, ord)
+			INNER JOIN pg_attribute a ON a.attrelid = x.indrelid AND a.attnum = k.attnum) = string_to_array($2, ','))`,
+		quoteIdent(table), strings.Join(columns, ",")).Scan(&ok)
+
+	return ok, err
+}
+
+func (c *Client) missingFunctions(functions []string) ([]string, error) {
+	rows, err := c.db.Query("SELECT DISTINCT proname::text FROM pg_proc WHERE proname = ANY(string_to_array($1, ','))", strings.Join(functions, ","))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	found := make(map[string]bool)
+
+	for rows.Next() {
+		var name string
+
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		found[name] = true
+	}
+
+	var missing []string
+
+	for _, f := range functions {
+		if !found[f] {
+			missing = append(missing, f)
+		}
+	}
+	return missing, rows.Err()
+}
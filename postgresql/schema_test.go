@@ -0,0 +1,52 @@
+package pgprometheus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareColumns(t *testing.T) {
+	c := &Client{cfg: &Config{usePgPrometheus: true, pgPrometheusNormalize: true}}
+	expected := c.expectedColumns("metrics")
+
+	drift := compareColumns("metrics_values", expected["metrics_values"], map[string]string{
+		"time":  "timestamp without time zone",
+		"value": "double precision",
+	})
+
+	want := []string{
+		"table metrics_values: column time has type timestamp without time zone, expected timestamp with time zone",
+		"table metrics_values: missing column labels_id integer",
+	}
+
+	if !reflect.DeepEqual(drift, want) {
+		t.Errorf("Expected drift %v, got %v", want, drift)
+	}
+}
+
+func TestExpectedColumns(t *testing.T) {
+	c := &Client{cfg: &Config{pgPrometheusNormalize: true, labelsFormat: labelsFormatArrays}}
+
+	labels := c.expectedColumns("metrics")["metrics_labels"]
+	want := []column{{"id", "integer"}, {"metric_name", "text"}, {"label_keys", "text[]"}, {"label_values", "text[]"}}
+
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("Expected labels columns %v, got %v", want, labels)
+	}
+
+	c.cfg.valueType = valueTypeNumeric
+
+	values := c.expectedColumns("metrics")["metrics_values"]
+	want = []column{{"time", "timestamp with time zone"}, {"value", "numeric"}, {"labels_id", "integer"}}
+
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Expected values columns %v, got %v", want, values)
+	}
+
+	c.cfg.usePgPrometheus = true
+	c.cfg.pgPrometheusNormalize = false
+
+	if _, ok := c.expectedColumns("metrics")["metrics_samples"]; !ok {
+		t.Error("Expected the raw samples table")
+	}
+}
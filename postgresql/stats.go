@@ -0,0 +1,223 @@
+package pgprometheus
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// StorageStats describes how much storage the samples take up
+type StorageStats struct {
+	Tables  []TableStats  `json:"tables"`
+	Metrics []MetricStats `json:"metrics,omitempty"`
+}
+
+// TableStats describes a table holding samples. Row counts are estimates.
+type TableStats struct {
+	Table                  string     `json:"table"`
+	Metric                 string     `json:"metric,omitempty"`
+	Rows                   int64      `json:"rows"`
+	TotalBytes             int64      `json:"total_bytes"`
+	BeforeCompressionBytes int64      `json:"before_compression_bytes,omitempty"`
+	AfterCompressionBytes  int64      `json:"after_compression_bytes,omitempty"`
+	Chunks                 int64      `json:"chunks"`
+	Oldest                 *time.Time `json:"oldest,omitempty"`
+	Newest                 *time.Time `json:"newest,omitempty"`
+}
+
+// MetricStats describes the samples of a metric in a table shared by all
+// metrics
+type MetricStats struct {
+	Metric string    `json:"metric"`
+	Rows   int64     `json:"rows"`
+	Oldest time.Time `json:"oldest"`
+	Newest time.Time `json:"newest"`
+}
+
+// Stats reports the size of each table holding samples and, if all metrics
+// share a table, the number of samples and time range of each metric. The
+// latter scans the whole table.
+func (c *Client) Stats() (*StorageStats, error) {
+	tables := map[string]string{c.cfg.table: ""}
+
+	if c.cfg.tablePerMetric {
+		var err error
+		tables, err = c.metricTablesByName()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stats := &StorageStats{}
+
+	for table, metric := range tables {
+		tableStats, err := c.tableStats(c.samplesTable(table))
+
+		if err != nil {
+			return nil, err
+		}
+
+		tableStats.Metric = metric
+		stats.Tables = append(stats.Tables, *tableStats)
+	}
+
+	if !c.cfg.tablePerMetric && c.cfg.pgPrometheusNormalize {
+		metrics, err := c.metricStats()
+
+		if err != nil {
+			return nil, err
+		}
+		stats.Metrics = metrics
+	}
+
+	return stats, nil
+}
+
+// StorageMode names how samples are stored, e.g. "pg_prometheus" or
+// "timescaledb"
+func (c *Client) StorageMode() string {
+	switch {
+	case c.cfg.dialect != dialectPostgreSQL:
+		return c.cfg.dialect
+	case c.cfg.usePgPrometheus && c.cfg.pgPrometheusNormalize:
+		return "pg_prometheus_normalized"
+	case c.cfg.usePgPrometheus:
+		return "pg_prometheus"
+	case c.cfg.distributed:
+		return "timescaledb_distributed"
+	case c.cfg.useTimescaleDb:
+		return "timescaledb"
+	case c.cfg.citus:
+		return "citus"
+	case len(c.cfg.partitioning) > 0:
+		return "partitioned_" + c.cfg.partitioning
+	}
+	return "postgresql"
+}
+
+// PoolStats returns the stats of the database connection pool
+func (c *Client) PoolStats() sql.DBStats {
+	return c.db.Stats()
+}
+
+// metricTablesByName returns the metric of each metric table
+func (c *Client) metricTablesByName() (map[string]string, error) {
+	rows, err := c.db.Query(fmt.Sprintf("SELECT metric_name, table_name FROM %s", ident(c.cfg.table, "_metric_tables")))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tables := make(map[string]string)
+
+	for rows.Next() {
+		var metric, table string
+
+		if err = rows.Scan(&metric, &table); err != nil {
+			return nil, err
+		}
+		tables[table] = metric
+	}
+	return tables, rows.Err()
+}
+
+func (c *Client) tableStats(table string) (*TableStats, error) {
+	stats := &TableStats{Table: table}
+	quoted := quoteIdent(table)
+
+	var err error
+
+	switch {
+	case c.cfg.useTimescaleDb:
+		err = c.db.QueryRow(`SELECT approximate_row_count($1::regclass),
+			(SELECT total_bytes FROM hypertable_detailed_size($1::regclass)),
+			COALESCE((SELECT before_compression_total_bytes FROM hypertable_compression_stats($1::regclass)), 0),
+			COALESCE((SELECT after_compression_total_bytes FROM hypertable_compression_stats($1::regclass)), 0),
+			(SELECT count(*) FROM show_chunks($1::regclass))`, quoted).Scan(
+			&stats.Rows, &stats.TotalBytes, &stats.BeforeCompressionBytes, &stats.AfterCompressionBytes, &stats.Chunks)
+	case len(c.cfg.partitioning) > 0:
+		err = c.db.QueryRow(`SELECT COALESCE(sum(GREATEST(r.reltuples, 0)), 0)::bigint, COALESCE(sum(pg_total_relation_size(t.relid)), 0)::bigint, count(*) FILTER (WHERE t.isleaf)
+			FROM pg_partition_tree($1::regclass) t INNER JOIN pg_class r ON r.oid = t.relid`, quoted).Scan(
+			&stats.Rows, &stats.TotalBytes, &stats.Chunks)
+	default:
+		err = c.db.QueryRow("SELECT GREATEST(reltuples, 0)::bigint, pg_total_relation_size(oid) FROM pg_class WHERE oid = $1::regclass", quoted).Scan(
+			&stats.Rows, &stats.TotalBytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	timeColumn := "time"
+	if c.cfg.usePgPrometheus && !c.cfg.pgPrometheusNormalize {
+		timeColumn = "prom_time(sample)"
+	}
+
+	var oldest, newest nullTime
+
+	err = c.db.QueryRow(fmt.Sprintf("SELECT min(%[1]s), max(%[1]s) FROM %[2]s", timeColumn, quoted)).Scan(&oldest, &newest)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Oldest = oldest.ptr()
+	stats.Newest = newest.ptr()
+
+	return stats, nil
+}
+
+func (c *Client) metricStats() ([]MetricStats, error) {
+	rows, err := c.db.Query(fmt.Sprintf(`SELECT l.metric_name, count(*), min(v.time), max(v.time)
+		FROM %s v INNER JOIN %s l ON l.id = v.labels_id
+		GROUP BY l.metric_name ORDER BY count(*) DESC`, ident(c.cfg.table, "_values"), ident(c.cfg.table, "_labels")))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var metrics []MetricStats
+
+	for rows.Next() {
+		var m MetricStats
+
+		if err = rows.Scan(&m.Metric, &m.Rows, &m.Oldest, &m.Newest); err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, rows.Err()
+}
+
+// nullTime scans a timestamp that may be NULL
+type nullTime struct {
+	time.Time
+	valid bool
+}
+
+func (t *nullTime) Scan(value interface{}) error {
+	if value == nil {
+		t.valid = false
+		return nil
+	}
+
+	v, ok := value.(time.Time)
+	if !ok {
+		return fmt.Errorf("invalid timestamp value %T", value)
+	}
+
+	t.Time, t.valid = v, true
+	return nil
+}
+
+func (t nullTime) ptr() *time.Time {
+	if !t.valid {
+		return nil
+	}
+	return &t.Time
+}
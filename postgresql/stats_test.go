@@ -0,0 +1,30 @@
+package pgprometheus
+
+import (
+	"testing"
+)
+
+func TestStorageMode(t *testing.T) {
+	testCases := []struct {
+		cfg  Config
+		mode string
+	}{
+		{cfg: Config{dialect: dialectPostgreSQL, usePgPrometheus: true, useTimescaleDb: true}, mode: "pg_prometheus"},
+		{cfg: Config{dialect: dialectPostgreSQL, usePgPrometheus: true, pgPrometheusNormalize: true}, mode: "pg_prometheus_normalized"},
+		{cfg: Config{dialect: dialectPostgreSQL, useTimescaleDb: true, distributed: true}, mode: "timescaledb_distributed"},
+		{cfg: Config{dialect: dialectPostgreSQL, useTimescaleDb: true}, mode: "timescaledb"},
+		{cfg: Config{dialect: dialectPostgreSQL, citus: true}, mode: "citus"},
+		{cfg: Config{dialect: dialectPostgreSQL, partitioning: partitioningPgPartman}, mode: "partitioned_pg_partman"},
+		{cfg: Config{dialect: dialectPostgreSQL}, mode: "postgresql"},
+		{cfg: Config{dialect: dialectCockroachDB}, mode: dialectCockroachDB},
+	}
+
+	for _, tc := range testCases {
+		cfg := tc.cfg
+		c := &Client{cfg: &cfg}
+
+		if mode := c.StorageMode(); mode != tc.mode {
+			t.Errorf("%+v: expected %s, got %s", tc.cfg, tc.mode, mode)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package pgprometheus
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// database/sql prepares a statement again on each connection it runs on, and
+// keeps it prepared there, so that PostgreSQL parses and plans the statements
+// writing samples, and the reads repeated by dashboards, once per connection
+// rather than for every batch or query.
+//
+// Preparing a statement with the pool takes a connection of its own, which a
+// write holding the connection of its transaction might wait for forever
+// once the pool is exhausted. Writes therefore only run statements prepared
+// already, which tx.StmtContext prepares on the connection of the
+// transaction, and prepare the statements they miss once their transaction
+// has released its connection.
+
+// maxCachedStatements is the number of statements kept prepared. The least
+// recently used statement is closed to prepare another.
+const maxCachedStatements = 256
+
+// stmtCache keeps the statements prepared by their SQL. A nil cache runs every
+// statement unprepared.
+type stmtCache struct {
+	db   *sql.DB
+	size int
+
+	mu    sync.Mutex
+	stmts map[string]*list.Element
+	// lru holds the cached statements, the most recently used first
+	lru *list.List
+	// missed are the statements written without being prepared
+	missed map[string]struct{}
+}
+
+type cachedStmt struct {
+	query string
+	stmt  *sql.Stmt
+}
+
+// newStmtCache returns a cache of statements prepared on db, or nil if
+// prepared statements are disabled or unavailable behind PgBouncer
+func newStmtCache(db *sql.DB, cfg *Config) *stmtCache {
+	if !cfg.prepareStatements || cfg.pgBouncer {
+		return nil
+	}
+	return &stmtCache{
+		db:     db,
+		size:   maxCachedStatements,
+		stmts:  make(map[string]*list.Element),
+		lru:    list.New(),
+		missed: make(map[string]struct{}),
+	}
+}
+
+// cached returns the statement of query if it is prepared already
+func (s *stmtCache) cached(query string) *sql.Stmt {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.stmts[query]
+	if !ok {
+		return nil
+	}
+
+	s.lru.MoveToFront(e)
+	return e.Value.(*cachedStmt).stmt
+}
+
+// prepared returns the statement of query, preparing it if needed, or nil if
+// it is to run unprepared. It takes a connection of the pool to prepare, so it
+// must not be called while holding one. Statements on the temporary table
+// cannot be prepared on connections that have not written yet, and are
+// prepared again after the next write.
+func (s *stmtCache) prepared(ctx context.Context, query string) *sql.Stmt {
+	if s == nil {
+		return nil
+	}
+
+	if stmt := s.cached(query); stmt != nil {
+		return stmt
+	}
+
+	stmt, err := s.db.PrepareContext(ctx, query)
+
+	if err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.stmts[query]; ok {
+		stmt.Close()
+		return e.Value.(*cachedStmt).stmt
+	}
+
+	s.stmts[query] = s.lru.PushFront(&cachedStmt{query: query, stmt: stmt})
+
+	for s.lru.Len() > s.size {
+		oldest := s.lru.Remove(s.lru.Back()).(*cachedStmt)
+		delete(s.stmts, oldest.query)
+		// Executions still using the statement finish first
+		oldest.stmt.Close()
+	}
+	return stmt
+}
+
+// miss records that query ran unprepared
+func (s *stmtCache) miss(query string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.missed[query] = struct{}{}
+	s.mu.Unlock()
+}
+
+// prepareMissed prepares the statements that ran unprepared. It must be
+// called once the transaction they ran in has released its connection.
+func (s *stmtCache) prepareMissed(ctx context.Context) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	missed := make([]string, 0, len(s.missed))
+	for query := range s.missed {
+		missed = append(missed, query)
+		delete(s.missed, query)
+	}
+	s.mu.Unlock()
+
+	for _, query := range missed {
+		s.prepared(ctx, query)
+	}
+}
+
+// execTx executes query as part of tx, prepared on the connection of tx if
+// the statement is cached, or unprepared to be prepared after tx otherwise
+func (c *Client) execTx(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	if stmt := c.stmts.cached(query); stmt != nil {
+		return tx.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+	}
+
+	c.stmts.miss(query)
+	return tx.ExecContext(ctx, query, args...)
+}
+
+// queryRead runs a read query, prepared if possible, or with pgx if it is the
+// driver. The time range and matcher values of prepared reads are bound to
+// args, so that their SQL repeats for the same selector.
+func (c *Client) queryRead(ctx context.Context, query string, args []interface{}) (sampleRows, error) {
+	if c.cfg.driver == driverPgx {
+		return c.queryPgx(ctx, query, args)
+	}
+
+	if stmt := c.stmts.prepared(ctx, query); stmt != nil {
+		return stmt.QueryContext(ctx, args...)
+	}
+	return c.db.QueryContext(ctx, query, args...)
+}
+
+// close closes the prepared statements
+func (s *stmtCache) close() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for query, e := range s.stmts {
+		e.Value.(*cachedStmt).stmt.Close()
+		delete(s.stmts, query)
+	}
+	s.lru.Init()
+}
@@ -0,0 +1,207 @@
+package pgprometheus
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestBuildStatementBind(t *testing.T) {
+	q := &prompb.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   20000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+		},
+	}
+
+	c := &Client{cfg: &Config{table: "metrics", pgPrometheusNormalize: true}}
+
+	testCases := []struct {
+		bind       bool
+		expected   []string
+		unexpected []string
+	}{
+		{
+			bind:       false,
+			expected:   []string{"time >= '1970-01-01T00:00:01.000Z'", "time <= '1970-01-01T00:00:20.000Z'"},
+			unexpected: []string{"$1", "$2"},
+		},
+		{
+			bind:       true,
+			expected:   []string{"time >= $1", "time <= $2"},
+			unexpected: []string{"1970-01-01"},
+		},
+	}
+
+	for _, tc := range testCases {
+		cmd, _, err := c.buildStatement(q, tc.bind)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range tc.expected {
+			if !strings.Contains(cmd, e) {
+				t.Errorf("bind %t: expected %q in command %s", tc.bind, e, cmd)
+			}
+		}
+
+		for _, e := range tc.unexpected {
+			if strings.Contains(cmd, e) {
+				t.Errorf("bind %t: unexpected %q in command %s", tc.bind, e, cmd)
+			}
+		}
+	}
+}
+
+func TestBuildStatementBindMatchers(t *testing.T) {
+	query := func(name, job, host string) *prompb.Query {
+		return &prompb.Query{
+			StartTimestampMs: 1000,
+			EndTimestampMs:   20000,
+			Matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: name},
+				{Type: prompb.LabelMatcher_EQ, Name: "job", Value: job},
+				{Type: prompb.LabelMatcher_RE, Name: "host", Value: host},
+			},
+		}
+	}
+
+	for _, format := range []string{labelsFormatJSONB, labelsFormatHstore, labelsFormatArrays} {
+		c := &Client{cfg: &Config{table: "metrics", pgPrometheusNormalize: true, labelsFormat: format}}
+
+		cmd, args, err := c.buildStatement(query("up", "o'brien", `local\.*`), true)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Values are not part of the SQL, so that selectors of the same
+		// shape share a prepared statement
+		other, _, err := c.buildStatement(query("down", "nginx", "remote"), true)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cmd != other {
+			t.Errorf("%s: expected the same statement for other values, got %s and %s", format, cmd, other)
+		}
+
+		for _, value := range []string{"'up'", "o'brien", "o''brien", "local"} {
+			if strings.Contains(cmd, value) {
+				t.Errorf("%s: unexpected value %q in command %s", format, value, cmd)
+			}
+		}
+
+		if len(args) < 5 || args[0] != toTimestamp(1000) || args[1] != toTimestamp(20000) {
+			t.Fatalf("%s: expected the time range and the values as arguments, got %v", format, args)
+		}
+
+		for _, value := range []string{"up", `^local\.*$`} {
+			found := false
+			for _, arg := range args {
+				found = found || arg == value
+			}
+
+			if !found {
+				t.Errorf("%s: expected %q in arguments %v", format, value, args)
+			}
+		}
+	}
+}
+
+func TestNewStmtCache(t *testing.T) {
+	testCases := []struct {
+		cfg      Config
+		expected bool
+	}{
+		{cfg: Config{prepareStatements: true}, expected: true},
+		{cfg: Config{prepareStatements: false}, expected: false},
+		{cfg: Config{prepareStatements: true, pgBouncer: true}, expected: false},
+	}
+
+	for i, tc := range testCases {
+		if cache := newStmtCache(nil, &tc.cfg); (cache != nil) != tc.expected {
+			t.Errorf("case %d: expected a cache %t, got %t", i, tc.expected, cache != nil)
+		}
+	}
+}
+
+func TestExecTxSingleConnection(t *testing.T) {
+	fake := newFakeDB()
+	db := fake.open(1)
+	defer db.Close()
+
+	c := &Client{db: db, stmts: newStmtCache(db, &Config{prepareStatements: true})}
+	query := "INSERT INTO metrics_values SELECT * FROM metrics_tmp"
+
+	// A write whose statement would be prepared with the pool waits for a
+	// second connection until it times out
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = c.execTx(ctx, tx, query); err != nil {
+			t.Fatalf("write %d: unexpected error %v", i, err)
+		}
+
+		if err = tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		c.stmts.prepareMissed(ctx)
+		cancel()
+	}
+
+	// Prepared after the first write, and reused by the others
+	if prepared := fake.preparedCount(query); prepared != 1 {
+		t.Errorf("expected the statement prepared once, got %d", prepared)
+	}
+
+	if len(fake.execs) != 3 {
+		t.Errorf("expected 3 executions, got %d", len(fake.execs))
+	}
+}
+
+func TestStmtCacheEviction(t *testing.T) {
+	fake := newFakeDB()
+	db := fake.open(1)
+	defer db.Close()
+
+	s := newStmtCache(db, &Config{prepareStatements: true})
+	s.size = 2
+
+	ctx := context.Background()
+
+	for _, query := range []string{"SELECT 1", "SELECT 2", "SELECT 1", "SELECT 3"} {
+		if stmt := s.prepared(ctx, query); stmt == nil {
+			t.Fatalf("expected %q prepared", query)
+		}
+	}
+
+	// SELECT 2 was the least recently used
+	for query, expected := range map[string]bool{"SELECT 1": true, "SELECT 2": false, "SELECT 3": true} {
+		if cached := s.cached(query) != nil; cached != expected {
+			t.Errorf("expected %q cached %t, got %t", query, expected, cached)
+		}
+	}
+
+	if closed := fake.closedCount(); closed != 1 {
+		t.Errorf("expected 1 statement closed, got %d", closed)
+	}
+
+	s.close()
+
+	if closed := fake.closedCount(); closed != 3 {
+		t.Errorf("expected 3 statements closed, got %d", closed)
+	}
+}
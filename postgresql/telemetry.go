@@ -0,0 +1,107 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The adapter can write its own key metrics into the database it writes
+// samples to, so that there is a history of its ingest rate and errors
+// without a second Prometheus scraping it.
+
+const (
+	sqlCreateTelemetryTable = `CREATE TABLE IF NOT EXISTS %s (
+		time timestamptz NOT NULL,
+		instance text NOT NULL,
+		received_samples bigint NOT NULL,
+		written_samples bigint NOT NULL,
+		failed_samples bigint NOT NULL,
+		ingest_rate double precision NOT NULL,
+		batches_in_progress integer NOT NULL,
+		open_connections integer NOT NULL
+	)`
+	sqlInsertTelemetry = `INSERT INTO %s VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+)
+
+// telemetry is a snapshot of the key metrics of the adapter
+type telemetry struct {
+	time              time.Time
+	receivedSamples   int64
+	writtenSamples    int64
+	failedSamples     int64
+	batchesInProgress int
+	openConnections   int
+}
+
+func (c *Client) telemetry(now time.Time) telemetry {
+	return telemetry{
+		time:              now,
+		receivedSamples:   int64(metricValue(c.writeMetrics.receivedSamples)),
+		writtenSamples:    int64(metricValue(c.writeMetrics.writtenSamples)),
+		failedSamples:     int64(metricValue(c.writeMetrics.failedSamples)),
+		batchesInProgress: int(metricValue(c.writeMetrics.batchesInFlight)),
+		openConnections:   c.db.Stats().OpenConnections,
+	}
+}
+
+// ingestRate returns the written samples per second since the previous
+// snapshot
+func (t telemetry) ingestRate(prev telemetry) float64 {
+	seconds := t.time.Sub(prev.time).Seconds()
+	if seconds <= 0 || prev.time.IsZero() {
+		return 0
+	}
+	return float64(t.writtenSamples-prev.writtenSamples) / seconds
+}
+
+// metricValue returns the value of a counter or gauge
+func metricValue(m prometheus.Metric) float64 {
+	var metric dto.Metric
+
+	if err := m.Write(&metric); err != nil {
+		return 0
+	}
+
+	if metric.Counter != nil {
+		return metric.Counter.GetValue()
+	}
+	return metric.Gauge.GetValue()
+}
+
+// runSelfTelemetry periodically writes the key metrics of the adapter into
+// the telemetry table
+func (c *Client) runSelfTelemetry() {
+	_, err := c.db.Exec(fmt.Sprintf(sqlCreateTelemetryTable, ident(c.cfg.table, "_adapter_telemetry")))
+
+	if err != nil {
+		log.Error("msg", "Error creating the telemetry table, not writing telemetry", "err", err)
+		return
+	}
+
+	instance, err := os.Hostname()
+
+	if err != nil {
+		instance = "unknown"
+	}
+
+	ticker := time.NewTicker(c.cfg.selfTelemetryInterval)
+	prev := c.telemetry(time.Now())
+
+	for now := range ticker.C {
+		current := c.telemetry(now)
+
+		_, err = c.db.Exec(fmt.Sprintf(sqlInsertTelemetry, ident(c.cfg.table, "_adapter_telemetry")), current.time, instance, current.receivedSamples,
+			current.writtenSamples, current.failedSamples, current.ingestRate(prev), current.batchesInProgress, current.openConnections)
+
+		if err != nil {
+			log.Warn("msg", "Error writing telemetry", "err", err)
+		}
+		prev = current
+	}
+}
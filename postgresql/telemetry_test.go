@@ -0,0 +1,41 @@
+package pgprometheus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIngestRate(t *testing.T) {
+	now := time.Now()
+
+	testCases := []struct {
+		prev telemetry
+		cur  telemetry
+		rate float64
+	}{
+		{prev: telemetry{time: now, writtenSamples: 100}, cur: telemetry{time: now.Add(10 * time.Second), writtenSamples: 600}, rate: 50},
+		{prev: telemetry{}, cur: telemetry{time: now, writtenSamples: 600}},
+		{prev: telemetry{time: now}, cur: telemetry{time: now, writtenSamples: 600}},
+	}
+
+	for i, tc := range testCases {
+		if rate := tc.cur.ingestRate(tc.prev); rate != tc.rate {
+			t.Errorf("%d: expected %v, got %v", i, tc.rate, rate)
+		}
+	}
+}
+
+func TestMetricValue(t *testing.T) {
+	m := newWriteMetrics()
+
+	m.writtenSamples.Add(42)
+	m.batchesInFlight.Set(3)
+
+	if v := metricValue(m.writtenSamples); v != 42 {
+		t.Errorf("expected 42, got %v", v)
+	}
+
+	if v := metricValue(m.batchesInFlight); v != 3 {
+		t.Errorf("expected 3, got %v", v)
+	}
+}
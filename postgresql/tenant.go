@@ -0,0 +1,295 @@
+package pgprometheus
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/lib/pq"
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// Writes and reads of a tenant go to tables of their own, either a set of
+// tables named after the tenant next to the default tables, or the tables of
+// a schema of the tenant. The tables of a tenant are created the first time
+// it is seen, with the settings of the default tables. Schema tenants have a
+// connection pool of their own, whose search_path starts with their schema.
+
+const (
+	tenantTable  = "table"
+	tenantSchema = "schema"
+
+	// Tenants are registered in a table, so that their retention is
+	// enforced even if they have not been seen since the adapter started
+	sqlCreateTenantsTable = "CREATE TABLE IF NOT EXISTS %s (tenant TEXT PRIMARY KEY, tier TEXT NOT NULL, created TIMESTAMPTZ NOT NULL DEFAULT now())"
+	sqlRegisterTenant     = "INSERT INTO %s (tenant, tier) VALUES ($1, $2) ON CONFLICT (tenant) DO UPDATE SET tier = excluded.tier"
+)
+
+// Tenants become part of table and schema names, and are limited so that the
+// longest derived names fit in 63 bytes
+var tenantPattern = regexp.MustCompile("^[a-z0-9_]{1,32}$")
+
+type tenantKey struct{}
+
+// WithTenant returns a context routing the writes and reads of the client to
+// the tables of the tenant
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant set with WithTenant, or an empty string
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// ValidateTenant checks that the tenant can be part of table and schema names
+func ValidateTenant(tenant string) error {
+	if !tenantPattern.MatchString(tenant) {
+		return fmt.Errorf("invalid tenant %q, expected 1 to 32 lowercase letters, digits or underscores", tenant)
+	}
+	return nil
+}
+
+// tenantProvisioning is the setup of the client of a tenant, which the
+// requests of the tenant arriving meanwhile wait for
+type tenantProvisioning struct {
+	done   chan struct{}
+	client *Client
+	err    error
+}
+
+// tenantClient returns the client of the tables of the tenant, creating them
+// when the tenant is first seen. The tables are created without holding
+// tenantsLock, so that a new tenant does not hold up the others, and once for
+// all concurrent requests of the tenant.
+func (c *Client) tenantClient(tenant string) (*Client, error) {
+	c.tenantsLock.RLock()
+	client, ok := c.tenants[tenant]
+	c.tenantsLock.RUnlock()
+
+	if ok {
+		return client, nil
+	}
+
+	if err := ValidateTenant(tenant); err != nil {
+		return nil, err
+	}
+
+	c.tenantsLock.Lock()
+
+	if client, ok = c.tenants[tenant]; ok {
+		c.tenantsLock.Unlock()
+		return client, nil
+	}
+
+	if c.provisioning == nil {
+		c.provisioning = make(map[string]*tenantProvisioning)
+	}
+
+	p, ok := c.provisioning[tenant]
+
+	if ok {
+		c.tenantsLock.Unlock()
+		<-p.done
+		return p.client, p.err
+	}
+
+	p = &tenantProvisioning{done: make(chan struct{})}
+	c.provisioning[tenant] = p
+	c.tenantsLock.Unlock()
+
+	p.client, p.err = c.provisionTenantClient(tenant)
+
+	// Failed setups are not kept, so that the next request tries again
+	c.tenantsLock.Lock()
+	delete(c.provisioning, tenant)
+
+	if p.err == nil {
+		c.tenants[tenant] = p.client
+		c.tenantMetrics.tenants.Set(float64(len(c.tenants)))
+	}
+	c.tenantsLock.Unlock()
+
+	close(p.done)
+	return p.client, p.err
+}
+
+// provisionTenantClient sets up the client of the tenant, and registers it
+func (c *Client) provisionTenantClient(tenant string) (*Client, error) {
+	client, created, err := c.newTenantClient(tenant)
+
+	if err != nil {
+		c.tenantMetrics.errors.Inc()
+		return nil, fmt.Errorf("error setting up tenant %s: %v", tenant, err)
+	}
+
+	if created {
+		c.tenantMetrics.provisioned.Inc()
+		log.Info("msg", "Provisioned the tables of a new tenant", "tenant", tenant, "tier", tierOf(c.tenantTiers, tenant), "table", client.cfg.table, "schema", client.cfg.schema)
+	}
+
+	if err = c.registerTenant(tenant); err != nil {
+		log.Warn("msg", "Error registering a tenant", "tenant", tenant, "err", err)
+	}
+	return client, nil
+}
+
+func (c *Client) registerTenant(tenant string) error {
+	_, err := c.db.Exec(fmt.Sprintf(sqlCreateTenantsTable, ident(c.cfg.table, "_tenants")))
+
+	if err == nil {
+		_, err = c.db.Exec(fmt.Sprintf(sqlRegisterTenant, ident(c.cfg.table, "_tenants")), tenant, tierOf(c.tenantTiers, tenant))
+	}
+	return err
+}
+
+// registeredTenants returns the tenants seen by any adapter
+func (c *Client) registeredTenants() ([]string, error) {
+	var exists bool
+
+	err := c.db.QueryRow("SELECT to_regclass($1) IS NOT NULL", ident(c.cfg.table, "_tenants")).Scan(&exists)
+
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	rows, err := c.db.Query(fmt.Sprintf("SELECT tenant FROM %s ORDER BY tenant", ident(c.cfg.table, "_tenants")))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var tenants []string
+
+	for rows.Next() {
+		var tenant string
+
+		if err = rows.Scan(&tenant); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, rows.Err()
+}
+
+// newTenantClient returns the client of the tenant, and whether its tables
+// were created
+func (c *Client) newTenantClient(tenant string) (*Client, bool, error) {
+	cfg := *c.cfg
+
+	switch c.cfg.tenantMode {
+	case tenantTable:
+		cfg.table = c.cfg.table + "_" + tenant
+	case tenantSchema:
+		cfg.schema = c.cfg.tenantSchemaPrefix + tenant
+	default:
+		return nil, false, fmt.Errorf("invalid tenant mode %q", c.cfg.tenantMode)
+	}
+
+	exists, err := c.tenantExists(&cfg)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !exists && !c.cfg.tenantAutoProvision {
+		return nil, false, fmt.Errorf("the tenant has no tables and auto-provisioning is disabled")
+	}
+
+	db := c.db
+
+	if c.cfg.tenantMode == tenantSchema {
+		if _, err = c.db.Exec(fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", pq.QuoteIdentifier(cfg.schema))); err != nil {
+			return nil, false, err
+		}
+
+		connStr, err := cfg.connString()
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		if db, err = openDB(&cfg, connStr); err != nil {
+			return nil, false, err
+		}
+
+		// Each tenant has a pool of its own, which would otherwise open as
+		// many connections as the default pool
+		cfg.maxOpenConns = tenantMaxOpenConns(&cfg)
+		if cfg.maxIdleConns > cfg.maxOpenConns {
+			cfg.maxIdleConns = cfg.maxOpenConns
+		}
+
+		db.SetMaxOpenConns(cfg.maxOpenConns)
+		db.SetMaxIdleConns(cfg.maxIdleConns)
+		db.SetConnMaxLifetime(cfg.connMaxLifetime)
+	}
+
+	// Tenants share the metrics and leader election of the default client
+	client := &Client{
+		db:            db,
+		cfg:           &cfg,
+		metricTables:  make(map[string]string),
+		maxIdleConns:  cfg.maxIdleConns,
+		writeMetrics:  c.writeMetrics,
+		readMetrics:   c.readMetrics,
+		topMetrics:    c.topMetrics,
+		recentQueries: c.recentQueries,
+		elector:       c.elector,
+		replicaLabels: c.replicaLabels,
+		waitLatency:   c.waitLatency,
+		commitLatency: c.commitLatency,
+		labels:        c.labels,
+		stmts:         newStmtCache(db, &cfg),
+	}
+
+	err = client.setupPgPrometheus()
+
+	if err == nil {
+		err = client.checkSchema()
+	}
+
+	if err == nil && !exists {
+		err = c.provisionTenant(client, tenant)
+	}
+
+	if err == nil && client.useCopy() && !cfg.pgBouncer {
+		client.createTmpTableStmt, err = db.Prepare(client.createTmpTable())
+	}
+
+	if err != nil {
+		if db != c.db {
+			db.Close()
+		}
+		return nil, false, err
+	}
+	return client, !exists, nil
+}
+
+// tenantMaxOpenConns returns the max number of open connections of the pool
+// of a schema tenant, which is at most that of the default pool
+func tenantMaxOpenConns(cfg *Config) int {
+	n := cfg.tenantMaxOpenConns
+
+	if n <= 0 || (cfg.maxOpenConns > 0 && n > cfg.maxOpenConns) {
+		n = cfg.maxOpenConns
+	}
+	return n
+}
+
+// closeTenants closes the connection pools of schema tenants
+func (c *Client) closeTenants() {
+	c.tenantsLock.Lock()
+	defer c.tenantsLock.Unlock()
+
+	for _, client := range c.tenants {
+		client.stmts.close()
+
+		if client.db != c.db {
+			client.db.Close()
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package pgprometheus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestValidateTenant(t *testing.T) {
+	for tenant, valid := range map[string]bool{
+		"acme":                               true,
+		"team_42":                            true,
+		"":                                   false,
+		"Acme":                               false,
+		"team-a":                             false,
+		"a; DROP TABLE metrics":              false,
+		"a_tenant_with_a_much_too_long_name": false,
+	} {
+		if err := ValidateTenant(tenant); (err == nil) != valid {
+			t.Errorf("Unexpected validation of tenant %q: %v", tenant, err)
+		}
+	}
+}
+
+func TestWithTenant(t *testing.T) {
+	if tenant := TenantFromContext(context.Background()); tenant != "" {
+		t.Errorf("Expected no tenant, got %q", tenant)
+	}
+
+	if tenant := TenantFromContext(WithTenant(context.Background(), "acme")); tenant != "acme" {
+		t.Errorf("Expected tenant acme, got %q", tenant)
+	}
+}
+
+func TestNewTenantClientMode(t *testing.T) {
+	c := &Client{cfg: &Config{table: "metrics", tenantMode: "database"}, tenants: make(map[string]*Client), tenantMetrics: newTenantMetrics()}
+
+	if _, err := c.tenantClient("acme"); err == nil {
+		t.Error("Expected an error for an invalid tenant mode")
+	}
+
+	if _, err := c.tenantClient("Acme"); err == nil {
+		t.Error("Expected an error for an invalid tenant")
+	}
+}
+
+func TestTenantClientProvisioning(t *testing.T) {
+	c := &Client{cfg: &Config{table: "metrics", tenantMode: "database"}, tenants: make(map[string]*Client), tenantMetrics: newTenantMetrics()}
+
+	pending := &tenantProvisioning{done: make(chan struct{})}
+	c.provisioning = map[string]*tenantProvisioning{"acme": pending}
+
+	// Other tenants are set up while acme is
+	if _, err := c.tenantClient("initech"); err == nil {
+		t.Error("Expected an error for an invalid tenant mode")
+	}
+
+	if _, ok := c.provisioning["initech"]; ok {
+		t.Error("Expected the failed setup of initech not to be kept")
+	}
+
+	result := make(chan *Client)
+
+	go func() {
+		client, _ := c.tenantClient("acme")
+		result <- client
+	}()
+
+	select {
+	case <-result:
+		t.Fatal("Expected the request of acme to wait for its setup")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	pending.client = &Client{}
+	close(pending.done)
+
+	if client := <-result; client != pending.client {
+		t.Error("Expected the client set up for acme")
+	}
+}
+
+func TestTenantMaxOpenConns(t *testing.T) {
+	testCases := []struct {
+		maxOpenConns       int
+		tenantMaxOpenConns int
+		expected           int
+	}{
+		{maxOpenConns: 50, tenantMaxOpenConns: 5, expected: 5},
+		{maxOpenConns: 2, tenantMaxOpenConns: 5, expected: 2},
+		{maxOpenConns: 50, tenantMaxOpenConns: 0, expected: 50},
+		{maxOpenConns: 0, tenantMaxOpenConns: 5, expected: 5},
+	}
+
+	for _, c := range testCases {
+		cfg := &Config{maxOpenConns: c.maxOpenConns, tenantMaxOpenConns: c.tenantMaxOpenConns}
+
+		if actual := tenantMaxOpenConns(cfg); actual != c.expected {
+			t.Errorf("Expected %d connections for %d and %d, got %d", c.expected, c.maxOpenConns, c.tenantMaxOpenConns, actual)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package pgprometheus
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+// The metrics with the most written samples are tracked with the Space-Saving
+// algorithm in memory bounded by the number of tracked metrics. A metric that
+// is not tracked replaces the one with the fewest samples, taking over its
+// count as the error bound, so the counts are upper bounds that are exact for
+// metrics tracked from the start.
+
+// MetricCount is the number of samples written for a metric
+type MetricCount struct {
+	Metric  string `json:"metric"`
+	Samples int64  `json:"samples"`
+	// Error is how much Samples may overcount
+	Error int64 `json:"error"`
+}
+
+// TopMetrics returns the metrics with the most written samples, if tracked
+func (c *Client) TopMetrics() []MetricCount {
+	if c.topMetrics == nil {
+		return nil
+	}
+	return c.topMetrics.top()
+}
+
+type topKEntry struct {
+	MetricCount
+	index int
+}
+
+// topKHeap is a min-heap of entries by samples
+type topKHeap []*topKEntry
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].Samples < h[j].Samples }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	entry := x.(*topKEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+type topK struct {
+	size    int
+	lock    sync.Mutex
+	entries map[string]*topKEntry
+	heap    topKHeap
+}
+
+func newTopK(size int) *topK {
+	return &topK{size: size, entries: make(map[string]*topKEntry)}
+}
+
+func (t *topK) add(metric string, samples int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if entry, ok := t.entries[metric]; ok {
+		entry.Samples += samples
+		heap.Fix(&t.heap, entry.index)
+		return
+	}
+
+	if len(t.heap) < t.size {
+		entry := &topKEntry{MetricCount: MetricCount{Metric: metric, Samples: samples}}
+		t.entries[metric] = entry
+		heap.Push(&t.heap, entry)
+		return
+	}
+
+	min := t.heap[0]
+	delete(t.entries, min.Metric)
+
+	min.Error = min.Samples
+	min.Metric = metric
+	min.Samples += samples
+
+	t.entries[metric] = min
+	heap.Fix(&t.heap, 0)
+}
+
+// addSamples counts the samples of each metric
+func (t *topK) addSamples(samples model.Samples) {
+	counts := make(map[string]int64)
+	for _, s := range samples {
+		counts[string(s.Metric[model.MetricNameLabel])]++
+	}
+
+	for metric, n := range counts {
+		t.add(metric, n)
+	}
+}
+
+// top returns the tracked metrics by descending samples
+func (t *topK) top() []MetricCount {
+	t.lock.Lock()
+	counts := make([]MetricCount, 0, len(t.heap))
+	for _, entry := range t.heap {
+		counts = append(counts, entry.MetricCount)
+	}
+	t.lock.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Samples != counts[j].Samples {
+			return counts[i].Samples > counts[j].Samples
+		}
+		return counts[i].Metric < counts[j].Metric
+	})
+	return counts
+}
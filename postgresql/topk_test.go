@@ -0,0 +1,42 @@
+package pgprometheus
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestTopK(t *testing.T) {
+	top := newTopK(2)
+
+	top.addSamples(model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "up"}},
+		{Metric: model.Metric{model.MetricNameLabel: "up"}},
+		{Metric: model.Metric{model.MetricNameLabel: "up"}},
+		{Metric: model.Metric{model.MetricNameLabel: "node_load1"}},
+	})
+	top.add("node_load5", 2)
+	top.add("up", 1)
+
+	expected := []MetricCount{
+		{Metric: "up", Samples: 4},
+		{Metric: "node_load5", Samples: 3, Error: 1},
+	}
+
+	if counts := top.top(); !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected %v, got %v", expected, counts)
+	}
+
+	top.add("node_load5", 5)
+	top.add("rare", 1)
+
+	expected = []MetricCount{
+		{Metric: "node_load5", Samples: 8, Error: 1},
+		{Metric: "rare", Samples: 5, Error: 4},
+	}
+
+	if counts := top.top(); !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected %v, got %v", expected, counts)
+	}
+}
@@ -0,0 +1,83 @@
+package pgprometheus
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// storageParameters returns the configured storage parameters of the table
+// holding samples, formatted for a WITH or SET clause. Metric samples are
+// append-only, so they rarely need vacuuming for dead tuples and pages can be
+// filled completely.
+func (c *Client) storageParameters() string {
+	var params []string
+
+	if c.cfg.fillfactor > 0 {
+		params = append(params, fmt.Sprintf("fillfactor = %d", c.cfg.fillfactor))
+	}
+	if c.cfg.autovacuumVacuumThreshold >= 0 {
+		params = append(params, fmt.Sprintf("autovacuum_vacuum_threshold = %d", c.cfg.autovacuumVacuumThreshold))
+	}
+	if c.cfg.autovacuumVacuumScaleFactor >= 0 {
+		params = append(params, fmt.Sprintf("autovacuum_vacuum_scale_factor = %s", strconv.FormatFloat(c.cfg.autovacuumVacuumScaleFactor, 'g', -1, 64)))
+	}
+	if c.cfg.autovacuumAnalyzeScaleFactor >= 0 {
+		params = append(params, fmt.Sprintf("autovacuum_analyze_scale_factor = %s", strconv.FormatFloat(c.cfg.autovacuumAnalyzeScaleFactor, 'g', -1, 64)))
+	}
+	return strings.Join(params, ", ")
+}
+
+func (c *Client) validateStorageParameters() error {
+	if len(c.storageParameters()) == 0 {
+		return nil
+	}
+
+	if c.cfg.fillfactor > 100 || (c.cfg.fillfactor > 0 && c.cfg.fillfactor < 10) {
+		return fmt.Errorf("the fillfactor must be between 10 and 100")
+	}
+
+	if c.cfg.dialect != dialectPostgreSQL {
+		return fmt.Errorf("storage parameters are not supported by the %s dialect", c.cfg.dialect)
+	}
+
+	if c.cfg.partitioning == partitioningPgPartman {
+		return fmt.Errorf("storage parameters are not supported with %s partitioning", partitioningPgPartman)
+	}
+
+	return nil
+}
+
+// partitionParameters returns the WITH clause of a new time partition
+func (c *Client) partitionParameters() string {
+	if params := c.storageParameters(); len(params) > 0 {
+		return fmt.Sprintf(" WITH (%s)", params)
+	}
+	return ""
+}
+
+// setStorageParameters applies the storage parameters to the samples table
+// of a newly created table. TimescaleDB propagates them to the chunks of a
+// hypertable, while natively partitioned tables get them on each partition.
+func (c *Client) setStorageParameters(tx *sql.Tx, table string) error {
+	params := c.storageParameters()
+
+	if len(params) == 0 || len(c.cfg.partitioning) > 0 {
+		return nil
+	}
+
+	samplesTable := c.samplesTable(table)
+
+	_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s SET (%s)", quoteIdent(samplesTable), params))
+
+	if err != nil {
+		return err
+	}
+
+	log.Info("msg", "Set storage parameters", "table", samplesTable, "parameters", params)
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package pgprometheus
+
+import "testing"
+
+func TestStorageParameters(t *testing.T) {
+	c := &Client{cfg: &Config{
+		fillfactor:                   100,
+		autovacuumVacuumThreshold:    -1,
+		autovacuumVacuumScaleFactor:  0,
+		autovacuumAnalyzeScaleFactor: 0.05,
+	}}
+
+	params := c.storageParameters()
+	expected := "fillfactor = 100, autovacuum_vacuum_scale_factor = 0, autovacuum_analyze_scale_factor = 0.05"
+
+	if params != expected {
+		t.Errorf("Expected storage parameters %q, got %q", expected, params)
+	}
+
+	if clause := c.partitionParameters(); clause != " WITH ("+expected+")" {
+		t.Errorf("Unexpected partition parameters %q", clause)
+	}
+
+	c.cfg.fillfactor = 5
+	if err := c.validateStorageParameters(); err == nil {
+		t.Error("Expected an error for a fillfactor below 10")
+	}
+}
@@ -0,0 +1,220 @@
+package pgprometheus
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// TenantUsage is the usage of a tenant, e.g. for chargeback. Counts of
+// samples and queries are since the adapter started, while the series and
+// storage estimates are refreshed every -pg.tenant-usage-interval.
+type TenantUsage struct {
+	Tenant         string     `json:"tenant"`
+	Tier           string     `json:"tier"`
+	WrittenSamples int64      `json:"written_samples"`
+	ReadQueries    int64      `json:"read_queries"`
+	ReadSamples    int64      `json:"read_samples"`
+	Series         int64      `json:"series"`
+	Bytes          int64      `json:"bytes"`
+	MeasuredAt     *time.Time `json:"measured_at,omitempty"`
+}
+
+// tenantCounters count the usage of a tenant client
+type tenantCounters struct {
+	writtenSamples int64
+	readQueries    int64
+	readSamples    int64
+	series         int64
+	bytes          int64
+	measuredAt     int64
+}
+
+func (u *tenantCounters) addWrite(samples int) {
+	atomic.AddInt64(&u.writtenSamples, int64(samples))
+}
+
+func (u *tenantCounters) addRead(queries, samples int) {
+	atomic.AddInt64(&u.readQueries, int64(queries))
+	atomic.AddInt64(&u.readSamples, int64(samples))
+}
+
+func (u *tenantCounters) setStorage(series, bytes int64, now time.Time) {
+	atomic.StoreInt64(&u.series, series)
+	atomic.StoreInt64(&u.bytes, bytes)
+	atomic.StoreInt64(&u.measuredAt, now.UnixNano())
+}
+
+// TenantUsage returns the usage of the tenants seen since the adapter started,
+// sorted by tenant
+func (c *Client) TenantUsage() []TenantUsage {
+	c.tenantsLock.RLock()
+	defer c.tenantsLock.RUnlock()
+
+	usage := make([]TenantUsage, 0, len(c.tenants))
+
+	for tenant, client := range c.tenants {
+		u := &client.usage
+
+		tu := TenantUsage{
+			Tenant:         tenant,
+			Tier:           tierOf(c.tenantTiers, tenant),
+			WrittenSamples: atomic.LoadInt64(&u.writtenSamples),
+			ReadQueries:    atomic.LoadInt64(&u.readQueries),
+			ReadSamples:    atomic.LoadInt64(&u.readSamples),
+			Series:         atomic.LoadInt64(&u.series),
+			Bytes:          atomic.LoadInt64(&u.bytes),
+		}
+
+		if measuredAt := atomic.LoadInt64(&u.measuredAt); measuredAt > 0 {
+			t := time.Unix(0, measuredAt)
+			tu.MeasuredAt = &t
+		}
+		usage = append(usage, tu)
+	}
+
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Tenant < usage[j].Tenant })
+	return usage
+}
+
+// runTenantUsage periodically estimates the series and storage of every
+// registered tenant
+func (c *Client) runTenantUsage() {
+	ticker := time.NewTicker(c.cfg.tenantUsageInterval)
+
+	for range ticker.C {
+		tenants, err := c.registeredTenants()
+
+		if err != nil {
+			log.Error("msg", "Error listing tenants", "err", err)
+			continue
+		}
+
+		for _, tenant := range tenants {
+			client, err := c.tenantClient(tenant)
+
+			if err == nil {
+				err = client.measureStorage()
+			}
+
+			if err != nil {
+				log.Warn("msg", "Error estimating the storage of a tenant", "tenant", tenant, "err", err)
+			}
+		}
+	}
+}
+
+// measureStorage estimates the series and bytes of the tables of the client
+func (c *Client) measureStorage() error {
+	tables := []string{c.cfg.table}
+
+	if c.cfg.tablePerMetric {
+		metricTables, err := c.metricTablesByName()
+
+		if err != nil {
+			return err
+		}
+
+		tables = tables[:0]
+		for table := range metricTables {
+			tables = append(tables, table)
+		}
+	}
+
+	var series, bytes int64
+
+	for _, table := range tables {
+		var tableSeries, tableBytes int64
+
+		err := c.db.QueryRow(`SELECT COALESCE((SELECT GREATEST(reltuples, 0)::bigint FROM pg_class WHERE oid = to_regclass($1)), 0),
+			COALESCE((SELECT pg_total_relation_size(to_regclass($1))), 0)`, ident(table, "_labels")).Scan(&tableSeries, &tableBytes)
+
+		if err != nil {
+			return err
+		}
+
+		samplesBytes, err := c.tableBytes(c.samplesTable(table))
+
+		if err != nil {
+			return err
+		}
+
+		series += tableSeries
+		bytes += tableBytes + samplesBytes
+	}
+
+	c.usage.setStorage(series, bytes, time.Now())
+	return nil
+}
+
+// tableBytes returns the size of a table holding samples, including its
+// chunks or partitions
+func (c *Client) tableBytes(table string) (int64, error) {
+	var bytes int64
+	var err error
+
+	table = quoteIdent(table)
+
+	switch {
+	case c.cfg.useTimescaleDb:
+		err = c.db.QueryRow("SELECT COALESCE((SELECT total_bytes FROM hypertable_detailed_size($1::regclass)), 0)", table).Scan(&bytes)
+	case len(c.cfg.partitioning) > 0:
+		err = c.db.QueryRow("SELECT COALESCE(sum(pg_total_relation_size(relid)), 0)::bigint FROM pg_partition_tree($1::regclass)", table).Scan(&bytes)
+	default:
+		err = c.db.QueryRow("SELECT pg_total_relation_size($1::regclass)", table).Scan(&bytes)
+	}
+	return bytes, err
+}
+
+var (
+	tenantWrittenSamplesDesc = prometheus.NewDesc("pg_tenant_written_samples_total",
+		"Total number of samples written for the tenant.", []string{"tenant", "tier"}, nil)
+	tenantReadQueriesDesc = prometheus.NewDesc("pg_tenant_read_queries_total",
+		"Total number of remote read queries served to the tenant.", []string{"tenant", "tier"}, nil)
+	tenantReadSamplesDesc = prometheus.NewDesc("pg_tenant_read_samples_total",
+		"Total number of samples returned to the tenant by remote reads.", []string{"tenant", "tier"}, nil)
+	tenantSeriesDesc = prometheus.NewDesc("pg_tenant_series",
+		"Estimated number of series of the tenant.", []string{"tenant", "tier"}, nil)
+	tenantBytesDesc = prometheus.NewDesc("pg_tenant_bytes",
+		"Estimated size of the tables of the tenant in bytes.", []string{"tenant", "tier"}, nil)
+)
+
+// tenantUsageCollector exports the usage of each tenant
+type tenantUsageCollector struct {
+	client *Client
+}
+
+func (t tenantUsageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tenantWrittenSamplesDesc
+	ch <- tenantReadQueriesDesc
+	ch <- tenantReadSamplesDesc
+	ch <- tenantSeriesDesc
+	ch <- tenantBytesDesc
+}
+
+func (t tenantUsageCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, u := range t.client.TenantUsage() {
+		ch <- prometheus.MustNewConstMetric(tenantWrittenSamplesDesc, prometheus.CounterValue, float64(u.WrittenSamples), u.Tenant, u.Tier)
+		ch <- prometheus.MustNewConstMetric(tenantReadQueriesDesc, prometheus.CounterValue, float64(u.ReadQueries), u.Tenant, u.Tier)
+		ch <- prometheus.MustNewConstMetric(tenantReadSamplesDesc, prometheus.CounterValue, float64(u.ReadSamples), u.Tenant, u.Tier)
+
+		if u.MeasuredAt != nil {
+			ch <- prometheus.MustNewConstMetric(tenantSeriesDesc, prometheus.GaugeValue, float64(u.Series), u.Tenant, u.Tier)
+			ch <- prometheus.MustNewConstMetric(tenantBytesDesc, prometheus.GaugeValue, float64(u.Bytes), u.Tenant, u.Tier)
+		}
+	}
+}
+
+func responseSamples(resp *prompb.ReadResponse) int {
+	var n int
+	for _, result := range resp.Results {
+		for _, ts := range result.Timeseries {
+			n += len(ts.Samples)
+		}
+	}
+	return n
+}
@@ -0,0 +1,57 @@
+package pgprometheus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestTenantUsage(t *testing.T) {
+	acme, team := &Client{}, &Client{}
+
+	acme.usage.addWrite(100)
+	acme.usage.addWrite(50)
+	acme.usage.addRead(2, 30)
+	acme.usage.setStorage(10, 4096, time.Now())
+	team.usage.addWrite(5)
+
+	tiers, _ := parseTenantTiers("acme=premium")
+	c := &Client{tenants: map[string]*Client{"team": team, "acme": acme}, tenantTiers: tiers, tenantMetrics: newTenantMetrics()}
+
+	usage := c.TenantUsage()
+
+	if len(usage) != 2 || usage[0].Tenant != "acme" || usage[1].Tenant != "team" {
+		t.Fatalf("Expected the usage of acme and team, got %+v", usage)
+	}
+
+	u := usage[0]
+	if u.Tier != "premium" || u.WrittenSamples != 150 || u.ReadQueries != 2 || u.ReadSamples != 30 || u.Series != 10 || u.Bytes != 4096 || u.MeasuredAt == nil {
+		t.Errorf("Unexpected usage of acme %+v", u)
+	}
+
+	if usage[1].Tier != defaultTenantTier || usage[1].MeasuredAt != nil {
+		t.Errorf("Unexpected usage of team %+v", usage[1])
+	}
+
+	ch := make(chan prometheus.Metric, 16)
+	tenantUsageCollector{client: c}.Collect(ch)
+	close(ch)
+
+	// All metrics of acme, and the counters of team, which was not measured
+	if len(ch) != 8 {
+		t.Errorf("Expected 8 metrics, got %d", len(ch))
+	}
+}
+
+func TestResponseSamples(t *testing.T) {
+	resp := &prompb.ReadResponse{Results: []*prompb.QueryResult{
+		{Timeseries: []*prompb.TimeSeries{{Samples: make([]*prompb.Sample, 2)}, {Samples: make([]*prompb.Sample, 3)}}},
+		{Timeseries: []*prompb.TimeSeries{{Samples: make([]*prompb.Sample, 1)}}},
+	}}
+
+	if n := responseSamples(resp); n != 6 {
+		t.Errorf("Expected 6 samples, got %d", n)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+// pruneCommand deletes samples older than a cutoff on demand, e.g. for a
+// one-off cleanup without configuring retention policies
+func pruneCommand(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: prometheus-postgresql-adapter [flags] prune -older-than=<duration> [options]")
+		fs.PrintDefaults()
+	}
+
+	var (
+		olderThan, metric, tenant string
+		dryRun                    bool
+	)
+	fs.StringVar(&olderThan, "older-than", "", "Delete samples older than this duration, e.g. 90d")
+	fs.StringVar(&metric, "metric", "", "Only delete samples of the metrics whose name matches this regular expression")
+	fs.BoolVar(&dryRun, "dry-run", false, "Only report the samples and chunks that would be deleted")
+	fs.StringVar(&tenant, "tenant", "", "Delete samples of the tables of this tenant")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if len(olderThan) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("missing -older-than")
+	}
+
+	age, err := model.ParseDuration(olderThan)
+
+	if err != nil {
+		return err
+	}
+
+	if age <= 0 {
+		return fmt.Errorf("-older-than must be positive")
+	}
+
+	ctx := context.Background()
+	if len(tenant) > 0 {
+		ctx = pgprometheus.WithTenant(ctx, tenant)
+	}
+
+	client := pgprometheus.NewClient(&cfg.pgPrometheusConfig)
+	defer client.Close()
+
+	cutoff := time.Now().Add(-time.Duration(age))
+	results, err := client.Prune(ctx, cutoff, metric, dryRun)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(w, "TABLE\tMETRIC\tROWS\tCHUNKS")
+	for _, r := range results {
+		m := r.Metric
+		if len(m) == 0 {
+			m = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", r.Table, m, r.Rows, len(r.Chunks))
+	}
+
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+
+	if dryRun {
+		fmt.Fprintf(os.Stderr, "dry run, samples older than %s were not deleted\n", cutoff.UTC().Format(time.RFC3339))
+	}
+	return err
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	// A tenant may send this many seconds worth of its rate limit at once,
+	// so that the batches of remote write fit
+	tenantBurstSeconds = 10
+	// Series without samples for this long no longer count as active
+	activeSeriesWindow = 20 * time.Minute
+)
+
+// tenantLimit is the quota of the tenants matching the glob pattern. Zero
+// values are unlimited.
+type tenantLimit struct {
+	pattern          string
+	samplesPerSecond float64
+	maxSeries        int
+}
+
+// tenantQuotaState is the token bucket and the active series of a tenant
+type tenantQuotaState struct {
+	tokens    float64
+	updated   time.Time
+	series    map[uint64]time.Time
+	lastPurge time.Time
+}
+
+// tenantQuotas limits the ingestion rate and active series of each tenant,
+// so that one tenant cannot take up the whole database
+type tenantQuotas struct {
+	limits   []tenantLimit
+	defaults tenantLimit
+
+	mu      sync.Mutex
+	tenants map[string]*tenantQuotaState
+}
+
+// quotaError is returned for writes beyond the quota of the tenant
+type quotaError struct {
+	reason string
+	msg    string
+}
+
+func (e *quotaError) Error() string {
+	return e.msg
+}
+
+// parseTenantLimits parses comma-separated pattern=rate:series triples, e.g.
+// "acme=50000:1000000,team_*=10000:200000". Either limit may be empty, which
+// uses the default limit.
+func parseTenantLimits(s string, defaults tenantLimit) ([]tenantLimit, error) {
+	var limits []tenantLimit
+
+	for _, limit := range strings.Split(s, ",") {
+		limit = strings.TrimSpace(limit)
+		if len(limit) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(limit, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid tenant limit %q, expected pattern=rate:series", limit)
+		}
+
+		pattern := strings.TrimSpace(parts[0])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid tenant pattern %q: %v", pattern, err)
+		}
+
+		values := strings.SplitN(parts[1], ":", 2)
+		if len(values) != 2 {
+			return nil, fmt.Errorf("invalid tenant limit %q, expected pattern=rate:series", limit)
+		}
+
+		l := defaults
+		l.pattern = pattern
+
+		var err error
+
+		if v := strings.TrimSpace(values[0]); len(v) > 0 {
+			if l.samplesPerSecond, err = strconv.ParseFloat(v, 64); err != nil || l.samplesPerSecond < 0 {
+				return nil, fmt.Errorf("invalid samples per second of tenant pattern %q", pattern)
+			}
+		}
+
+		if v := strings.TrimSpace(values[1]); len(v) > 0 {
+			if l.maxSeries, err = strconv.Atoi(v); err != nil || l.maxSeries < 0 {
+				return nil, fmt.Errorf("invalid max series of tenant pattern %q", pattern)
+			}
+		}
+		limits = append(limits, l)
+	}
+	return limits, nil
+}
+
+// newTenantQuotas returns the quotas of the config, or nil, which does not
+// limit, if no tenant has a limit
+func newTenantQuotas(cfg *config) (*tenantQuotas, error) {
+	defaults := tenantLimit{samplesPerSecond: cfg.tenantSamplesPerSecond, maxSeries: cfg.tenantMaxSeries}
+
+	limits, err := parseTenantLimits(cfg.tenantLimits, defaults)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.tenantSource) == 0 || (len(limits) == 0 && defaults.samplesPerSecond == 0 && defaults.maxSeries == 0) {
+		return nil, nil
+	}
+
+	return &tenantQuotas{
+		limits:   limits,
+		defaults: defaults,
+		tenants:  make(map[string]*tenantQuotaState),
+	}, nil
+}
+
+func (q *tenantQuotas) limit(tenant string) tenantLimit {
+	for _, l := range q.limits {
+		if ok, _ := path.Match(l.pattern, tenant); ok {
+			return l
+		}
+	}
+	return q.defaults
+}
+
+// admit takes the samples of the request from the quota of the tenant, or
+// returns a quotaError if the request exceeds it
+func (q *tenantQuotas) admit(tenant string, req *prompb.WriteRequest, samples int) error {
+	return q.admitAt(tenant, req, samples, time.Now())
+}
+
+// admitAt admits the request at the given time. A request of more samples than
+// the burst is admitted once the bucket is full, and leaves it in debt until
+// its excess is refilled, since Prometheus retries a rejected request
+// unchanged.
+func (q *tenantQuotas) admitAt(tenant string, req *prompb.WriteRequest, samples int, now time.Time) error {
+	if q == nil || len(tenant) == 0 {
+		return nil
+	}
+
+	limit := q.limit(tenant)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage, ok := q.tenants[tenant]
+	if !ok {
+		usage = &tenantQuotaState{
+			tokens:    limit.samplesPerSecond * tenantBurstSeconds,
+			updated:   now,
+			series:    make(map[uint64]time.Time),
+			lastPurge: now,
+		}
+		q.tenants[tenant] = usage
+	}
+
+	if limit.samplesPerSecond > 0 {
+		burst := limit.samplesPerSecond * tenantBurstSeconds
+
+		usage.tokens += now.Sub(usage.updated).Seconds() * limit.samplesPerSecond
+		if usage.tokens > burst {
+			usage.tokens = burst
+		}
+		usage.updated = now
+
+		if math.Min(float64(samples), burst) > usage.tokens {
+			return &quotaError{
+				reason: "rate",
+				msg:    fmt.Sprintf("tenant %s exceeded its ingestion rate limit of %g samples/s", tenant, limit.samplesPerSecond),
+			}
+		}
+	}
+
+	if limit.maxSeries > 0 {
+		if now.Sub(usage.lastPurge) > activeSeriesWindow/10 {
+			usage.purge(now)
+		}
+
+		fingerprints := make([]uint64, 0, len(req.Timeseries))
+		var added int
+
+		for _, ts := range req.Timeseries {
+			fp := seriesFingerprint(ts.Labels)
+			if _, ok := usage.series[fp]; !ok {
+				added++
+			}
+			fingerprints = append(fingerprints, fp)
+		}
+
+		if added > 0 && len(usage.series)+added > limit.maxSeries {
+			return &quotaError{
+				reason: "series",
+				msg:    fmt.Sprintf("tenant %s exceeded its limit of %d active series", tenant, limit.maxSeries),
+			}
+		}
+
+		for _, fp := range fingerprints {
+			usage.series[fp] = now
+		}
+	}
+
+	if limit.samplesPerSecond > 0 {
+		usage.tokens -= float64(samples)
+	}
+	return nil
+}
+
+// purge forgets the series without samples in the active series window
+func (u *tenantQuotaState) purge(now time.Time) {
+	for fp, seen := range u.series {
+		if now.Sub(seen) > activeSeriesWindow {
+			delete(u.series, fp)
+		}
+	}
+	u.lastPurge = now
+}
+
+// seriesFingerprint hashes the labels of a series, which Prometheus sends
+// sorted by name
+func seriesFingerprint(labels []*prompb.Label) uint64 {
+	h := fnv.New64a()
+
+	for _, l := range labels {
+		h.Write([]byte(l.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(l.Value))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
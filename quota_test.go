@@ -0,0 +1,174 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func writeRequest(series ...string) *prompb.WriteRequest {
+	req := &prompb.WriteRequest{}
+
+	for _, s := range series {
+		req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+			Labels: []*prompb.Label{{Name: "__name__", Value: s}},
+		})
+	}
+	return req
+}
+
+func TestTenantQuotasRate(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	// The burst is 10 seconds at 100 samples/s
+	testCases := []struct {
+		name     string
+		requests []int
+		offsets  []time.Duration
+		admitted []bool
+	}{
+		{
+			name:     "burst",
+			requests: []int{600, 400, 1},
+			offsets:  []time.Duration{0, 0, 0},
+			admitted: []bool{true, true, false},
+		},
+		{
+			name:     "refill",
+			requests: []int{1000, 100, 100, 200},
+			offsets:  []time.Duration{0, 0, time.Second, time.Second},
+			admitted: []bool{true, false, true, false},
+		},
+		{
+			name:     "refill up to the burst",
+			requests: []int{1000, 1000, 1},
+			offsets:  []time.Duration{0, time.Hour, time.Hour},
+			admitted: []bool{true, true, false},
+		},
+		{
+			name:     "request larger than the burst",
+			requests: []int{5000, 1, 1000, 1000},
+			offsets:  []time.Duration{0, 0, 49 * time.Second, 50 * time.Second},
+			admitted: []bool{true, false, false, true},
+		},
+		{
+			name:     "request larger than the burst waits for a full bucket",
+			requests: []int{500, 5000, 5000},
+			offsets:  []time.Duration{0, 0, 5 * time.Second},
+			admitted: []bool{true, false, true},
+		},
+	}
+
+	for _, tc := range testCases {
+		q := &tenantQuotas{
+			defaults: tenantLimit{samplesPerSecond: 100},
+			tenants:  make(map[string]*tenantQuotaState),
+		}
+
+		for i, samples := range tc.requests {
+			err := q.admitAt("acme", writeRequest("up"), samples, start.Add(tc.offsets[i]))
+
+			if admitted := err == nil; admitted != tc.admitted[i] {
+				t.Errorf("%s: expected request %d admitted %t, got %v", tc.name, i, tc.admitted[i], err)
+			}
+
+			if qe, ok := err.(*quotaError); err != nil && (!ok || qe.reason != "rate") {
+				t.Errorf("%s: expected a rate quota error, got %v", tc.name, err)
+			}
+		}
+	}
+}
+
+func TestTenantQuotasSeries(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	testCases := []struct {
+		name     string
+		requests [][]string
+		offsets  []time.Duration
+		admitted []bool
+	}{
+		{
+			name:     "within the limit",
+			requests: [][]string{{"a", "b"}, {"c"}, {"a", "b", "c"}},
+			offsets:  []time.Duration{0, 0, 0},
+			admitted: []bool{true, true, true},
+		},
+		{
+			name:     "new series beyond the limit",
+			requests: [][]string{{"a", "b", "c"}, {"d"}, {"a"}},
+			offsets:  []time.Duration{0, 0, 0},
+			admitted: []bool{true, false, true},
+		},
+		{
+			name:     "inactive series are forgotten",
+			requests: [][]string{{"a", "b", "c"}, {"d"}},
+			offsets:  []time.Duration{0, activeSeriesWindow + time.Minute},
+			admitted: []bool{true, true},
+		},
+		{
+			name:     "rejected requests add no series",
+			requests: [][]string{{"a", "b", "c", "d"}, {"a", "b", "c"}},
+			offsets:  []time.Duration{0, 0},
+			admitted: []bool{false, true},
+		},
+	}
+
+	for _, tc := range testCases {
+		q := &tenantQuotas{
+			defaults: tenantLimit{maxSeries: 3},
+			tenants:  make(map[string]*tenantQuotaState),
+		}
+
+		for i, series := range tc.requests {
+			err := q.admitAt("acme", writeRequest(series...), len(series), start.Add(tc.offsets[i]))
+
+			if admitted := err == nil; admitted != tc.admitted[i] {
+				t.Errorf("%s: expected request %d admitted %t, got %v", tc.name, i, tc.admitted[i], err)
+			}
+
+			if qe, ok := err.(*quotaError); err != nil && (!ok || qe.reason != "series") {
+				t.Errorf("%s: expected a series quota error, got %v", tc.name, err)
+			}
+		}
+	}
+}
+
+func TestTenantQuotasLimits(t *testing.T) {
+	defaults := tenantLimit{samplesPerSecond: 10, maxSeries: 100}
+
+	limits, err := parseTenantLimits("acme=50:,team_*=:5", defaults)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := &tenantQuotas{limits: limits, defaults: defaults}
+
+	testCases := []struct {
+		tenant   string
+		expected tenantLimit
+	}{
+		{tenant: "acme", expected: tenantLimit{pattern: "acme", samplesPerSecond: 50, maxSeries: 100}},
+		{tenant: "team_a", expected: tenantLimit{pattern: "team_*", samplesPerSecond: 10, maxSeries: 5}},
+		{tenant: "other", expected: defaults},
+	}
+
+	for _, tc := range testCases {
+		if actual := q.limit(tc.tenant); actual != tc.expected {
+			t.Errorf("%s: expected limit %+v, got %+v", tc.tenant, tc.expected, actual)
+		}
+	}
+
+	for _, invalid := range []string{"acme", "acme=50", "acme=x:1", "acme=1:-1", "[=1:1"} {
+		if _, err := parseTenantLimits(invalid, defaults); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+
+	var disabled *tenantQuotas
+	if err := disabled.admit("acme", writeRequest("up"), 1); err != nil {
+		t.Errorf("expected no quotas to admit every request, got %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+type reloader interface {
+	Reload(cfg *pgprometheus.Config) error
+}
+
+// loadConfig parses the command line arguments into a new config, and then
+// the config file for flags that are not set on the command line
+func loadConfig(fs *flag.FlagSet, args []string) (*config, error) {
+	cfg := &config{}
+	registerFlags(fs, cfg)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.configFile) > 0 {
+		if err := applyConfigFile(fs, cfg.configFile); err != nil {
+			return nil, fmt.Errorf("error reading config file %s: %v", cfg.configFile, err)
+		}
+	}
+	return cfg, nil
+}
+
+// applyConfigFile sets the flags of flag=value lines of the file, skipping
+// blank lines, comments starting with # and flags set on the command line
+func applyConfigFile(fs *flag.FlagSet, filename string) error {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	scanner := bufio.NewScanner(f)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("line %d: expected flag=value", n)
+		}
+
+		name := strings.TrimLeft(strings.TrimSpace(parts[0]), "-")
+
+		switch {
+		case name == "config.file":
+			return fmt.Errorf("line %d: config files cannot be nested", n)
+		case fs.Lookup(name) == nil:
+			return fmt.Errorf("line %d: unknown flag %q", n, name)
+		case set[name]:
+			continue
+		}
+
+		if err = fs.Set(name, strings.TrimSpace(parts[1])); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// configReloader re-reads the configuration and applies the settings that
+// can change while the adapter runs
+type configReloader struct {
+	args   []string
+	target reloader
+	lock   sync.Mutex
+}
+
+func (r *configReloader) reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+
+	cfg, err := loadConfig(fs, r.args)
+
+	if err != nil {
+		return err
+	}
+
+	if err = log.SetLevel(cfg.logLevel); err != nil {
+		return err
+	}
+	return r.target.Reload(&cfg.pgPrometheusConfig)
+}
+
+// reloadOnSignal reloads the configuration on SIGHUP
+func (r *configReloader) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		if err := r.reload(); err != nil {
+			log.Error("msg", "Error reloading the configuration", "err", err)
+		}
+	}
+}
+
+// handler reloads the configuration on POST requests
+func (r *configReloader) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "reloading requires a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := r.reload(); err != nil {
+			log.Error("msg", "Error reloading the configuration", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
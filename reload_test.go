@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+// writeConfigFile writes the lines of a config file to a temporary file
+func writeConfigFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "adapter.conf")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return fs
+}
+
+func TestLoadConfig(t *testing.T) {
+	file := writeConfigFile(t, `
+# The listen address is set on the command line
+web.listen-address=:9999
+-log.level = warn
+adapter.send-timeout=10s
+`)
+	defer os.Remove(file)
+
+	cfg, err := loadConfig(newFlagSet(), []string{"-config.file", file, "-web.listen-address", ":9201"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The command line takes precedence over the file
+	if cfg.listenAddr != ":9201" {
+		t.Errorf("Expected the listen address of the command line, got %s", cfg.listenAddr)
+	}
+
+	if cfg.logLevel != "warn" || cfg.remoteTimeout != 10*time.Second {
+		t.Errorf("Expected the log level and send timeout of the file, got %s and %s", cfg.logLevel, cfg.remoteTimeout)
+	}
+}
+
+func TestApplyConfigFileErrors(t *testing.T) {
+	for _, content := range []string{
+		"web.listen-address",
+		"config.file=other.conf",
+		"web.unknown-flag=1",
+		"adapter.send-timeout=soon",
+	} {
+		file := writeConfigFile(t, content)
+
+		fs := newFlagSet()
+		registerFlags(fs, &config{})
+
+		if err := applyConfigFile(fs, file); err == nil {
+			t.Errorf("%q: expected an error", content)
+		}
+		os.Remove(file)
+	}
+
+	if err := applyConfigFile(newFlagSet(), "missing.conf"); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+// reloadRecorder records the configurations it reloads
+type reloadRecorder struct {
+	reloaded []*pgprometheus.Config
+}
+
+func (r *reloadRecorder) Reload(cfg *pgprometheus.Config) error {
+	r.reloaded = append(r.reloaded, cfg)
+	return nil
+}
+
+func TestReloadHandler(t *testing.T) {
+	file := writeConfigFile(t, "log.level=info\n")
+	defer os.Remove(file)
+
+	target := &reloadRecorder{}
+	handler := (&configReloader{args: []string{"-config.file", file}, target: target}).handler()
+
+	for method, status := range map[string]int{"GET": http.StatusMethodNotAllowed, "POST": http.StatusOK} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/-/reload", nil))
+
+		if rec.Code != status {
+			t.Errorf("%s: expected status %d, got %d", method, status, rec.Code)
+		}
+	}
+
+	if len(target.reloaded) != 1 {
+		t.Errorf("Expected 1 reload, got %d", len(target.reloaded))
+	}
+
+	// Invalid files are not applied
+	if err := ioutil.WriteFile(file, []byte("log.level=loud\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/-/reload", nil))
+
+	if rec.Code != http.StatusInternalServerError || len(target.reloaded) != 1 {
+		t.Errorf("Expected an invalid file not to be applied, got status %d", rec.Code)
+	}
+}
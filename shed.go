@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// loadShedStep is how much the fraction of shed writes changes per interval
+const loadShedStep = 0.1
+
+type writeLatencyReporter interface {
+	WriteLatency() (wait, commit time.Duration)
+}
+
+// loadShedder rejects a growing fraction of write requests while the 99th
+// percentile of the time writes wait for a database connection, or take to
+// commit, is above a threshold, and a shrinking fraction once it is below, so
+// that a slow database is not buried under retries
+type loadShedder struct {
+	threshold   time.Duration
+	maxFraction float64
+	latency     writeLatencyReporter
+
+	mu       sync.Mutex
+	fraction float64
+}
+
+// newLoadShedder returns a load shedder, or nil, which does not shed, if
+// threshold is not positive
+func newLoadShedder(threshold time.Duration, maxFraction float64, latency writeLatencyReporter) (*loadShedder, error) {
+	if threshold <= 0 {
+		return nil, nil
+	}
+
+	if maxFraction <= 0 || maxFraction > 1 {
+		return nil, fmt.Errorf("the max fraction of shed writes must be above 0 and at most 1")
+	}
+	return &loadShedder{threshold: threshold, maxFraction: maxFraction, latency: latency}, nil
+}
+
+// adjust sheds more writes if the latency is above the threshold, and fewer
+// otherwise
+func (s *loadShedder) adjust() {
+	wait, commit := s.latency.WriteLatency()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.fraction
+
+	if wait > s.threshold || commit > s.threshold {
+		s.fraction += loadShedStep
+		if s.fraction > s.maxFraction {
+			s.fraction = s.maxFraction
+		}
+	} else {
+		s.fraction -= loadShedStep
+		if s.fraction < 0 {
+			s.fraction = 0
+		}
+	}
+
+	loadShedFraction.Set(s.fraction)
+
+	if previous == 0 && s.fraction > 0 {
+		log.Warn("msg", "Shedding writes while the database is slow", "wait_p99", wait, "commit_p99", commit, "threshold", s.threshold)
+	} else if previous > 0 && s.fraction == 0 {
+		log.Info("msg", "Stopped shedding writes", "wait_p99", wait, "commit_p99", commit)
+	}
+}
+
+// run adjusts the fraction of shed writes every interval
+func (s *loadShedder) run(interval time.Duration) {
+	if s == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		s.adjust()
+	}
+}
+
+func (s *loadShedder) shed(h http.Handler) http.Handler {
+	if s == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		fraction := s.fraction
+		s.mu.Unlock()
+
+		if fraction > 0 && rand.Float64() < fraction {
+			latencyShedRequests.Inc()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "the database is slow, shedding writes", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
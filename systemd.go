@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// sdNotify sends a state to the systemd service manager, if the adapter
+// runs as a Type=notify service. See sd_notify(3).
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if len(socket) == 0 {
+		return nil
+	}
+
+	// Abstract sockets start with a NUL byte
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the watchdog timeout configured with WatchdogSec,
+// or 0 if the watchdog is disabled for the adapter
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runSdWatchdog notifies the systemd watchdog at half its timeout. The
+// database is not checked, since restarting the adapter would not help while
+// the database is down.
+func runSdWatchdog(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+
+	for range ticker.C {
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Warn("msg", "Error notifying the systemd watchdog", "err", err)
+		}
+	}
+}
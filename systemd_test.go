@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// setenv sets an environment variable and returns a function restoring it
+func setenv(key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	defer setenv("NOTIFY_SOCKET", "")()
+
+	// Nothing is sent outside of systemd
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "systemd")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+
+	if err = sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state := string(buf[:n]); state != "READY=1" {
+		t.Errorf("Expected READY=1, got %q", state)
+	}
+
+	os.Setenv("NOTIFY_SOCKET", filepath.Join(dir, "missing"))
+
+	if err = sdNotify("READY=1"); err == nil {
+		t.Error("Expected an error for a missing socket")
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	defer setenv("WATCHDOG_USEC", "")()
+	defer setenv("WATCHDOG_PID", "")()
+
+	pid := strconv.Itoa(os.Getpid())
+
+	testCases := []struct {
+		usec, pid string
+		expected  time.Duration
+	}{
+		{expected: 0},
+		{usec: "30000000", expected: 30 * time.Second},
+		{usec: "30000000", pid: pid, expected: 30 * time.Second},
+		// The watchdog is meant for another process
+		{usec: "30000000", pid: pid + "0", expected: 0},
+		{usec: "0", expected: 0},
+		{usec: "soon", expected: 0},
+	}
+
+	for _, tc := range testCases {
+		os.Setenv("WATCHDOG_USEC", tc.usec)
+		os.Setenv("WATCHDOG_PID", tc.pid)
+
+		if actual := sdWatchdogInterval(); actual != tc.expected {
+			t.Errorf("%q, %q: expected %s, got %s", tc.usec, tc.pid, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+const (
+	tenantSourceHeader    = "header"
+	tenantSourceBasicAuth = "basic-auth"
+)
+
+// requireTenant routes the writes and reads of each tenant to its own tables.
+// The tenant is either the value of a header, such as the X-Scope-OrgID
+// header of Cortex and Loki clients, or the basic auth user authenticated by
+// a proxy in front of the adapter. Requests without a tenant are rejected.
+func requireTenant(cfg *config, handler http.Handler) (http.Handler, error) {
+	switch cfg.tenantSource {
+	case "":
+		return handler, nil
+	case tenantSourceHeader, tenantSourceBasicAuth:
+	default:
+		return nil, fmt.Errorf("invalid tenant source %q", cfg.tenantSource)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var tenant string
+
+		if cfg.tenantSource == tenantSourceHeader {
+			tenant = r.Header.Get(cfg.tenantHeader)
+		} else {
+			tenant, _, _ = r.BasicAuth()
+		}
+
+		if len(tenant) == 0 {
+			http.Error(w, "no tenant", http.StatusUnauthorized)
+			return
+		}
+
+		if err := pgprometheus.ValidateTenant(tenant); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		handler.ServeHTTP(w, r.WithContext(pgprometheus.WithTenant(r.Context(), tenant)))
+	}), nil
+}
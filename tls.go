@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/log"
+)
+
+// certReloader serves the certificate of the key pair files, reloading them
+// once they change, so that rotated certificates are picked up without a
+// restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	if _, err := r.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var modTimes [2]time.Time
+
+	for i, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+
+		if err != nil {
+			return r.loaded(err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	if r.cert != nil && modTimes == r.modTimes {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+
+	if err != nil {
+		return r.loaded(err)
+	}
+
+	if r.cert != nil {
+		log.Info("msg", "Reloaded TLS certificate", "file", r.certFile)
+	}
+
+	r.cert = &cert
+	r.modTimes = modTimes
+
+	return r.cert, nil
+}
+
+// loaded keeps serving the loaded certificate if reloading fails, e.g. while
+// only one of the files has been replaced
+func (r *certReloader) loaded(err error) (*tls.Certificate, error) {
+	if r.cert == nil {
+		return nil, fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+
+	log.Warn("msg", "Error reloading TLS certificate, using the loaded one", "err", err)
+	return r.cert, nil
+}
+
+// tlsConfig returns the TLS configuration of the web listener, or nil if TLS
+// is disabled
+func tlsConfig(cfg *config) (*tls.Config, error) {
+	if len(cfg.tlsCertFile) == 0 && len(cfg.tlsKeyFile) == 0 {
+		if len(cfg.tlsClientCAFile) > 0 {
+			return nil, fmt.Errorf("-web.tls-client-ca-file requires -web.tls-cert-file and -web.tls-key-file")
+		}
+		return nil, nil
+	}
+
+	if len(cfg.tlsCertFile) == 0 || len(cfg.tlsKeyFile) == 0 {
+		return nil, fmt.Errorf("both -web.tls-cert-file and -web.tls-key-file must be set")
+	}
+
+	reloader, err := newCertReloader(cfg.tlsCertFile, cfg.tlsKeyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if len(cfg.tlsClientCAFile) > 0 {
+		pem, err := ioutil.ReadFile(cfg.tlsClientCAFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA file: %v", err)
+		}
+
+		tlsConfig.ClientCAs = x509.NewCertPool()
+
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client CA file %s", cfg.tlsClientCAFile)
+		}
+
+		// Client certificates are required by the write and read endpoints
+		// only, so that health checks and scrapes work without one
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// requireClientCert rejects requests without a client certificate signed by
+// the client CA, if one is configured
+func requireClientCert(cfg *config, handler http.Handler) http.Handler {
+	if len(cfg.tlsClientCAFile) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate and its key to dir
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "adapter"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSConfigClientCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCertificate(t, dir)
+	emptyFile := filepath.Join(dir, "empty.pem")
+
+	if err = ioutil.WriteFile(emptyFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		cfg     *config
+		invalid bool
+	}{
+		{name: "client CA without a certificate", cfg: &config{tlsClientCAFile: certFile}, invalid: true},
+		{name: "client CA without certificates", cfg: &config{tlsCertFile: certFile, tlsKeyFile: keyFile, tlsClientCAFile: emptyFile}, invalid: true},
+		{name: "missing client CA", cfg: &config{tlsCertFile: certFile, tlsKeyFile: keyFile, tlsClientCAFile: emptyFile + ".missing"}, invalid: true},
+		{name: "client CA", cfg: &config{tlsCertFile: certFile, tlsKeyFile: keyFile, tlsClientCAFile: certFile}},
+	}
+
+	for _, tc := range testCases {
+		tlsConfig, err := tlsConfig(tc.cfg)
+
+		if (err != nil) != tc.invalid {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		// Endpoints other than write and read work without a certificate
+		if tlsConfig.ClientAuth != tls.VerifyClientCertIfGiven || tlsConfig.ClientCAs == nil {
+			t.Errorf("%s: expected client certificates to be verified if given", tc.name)
+		}
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	testCases := []struct {
+		name   string
+		caFile string
+		state  *tls.ConnectionState
+		status int
+	}{
+		{name: "no client CA", status: http.StatusOK},
+		{name: "plain HTTP", caFile: "ca.pem", status: http.StatusForbidden},
+		{name: "no client certificate", caFile: "ca.pem", state: &tls.ConnectionState{}, status: http.StatusForbidden},
+		{name: "verified client certificate", caFile: "ca.pem", state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}, status: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("POST", "/write", nil)
+		req.TLS = tc.state
+
+		rec := httptest.NewRecorder()
+		requireClientCert(&config{tlsClientCAFile: tc.caFile}, ok).ServeHTTP(rec, req)
+
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, rec.Code)
+		}
+	}
+}
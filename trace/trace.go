@@ -0,0 +1,172 @@
+// Package trace records spans of the write and read paths and exports them
+// to an OpenTelemetry collector with OTLP over HTTP.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind is the OpenTelemetry span kind
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+type contextKey struct{}
+
+// Span is an operation of a trace. All methods of a nil span, which is not
+// recorded, do nothing.
+type Span struct {
+	spanContext
+	parentID   [8]byte
+	name       string
+	kind       Kind
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+	mu         sync.Mutex
+}
+
+var (
+	exp        *exporter
+	sampleRate float64
+)
+
+// Init starts exporting spans to the OTLP/HTTP endpoint, e.g.
+// http://localhost:4318. Traces started by the adapter are sampled at the
+// given rate, while traces continued from a traceparent header keep the
+// sampling decision of the caller.
+func Init(endpoint, serviceName string, rate float64) {
+	if len(endpoint) == 0 {
+		return
+	}
+
+	sampleRate = rate
+	exp = newExporter(strings.TrimSuffix(endpoint, "/")+"/v1/traces", serviceName)
+	go exp.run()
+}
+
+// Start starts a span as a child of the span in ctx, if any, and returns a
+// context holding the new span
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	if exp == nil {
+		return ctx, nil
+	}
+
+	parent, ok := ctx.Value(contextKey{}).(spanContext)
+
+	sc := spanContext{traceID: parent.traceID, sampled: parent.sampled}
+	if !ok {
+		rand.Read(sc.traceID[:])
+		sc.sampled = mathrand.Float64() < sampleRate
+	}
+
+	// Unsampled traces are kept in the context, so that their child
+	// spans are not sampled either
+	if !sc.sampled {
+		return context.WithValue(ctx, contextKey{}, sc), nil
+	}
+
+	rand.Read(sc.spanID[:])
+	ctx = context.WithValue(ctx, contextKey{}, sc)
+
+	return ctx, &Span{
+		spanContext: sc,
+		parentID:    parent.spanID,
+		name:        name,
+		kind:        kind,
+		start:       time.Now(),
+		attributes:  make(map[string]interface{}),
+	}
+}
+
+// WithTraceParent returns a context continuing the trace of a W3C
+// traceparent header, or ctx if the header is invalid
+func WithTraceParent(ctx context.Context, header string) context.Context {
+	sc, err := parseTraceParent(header)
+
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+func parseTraceParent(header string) (spanContext, error) {
+	var sc spanContext
+
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent %q", header)
+	}
+
+	var flags [1]byte
+
+	for _, field := range []struct {
+		hex string
+		dst []byte
+	}{{parts[1], sc.traceID[:]}, {parts[2], sc.spanID[:]}, {parts[3], flags[:]}} {
+		if _, err := hex.Decode(field.dst, []byte(field.hex)); err != nil {
+			return sc, fmt.Errorf("invalid traceparent %q: %v", header, err)
+		}
+	}
+
+	if sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return sc, fmt.Errorf("invalid traceparent %q", header)
+	}
+
+	sc.sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// SetAttribute sets an attribute of the span, with a string, bool, int,
+// int64 or float64 value
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed, if err is not nil
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// End ends the span and queues it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	exp.add(s)
+}
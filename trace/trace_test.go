@@ -0,0 +1,109 @@
+package trace
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	testCases := []struct {
+		header  string
+		traceID string
+		spanID  string
+		sampled bool
+		valid   bool
+	}{
+		{
+			header:  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			traceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+			spanID:  "00f067aa0ba902b7",
+			sampled: true,
+			valid:   true,
+		},
+		{
+			header:  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			traceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+			spanID:  "00f067aa0ba902b7",
+			valid:   true,
+		},
+		{header: ""},
+		{header: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01"},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7"},
+	}
+
+	for _, tc := range testCases {
+		sc, err := parseTraceParent(tc.header)
+
+		if (err == nil) != tc.valid {
+			t.Errorf("%q: expected valid %v, got error %v", tc.header, tc.valid, err)
+			continue
+		}
+
+		if !tc.valid {
+			continue
+		}
+
+		if traceID := hex.EncodeToString(sc.traceID[:]); traceID != tc.traceID {
+			t.Errorf("%q: expected trace id %s, got %s", tc.header, tc.traceID, traceID)
+		}
+
+		if spanID := hex.EncodeToString(sc.spanID[:]); spanID != tc.spanID {
+			t.Errorf("%q: expected span id %s, got %s", tc.header, tc.spanID, spanID)
+		}
+
+		if sc.sampled != tc.sampled {
+			t.Errorf("%q: expected sampled %v, got %v", tc.header, tc.sampled, sc.sampled)
+		}
+	}
+}
+
+func TestOTLPRequest(t *testing.T) {
+	sc, err := parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	span := &Span{
+		spanContext: spanContext{traceID: sc.traceID, spanID: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, sampled: true},
+		parentID:    sc.spanID,
+		name:        "query",
+		kind:        KindClient,
+		start:       time.Unix(1, 0),
+		end:         time.Unix(2, 0),
+		attributes:  map[string]interface{}{"db.statement": "SELECT 1", "db.rows": 1},
+		err:         errors.New("canceled"),
+	}
+
+	data, err := json.Marshal(newExporter("", "adapter").request([]*Span{span}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		`{"key":"service.name","value":{"stringValue":"adapter"}}`,
+		`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736","spanId":"0102030405060708","parentSpanId":"00f067aa0ba902b7"`,
+		`"kind":3,"startTimeUnixNano":"1000000000","endTimeUnixNano":"2000000000"`,
+		`"attributes":[{"key":"db.rows","value":{"intValue":"1"}},{"key":"db.statement","value":{"stringValue":"SELECT 1"}}]`,
+		`"status":{"code":2,"message":"canceled"}`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("expected %s in %s", expected, data)
+		}
+	}
+}
+
+func TestNilSpan(t *testing.T) {
+	var span *Span
+
+	span.SetAttribute("samples", 1)
+	span.SetError(errors.New("failed"))
+	span.End()
+}
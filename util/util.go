@@ -70,3 +70,29 @@ func RetryWithFixedDelay(retries uint, wait time.Duration, f func() (interface{}
 		time.Sleep(wait)
 	}
 }
+
+// Blocking retry with a delay that doubles after every attempt, up to maxWait.
+// Gives up after the given number of attempts, or once timeout has passed if
+// it is not 0, whichever is later.
+func RetryWithBackoff(retries uint, timeout, wait, maxWait time.Duration, f func() error) error {
+	start := time.Now()
+	current := uint(0)
+	for {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		log.Error("msg", "Error running function with retry", "err", err)
+		current++
+		if current >= retries && time.Since(start)+wait > timeout {
+			log.Error("msg", fmt.Sprintf("Giving up retrying after %d failed attempts in %v", current, time.Since(start)))
+			return err
+		}
+		log.Debug("msg", "Sleeping before next retry", "wait", wait)
+		time.Sleep(wait)
+		wait *= 2
+		if wait > maxWait {
+			wait = maxWait
+		}
+	}
+}
@@ -70,3 +70,47 @@ func TestSuccessAfterRetry(t *testing.T) {
 	}
 
 }
+
+func TestRetryWithBackoff(t *testing.T) {
+	counter := 0
+	fail := func() error {
+		counter++
+		return fmt.Errorf("failed")
+	}
+
+	err := RetryWithBackoff(3, 0, time.Millisecond, 2*time.Millisecond, fail)
+	if err == nil {
+		t.Error("Should fail after retrying!")
+	}
+	if counter != 3 {
+		t.Errorf("Expected 3 invocations but got %d", counter)
+	}
+
+	counter = 0
+	start := time.Now()
+	err = RetryWithBackoff(0, hundredMs, 10*time.Millisecond, 20*time.Millisecond, fail)
+	if err == nil {
+		t.Error("Should fail after the timeout!")
+	}
+	if elapsed := time.Since(start); elapsed > hundredMs {
+		t.Errorf("Expected to give up within %v, took %v", hundredMs, elapsed)
+	}
+	if counter < 5 {
+		t.Errorf("Expected at least 5 invocations within the timeout but got %d", counter)
+	}
+
+	counter = 0
+	succeed := func() error {
+		counter++
+		if counter < 3 {
+			return fmt.Errorf("failed")
+		}
+		return nil
+	}
+	if err = RetryWithBackoff(0, time.Second, time.Millisecond, time.Millisecond, succeed); err != nil {
+		t.Error("Should not return error!", err)
+	}
+	if counter != 3 {
+		t.Error("Wrong invocation counter ", counter)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/timescale/prometheus-postgresql-adapter/postgresql"
+)
+
+type storageModeReporter interface {
+	StorageMode() string
+}
+
+// buildInfo is served on /version
+type buildInfo struct {
+	Version     string `json:"version"`
+	Commit      string `json:"commit"`
+	GoVersion   string `json:"go_version"`
+	StorageMode string `json:"storage_mode"`
+}
+
+func newBuildInfo(storage storageModeReporter) buildInfo {
+	return buildInfo{
+		Version:     pgprometheus.Version,
+		Commit:      pgprometheus.Commit,
+		GoVersion:   runtime.Version(),
+		StorageMode: storage.StorageMode(),
+	}
+}
+
+// registerBuildInfo exports the build as the labels of a build_info gauge
+// that is always 1
+func registerBuildInfo(info buildInfo) {
+	gauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "build_info",
+			Help: "A metric with a constant '1' value labeled by the version, commit and Go version of the adapter and its storage mode.",
+		},
+		[]string{"version", "commit", "goversion", "storage_mode"},
+	)
+	gauge.WithLabelValues(info.Version, info.Commit, info.GoVersion, info.StorageMode).Set(1)
+	prometheus.MustRegister(gauge)
+}
+
+func version(info buildInfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}